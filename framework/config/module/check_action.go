@@ -53,6 +53,14 @@ type FailAction struct {
 	Quarantine bool
 	Reject     bool
 
+	// Score is added to the message score instead of rejecting or
+	// quarantining it directly. msgpipeline compares the accumulated
+	// score against the configured thresholds.
+	Score float64
+
+	// Monitor makes msgpipeline log the action instead of applying it.
+	Monitor bool
+
 	ReasonOverride *exterrors.SMTPError
 }
 
@@ -73,6 +81,18 @@ func ParseActionDirective(args []string) (FailAction, error) {
 		return FailAction{}, errors.New("expected at least 1 argument")
 	}
 
+	if args[0] == "monitor" {
+		if len(args) == 1 {
+			return FailAction{}, errors.New("monitor: action to evaluate is required")
+		}
+		res, err := ParseActionDirective(args[1:])
+		if err != nil {
+			return FailAction{}, err
+		}
+		res.Monitor = true
+		return res, nil
+	}
+
 	res := FailAction{}
 
 	switch args[0] {
@@ -84,6 +104,15 @@ func ParseActionDirective(args []string) (FailAction, error) {
 				return FailAction{}, err
 			}
 		}
+	case "score":
+		if len(args) != 2 {
+			return FailAction{}, errors.New("score: expected exactly 1 argument")
+		}
+		score, err := strconv.ParseFloat(args[1], 64)
+		if err != nil {
+			return FailAction{}, fmt.Errorf("score: invalid number: %v", err)
+		}
+		res.Score = score
 	case "ignore":
 	default:
 		return FailAction{}, errors.New("invalid action")
@@ -113,6 +142,8 @@ func (cfa FailAction) Apply(originalRes module.CheckResult) module.CheckResult {
 
 	originalRes.Quarantine = cfa.Quarantine || originalRes.Quarantine
 	originalRes.Reject = cfa.Reject || originalRes.Reject
+	originalRes.Score += cfa.Score
+	originalRes.Monitor = cfa.Monitor || originalRes.Monitor
 	return originalRes
 }
 
@@ -69,6 +69,16 @@ func IMAPFilter(globals map[string]interface{}, args []string, block config.Node
 	return filter, nil
 }
 
+// SpamLearner creates a SpamLearner module from the configuration node.
+// Module names are looked up in the "check" namespace.
+func SpamLearner(globals map[string]interface{}, args []string, block config.Node) (module.SpamLearner, error) {
+	var learner module.SpamLearner
+	if err := ModuleFromNode("check", args, block, globals, &learner); err != nil {
+		return nil, err
+	}
+	return learner, nil
+}
+
 func StorageDirective(m *config.Map, node config.Node) (interface{}, error) {
 	var backend module.Storage
 	if err := ModuleFromNode("storage", node.Args, node, m.Globals, &backend); err != nil {
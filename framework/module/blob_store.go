@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"io"
+	"time"
 )
 
 type Blob interface {
@@ -44,3 +45,69 @@ type BlobStore interface {
 	// Delete removes a set of keys from store. Non-existent keys are ignored.
 	Delete(ctx context.Context, keys []string) error
 }
+
+var ErrNotReencryptable = errors.New("blob_store: store does not support re-encryption")
+
+// ReencryptableBlobStore is implemented by blob stores that can rewrite
+// stored objects using the currently active encryption key.
+//
+// Wrappers that do not encrypt data themselves may implement it by passing
+// the call to the underlying store using ReencryptBlob.
+type ReencryptableBlobStore interface {
+	BlobStore
+
+	// Reencrypt rewrites the object specified by passed key if it is not
+	// encrypted using the active key. It reports whether the object was
+	// rewritten.
+	Reencrypt(ctx context.Context, key string) (bool, error)
+}
+
+// ReencryptBlob calls Reencrypt if the store implements
+// ReencryptableBlobStore and returns ErrNotReencryptable otherwise.
+func ReencryptBlob(ctx context.Context, store BlobStore, key string) (bool, error) {
+	re, ok := store.(ReencryptableBlobStore)
+	if !ok {
+		return false, ErrNotReencryptable
+	}
+	return re.Reencrypt(ctx, key)
+}
+
+// RenamableBlobStore is implemented by blob stores that can atomically
+// replace one object with another.
+type RenamableBlobStore interface {
+	BlobStore
+
+	// Rename moves the object specified by oldKey to newKey, replacing the
+	// existing object. Readers of newKey see either the old or the new
+	// contents, never a partially written object.
+	Rename(ctx context.Context, oldKey, newKey string) error
+}
+
+var ErrNotListable = errors.New("blob_store: store does not support listing")
+
+// ListableBlobStore is implemented by blob stores that can enumerate stored
+// objects.
+//
+// Wrappers that do not change keys may implement it by passing the call to
+// the underlying store using ListBlobs.
+type ListableBlobStore interface {
+	BlobStore
+
+	// ListBlobs calls fn for the key of each stored object. Order is
+	// undefined. If fn returns an error, iteration stops and that error is
+	// returned.
+	//
+	// modTime is the time the object was last written or zero value if the
+	// store does not track it.
+	ListBlobs(ctx context.Context, fn func(key string, modTime time.Time) error) error
+}
+
+// ListBlobs calls ListBlobs if the store implements ListableBlobStore and
+// returns ErrNotListable otherwise.
+func ListBlobs(ctx context.Context, store BlobStore, fn func(key string, modTime time.Time) error) error {
+	l, ok := store.(ListableBlobStore)
+	if !ok {
+		return ErrNotListable
+	}
+	return l.ListBlobs(ctx, fn)
+}
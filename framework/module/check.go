@@ -67,6 +67,33 @@ type SafelistCheck interface {
 	CheckSafelist(ctx context.Context, msgMeta *MsgMetadata) SafelistCheckResult
 }
 
+// RcptSafelistCheck is an optional module interface that can be implemented
+// by modules implementing SafelistCheck.
+//
+// It is used to safelist a message only for some of its recipients.
+// CheckRcptSafelist is called for each final recipient (after rewriting)
+// of checks in the global check block. Unlike SafelistCheck, the result
+// does not make the message skip other checks. It only prevents the
+// message from being quarantined for the recipient, rejections and
+// quarantine by authentication checks, DMARC and malware checks are still
+// applied. If RequiresAuthResults is set, the envelope sender should also
+// be authenticated by SPF or DKIM.
+//
+// Header field in the result is not used.
+type RcptSafelistCheck interface {
+	CheckRcptSafelist(ctx context.Context, msgMeta *MsgMetadata, rcptTo string) SafelistCheckResult
+}
+
+// CommitCheckState is an optional interface that can be implemented by
+// CheckState objects.
+//
+// CheckCommit is called after the message is committed to all delivery
+// targets, before the state is closed. It is not called if the message is
+// rejected or the delivery is aborted.
+type CommitCheckState interface {
+	CheckCommit(ctx context.Context)
+}
+
 type CheckState interface {
 	// CheckConnection is executed once when client sends a new message.
 	//
@@ -110,6 +137,23 @@ type CheckResult struct {
 	// This value is copied into MsgMetadata by the msgpipeline.
 	Quarantine bool
 
+	// Score is the value added to the message score if check
+	// uses the 'score' action. Message is rejected or quarantined
+	// by the msgpipeline if the total score reaches the configured
+	// thresholds.
+	Score float64
+
+	// Monitor is the flag that specifies that Reject, Quarantine and
+	// Score should not be applied. Instead, the msgpipeline logs what
+	// would have happened. It is used to evaluate the impact of new
+	// checks before enforcing them.
+	Monitor bool
+
+	// Malware is the flag that specifies that the message is known to
+	// contain malware. Quarantine of such messages is applied even for
+	// recipients that allowlist or safelist the sender.
+	Malware bool
+
 	// AuthResult is the information that is supposed to
 	// be included in Authentication-Results header.
 	AuthResult []authres.Result
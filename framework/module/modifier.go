@@ -31,7 +31,8 @@ import (
 // Currently, the message body can't be mutated for efficiency and
 // correctness reasons: It would require "rebuffering" (see buffer.Buffer doc),
 // can invalidate assertions made on the body contents before modification and
-// will break DKIM signatures.
+// will break DKIM signatures. The only exception is BodyReplacer interface
+// intended for removal of dangerous content.
 //
 // Only message header can be modified. Furthermore, it is highly discouraged for
 // modifiers to remove or change existing fields to prevent issues outlined
@@ -81,3 +82,22 @@ type ModifierState interface {
 	// Rewrite* functions return an error.
 	Close() error
 }
+
+// BodyReplacer is an optional interface that can be implemented by
+// ModifierState to replace the message body.
+//
+// See Modifier documentation for reasons why body modification should be
+// avoided. It is intended only for cases where delivering the original body
+// is not acceptable (e.g. removal of dangerous attachments).
+//
+// ReplaceBody is called for all modifiers before any RewriteBody calls so
+// header fields added by RewriteBody (e.g. DKIM signatures) cover the
+// new body.
+type BodyReplacer interface {
+	// ReplaceBody returns the new message body or nil if no changes are
+	// needed. The header may be modified to match the new body.
+	//
+	// Returned Buffer is owned by the caller that is responsible for
+	// calling Remove on it.
+	ReplaceBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) (buffer.Buffer, error)
+}
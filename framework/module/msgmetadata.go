@@ -99,6 +99,13 @@ type MsgMetadata struct {
 	// the message. It is set only by the message pipeline.
 	Quarantine bool
 
+	// RcptQuarantine overrides Quarantine flag for individual recipients
+	// (as passed to Delivery.AddRcpt). It is set by the message pipeline
+	// if per-recipient preferences are used.
+	//
+	// Use IsQuarantined to check the flag for a recipient.
+	RcptQuarantine map[string]bool
+
 	// OriginalRcpts contains the mapping from the final recipient to the
 	// recipient that was presented by the client.
 	//
@@ -140,9 +147,25 @@ func (msgMeta *MsgMetadata) DeepCopy() *MsgMetadata {
 	cpy := *msgMeta
 	// There is no good way to copy net.Addr, but it should not be
 	// modified by anything anyway so we are safe.
+
+	if msgMeta.RcptQuarantine != nil {
+		cpy.RcptQuarantine = make(map[string]bool, len(msgMeta.RcptQuarantine))
+		for rcpt, quarantine := range msgMeta.RcptQuarantine {
+			cpy.RcptQuarantine[rcpt] = quarantine
+		}
+	}
 	return &cpy
 }
 
+// IsQuarantined reports whether the message should be quarantined for the
+// recipient.
+func (msgMeta *MsgMetadata) IsQuarantined(rcptTo string) bool {
+	if quarantine, ok := msgMeta.RcptQuarantine[rcptTo]; ok {
+		return quarantine
+	}
+	return msgMeta.Quarantine
+}
+
 // GenerateMsgID generates a string usable as MsgID field in module.MsgMeta.
 func GenerateMsgID() (string, error) {
 	rawID := make([]byte, 4)
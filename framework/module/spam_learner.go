@@ -0,0 +1,38 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package module
+
+import (
+	"context"
+
+	"github.com/foxcpp/maddy/framework/buffer"
+)
+
+// SpamLearner is an optional interface implemented by check modules that
+// can be trained using messages classified by users (e.g. moved to or out
+// of the Junk mailbox).
+type SpamLearner interface {
+	// Learn submits the message as an example of spam (spam = true) or
+	// legitimate mail (spam = false). msg contains the full message,
+	// header included.
+	//
+	// accountName is the name of the storage account the message belongs
+	// to. It can be used by learners that maintain per-user statistics.
+	Learn(ctx context.Context, accountName string, spam bool, msg buffer.Buffer) error
+}
@@ -0,0 +1,188 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package attachments
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.attachments"
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	policy    policy
+	errAction modconfig.FailAction
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	c.policy.configure(cfg)
+	cfg.Custom("error_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.errAction)
+	_, err := cfg.Process()
+	return err
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+// severity is used to select the finding that determines the check result.
+func severity(res module.CheckResult) int {
+	switch {
+	case res.Monitor:
+		return 1
+	case res.Reject:
+		return 4
+	case res.Quarantine:
+		return 3
+	case res.Score != 0:
+		return 2
+	}
+	return 0
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	bodyR, err := body.Open()
+	if err != nil {
+		return s.errorResult(err)
+	}
+	defer bodyR.Close()
+
+	findings, err := s.c.policy.inspect(ctx, hdr, bodyR, 0)
+	if err != nil {
+		return s.errorResult(err)
+	}
+
+	var (
+		res    module.CheckResult
+		resSev = -1
+	)
+	for _, f := range findings {
+		s.log.DebugMsg("policy violation", "file", f.File.Path, "reason", f.Reason)
+
+		code, enchCode := 554, exterrors.EnhancedCode{5, 7, 1}
+		if f.Oversize {
+			code, enchCode = 552, exterrors.EnhancedCode{5, 3, 4}
+		}
+
+		fRes := f.Action.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         code,
+				EnhancedCode: enchCode,
+				Message:      "Message contains an attachment that is not allowed by the local policy: " + printable(f.File.Path),
+				Reason:       f.Reason,
+				CheckName:    modName,
+				Misc: map[string]interface{}{
+					"file": f.File.Path,
+				},
+			},
+		})
+		if sev := severity(fRes); sev > resSev {
+			res, resSev = fRes, sev
+		}
+	}
+
+	return res
+}
+
+// printable replaces characters that can't be used in the SMTP reply.
+func printable(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r >= 0x7f {
+			return '?'
+		}
+		return r
+	}, s)
+}
+
+func (s *state) errorResult(err error) module.CheckResult {
+	return s.c.errAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+			Message:      "Internal error during policy check",
+			CheckName:    modName,
+			Err:          err,
+		},
+	})
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,271 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package attachments
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testPolicy() policy {
+	return policy{
+		maxDepth:        3,
+		encryptedAction: modconfig.FailAction{Quarantine: true},
+		mismatchAction:  modconfig.FailAction{Quarantine: true},
+		oversizeAction:  modconfig.FailAction{Reject: true},
+	}
+}
+
+type attachment struct {
+	name, ctype string
+	data        []byte
+}
+
+// buildMessage creates a multipart/mixed message with a text part followed
+// by the attachments.
+func buildMessage(atts ...attachment) (textproto.Header, []byte) {
+	hdr := textproto.Header{}
+	hdr.Add("From", "<test@example.org>")
+	hdr.Add("Content-Type", `multipart/mixed; boundary="BOUNDARY"`)
+
+	var b strings.Builder
+	b.WriteString("--BOUNDARY\r\n")
+	b.WriteString("Content-Type: text/plain\r\n\r\n")
+	b.WriteString("Hello!\r\n")
+	for _, att := range atts {
+		b.WriteString("--BOUNDARY\r\n")
+		b.WriteString("Content-Type: " + att.ctype + "\r\n")
+		b.WriteString(`Content-Disposition: attachment; filename="` + att.name + "\"\r\n")
+		b.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+		b.WriteString(base64.StdEncoding.EncodeToString(att.data) + "\r\n")
+	}
+	b.WriteString("--BOUNDARY--\r\n")
+	return hdr, []byte(b.String())
+}
+
+func buildZip(t *testing.T, name string, encrypted bool, data []byte) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	fh := &zip.FileHeader{Name: name, Method: zip.Store}
+	if encrypted {
+		fh.Flags |= 0x1
+	}
+	w, err := zw.CreateHeader(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func runCheck(t *testing.T, p policy, hdr textproto.Header, body []byte) module.CheckResult {
+	c := &Check{
+		log:    testutils.Logger(t, modName),
+		policy: p,
+	}
+	st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	return st.(*state).CheckBody(context.Background(), hdr, buffer.MemoryBuffer{Slice: body})
+}
+
+func TestCheck(t *testing.T) {
+	exe := []byte("MZ\x90\x00 this program cannot be run in DOS mode")
+
+	test := func(name string, reject, quarantine bool, atts ...attachment) {
+		t.Run(name, func(t *testing.T) {
+			hdr, body := buildMessage(atts...)
+			res := runCheck(t, testPolicy(), hdr, body)
+			if res.Reject != reject {
+				t.Errorf("Reject = %v, want %v", res.Reject, reject)
+			}
+			if res.Quarantine != quarantine {
+				t.Errorf("Quarantine = %v, want %v", res.Quarantine, quarantine)
+			}
+			if (reject || quarantine) && res.Reason == nil {
+				t.Errorf("Reason is not set")
+			}
+		})
+	}
+
+	test("clean", false, false,
+		attachment{"report.txt", "text/plain", []byte("hello")})
+	test("executable", true, false,
+		attachment{"invoice.exe", "application/octet-stream", exe})
+	test("sniffed executable", true, false,
+		attachment{"invoice.dat", "application/octet-stream", exe})
+	test("macro document", false, true,
+		attachment{"invoice.docm", "application/octet-stream", []byte("data")})
+	test("type mismatch", false, true,
+		attachment{"invoice.pdf", "application/pdf", buildZip(t, "invoice.txt", false, []byte("text"))})
+	test("executable in zip", true, false,
+		attachment{"invoice.zip", "application/zip", buildZip(t, "invoice.exe", false, exe)})
+	test("encrypted zip", false, true,
+		attachment{"invoice.zip", "application/zip", buildZip(t, "invoice.txt", true, []byte("text"))})
+	test("reject wins", true, false,
+		attachment{"invoice.docm", "application/octet-stream", []byte("data")},
+		attachment{"invoice.exe", "application/octet-stream", exe})
+}
+
+func TestCheck_NestedMessage(t *testing.T) {
+	innerHdr, innerBody := buildMessage(attachment{"run.bat", "text/plain", []byte("echo")})
+	var inner bytes.Buffer
+	if err := textproto.WriteHeader(&inner, innerHdr); err != nil {
+		t.Fatal(err)
+	}
+	inner.Write(innerBody)
+
+	hdr := textproto.Header{}
+	hdr.Add("Content-Type", "message/rfc822")
+
+	res := runCheck(t, testPolicy(), hdr, inner.Bytes())
+	if !res.Reject {
+		t.Fatal("Expected the message to be rejected")
+	}
+
+	p := testPolicy()
+	p.maxDepth = 0
+	res = runCheck(t, p, hdr, inner.Bytes())
+	if res.Reject {
+		t.Fatal("Nested message should not be inspected with max_depth 0")
+	}
+}
+
+func TestCheck_Oversize(t *testing.T) {
+	p := testPolicy()
+	p.maxPartSize = 10
+	hdr, body := buildMessage(attachment{"big.txt", "text/plain", bytes.Repeat([]byte("a"), 100)})
+	res := runCheck(t, p, hdr, body)
+	if !res.Reject {
+		t.Fatal("Expected the message to be rejected")
+	}
+	if code := res.Reason.(*exterrors.SMTPError).Code; code != 552 {
+		t.Fatal("Wrong SMTP code:", code)
+	}
+}
+
+func TestStrip(t *testing.T) {
+	exe := []byte("MZ\x90\x00 this program cannot be run in DOS mode")
+	hdr, body := buildMessage(
+		attachment{"report.txt", "text/plain", []byte("hello")},
+		attachment{"invoice.exe", "application/octet-stream", exe},
+	)
+
+	s := &Stripper{
+		log:    testutils.Logger(t, stripModName),
+		policy: testPolicy(),
+		notice: defaultNotice,
+	}
+	st, err := s.ModStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	newBody, err := st.(module.BodyReplacer).ReplaceBody(context.Background(), &hdr, buffer.MemoryBuffer{Slice: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newBody == nil {
+		t.Fatal("Body was not replaced")
+	}
+	defer newBody.Remove()
+
+	r, err := newBody.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	e, err := message.New(message.Header{Header: hdr}, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parts []string
+	err = e.Walk(func(path []int, part *message.Entity, err error) error {
+		if err != nil {
+			return err
+		}
+		if len(path) == 0 {
+			return nil
+		}
+		data, err := io.ReadAll(part.Body)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, fileName(part.Header)+":"+strings.TrimSpace(string(data)))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(parts) != 3 {
+		t.Fatalf("Wrong amount of parts: %v", parts)
+	}
+	if parts[0] != ":Hello!" || parts[1] != "report.txt:hello" {
+		t.Errorf("Unrelated parts were changed: %v", parts)
+	}
+	if !strings.HasPrefix(parts[2], ":The attachment invoice.exe was removed") {
+		t.Errorf("Attachment was not replaced: %v", parts[2])
+	}
+}
+
+func TestStrip_Clean(t *testing.T) {
+	hdr, body := buildMessage(attachment{"report.txt", "text/plain", []byte("hello")})
+
+	s := &Stripper{
+		log:    testutils.Logger(t, stripModName),
+		policy: testPolicy(),
+		notice: defaultNotice,
+	}
+	st, err := s.ModStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	newBody, err := st.(module.BodyReplacer).ReplaceBody(context.Background(), &hdr, buffer.MemoryBuffer{Slice: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newBody != nil {
+		t.Fatal("Body should not be replaced")
+	}
+}
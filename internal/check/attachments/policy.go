@@ -0,0 +1,246 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package attachments
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// defaultPolicy is used if policy_table is not specified.
+var defaultPolicy = map[string]string{
+	// Executables and scripts.
+	".exe": "reject", ".com": "reject", ".scr": "reject", ".pif": "reject",
+	".bat": "reject", ".cmd": "reject", ".cpl": "reject", ".msi": "reject",
+	".msp": "reject", ".hta": "reject", ".jar": "reject", ".js": "reject",
+	".jse": "reject", ".vbs": "reject", ".vbe": "reject", ".wsf": "reject",
+	".wsh": "reject", ".ps1": "reject", ".lnk": "reject", ".reg": "reject",
+	"application/x-msdownload": "reject",
+	"application/x-executable": "reject",
+
+	// Macro-enabled documents.
+	".docm": "quarantine", ".dotm": "quarantine", ".xlsm": "quarantine",
+	".xltm": "quarantine", ".xlam": "quarantine", ".pptm": "quarantine",
+	".potm": "quarantine", ".ppam": "quarantine", ".sldm": "quarantine",
+}
+
+// magic is the list of signatures used to detect the actual content type
+// of the file.
+var magic = []struct {
+	prefix []byte
+	ctype  string
+}{
+	{[]byte("MZ"), "application/x-msdownload"},
+	{[]byte("\x7fELF"), "application/x-executable"},
+	{[]byte("PK\x03\x04"), "application/zip"},
+	{[]byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1"), "application/x-ole-storage"},
+	{[]byte("Rar!\x1a\x07"), "application/vnd.rar"},
+	{[]byte("7z\xbc\xaf\x27\x1c"), "application/x-7z-compressed"},
+	{[]byte("%PDF-"), "application/pdf"},
+}
+
+// compatibleTypes lists declared content types (or prefixes ending with
+// '*') that are not considered mismatching for the sniffed type.
+var compatibleTypes = map[string][]string{
+	"application/x-msdownload": {
+		"application/x-msdownload", "application/x-dosexec",
+		"application/x-ms-dos-executable", "application/vnd.microsoft.portable-executable",
+	},
+	"application/x-executable": {"application/x-executable", "application/x-elf"},
+	"application/zip": {
+		"application/zip", "application/x-zip-compressed", "application/x-zip",
+		"application/vnd.openxmlformats-*", "application/vnd.oasis.opendocument.*",
+		"application/vnd.ms-*", "application/java-archive", "application/epub+zip",
+	},
+	"application/x-ole-storage": {
+		"application/msword", "application/vnd.ms-*", "application/vnd.visio",
+		"application/x-msi", "application/x-ole-storage",
+	},
+	"application/vnd.rar":         {"application/vnd.rar", "application/x-rar-compressed", "application/x-rar"},
+	"application/x-7z-compressed": {"application/x-7z-compressed"},
+	"application/pdf":             {"application/pdf", "application/x-pdf"},
+}
+
+// sniff returns the content type detected using magic numbers or an empty
+// string if the content type is unknown.
+func sniff(data []byte) string {
+	for _, m := range magic {
+		if bytes.HasPrefix(data, m.prefix) {
+			return m.ctype
+		}
+	}
+	return ""
+}
+
+func typeMismatch(declared, sniffed string) bool {
+	if sniffed == "" {
+		return false
+	}
+	switch declared {
+	case "", "application/octet-stream", "application/binary", "application/x-binary":
+		return false
+	}
+
+	for _, compatible := range compatibleTypes[sniffed] {
+		if strings.HasSuffix(compatible, "*") {
+			if strings.HasPrefix(declared, strings.TrimSuffix(compatible, "*")) {
+				return false
+			}
+		} else if declared == compatible {
+			return false
+		}
+	}
+	return true
+}
+
+// file describes a single attachment or archive member.
+type file struct {
+	// Name is the file name as specified in the message or archive.
+	Name string
+	// Path is the Name prefixed by names of containing archives and
+	// messages separated by '/'. Used for logging.
+	Path string
+
+	DeclaredType string
+	SniffedType  string
+	Size         int64
+	Encrypted    bool
+}
+
+func (f file) ext() string {
+	return strings.ToLower(path.Ext(f.Name))
+}
+
+// finding is the policy violation found in the message.
+type finding struct {
+	File     file
+	Action   modconfig.FailAction
+	Reason   string
+	Oversize bool
+}
+
+// policy contains configuration shared by check.attachments and
+// modify.strip_attachments.
+type policy struct {
+	table       module.Table
+	maxDepth    int
+	maxPartSize int
+
+	encryptedAction modconfig.FailAction
+	mismatchAction  modconfig.FailAction
+	oversizeAction  modconfig.FailAction
+}
+
+func (p *policy) configure(cfg *config.Map) {
+	cfg.Custom("policy_table", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, modconfig.TableDirective, &p.table)
+	cfg.Int("max_depth", false, false, 3, &p.maxDepth)
+	cfg.DataSize("max_part_size", false, false, 0, &p.maxPartSize)
+	cfg.Custom("encrypted_archive_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Quarantine: true}, nil
+		}, modconfig.FailActionDirective, &p.encryptedAction)
+	cfg.Custom("type_mismatch_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Quarantine: true}, nil
+		}, modconfig.FailActionDirective, &p.mismatchAction)
+	cfg.Custom("oversize_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &p.oversizeAction)
+}
+
+func (p *policy) lookup(ctx context.Context, key string) (string, bool, error) {
+	if p.table == nil {
+		val, ok := defaultPolicy[key]
+		return val, ok, nil
+	}
+	return p.table.Lookup(ctx, key)
+}
+
+// evaluate checks the file against the policy and returns found
+// violations.
+func (p *policy) evaluate(ctx context.Context, f file) ([]finding, error) {
+	var findings []finding
+
+	for _, key := range []string{f.ext(), f.SniffedType, f.DeclaredType} {
+		if key == "" {
+			continue
+		}
+		val, ok, err := p.lookup(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		action, err := modconfig.ParseActionDirective(strings.Fields(val))
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy for %s: %v", key, err)
+		}
+		findings = append(findings, finding{
+			File:   f,
+			Action: action,
+			Reason: "forbidden file type " + key,
+		})
+		break
+	}
+
+	if typeMismatch(f.DeclaredType, f.SniffedType) {
+		findings = append(findings, finding{
+			File:   f,
+			Action: p.mismatchAction,
+			Reason: fmt.Sprintf("declared type %s does not match the content (%s)", f.DeclaredType, f.SniffedType),
+		})
+	}
+	if f.Encrypted {
+		findings = append(findings, finding{
+			File:   f,
+			Action: p.encryptedAction,
+			Reason: "encrypted archive",
+		})
+	}
+	if p.maxPartSize > 0 && f.Size > int64(p.maxPartSize) {
+		findings = append(findings, finding{
+			File:     f,
+			Action:   p.oversizeAction,
+			Reason:   fmt.Sprintf("file is too big (%d bytes)", f.Size),
+			Oversize: true,
+		})
+	}
+
+	return findings, nil
+}
+
+// enforced reports whether the finding should result in an action.
+// Findings with 'ignore' or 'monitor' actions are only logged.
+func (f finding) enforced() bool {
+	if f.Action.Monitor {
+		return false
+	}
+	return f.Action.Reject || f.Action.Quarantine || f.Action.Score != 0
+}
@@ -0,0 +1,275 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package attachments
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime/quotedprintable"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const stripModName = "modify.strip_attachments"
+
+const defaultNotice = "The attachment {filename} was removed from this message: {reason}.\r\n"
+
+// Stripper is a modifier that replaces attachments violating the policy with
+// a text notice, keeping the rest of the message structure intact.
+type Stripper struct {
+	instName string
+	log      log.Logger
+
+	policy policy
+	notice string
+}
+
+func NewStripper(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", stripModName)
+	}
+	return &Stripper{
+		instName: instName,
+		log:      log.Logger{Name: stripModName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (s *Stripper) Name() string {
+	return stripModName
+}
+
+func (s *Stripper) InstanceName() string {
+	return s.instName
+}
+
+func (s *Stripper) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &s.log.Debug)
+	s.policy.configure(cfg)
+	cfg.String("notice", false, false, defaultNotice, &s.notice)
+	_, err := cfg.Process()
+	return err
+}
+
+type stripState struct {
+	s   *Stripper
+	log log.Logger
+}
+
+func (s *Stripper) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return stripState{
+		s:   s,
+		log: target.DeliveryLogger(s.log, msgMeta),
+	}, nil
+}
+
+func (ss stripState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (ss stripState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
+}
+
+func (ss stripState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	return nil
+}
+
+func (ss stripState) ReplaceBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	bodyR, err := body.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer bodyR.Close()
+	data, err := io.ReadAll(bodyR)
+	if err != nil {
+		return nil, err
+	}
+
+	newData, changed, err := ss.strip(ctx, h, data, 0)
+	if err != nil {
+		// Malformed messages are left as is, check.attachments can be used
+		// to reject them.
+		ss.log.Error("failed to parse message, leaving it unchanged", err)
+		return nil, nil
+	}
+	if !changed {
+		return nil, nil
+	}
+	return buffer.MemoryBuffer{Slice: newData}, nil
+}
+
+// strip walks the MIME entity given by its header and raw body and returns
+// the new body if any part of it was replaced. hdr is updated if the entity
+// itself is replaced.
+func (ss stripState) strip(ctx context.Context, hdr *textproto.Header, body []byte, depth int) ([]byte, bool, error) {
+	mHdr := message.Header{Header: *hdr}
+	mediaType, params, _ := mHdr.ContentType()
+	mediaType = strings.ToLower(mediaType)
+
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		return ss.stripMultipart(ctx, body, params["boundary"], depth)
+	}
+
+	if mediaType == "message/rfc822" && depth < ss.s.policy.maxDepth && identityEncoding(*hdr) {
+		br := bufio.NewReader(bytes.NewReader(body))
+		innerHdr, err := textproto.ReadHeader(br)
+		if err != nil {
+			return nil, false, err
+		}
+		innerBody, err := io.ReadAll(br)
+		if err != nil {
+			return nil, false, err
+		}
+		newInner, changed, err := ss.strip(ctx, &innerHdr, innerBody, depth+1)
+		if err != nil || !changed {
+			return nil, false, err
+		}
+		var out bytes.Buffer
+		if err := textproto.WriteHeader(&out, innerHdr); err != nil {
+			return nil, false, err
+		}
+		out.Write(newInner)
+		return out.Bytes(), true, nil
+	}
+
+	findings, err := ss.s.policy.inspect(ctx, *hdr, bytes.NewReader(body), depth)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, f := range findings {
+		if !f.enforced() {
+			continue
+		}
+		return ss.replace(hdr, f)
+	}
+	return nil, false, nil
+}
+
+func (ss stripState) stripMultipart(ctx context.Context, body []byte, boundary string, depth int) ([]byte, bool, error) {
+	type part struct {
+		hdr  textproto.Header
+		body []byte
+	}
+	var (
+		parts   []part
+		changed bool
+	)
+
+	mr := textproto.NewMultipartReader(bytes.NewReader(body), boundary)
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		raw, err := io.ReadAll(p)
+		if err != nil {
+			return nil, false, err
+		}
+
+		partHdr := p.Header
+		newRaw, partChanged, err := ss.strip(ctx, &partHdr, raw, depth)
+		if err != nil {
+			return nil, false, err
+		}
+		if partChanged {
+			raw = newRaw
+			changed = true
+		}
+		parts = append(parts, part{hdr: partHdr, body: raw})
+	}
+	if !changed {
+		return nil, false, nil
+	}
+
+	var out bytes.Buffer
+	mw := textproto.NewMultipartWriter(&out)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return nil, false, err
+	}
+	for _, p := range parts {
+		w, err := mw.CreatePart(p.hdr)
+		if err != nil {
+			return nil, false, err
+		}
+		if _, err := w.Write(p.body); err != nil {
+			return nil, false, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, false, err
+	}
+	return out.Bytes(), true, nil
+}
+
+// replace replaces the entity with the text notice.
+func (ss stripState) replace(hdr *textproto.Header, f finding) ([]byte, bool, error) {
+	name := fileName(message.Header{Header: *hdr})
+	if name == "" {
+		name = f.File.Path
+	}
+	ss.log.Msg("attachment removed", "file", f.File.Path, "reason", f.Reason)
+
+	notice := strings.NewReplacer(
+		"{filename}", name,
+		"{reason}", f.Reason,
+	).Replace(ss.s.notice)
+
+	var out bytes.Buffer
+	qp := quotedprintable.NewWriter(&out)
+	if _, err := qp.Write([]byte(notice)); err != nil {
+		return nil, false, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, false, err
+	}
+
+	hdr.Set("Content-Type", "text/plain; charset=utf-8")
+	hdr.Set("Content-Transfer-Encoding", "quoted-printable")
+	hdr.Del("Content-Disposition")
+	return out.Bytes(), true, nil
+}
+
+func (ss stripState) Close() error {
+	return nil
+}
+
+func identityEncoding(hdr textproto.Header) bool {
+	switch strings.ToLower(strings.TrimSpace(hdr.Get("Content-Transfer-Encoding"))) {
+	case "", "7bit", "8bit", "binary":
+		return true
+	}
+	return false
+}
+
+func init() {
+	module.Register(stripModName, NewStripper)
+}
@@ -0,0 +1,194 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package attachments
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+// maxArchiveMemberSize is the maximum uncompressed size of the archive member
+// that is extracted for inspection of nested archives. Bigger members are
+// inspected only using information from the archive directory.
+const maxArchiveMemberSize = 32 * 1024 * 1024
+
+// inspector walks the message structure and reports policy violations for
+// all found files.
+type inspector struct {
+	p   *policy
+	ctx context.Context
+
+	findings []finding
+}
+
+func (i *inspector) report(f file) error {
+	findings, err := i.p.evaluate(i.ctx, f)
+	if err != nil {
+		return err
+	}
+	i.findings = append(i.findings, findings...)
+	return nil
+}
+
+// inspectEntity inspects the MIME entity given by its header and raw (not
+// decoded) body.
+func (i *inspector) inspectEntity(hdr textproto.Header, body io.Reader, depth int, prefix string) error {
+	e, err := message.New(message.Header{Header: hdr}, body)
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		return err
+	}
+	return i.inspectDecoded(e, depth, prefix)
+}
+
+// inspectDecoded inspects the MIME entity with the already decoded body.
+//
+// depth is the nesting level of message/rfc822 parts and archives, prefix
+// is the name of the containing message or archive.
+func (i *inspector) inspectDecoded(e *message.Entity, depth int, prefix string) error {
+	mediaType, _, _ := e.Header.ContentType()
+	mediaType = strings.ToLower(mediaType)
+
+	if mr := e.MultipartReader(); mr != nil {
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+				return err
+			}
+			if err := i.inspectDecoded(part, depth, prefix); err != nil {
+				return err
+			}
+		}
+	}
+
+	name := fileName(e.Header)
+
+	if mediaType == "message/rfc822" && depth < i.p.maxDepth {
+		inner, err := message.Read(e.Body)
+		if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+			return err
+		}
+		return i.inspectDecoded(inner, depth+1, joinName(prefix, name, "message"))
+	}
+
+	data, err := io.ReadAll(e.Body)
+	if err != nil {
+		return err
+	}
+
+	f := file{
+		Name:         name,
+		Path:         joinName(prefix, name, "part"),
+		DeclaredType: mediaType,
+		SniffedType:  sniff(data),
+		Size:         int64(len(data)),
+	}
+	if err := i.report(f); err != nil {
+		return err
+	}
+
+	if f.SniffedType == "application/zip" && depth < i.p.maxDepth {
+		return i.inspectZip(data, depth+1, f.Path)
+	}
+	return nil
+}
+
+func (i *inspector) inspectZip(data []byte, depth int, prefix string) error {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		// Not a valid archive, nothing to inspect.
+		return nil
+	}
+
+	for _, zf := range zr.File {
+		if strings.HasSuffix(zf.Name, "/") {
+			continue
+		}
+
+		f := file{
+			Name:      zf.Name,
+			Path:      joinName(prefix, zf.Name, ""),
+			Size:      int64(zf.UncompressedSize64),
+			Encrypted: zf.Flags&0x1 != 0,
+		}
+
+		var content []byte
+		if !f.Encrypted && zf.UncompressedSize64 <= maxArchiveMemberSize {
+			r, err := zf.Open()
+			if err == nil {
+				content, err = io.ReadAll(io.LimitReader(r, maxArchiveMemberSize))
+				r.Close()
+			}
+			if err != nil {
+				content = nil
+			}
+			f.SniffedType = sniff(content)
+		}
+
+		if err := i.report(f); err != nil {
+			return err
+		}
+
+		if f.SniffedType == "application/zip" && depth < i.p.maxDepth {
+			if err := i.inspectZip(content, depth+1, f.Path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fileName returns the name of the file from Content-Disposition or
+// Content-Type header fields.
+func fileName(hdr message.Header) string {
+	if _, params, err := hdr.ContentDisposition(); err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	if _, params, err := hdr.ContentType(); err == nil && params["name"] != "" {
+		return params["name"]
+	}
+	return ""
+}
+
+func joinName(prefix, name, placeholder string) string {
+	if name == "" {
+		name = "(unnamed " + placeholder + ")"
+	}
+	if prefix == "" {
+		return name
+	}
+	return prefix + "/" + name
+}
+
+// inspect walks the message and returns all policy violations.
+func (p *policy) inspect(ctx context.Context, hdr textproto.Header, body io.Reader, depth int) ([]finding, error) {
+	i := inspector{p: p, ctx: ctx}
+	if err := i.inspectEntity(hdr, body, depth, ""); err != nil {
+		return i.findings, err
+	}
+	return i.findings, nil
+}
@@ -0,0 +1,353 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package bayes implements the naive Bayes content classifier.
+package bayes
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime/trace"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/authz"
+	"github.com/foxcpp/maddy/internal/target"
+	_ "github.com/lib/pq"
+)
+
+const modName = "check.bayes"
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	db    *sql.DB
+	store store
+
+	perRecipient bool
+	minTraining  int
+
+	quarantineThreshold float64
+	rejectThreshold     float64
+	errAction           modconfig.FailAction
+
+	normalize func(string) (string, error)
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var (
+		driver    string
+		dsn       []string
+		normalize string
+	)
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("driver", false, false, "sqlite3", &driver)
+	cfg.StringList("dsn", false, false, []string{filepath.Join(config.StateDirectory, "bayes.db")}, &dsn)
+	cfg.Bool("per_recipient", false, false, &c.perRecipient)
+	cfg.String("recipient_normalize", false, false, "precis_casefold_email", &normalize)
+	cfg.Int("min_training", false, false, 50, &c.minTraining)
+	cfg.Float("quarantine_threshold", false, false, 0.9, &c.quarantineThreshold)
+	cfg.Float("reject_threshold", false, false, 0, &c.rejectThreshold)
+	cfg.Custom("error_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.errAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	var ok bool
+	c.normalize, ok = authz.NormalizeFuncs[normalize]
+	if !ok {
+		return fmt.Errorf("%s: unknown normalization function: %s", modName, normalize)
+	}
+
+	db, err := sql.Open(driver, strings.Join(dsn, " "))
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	if driver == "sqlite3" {
+		// Token counts are updated in large transactions, avoid "database is
+		// locked" errors.
+		db.SetMaxOpenConns(1)
+	}
+	c.db = db
+	c.store = store{db: db, driver: driver}
+	if err := c.store.initSchema(); err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+
+	return nil
+}
+
+func (c *Check) Close() error {
+	if c.db == nil {
+		return nil
+	}
+	return c.db.Close()
+}
+
+func (c *Check) modelName(addr string) (string, error) {
+	if !c.perRecipient || addr == "" {
+		return globalModel, nil
+	}
+	return c.normalize(addr)
+}
+
+// messageDigest identifies the message for training. Copies of the same
+// message (e.g. delivered to multiple recipients) have the same digest.
+func messageDigest(hdr textproto.Header, tokens []string) string {
+	sorted := append([]string(nil), tokens...)
+	sort.Strings(sorted)
+
+	h := sha256.New()
+	io.WriteString(h, hdr.Get("Message-Id")) // nolint:errcheck
+	for _, token := range sorted {
+		io.WriteString(h, "\n"+token) // nolint:errcheck
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Learn implements module.SpamLearner. The message is added to the global
+// model and, if per_recipient is enabled, to the model of the account.
+// If accountName is empty, only the global model is trained.
+//
+// Messages that were already learned are skipped. If the message was
+// learned with the other class before, it is moved to the new one.
+func (c *Check) Learn(ctx context.Context, accountName string, spam bool, msg buffer.Buffer) error {
+	body, err := msg.Open()
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	br := bufio.NewReader(body)
+	hdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	tokens, err := Tokenize(hdr, br)
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+
+	models := []string{globalModel}
+	if model, err := c.modelName(accountName); err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	} else if model != globalModel {
+		models = append(models, model)
+	}
+	digest := messageDigest(hdr, tokens)
+	for _, model := range models {
+		learned, err := c.store.train(ctx, model, digest, spam, tokens)
+		if err != nil {
+			return fmt.Errorf("%s: %w", modName, err)
+		}
+		if !learned {
+			c.log.DebugMsg("message already learned", "account", accountName, "model", model, "spam", spam)
+			continue
+		}
+		c.log.DebugMsg("message learned", "account", accountName, "model", model, "spam", spam, "tokens", len(tokens))
+	}
+	return nil
+}
+
+// classify returns the spam probability of the message with the specified
+// tokens. ok is false if the model is not trained enough.
+func (c *Check) classify(ctx context.Context, model string, tokens []string) (score float64, ok bool, err error) {
+	counts, err := c.store.messageCounts(ctx, model)
+	if err != nil {
+		return 0, false, err
+	}
+	if counts.spam < int64(c.minTraining) || counts.ham < int64(c.minTraining) {
+		return 0, false, nil
+	}
+
+	tokenCounts, err := c.store.tokenCounts(ctx, model, tokens)
+	if err != nil {
+		return 0, false, err
+	}
+	probs := make([]float64, 0, len(tokenCounts))
+	for _, tc := range tokenCounts {
+		probs = append(probs, tokenProb(tc, counts.spam, counts.ham))
+	}
+	return combine(probs), true, nil
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+
+	rcpts []string
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
+	s.rcpts = append(s.rcpts, rcptTo)
+	return module.CheckResult{}
+}
+
+func (s *state) errorResult(err error) module.CheckResult {
+	return s.c.errAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+			Message:      "Internal error during policy check",
+			CheckName:    modName,
+			Err:          err,
+		},
+	})
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	defer trace.StartRegion(ctx, "bayes/CheckBody").End()
+
+	bodyR, err := body.Open()
+	if err != nil {
+		return s.errorResult(err)
+	}
+	defer bodyR.Close()
+	tokens, err := Tokenize(hdr, bodyR)
+	if err != nil {
+		return s.errorResult(err)
+	}
+
+	// Per-recipient model is used only if the message has one recipient
+	// and the model has enough training data.
+	var (
+		score float64
+		ok    bool
+		model = globalModel
+	)
+	if len(s.rcpts) == 1 {
+		model, err = s.c.modelName(s.rcpts[0])
+		if err != nil {
+			s.log.Error("cannot normalize recipient, using global model", err, "rcpt", s.rcpts[0])
+			model = globalModel
+		}
+	}
+	if model != globalModel {
+		score, ok, err = s.c.classify(ctx, model, tokens)
+		if err != nil {
+			return s.errorResult(err)
+		}
+	}
+	if !ok {
+		model = globalModel
+		score, ok, err = s.c.classify(ctx, model, tokens)
+		if err != nil {
+			return s.errorResult(err)
+		}
+	}
+	if !ok {
+		s.log.DebugMsg("not enough training data, skipping")
+		return module.CheckResult{}
+	}
+
+	s.log.DebugMsg("message classified", "score", score, "model", model, "tokens", len(tokens))
+
+	hdrAdd := textproto.Header{}
+	hdrAdd.Add("X-Spam-Bayes", strconv.FormatFloat(score, 'f', 4, 64))
+
+	var (
+		action modconfig.FailAction
+		reason string
+		misc   map[string]interface{}
+	)
+	switch {
+	case s.c.rejectThreshold > 0 && score >= s.c.rejectThreshold:
+		action.Reject = true
+		reason = "spam probability exceeds reject threshold"
+		misc = map[string]interface{}{"bayes-score": score, "bayes-reject-threshold": s.c.rejectThreshold}
+	case s.c.quarantineThreshold > 0 && score >= s.c.quarantineThreshold:
+		action.Quarantine = true
+		reason = "spam probability exceeds quarantine threshold"
+		misc = map[string]interface{}{"bayes-score": score, "bayes-quarantine-threshold": s.c.quarantineThreshold}
+	default:
+		return module.CheckResult{Header: hdrAdd}
+	}
+
+	return action.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 0},
+			Message:      "Message rejected due to local policy",
+			CheckName:    modName,
+			Reason:       reason,
+			Misc:         misc,
+		},
+		Header: hdrAdd,
+	})
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,181 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bayes
+
+import (
+	"bufio"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+var (
+	spamMsgs = []string{
+		"From: Winner <prize@lottery.example>\r\nSubject: You won a free prize\r\n\r\nClaim your free lottery prize now, click here to claim cash\r\n",
+		"From: Pharmacy <sales@pills.example>\r\nSubject: Cheap pills, free shipping\r\n\r\nBuy cheap pills now with free shipping and cash discount\r\n",
+		"From: Offer <offer@deals.example>\r\nSubject: Limited offer\r\nContent-Type: text/html\r\n\r\n<p>Click <a href=\"http://deals.example/x\">here</a> for free cash now</p>\r\n",
+	}
+	hamMsgs = []string{
+		"From: Alice <alice@example.org>\r\nSubject: Meeting notes\r\n\r\nHere are the notes from yesterday's meeting about the project schedule\r\n",
+		"From: Bob <bob@example.org>\r\nSubject: Re: project schedule\r\n\r\nThanks for the notes, the schedule looks fine for the project review\r\n",
+		"From: Alice <alice@example.org>\r\nSubject: Lunch tomorrow\r\n\r\nShould we discuss the review over lunch tomorrow?\r\n",
+	}
+)
+
+func classifyMsg(t *testing.T, c *Check, rcpt, msg string) module.CheckResult {
+	t.Helper()
+	br := bufio.NewReader(strings.NewReader(msg))
+	hdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := buffer.BufferInMemory(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	st.CheckRcpt(context.Background(), rcpt)
+	return st.CheckBody(context.Background(), hdr, body)
+}
+
+func TestClassify(t *testing.T) {
+	dir := testutils.Dir(t)
+	mod, err := New(modName, "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	c.log = testutils.Logger(t, modName)
+	err = c.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "dsn", Args: []string{filepath.Join(dir, "bayes.db")}},
+			{Name: "per_recipient", Args: []string{"yes"}},
+			{Name: "min_training", Args: []string{"3"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Not trained yet.
+	res := classifyMsg(t, c, "user@example.org", spamMsgs[0])
+	if res.Quarantine || res.Reject || res.Header.Has("X-Spam-Bayes") {
+		t.Fatalf("unexpected result without training: %+v", res)
+	}
+
+	for _, msg := range spamMsgs {
+		if err := c.Learn(context.Background(), "user@example.org", true, buffer.MemoryBuffer{Slice: []byte(msg)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, msg := range hamMsgs {
+		if err := c.Learn(context.Background(), "user@example.org", false, buffer.MemoryBuffer{Slice: []byte(msg)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	spam := "From: Prizes <prize@lottery.example>\r\nSubject: Free cash prize\r\n\r\nClick here now to claim free cash\r\n"
+	ham := "From: Bob <bob@example.org>\r\nSubject: Project review notes\r\n\r\nThe review of the project schedule is tomorrow\r\n"
+
+	// Per-recipient model and global model (used for other recipients)
+	// are trained with the same messages.
+	for _, rcpt := range []string{"user@example.org", "other@example.org"} {
+		res = classifyMsg(t, c, rcpt, spam)
+		if !res.Quarantine {
+			t.Errorf("%s: spam is not quarantined, score %s", rcpt, res.Header.Get("X-Spam-Bayes"))
+		}
+		res = classifyMsg(t, c, rcpt, ham)
+		if res.Quarantine || res.Reject || !res.Header.Has("X-Spam-Bayes") {
+			t.Errorf("%s: unexpected result for ham: %+v", rcpt, res)
+		}
+	}
+
+	counts, err := c.store.messageCounts(context.Background(), "user@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts.spam != 3 || counts.ham != 3 {
+		t.Errorf("wrong per-recipient model counts: %+v", counts)
+	}
+}
+
+func TestLearn_Relearn(t *testing.T) {
+	mod, err := New(modName, "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	c.log = testutils.Logger(t, modName)
+	err = c.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "dsn", Args: []string{filepath.Join(testutils.Dir(t), "bayes.db")}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	learn := func(spam bool) {
+		t.Helper()
+		if err := c.Learn(context.Background(), "", spam, buffer.MemoryBuffer{Slice: []byte(spamMsgs[0])}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(spam, ham int64) {
+		t.Helper()
+		counts, err := c.store.messageCounts(context.Background(), globalModel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if counts.spam != spam || counts.ham != ham {
+			t.Errorf("wrong model counts: %+v, want spam %d, ham %d", counts, spam, ham)
+		}
+		tokens, err := c.store.tokenCounts(context.Background(), globalModel, []string{"subject:prize"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc := tokens["subject:prize"]; tc.spam != spam || tc.ham != ham {
+			t.Errorf("wrong token counts: %+v, want spam %d, ham %d", tc, spam, ham)
+		}
+	}
+
+	learn(true)
+	learn(true)
+	check(1, 0)
+
+	// Message moved out of Junk.
+	learn(false)
+	check(0, 1)
+}
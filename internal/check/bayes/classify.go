@@ -0,0 +1,95 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bayes
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	// Strength of the background information for rarely seen tokens and
+	// the assumed probability of the unknown token (Robinson's s and x).
+	unknownStrength = 0.45
+	unknownProb     = 0.5
+
+	// Tokens with probability closer to 0.5 than that are ignored.
+	minDeviation = 0.1
+	// Maximum amount of the most significant tokens used for the score.
+	maxDiscriminators = 150
+)
+
+// tokenProb computes the probability that a message containing the token is
+// spam (Robinson's f(w)).
+func tokenProb(c tokenCounts, nSpam, nHam int64) float64 {
+	spamRatio := float64(c.spam) / float64(nSpam)
+	hamRatio := float64(c.ham) / float64(nHam)
+	if spamRatio+hamRatio == 0 {
+		return unknownProb
+	}
+	p := spamRatio / (spamRatio + hamRatio)
+
+	n := float64(c.spam + c.ham)
+	return (unknownStrength*unknownProb + n*p) / (unknownStrength + n)
+}
+
+// chi2Q returns the probability that chi-square with v (even) degrees of
+// freedom is greater or equal to x2.
+func chi2Q(x2 float64, v int) float64 {
+	m := x2 / 2
+	sum := math.Exp(-m)
+	term := sum
+	for i := 1; i < v/2; i++ {
+		term *= m / float64(i)
+		sum += term
+	}
+	return math.Min(sum, 1)
+}
+
+// combine computes the spam probability of the message using Fisher's
+// method for combining token probabilities. 0.5 is returned if there are
+// no significant tokens.
+func combine(probs []float64) float64 {
+	sig := make([]float64, 0, len(probs))
+	for _, p := range probs {
+		if math.Abs(p-0.5) >= minDeviation {
+			sig = append(sig, p)
+		}
+	}
+	if len(sig) == 0 {
+		return 0.5
+	}
+	sort.Slice(sig, func(i, j int) bool {
+		return math.Abs(sig[i]-0.5) > math.Abs(sig[j]-0.5)
+	})
+	if len(sig) > maxDiscriminators {
+		sig = sig[:maxDiscriminators]
+	}
+
+	var hamLog, spamLog float64
+	for _, p := range sig {
+		// Keep logarithms finite.
+		p = math.Max(math.Min(p, 0.9999), 0.0001)
+		hamLog += math.Log(p)
+		spamLog += math.Log(1 - p)
+	}
+	s := 1 - chi2Q(-2*spamLog, 2*len(sig))
+	h := 1 - chi2Q(-2*hamLog, 2*len(sig))
+	return (s - h + 1) / 2
+}
@@ -0,0 +1,225 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bayes
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/foxcpp/maddy/internal/sqlutil"
+)
+
+// globalModel is the name of the model used for all recipients.
+const globalModel = ""
+
+// queryChunkSize is the maximum amount of tokens looked up using one query.
+const queryChunkSize = 500
+
+type tokenCounts struct {
+	spam, ham int64
+}
+
+// store keeps token counts in the SQL database.
+//
+// Counts are kept for each model separately. Model is the recipient address
+// for per-recipient models or an empty string for the global model.
+type store struct {
+	db     *sql.DB
+	driver string
+}
+
+func (s *store) rebind(query string) string {
+	return sqlutil.Rebind(s.driver, query)
+}
+
+func (s *store) initSchema() error {
+	_, err := s.db.Exec(`
+		CREATE TABLE IF NOT EXISTS bayesModels (
+			model VARCHAR(255) PRIMARY KEY NOT NULL,
+			spam BIGINT NOT NULL DEFAULT 0,
+			ham BIGINT NOT NULL DEFAULT 0
+		)`)
+	if err != nil {
+		return fmt.Errorf("create table bayesModels: %w", err)
+	}
+	_, err = s.db.Exec(`
+		CREATE TABLE IF NOT EXISTS bayesTokens (
+			model VARCHAR(255) NOT NULL,
+			token VARCHAR(255) NOT NULL,
+			spam BIGINT NOT NULL DEFAULT 0,
+			ham BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY(model, token)
+		)`)
+	if err != nil {
+		return fmt.Errorf("create table bayesTokens: %w", err)
+	}
+	_, err = s.db.Exec(`
+		CREATE TABLE IF NOT EXISTS bayesSeen (
+			model VARCHAR(255) NOT NULL,
+			digest CHAR(64) NOT NULL,
+			spam INTEGER NOT NULL,
+			PRIMARY KEY(model, digest)
+		)`)
+	if err != nil {
+		return fmt.Errorf("create table bayesSeen: %w", err)
+	}
+	return nil
+}
+
+// messageCounts returns the amount of spam and ham messages the model was
+// trained with.
+func (s *store) messageCounts(ctx context.Context, model string) (tokenCounts, error) {
+	var c tokenCounts
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT spam, ham FROM bayesModels WHERE model = ?`), model).Scan(&c.spam, &c.ham)
+	if err == sql.ErrNoRows {
+		return c, nil
+	}
+	return c, err
+}
+
+// tokenCounts returns counts for the specified tokens. Tokens never seen
+// before are not included.
+func (s *store) tokenCounts(ctx context.Context, model string, tokens []string) (map[string]tokenCounts, error) {
+	res := make(map[string]tokenCounts, len(tokens))
+	for len(tokens) != 0 {
+		chunk := tokens
+		if len(chunk) > queryChunkSize {
+			chunk = chunk[:queryChunkSize]
+		}
+		tokens = tokens[len(chunk):]
+
+		args := make([]interface{}, 0, len(chunk)+1)
+		args = append(args, model)
+		for _, t := range chunk {
+			args = append(args, t)
+		}
+		query := `SELECT token, spam, ham FROM bayesTokens WHERE model = ? AND token IN (?` +
+			strings.Repeat(", ?", len(chunk)-1) + `)`
+
+		rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var (
+				token string
+				c     tokenCounts
+			)
+			if err := rows.Scan(&token, &c.spam, &c.ham); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			res[token] = c
+		}
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		rows.Close()
+	}
+	return res, nil
+}
+
+// train adds the message tokens to the model.
+//
+// Each message is learned only once for each model, messages are told
+// apart using the digest. If the message was learned before with the other
+// class, it is removed from counts of that class. false is returned if the
+// message was already learned with the same class.
+func (s *store) train(ctx context.Context, model, digest string, spam bool, tokens []string) (bool, error) {
+	class := 0
+	if spam {
+		class = 1
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	res, err := tx.ExecContext(ctx, s.rebind(`
+		INSERT INTO bayesSeen(model, digest, spam) VALUES (?, ?, ?)
+		ON CONFLICT (model, digest) DO NOTHING`), model, digest, class)
+	if err != nil {
+		return false, err
+	}
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	var spamDelta, hamDelta int64
+	if inserted == 0 {
+		res, err := tx.ExecContext(ctx, s.rebind(`
+			UPDATE bayesSeen SET spam = ?
+			WHERE model = ? AND digest = ? AND spam <> ?`), class, model, digest, class)
+		if err != nil {
+			return false, err
+		}
+		changed, err := res.RowsAffected()
+		if err != nil {
+			return false, err
+		}
+		if changed == 0 {
+			return false, nil
+		}
+
+		// Unlearn the old class.
+		if spam {
+			hamDelta--
+		} else {
+			spamDelta--
+		}
+	}
+	if spam {
+		spamDelta++
+	} else {
+		hamDelta++
+	}
+
+	// ON CONFLICT is used instead of UPDATE and INSERT so concurrent
+	// training does not fail on the primary key constraint.
+	_, err = tx.ExecContext(ctx, s.rebind(`
+		INSERT INTO bayesModels(model, spam, ham) VALUES (?, ?, ?)
+		ON CONFLICT (model) DO UPDATE
+		SET spam = bayesModels.spam + excluded.spam, ham = bayesModels.ham + excluded.ham`),
+		model, spamDelta, hamDelta)
+	if err != nil {
+		return false, err
+	}
+
+	addToken, err := tx.PrepareContext(ctx, s.rebind(`
+		INSERT INTO bayesTokens(model, token, spam, ham) VALUES (?, ?, ?, ?)
+		ON CONFLICT (model, token) DO UPDATE
+		SET spam = bayesTokens.spam + excluded.spam, ham = bayesTokens.ham + excluded.ham`))
+	if err != nil {
+		return false, err
+	}
+	defer addToken.Close()
+	for _, token := range tokens {
+		if _, err := addToken.ExecContext(ctx, model, token, spamDelta, hamDelta); err != nil {
+			return false, err
+		}
+	}
+
+	return true, tx.Commit()
+}
@@ -0,0 +1,212 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bayes
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"unicode"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/internal/check/domainbl"
+	"golang.org/x/net/html"
+)
+
+const (
+	minTokenLen = 3
+	maxTokenLen = 40
+	// maxStoredLen is the maximum length of the token with prefix in
+	// bytes. Must fit into the database column.
+	maxStoredLen = 200
+
+	// maxTokens is the maximum amount of unique tokens used for one message.
+	maxTokens = 3000
+	// maxTextSize is the maximum amount of text read from each message part.
+	maxTextSize = 512 * 1024
+)
+
+type tokenSet struct {
+	tokens map[string]struct{}
+}
+
+func (ts *tokenSet) add(token string) {
+	if len(ts.tokens) >= maxTokens || len(token) > maxStoredLen {
+		return
+	}
+	ts.tokens[token] = struct{}{}
+}
+
+// addWords splits text into words and adds them with the prefix.
+func (ts *tokenSet) addWords(prefix, text string) {
+	for _, word := range strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '$' && r != '\'' && r != '-'
+	}) {
+		word = strings.Trim(word, "'-")
+		if len(word) < minTokenLen {
+			continue
+		}
+		if len(word) > maxTokenLen {
+			// Long words are mostly base64 blobs and such, only their
+			// presence matters.
+			ts.add(prefix + "skip:" + string([]rune(word)[0]) + ":" + lengthBucket(len(word)))
+			continue
+		}
+		ts.add(prefix + strings.ToLower(word))
+	}
+}
+
+func lengthBucket(l int) string {
+	switch {
+	case l < 100:
+		return "short"
+	case l < 1000:
+		return "medium"
+	default:
+		return "long"
+	}
+}
+
+func (ts *tokenSet) list() []string {
+	res := make([]string, 0, len(ts.tokens))
+	for token := range ts.tokens {
+		res = append(res, token)
+	}
+	return res
+}
+
+// headerTokens adds tokens derived from the message header. Tokens are
+// prefixed with the field name so the same word in the Subject and body are
+// counted separately.
+func (ts *tokenSet) headerTokens(hdr textproto.Header) {
+	ts.addWords("subject:", hdr.Get("Subject"))
+
+	for _, field := range []string{"From", "Reply-To"} {
+		value := hdr.Get(field)
+		if value == "" {
+			continue
+		}
+		prefix := strings.ToLower(field) + ":"
+		if start, end := strings.LastIndexByte(value, '<'), strings.LastIndexByte(value, '>'); start != -1 && end > start {
+			addr := value[start+1 : end]
+			ts.addWords(prefix+"name:", value[:start])
+			value = addr
+		}
+		_, domain, err := address.Split(strings.TrimSpace(value))
+		if err == nil && domain != "" {
+			ts.add(prefix + "domain:" + strings.ToLower(domain))
+		}
+		ts.add(prefix + "addr:" + strings.ToLower(strings.TrimSpace(value)))
+	}
+
+	for _, field := range []string{"X-Mailer", "User-Agent"} {
+		ts.addWords("mailer:", hdr.Get(field))
+	}
+
+	if ctype := hdr.Get("Content-Type"); ctype != "" {
+		ts.add("ctype:" + strings.ToLower(strings.TrimSpace(strings.SplitN(ctype, ";", 2)[0])))
+	}
+	if hdr.Get("Message-Id") == "" {
+		ts.add("header:no-message-id")
+	}
+}
+
+func (ts *tokenSet) textTokens(r io.Reader) error {
+	scanner := bufio.NewScanner(io.LimitReader(r, maxTextSize))
+	scanner.Buffer(make([]byte, 0, 4096), maxTextSize)
+	for scanner.Scan() {
+		ts.addWords("", scanner.Text())
+	}
+	return scanner.Err()
+}
+
+func (ts *tokenSet) htmlTokens(r io.Reader) error {
+	z := html.NewTokenizer(io.LimitReader(r, maxTextSize))
+	skip := false
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return nil
+			}
+			return z.Err()
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			tag := string(name)
+			switch tag {
+			case "script", "style":
+				skip = true
+			}
+			ts.add("html:" + tag)
+			for hasAttr {
+				var key, val []byte
+				key, val, hasAttr = z.TagAttr()
+				if string(key) == "href" || string(key) == "src" {
+					ts.urlTokens(string(val))
+				}
+			}
+		case html.EndTagToken:
+			skip = false
+		case html.TextToken:
+			if !skip {
+				ts.addWords("", string(z.Text()))
+			}
+		}
+	}
+}
+
+func (ts *tokenSet) urlTokens(u string) {
+	u = strings.ToLower(u)
+	if i := strings.Index(u, "://"); i != -1 {
+		u = u[i+3:]
+	}
+	host := u
+	if i := strings.IndexAny(host, "/?#"); i != -1 {
+		host = host[:i]
+	}
+	if host != "" {
+		ts.add("url:" + host)
+	}
+}
+
+// Tokenize returns the set of tokens used for classification of the
+// message with the specified header and body.
+func Tokenize(hdr textproto.Header, body io.Reader) ([]string, error) {
+	ts := tokenSet{tokens: make(map[string]struct{})}
+	ts.headerTokens(hdr)
+
+	// Reconstruct the message for the MIME parser.
+	var buf strings.Builder
+	if err := textproto.WriteHeader(&buf, hdr); err != nil {
+		return nil, err
+	}
+	msg := io.MultiReader(strings.NewReader(buf.String()), body)
+
+	err := domainbl.WalkTextParts(msg, func(ctype string, part io.Reader) error {
+		if ctype == "text/html" {
+			return ts.htmlTokens(part)
+		}
+		return ts.textTokens(part)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ts.list(), nil
+}
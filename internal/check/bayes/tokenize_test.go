@@ -0,0 +1,73 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bayes
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+func TestTokenize(t *testing.T) {
+	msg := "From: Offer <offer@deals.example>\r\nSubject: Limited offer\r\n" +
+		"Content-Type: multipart/alternative; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nFree CASH now\r\n" +
+		"--b\r\nContent-Type: text/html\r\n\r\n<style>ignored{}</style><a href=\"https://deals.example/x\">Click</a>\r\n" +
+		"--b--\r\n"
+	br := bufio.NewReader(strings.NewReader(msg))
+	hdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := Tokenize(hdr, br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := make(map[string]struct{}, len(tokens))
+	for _, token := range tokens {
+		set[token] = struct{}{}
+	}
+	for _, expected := range []string{
+		"subject:limited", "subject:offer", "from:addr:offer@deals.example",
+		"from:domain:deals.example", "from:name:offer", "free", "cash", "now",
+		"click", "html:a", "url:deals.example", "ctype:multipart/alternative",
+		"header:no-message-id",
+	} {
+		if _, ok := set[expected]; !ok {
+			t.Errorf("missing token %s in %v", expected, tokens)
+		}
+	}
+	if _, ok := set["ignored"]; ok {
+		t.Errorf("style contents are tokenized")
+	}
+}
+
+func TestCombine(t *testing.T) {
+	if score := combine(nil); score != 0.5 {
+		t.Errorf("expected 0.5 without tokens, got %v", score)
+	}
+	if score := combine([]float64{0.99, 0.98, 0.95, 0.5}); score < 0.9 {
+		t.Errorf("expected high score, got %v", score)
+	}
+	if score := combine([]float64{0.01, 0.02, 0.05, 0.5}); score > 0.1 {
+		t.Errorf("expected low score, got %v", score)
+	}
+}
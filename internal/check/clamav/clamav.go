@@ -0,0 +1,281 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package clamav
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.clamav"
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	endpoint   string
+	network    string
+	address    string
+	dialer     *net.Dialer
+	cmdTimeout time.Duration
+	maxSize    int
+	addHeader  bool
+
+	virusAction     modconfig.FailAction
+	ioErrAction     modconfig.FailAction
+	errorRespAction modconfig.FailAction
+	sizeLimitAction modconfig.FailAction
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	c := &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}
+
+	switch len(inlineArgs) {
+	case 1:
+		c.endpoint = inlineArgs[0]
+	case 0:
+		c.endpoint = "tcp://127.0.0.1:3310"
+	default:
+		return nil, fmt.Errorf("%s: unexpected amount of inline arguments", modName)
+	}
+
+	return c, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var connTimeout time.Duration
+
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("endpoint", false, false, c.endpoint, &c.endpoint)
+	cfg.Duration("connect_timeout", false, false, 3*time.Second, &connTimeout)
+	cfg.Duration("command_timeout", false, false, 30*time.Second, &c.cmdTimeout)
+	// Should match StreamMaxLength in clamd.conf.
+	cfg.DataSize("max_size", false, false, 25*1024*1024, &c.maxSize)
+	cfg.Bool("add_header", false, true, &c.addHeader)
+	cfg.Custom("virus_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.virusAction)
+	cfg.Custom("io_error_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.ioErrAction)
+	cfg.Custom("error_resp_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.errorRespAction)
+	cfg.Custom("size_limit_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.sizeLimitAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	endp, err := config.ParseEndpoint(c.endpoint)
+	if err != nil {
+		return fmt.Errorf("%s: %v", modName, err)
+	}
+	switch endp.Scheme {
+	case "tcp", "unix":
+	default:
+		return fmt.Errorf("%s: scheme unsupported: %v", modName, endp.Scheme)
+	}
+	if endp.Path != "" {
+		return fmt.Errorf("%s: stray path in endpoint: %v", modName, endp)
+	}
+
+	c.network = endp.Network()
+	c.address = endp.Address()
+	c.dialer = &net.Dialer{Timeout: connTimeout}
+
+	return nil
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) sizeLimitResult(size int) module.CheckResult {
+	res := s.c.sizeLimitAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         552,
+			EnhancedCode: exterrors.EnhancedCode{5, 3, 4},
+			Message:      "Message is too big to be scanned for viruses",
+			CheckName:    modName,
+			Misc: map[string]interface{}{
+				"size":     size,
+				"max_size": s.c.maxSize,
+			},
+		},
+	})
+	if s.c.addHeader && !res.Reject {
+		res.Header.Add("X-Virus-Scanned", "No (message is too big)")
+	}
+	return res
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	var hdrBuf bytes.Buffer
+	if err := textproto.WriteHeader(&hdrBuf, hdr); err != nil {
+		return s.c.ioErrAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+				Message:      "Internal error during policy check",
+				CheckName:    modName,
+				Err:          err,
+			},
+		})
+	}
+
+	size := hdrBuf.Len() + body.Len()
+	if s.c.maxSize > 0 && size > s.c.maxSize {
+		s.log.Msg("message is too big, not scanning", "size", size, "max_size", s.c.maxSize)
+		return s.sizeLimitResult(size)
+	}
+
+	bodyR, err := body.Open()
+	if err != nil {
+		return s.c.ioErrAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+				Message:      "Internal error during policy check",
+				CheckName:    modName,
+				Err:          err,
+			},
+		})
+	}
+	defer bodyR.Close()
+
+	res, err := instream(ctx, s.c.dialer, s.c.network, s.c.address, s.c.cmdTimeout, io.MultiReader(&hdrBuf, bodyR))
+	if err != nil {
+		var clamdErr clamdError
+		switch {
+		case errors.Is(err, errSizeLimit):
+			s.log.Msg("clamd StreamMaxLength exceeded, message is not scanned", "size", size)
+			return s.sizeLimitResult(size)
+		case errors.As(err, &clamdErr):
+			return s.c.errorRespAction.Apply(module.CheckResult{
+				Reason: &exterrors.SMTPError{
+					Code:         451,
+					EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+					Message:      "Internal error during policy check",
+					CheckName:    modName,
+					Err:          err,
+				},
+			})
+		default:
+			return s.c.ioErrAction.Apply(module.CheckResult{
+				Reason: &exterrors.SMTPError{
+					Code:         451,
+					EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+					Message:      "Internal error during policy check",
+					CheckName:    modName,
+					Err:          err,
+				},
+			})
+		}
+	}
+
+	if !res.Infected {
+		s.log.DebugMsg("message is clean")
+		if !s.c.addHeader {
+			return module.CheckResult{}
+		}
+		hdrAdd := textproto.Header{}
+		hdrAdd.Add("X-Virus-Scanned", "ClamAV")
+		hdrAdd.Add("X-Virus-Status", "Clean")
+		return module.CheckResult{Header: hdrAdd}
+	}
+
+	checkRes := s.c.virusAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Message contains a virus: " + res.Signature,
+			CheckName:    modName,
+			Misc: map[string]interface{}{
+				"signature": res.Signature,
+			},
+		},
+	})
+	checkRes.Malware = true
+	if s.c.addHeader {
+		checkRes.Header.Add("X-Virus-Scanned", "ClamAV")
+		checkRes.Header.Add("X-Virus-Status", "Infected ("+res.Signature+")")
+	}
+	return checkRes
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,167 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package clamav
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// fakeClamd implements INSTREAM command of the clamd protocol. It reports
+// the EICAR signature if the stream contains "EICAR" string.
+func fakeClamd(t *testing.T, streamMaxLength int) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				cmd, err := r.ReadString(0)
+				if err != nil {
+					return
+				}
+				if cmd != "zINSTREAM\x00" {
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+
+				var stream bytes.Buffer
+				lenBuf := make([]byte, 4)
+				for {
+					if _, err := io.ReadFull(r, lenBuf); err != nil {
+						return
+					}
+					chunkLen := binary.BigEndian.Uint32(lenBuf)
+					if chunkLen == 0 {
+						break
+					}
+					if _, err := io.CopyN(&stream, r, int64(chunkLen)); err != nil {
+						return
+					}
+					if stream.Len() > streamMaxLength {
+						conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+						return
+					}
+				}
+
+				if strings.Contains(stream.String(), "EICAR") {
+					conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+					return
+				}
+				conn.Write([]byte("stream: OK\x00"))
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func testCheck(t *testing.T, addr string) *Check {
+	return &Check{
+		log:         testutils.Logger(t, modName),
+		network:     "tcp",
+		address:     addr,
+		dialer:      &net.Dialer{Timeout: time.Second},
+		cmdTimeout:  5 * time.Second,
+		addHeader:   true,
+		virusAction: modconfig.FailAction{Reject: true},
+	}
+}
+
+func runCheck(t *testing.T, c *Check, body string) module.CheckResult {
+	st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	hdr := textproto.Header{}
+	hdr.Add("From", "<test@example.org>")
+	return st.CheckBody(context.Background(), hdr, buffer.MemoryBuffer{Slice: []byte(body)})
+}
+
+func TestClamAV(t *testing.T) {
+	c := testCheck(t, fakeClamd(t, 1024*1024))
+
+	res := runCheck(t, c, "Hello!\r\n")
+	if res.Reason != nil || res.Header.Get("X-Virus-Status") != "Clean" {
+		t.Fatalf("wrong result for clean message: %+v", res)
+	}
+
+	res = runCheck(t, c, strings.Repeat("A", 2*chunkSize)+"EICAR\r\n")
+	if !res.Reject {
+		t.Fatalf("infected message is not rejected: %+v", res)
+	}
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(res.Reason, &smtpErr) || !strings.Contains(smtpErr.Message, "Eicar-Test-Signature") {
+		t.Fatalf("signature name is not included in the reply: %v", res.Reason)
+	}
+}
+
+func TestClamAV_SizeLimit(t *testing.T) {
+	c := testCheck(t, fakeClamd(t, 1024))
+	c.sizeLimitAction = modconfig.FailAction{Quarantine: true}
+
+	// Checked by clamd.
+	res := runCheck(t, c, strings.Repeat("A", 4*chunkSize))
+	if !res.Quarantine || res.Header.Get("X-Virus-Scanned") != "No (message is too big)" {
+		t.Fatalf("wrong result for StreamMaxLength error: %+v", res)
+	}
+
+	// Checked locally.
+	c.maxSize = 1024
+	res = runCheck(t, c, strings.Repeat("A", 2048))
+	if !res.Quarantine {
+		t.Fatalf("wrong result for message over max_size: %+v", res)
+	}
+}
+
+func TestClamAV_IOError(t *testing.T) {
+	c := testCheck(t, "127.0.0.1:1")
+	c.ioErrAction = modconfig.FailAction{Reject: true}
+
+	res := runCheck(t, c, "Hello!\r\n")
+	if !res.Reject {
+		t.Fatalf("wrong result for I/O error: %+v", res)
+	}
+}
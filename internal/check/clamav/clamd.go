@@ -0,0 +1,165 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package clamav
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// chunkSize is the size of chunks the message is sent to clamd in.
+const chunkSize = 64 * 1024
+
+var errSizeLimit = errors.New("INSTREAM size limit exceeded")
+
+// scanResult is the parsed clamd response for the INSTREAM command.
+type scanResult struct {
+	// Infected is true if the virus signature is found, Signature
+	// contains its name.
+	Infected  bool
+	Signature string
+}
+
+// instream sends the content of r to clamd using the INSTREAM command
+// and returns the scan result.
+//
+// Errors reported by clamd are returned as clamdError. If clamd reports
+// that StreamMaxLength is exceeded, errSizeLimit is returned.
+func instream(ctx context.Context, dialer *net.Dialer, network, addr string, cmdTimeout time.Duration, r io.Reader) (scanResult, error) {
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return scanResult{}, err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(cmdTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return scanResult{}, err
+	}
+
+	w := bufio.NewWriterSize(conn, chunkSize+4)
+	if _, err := w.WriteString("zINSTREAM\x00"); err != nil {
+		return scanResult{}, err
+	}
+
+	buf := make([]byte, chunkSize)
+	lenBuf := make([]byte, 4)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n != 0 {
+			binary.BigEndian.PutUint32(lenBuf, uint32(n))
+			if _, err := w.Write(lenBuf); err != nil {
+				return scanResult{}, readErrorReply(conn, err)
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return scanResult{}, readErrorReply(conn, err)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return scanResult{}, err
+		}
+	}
+
+	// Zero-length chunk terminates the stream.
+	binary.BigEndian.PutUint32(lenBuf, 0)
+	if _, err := w.Write(lenBuf); err != nil {
+		return scanResult{}, readErrorReply(conn, err)
+	}
+	if err := w.Flush(); err != nil {
+		return scanResult{}, readErrorReply(conn, err)
+	}
+
+	reply, err := readReply(conn)
+	if err != nil {
+		return scanResult{}, err
+	}
+	return parseReply(reply)
+}
+
+type clamdError string
+
+func (err clamdError) Error() string {
+	return "clamd error: " + string(err)
+}
+
+func readReply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		if err == io.EOF && reply != "" {
+			return reply, nil
+		}
+		return "", err
+	}
+	return strings.TrimSuffix(reply, "\x00"), nil
+}
+
+// readErrorReply attempts to read the reply clamd sends before closing
+// the connection if the stream is rejected (e.g. due to StreamMaxLength).
+// writeErr is returned if no reply is available.
+func readErrorReply(conn net.Conn, writeErr error) error {
+	reply, err := readReply(conn)
+	if err != nil {
+		return writeErr
+	}
+	_, err = parseReply(reply)
+	if err == nil {
+		return writeErr
+	}
+	return err
+}
+
+func parseReply(reply string) (scanResult, error) {
+	reply = strings.TrimSpace(reply)
+	// "stream: OK", "stream: Eicar-Signature FOUND",
+	// "INSTREAM size limit exceeded. ERROR"
+	if idx := strings.Index(reply, ": "); idx != -1 && strings.HasPrefix(reply, "stream") {
+		reply = reply[idx+2:]
+	}
+
+	switch {
+	case reply == "OK":
+		return scanResult{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return scanResult{
+			Infected:  true,
+			Signature: strings.TrimSuffix(reply, " FOUND"),
+		}, nil
+	case strings.HasSuffix(reply, " ERROR"):
+		msg := strings.TrimSuffix(reply, " ERROR")
+		if strings.Contains(msg, "size limit exceeded") {
+			return scanResult{}, errSizeLimit
+		}
+		return scanResult{}, clamdError(msg)
+	default:
+		return scanResult{}, fmt.Errorf("malformed clamd reply: %q", reply)
+	}
+}
@@ -32,6 +32,7 @@ import (
 	"runtime/trace"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/foxcpp/maddy/framework/buffer"
@@ -40,6 +41,7 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/cmdworker"
 	"github.com/foxcpp/maddy/internal/target"
 )
 
@@ -64,11 +66,17 @@ type Check struct {
 	actions map[int]modconfig.FailAction
 	cmd     string
 	cmdArgs []string
+
+	// Set if the command is run as a pool of long-running workers
+	// ('mode worker').
+	pool     *cmdworker.Pool
+	bodyMode string
 }
 
 func New(modName, instName string, aliases, inlineArgs []string) (module.Module, error) {
 	c := &Check{
 		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
 		actions: map[int]modconfig.FailAction{
 			1: {
 				Reject: true,
@@ -103,9 +111,19 @@ func (c *Check) Init(cfg *config.Map) error {
 		return fmt.Errorf("command: %w", err)
 	}
 
+	var (
+		mode          string
+		workers       int
+		workerTimeout time.Duration
+	)
+	cfg.Bool("debug", true, false, &c.log.Debug)
 	cfg.Enum("run_on", false, false,
 		[]string{StageConnection, StageSender, StageRcpt, StageBody}, StageBody,
 		(*string)(&c.stage))
+	cfg.Enum("mode", false, false, []string{cmdworker.ModeExec, cmdworker.ModeWorker}, cmdworker.ModeExec, &mode)
+	cfg.Int("workers", false, false, 4, &workers)
+	cfg.Duration("worker_timeout", false, false, 30*time.Second, &workerTimeout)
+	cfg.Enum("body", false, false, []string{cmdworker.BodyInline, cmdworker.BodyPath}, cmdworker.BodyInline, &c.bodyMode)
 
 	cfg.AllowUnknown()
 	unknown, err := cfg.Process()
@@ -134,9 +152,23 @@ func (c *Check) Init(cfg *config.Map) error {
 		}
 	}
 
+	if mode == cmdworker.ModeWorker {
+		if workers <= 0 {
+			return fmt.Errorf("%s: workers should be positive", modName)
+		}
+		c.pool = cmdworker.NewPool(c.cmd, c.cmdArgs, workers, workerTimeout, c.log)
+	}
+
 	return nil
 }
 
+func (c *Check) Close() error {
+	if c.pool == nil {
+		return nil
+	}
+	return c.pool.Close()
+}
+
 type state struct {
 	c       *Check
 	msgMeta *module.MsgMetadata
@@ -144,6 +176,10 @@ type state struct {
 
 	mailFrom string
 	rcpts    []string
+
+	// Set only when the command is used to learn a message, see Learn.
+	accountName string
+	verdict     string
 }
 
 func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
@@ -199,6 +235,10 @@ func (s *state) expandCommand(address string) (string, []string) {
 				return strings.Join(s.rcpts, "\n")
 			case "{address}":
 				return address
+			case "{account_name}":
+				return s.accountName
+			case "{verdict}":
+				return s.verdict
 			}
 			return placeholder
 		})
@@ -326,6 +366,67 @@ func (s *state) errorRes(err error, res module.CheckResult, cmdLine string) modu
 	return action.Apply(res)
 }
 
+func (s *state) workerRequest(address string) *cmdworker.Request {
+	req := &cmdworker.Request{
+		Type:    cmdworker.TypeCheck,
+		Stage:   string(s.c.stage),
+		Sender:  s.mailFrom,
+		Rcpts:   s.rcpts,
+		Address: address,
+	}
+	req.SetConn(s.msgMeta)
+	return req
+}
+
+func (s *state) workerErrorRes(err error) module.CheckResult {
+	return module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:      450,
+			Message:   "Internal server error",
+			CheckName: "command",
+			Err:       err,
+			Misc: map[string]interface{}{
+				"cmd": s.c.cmd,
+			},
+		},
+		Reject: true,
+	}
+}
+
+func (s *state) runWorker(ctx context.Context, req *cmdworker.Request) module.CheckResult {
+	resp, err := s.c.pool.Do(ctx, req)
+	if err != nil {
+		return s.workerErrorRes(err)
+	}
+	if resp.Error != "" {
+		return s.workerErrorRes(errors.New(resp.Error))
+	}
+
+	action, ok, err := resp.FailAction()
+	if err != nil {
+		return s.workerErrorRes(err)
+	}
+
+	res := module.CheckResult{}
+	res.Header = resp.MessageHeader()
+	if !ok {
+		return res
+	}
+
+	res.Reason = &exterrors.SMTPError{
+		Code:         550,
+		EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+		Message:      "Message rejected due to a local policy",
+		CheckName:    "command",
+		Reason:       resp.Reason,
+		Misc: map[string]interface{}{
+			"cmd":    s.c.cmd,
+			"action": resp.Action,
+		},
+	}
+	return action.Apply(res)
+}
+
 func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
 	if s.c.stage != StageConnection {
 		return module.CheckResult{}
@@ -333,6 +434,10 @@ func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
 
 	defer trace.StartRegion(ctx, "command/CheckConnection-"+s.c.cmd).End()
 
+	if s.c.pool != nil {
+		return s.runWorker(ctx, s.workerRequest(""))
+	}
+
 	cmdName, cmdArgs := s.expandCommand("")
 	return s.run(cmdName, cmdArgs, bytes.NewReader(nil))
 }
@@ -346,6 +451,10 @@ func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult
 
 	defer trace.StartRegion(ctx, "command/CheckSender"+s.c.cmd).End()
 
+	if s.c.pool != nil {
+		return s.runWorker(ctx, s.workerRequest(addr))
+	}
+
 	cmdName, cmdArgs := s.expandCommand(addr)
 	return s.run(cmdName, cmdArgs, bytes.NewReader(nil))
 }
@@ -358,6 +467,10 @@ func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
 	}
 	defer trace.StartRegion(ctx, "command/CheckRcpt"+s.c.cmd).End()
 
+	if s.c.pool != nil {
+		return s.runWorker(ctx, s.workerRequest(addr))
+	}
+
 	cmdName, cmdArgs := s.expandCommand(addr)
 	return s.run(cmdName, cmdArgs, bytes.NewReader(nil))
 }
@@ -369,6 +482,16 @@ func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer
 
 	defer trace.StartRegion(ctx, "command/CheckBody"+s.c.cmd).End()
 
+	if s.c.pool != nil {
+		req := s.workerRequest("")
+		cleanup, err := req.SetBody(s.c.bodyMode, hdr, body)
+		if err != nil {
+			return s.workerErrorRes(err)
+		}
+		defer cleanup()
+		return s.runWorker(ctx, req)
+	}
+
 	cmdName, cmdArgs := s.expandCommand("")
 
 	var buf bytes.Buffer
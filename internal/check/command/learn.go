@@ -0,0 +1,112 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package command
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"runtime/trace"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/cmdworker"
+)
+
+// Learn implements module.SpamLearner by running the command with the
+// message as its standard input. {verdict} placeholder is replaced with
+// "spam" or "ham". Any non-zero exit code is considered a failure.
+//
+// In the worker mode, the "learn" request is sent to the worker instead.
+func (c *Check) Learn(ctx context.Context, accountName string, spam bool, msg buffer.Buffer) error {
+	defer trace.StartRegion(ctx, "command/Learn-"+c.cmd).End()
+
+	if c.pool != nil {
+		return c.learnWorker(ctx, accountName, spam, msg)
+	}
+
+	s := &state{
+		c:           c,
+		msgMeta:     &module.MsgMetadata{},
+		log:         c.log,
+		accountName: accountName,
+		verdict:     "ham",
+	}
+	if spam {
+		s.verdict = "spam"
+	}
+	cmdName, cmdArgs := s.expandCommand("")
+
+	body, err := msg.Open()
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	cmd := exec.CommandContext(ctx, cmdName, cmdArgs...)
+	cmd.Stdin = body
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w: %s", modName, err, out)
+	}
+	return nil
+}
+
+func (c *Check) learnWorker(ctx context.Context, accountName string, spam bool, msg buffer.Buffer) error {
+	req := &cmdworker.Request{
+		Type:        cmdworker.TypeLearn,
+		AccountName: accountName,
+		Verdict:     "ham",
+	}
+	if spam {
+		req.Verdict = "spam"
+	}
+
+	// Message header is passed separately.
+	msgR, err := msg.Open()
+	if err != nil {
+		return err
+	}
+	defer msgR.Close()
+	br := bufio.NewReader(msgR)
+	hdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	body, err := io.ReadAll(br)
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	cleanup, err := req.SetBody(c.bodyMode, hdr, buffer.MemoryBuffer{Slice: body})
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	defer cleanup()
+
+	resp, err := c.pool.Do(ctx, req)
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s: %s", modName, resp.Error)
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package correspondents implements a check that safelists messages from
+// addresses local users have sent messages to.
+package correspondents
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.correspondents"
+
+var errMutableTable = errors.New("check.correspondents: store requires a mutable table type")
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	store  module.MutableTable
+	maxAge time.Duration
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var store module.Table
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Custom("store", false, true, func() (interface{}, error) {
+		return nil, nil
+	}, modconfig.TableDirective, &store)
+	cfg.Duration("max_age", false, false, 0, &c.maxAge)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	var ok bool
+	if c.store, ok = store.(module.MutableTable); !ok {
+		return errMutableTable
+	}
+
+	return nil
+}
+
+// storeKey returns the table key used for the pair of the local user address
+// and the correspondent address.
+func storeKey(user, correspondent string) (string, error) {
+	user, err := address.ForLookup(user)
+	if err != nil {
+		return "", err
+	}
+	correspondent, err = address.ForLookup(correspondent)
+	if err != nil {
+		return "", err
+	}
+	return user + " " + correspondent, nil
+}
+
+// record remembers the recipients of the message sent by the user.
+func (c *Check) record(user string, rcpts []string, now time.Time, log log.Logger) {
+	value := strconv.FormatInt(now.Unix(), 10)
+	for _, rcpt := range rcpts {
+		key, err := storeKey(user, rcpt)
+		if err != nil {
+			log.Error("malformed address", err, "user", user, "rcpt", rcpt)
+			continue
+		}
+		if err := c.store.SetKey(key, value); err != nil {
+			log.Error("failed to record correspondent", err, "user", user, "rcpt", rcpt)
+			continue
+		}
+		log.DebugMsg("correspondent recorded", "user", user, "rcpt", rcpt)
+	}
+}
+
+// isCorrespondent checks whether the user sent a message to the
+// correspondent address.
+func (c *Check) isCorrespondent(ctx context.Context, user, correspondent string, now time.Time) (bool, error) {
+	key, err := storeKey(user, correspondent)
+	if err != nil {
+		return false, err
+	}
+	value, ok, err := c.store.Lookup(ctx, key)
+	if err != nil || !ok {
+		return false, err
+	}
+	if c.maxAge == 0 {
+		return true, nil
+	}
+	lastSent, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("malformed timestamp for %s: %w", key, err)
+	}
+	return now.Sub(time.Unix(lastSent, 0)) <= c.maxAge, nil
+}
+
+// CheckSafelist implements module.SafelistCheck. Recipients are not known
+// yet when it is called so the check is done by CheckRcptSafelist instead.
+func (c *Check) CheckSafelist(_ context.Context, _ *module.MsgMetadata) module.SafelistCheckResult {
+	return module.SafelistCheckResult{}
+}
+
+// CheckRcptSafelist implements module.RcptSafelistCheck, safelisting
+// messages from addresses the recipient has sent messages to. Records
+// are looked up using the final recipient address, so it should match the
+// user name used for authentication.
+func (c *Check) CheckRcptSafelist(ctx context.Context, msgMeta *module.MsgMetadata, rcptTo string) module.SafelistCheckResult {
+	if msgMeta.Conn == nil || msgMeta.Conn.AuthUser != "" || msgMeta.OriginalFrom == "" {
+		return module.SafelistCheckResult{}
+	}
+
+	dlog := target.DeliveryLogger(c.log, msgMeta)
+	ok, err := c.isCorrespondent(ctx, rcptTo, msgMeta.OriginalFrom, time.Now())
+	if err != nil {
+		dlog.Error("correspondent lookup failed", err, "rcpt", rcptTo)
+		return module.SafelistCheckResult{}
+	}
+	if !ok {
+		return module.SafelistCheckResult{}
+	}
+
+	dlog.DebugMsg("message from a correspondent", "rcpt", rcptTo, "from", msgMeta.OriginalFrom)
+	return module.SafelistCheckResult{
+		Safelist: true,
+		// Otherwise anyone can get the message safelisted by
+		// forging the sender address.
+		RequiresAuthResults: true,
+	}
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+	rcpts   []string
+}
+
+func (c *Check) CheckStateForMsg(_ context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(_ context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(_ context.Context, _ string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(_ context.Context, rcptTo string) module.CheckResult {
+	s.rcpts = append(s.rcpts, rcptTo)
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(_ context.Context, _ textproto.Header, _ buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+// CheckCommit implements module.CommitCheckState, recording recipients of
+// messages sent by authenticated users. Recipients of rejected or aborted
+// messages are not recorded.
+func (s *state) CheckCommit(_ context.Context) {
+	if s.msgMeta.Conn == nil || s.msgMeta.Conn.AuthUser == "" {
+		return
+	}
+
+	s.c.record(s.msgMeta.Conn.AuthUser, s.rcpts, time.Now(), s.log)
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
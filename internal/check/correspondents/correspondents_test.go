@@ -0,0 +1,168 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package correspondents
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type memTable map[string]string
+
+func (t memTable) Lookup(_ context.Context, key string) (string, bool, error) {
+	v, ok := t[key]
+	return v, ok, nil
+}
+
+func (t memTable) Keys() ([]string, error) {
+	keys := make([]string, 0, len(t))
+	for k := range t {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (t memTable) RemoveKey(key string) error {
+	delete(t, key)
+	return nil
+}
+
+func (t memTable) SetKey(key, value string) error {
+	t[key] = value
+	return nil
+}
+
+func send(t *testing.T, c *Check, authUser, from string, commit bool, rcpts ...string) {
+	st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		ID:   "test",
+		Conn: &module.ConnState{AuthUser: authUser},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	st.CheckConnection(context.Background())
+	st.CheckSender(context.Background(), from)
+	for _, rcpt := range rcpts {
+		st.CheckRcpt(context.Background(), rcpt)
+	}
+	st.CheckBody(context.Background(), textproto.Header{}, buffer.MemoryBuffer{})
+	if commit {
+		st.(module.CommitCheckState).CheckCommit(context.Background())
+	}
+}
+
+func safelisted(c *Check, authUser, from, rcpt string) module.SafelistCheckResult {
+	return c.CheckRcptSafelist(context.Background(), &module.MsgMetadata{
+		ID:           "test",
+		Conn:         &module.ConnState{AuthUser: authUser},
+		OriginalFrom: from,
+	}, rcpt)
+}
+
+func TestCorrespondents(t *testing.T) {
+	store := memTable{}
+	c := &Check{
+		log:   testutils.Logger(t, modName),
+		store: store,
+	}
+
+	// Unauthenticated messages are not recorded.
+	send(t, c, "", "alice@example.org", true, "bob@example.com")
+	if len(store) != 0 {
+		t.Fatal("recipient of unauthenticated message is recorded:", store)
+	}
+
+	// Messages that are not committed are not recorded.
+	send(t, c, "alice@example.org", "alice@example.org", false, "bob@example.com")
+	if len(store) != 0 {
+		t.Fatal("recipient of aborted message is recorded:", store)
+	}
+
+	// Recipients are recorded for the authenticated user, not the
+	// envelope sender.
+	send(t, c, "alice@example.org", "Alias@example.org", true, "Bob@Example.com", "carol@example.net")
+	if _, ok := store["alias@example.org bob@example.com"]; ok {
+		t.Fatal("recipient is recorded for the envelope sender:", store)
+	}
+
+	res := safelisted(c, "", "bob@example.com", "alice@EXAMPLE.org")
+	if !res.Safelist {
+		t.Fatal("message from a correspondent is not safelisted")
+	}
+	if !res.RequiresAuthResults {
+		t.Fatal("safelist does not require authentication results")
+	}
+
+	for _, test := range []struct {
+		authUser, from, rcpt string
+	}{
+		{"", "mallory@example.com", "alice@example.org"},
+		{"", "bob@example.com", "dave@example.org"},
+		{"", "", "alice@example.org"},
+		// Outgoing messages are not safelisted.
+		{"dave@example.org", "bob@example.com", "alice@example.org"},
+	} {
+		if safelisted(c, test.authUser, test.from, test.rcpt).Safelist {
+			t.Errorf("message from %s to %s (auth user %q) is safelisted", test.from, test.rcpt, test.authUser)
+		}
+	}
+}
+
+func TestCorrespondents_MaxAge(t *testing.T) {
+	store := memTable{}
+	c := &Check{
+		log:    testutils.Logger(t, modName),
+		store:  store,
+		maxAge: 24 * time.Hour,
+	}
+
+	now := time.Now()
+	c.record("alice@example.org", []string{"bob@example.com"}, now.Add(-48*time.Hour), c.log)
+	c.record("alice@example.org", []string{"carol@example.net"}, now.Add(-time.Hour), c.log)
+
+	ok, err := c.isCorrespondent(context.Background(), "alice@example.org", "bob@example.com", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("expired correspondent is safelisted")
+	}
+	ok, err = c.isCorrespondent(context.Background(), "alice@example.org", "carol@example.net", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error("correspondent is not safelisted")
+	}
+
+	// Sending a new message refreshes the timestamp.
+	c.record("alice@example.org", []string{"bob@example.com"}, now, c.log)
+	if store["alice@example.org bob@example.com"] != strconv.FormatInt(now.Unix(), 10) {
+		t.Error("timestamp is not updated:", store)
+	}
+}
@@ -49,6 +49,9 @@ type Check struct {
 	noSigAction     modconfig.FailAction
 	failOpen        bool
 
+	signerPolicy       module.Table
+	signerPolicyAction modconfig.FailAction
+
 	resolver dns.Resolver
 }
 
@@ -77,6 +80,13 @@ func (c *Check) Init(cfg *config.Map) error {
 		func() (interface{}, error) {
 			return modconfig.FailAction{}, nil
 		}, modconfig.FailActionDirective, &c.noSigAction)
+	cfg.Custom("signer_policy", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, modconfig.TableDirective, &c.signerPolicy)
+	cfg.Custom("signer_policy_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.signerPolicyAction)
 	_, err := cfg.Process()
 	if err != nil {
 		return err
@@ -125,7 +135,7 @@ func (d *dkimCheckState) CheckBody(ctx context.Context, header textproto.Header,
 		} else {
 			d.log.Debugf("no signatures present")
 		}
-		return d.c.noSigAction.Apply(module.CheckResult{
+		res := d.c.noSigAction.Apply(module.CheckResult{
 			Reason: &exterrors.SMTPError{
 				Code:         550,
 				EnhancedCode: exterrors.EnhancedCode{5, 7, 20},
@@ -138,6 +148,7 @@ func (d *dkimCheckState) CheckBody(ctx context.Context, header textproto.Header,
 				},
 			},
 		})
+		return d.applySignerPolicy(ctx, header, nil, res)
 	}
 
 	b := bytes.Buffer{}
@@ -156,10 +167,11 @@ func (d *dkimCheckState) CheckBody(ctx context.Context, header textproto.Header,
 		}
 	}
 
+	var keys keyRecorder
 	verifications, err := dkim.VerifyWithOptions(io.MultiReader(&b, bodyRdr), &dkim.VerifyOptions{
-		LookupTXT: func(domain string) ([]string, error) {
+		LookupTXT: keys.wrap(func(domain string) ([]string, error) {
 			return d.c.resolver.LookupTXT(ctx, domain)
-		},
+		}),
 	})
 	if err != nil {
 		return module.CheckResult{
@@ -175,9 +187,11 @@ func (d *dkimCheckState) CheckBody(ctx context.Context, header textproto.Header,
 	}
 
 	goodSigs := false
+	sigTags := signatureTags(header)
+	var goodKeys []sigKey
 
 	res := module.CheckResult{AuthResult: make([]authres.Result, 0, len(verifications))}
-	for _, verif := range verifications {
+	for i, verif := range verifications {
 		val := authres.ResultValue(authres.ResultPass)
 		reason := ""
 		if verif.Err != nil {
@@ -229,6 +243,19 @@ func (d *dkimCheckState) CheckBody(ctx context.Context, header textproto.Header,
 		if val == authres.ResultPass {
 			goodSigs = true
 			d.log.DebugMsg("good signature", "domain", verif.Domain, "identifier", verif.Identifier)
+
+			if d.c.signerPolicy != nil && i < len(sigTags) {
+				keyType, bits, err := keys.key(verif.Domain, sigTags[i]["s"])
+				if err != nil {
+					d.log.Error("failed to get key properties", err, "domain", verif.Domain)
+				} else {
+					goodKeys = append(goodKeys, sigKey{
+						domain:  strings.ToLower(verif.Domain),
+						keyType: keyType,
+						bits:    bits,
+					})
+				}
+			}
 		}
 
 		res.AuthResult = append(res.AuthResult, &authres.DKIMResult{
@@ -246,9 +273,45 @@ func (d *dkimCheckState) CheckBody(ctx context.Context, header textproto.Header,
 			Message:      "No passing DKIM signatures",
 			CheckName:    "check.dkim",
 		}
-		return d.c.brokenSigAction.Apply(res)
+		res = d.c.brokenSigAction.Apply(res)
+	}
+	return d.applySignerPolicy(ctx, header, goodKeys, res)
+}
+
+// applySignerPolicy checks the signer policy and merges the result with the
+// result of signatures verification.
+func (d *dkimCheckState) applySignerPolicy(ctx context.Context, header textproto.Header, keys []sigKey, res module.CheckResult) module.CheckResult {
+	err := d.checkSignerPolicy(ctx, header, keys)
+	if err == nil {
+		return res
+	}
+
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) {
+		return module.CheckResult{
+			Reject:     true,
+			Reason:     err,
+			AuthResult: res.AuthResult,
+		}
+	}
+
+	if res.Reject && !res.Monitor {
+		return res
+	}
+
+	policyRes := d.c.signerPolicyAction.Apply(module.CheckResult{
+		Reason:     err,
+		AuthResult: res.AuthResult,
+	})
+	if !policyRes.Reject && !policyRes.Quarantine && policyRes.Score == 0 && res.Reason != nil {
+		d.log.Error("signer policy violation", err)
+		return res
+	}
+	if !res.Monitor {
+		policyRes.Quarantine = policyRes.Quarantine || res.Quarantine
+		policyRes.Score += res.Score
 	}
-	return res
+	return policyRes
 }
 
 func (d *dkimCheckState) Name() string {
@@ -22,6 +22,7 @@ import (
 	"context"
 	"errors"
 	"net"
+	"strings"
 	"testing"
 
 	"github.com/emersion/go-msgauth/authres"
@@ -362,3 +363,79 @@ func TestDkimVerify_FailOpen(t *testing.T) {
 		t.Fatal("Result is not temp. error:", resVal)
 	}
 }
+
+func TestDkimVerify_SignerPolicy(t *testing.T) {
+	test := func(name, mail string, policy map[string]string, reject, temporary bool) {
+		t.Run(name, func(t *testing.T) {
+			check := testCheck(t, testZones, nil)
+			check.signerPolicy = testutils.Table{M: policy}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			s, err := check.CheckStateForMsg(ctx, &module.MsgMetadata{
+				ID: "test",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			hdr, buf := testutils.BodyFromStr(t, mail)
+			result := s.CheckBody(ctx, hdr, buf)
+
+			if result.Reject != reject {
+				t.Fatal("Wrong reject flag, reason:", result.Reason, exterrors.Fields(result.Reason))
+			}
+			if reject && exterrors.IsTemporary(result.Reason) != temporary {
+				t.Fatal("Wrong temporary flag, reason:", result.Reason)
+			}
+		})
+	}
+
+	test("no policy", verifiedMailString, map[string]string{}, false, false)
+	test("allowed domain", verifiedMailString, map[string]string{
+		"football.example.com": "d=example.org d=example.com",
+	}, false, false)
+	test("aligned", verifiedMailString, map[string]string{
+		"example.com": "",
+	}, false, false)
+	test("not allowed domain", verifiedMailString, map[string]string{
+		"football.example.com": "d=example.org",
+	}, true, false)
+	test("key too short", verifiedMailString, map[string]string{
+		"football.example.com": "d=example.com min_bits=2048",
+	}, true, false)
+	test("key type", verifiedMailString, map[string]string{
+		"football.example.com": "k=ed25519",
+	}, true, false)
+	test("allowed key type", verifiedMailString, map[string]string{
+		"football.example.com": "k=ed25519 k=rsa",
+	}, false, false)
+	test("unknown key type", verifiedMailString, map[string]string{
+		"football.example.com": "k=dsa",
+	}, true, true)
+	test("unsigned", unsignedMailString, map[string]string{
+		"football.example.com": "d=football.example.com",
+	}, true, false)
+	test("unsigned, no policy", unsignedMailString, map[string]string{
+		"example.org": "d=example.org",
+	}, false, false)
+	test("malformed policy", verifiedMailString, map[string]string{
+		"football.example.com": "d",
+	}, true, true)
+
+	policy := map[string]string{
+		"example.org": "d=example.org",
+	}
+	test("second From field", strings.Replace(unsignedMailString,
+		"From: Joe SixPack <joe@football.example.com>\n",
+		"From: Joe SixPack <joe@football.example.com>\nFrom: <joe@example.org>\n", 1), policy, true, false)
+	test("second From field, no policy", "From: <joe@example.net>\n"+verifiedMailString, policy, false, false)
+	test("second From address", strings.Replace(unsignedMailString,
+		"From: Joe SixPack <joe@football.example.com>",
+		"From: Joe SixPack <joe@football.example.com>, <joe@example.org>", 1), policy, true, false)
+	test("no From field", strings.Replace(unsignedMailString,
+		"From: Joe SixPack <joe@football.example.com>\n", "", 1), policy, true, false)
+	test("malformed From field", strings.Replace(unsignedMailString,
+		"From: Joe SixPack <joe@football.example.com>", "From: Joe SixPack <joe@", 1), policy, true, false)
+}
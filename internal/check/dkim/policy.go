@@ -0,0 +1,348 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+// signerPolicy describes the signatures required for messages with the
+// specific From domain.
+type signerPolicy struct {
+	// Allowed signing domains. If empty, the signing domain should be aligned
+	// with the From domain.
+	domains []string
+	// Allowed key types. If empty, any key type is allowed.
+	keyTypes []string
+	// Minimal size of RSA keys.
+	minBits int
+}
+
+// parseSignerPolicy parses the policy table value in the form
+// "d=domain1 d=domain2 k=rsa k=ed25519 min_bits=2048".
+//
+// Lists are specified by repeating the option since table.file uses commas
+// to separate multiple values.
+func parseSignerPolicy(s string) (signerPolicy, error) {
+	var p signerPolicy
+	for _, opt := range strings.Fields(s) {
+		parts := strings.SplitN(opt, "=", 2)
+		if len(parts) != 2 {
+			return p, fmt.Errorf("malformed option: %s", opt)
+		}
+		switch key, val := parts[0], strings.ToLower(parts[1]); key {
+		case "d":
+			p.domains = append(p.domains, strings.TrimSuffix(val, "."))
+		case "k":
+			if val != "rsa" && val != "ed25519" {
+				return p, fmt.Errorf("unknown key type: %s", val)
+			}
+			p.keyTypes = append(p.keyTypes, val)
+		case "min_bits":
+			bits, err := strconv.Atoi(val)
+			if err != nil {
+				return p, fmt.Errorf("malformed min_bits: %w", err)
+			}
+			p.minBits = bits
+		default:
+			return p, fmt.Errorf("unknown option: %s", key)
+		}
+	}
+	return p, nil
+}
+
+// sigKey contains the information about the key used to create a valid
+// signature.
+type sigKey struct {
+	domain  string
+	keyType string
+	bits    int
+}
+
+func (p signerPolicy) matches(fromDomain string, key sigKey) (bool, string) {
+	if len(p.domains) == 0 {
+		if key.domain != fromDomain && !strings.HasSuffix(fromDomain, "."+key.domain) {
+			return false, "signing domain " + key.domain + " is not aligned with From"
+		}
+	} else {
+		found := false
+		for _, d := range p.domains {
+			if key.domain == d {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, "signing domain " + key.domain + " is not allowed"
+		}
+	}
+
+	if len(p.keyTypes) != 0 {
+		found := false
+		for _, t := range p.keyTypes {
+			if key.keyType == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, "key type " + key.keyType + " is not allowed"
+		}
+	}
+
+	if key.keyType == "rsa" && key.bits < p.minBits {
+		return false, fmt.Sprintf("key is too short (%d bits)", key.bits)
+	}
+
+	return true, ""
+}
+
+// keyRecorder saves DKIM key records fetched during the verification so
+// signer policy can check key properties.
+type keyRecorder struct {
+	lock    sync.Mutex
+	records map[string]string
+}
+
+func (kr *keyRecorder) wrap(lookup func(string) ([]string, error)) func(string) ([]string, error) {
+	return func(domain string) ([]string, error) {
+		txts, err := lookup(domain)
+		if err == nil {
+			kr.lock.Lock()
+			if kr.records == nil {
+				kr.records = make(map[string]string)
+			}
+			kr.records[strings.ToLower(domain)] = strings.Join(txts, "")
+			kr.lock.Unlock()
+		}
+		return txts, err
+	}
+}
+
+// key returns the type and the size of the key used by the signature with
+// the specified domain and selector.
+func (kr *keyRecorder) key(domain, selector string) (string, int, error) {
+	kr.lock.Lock()
+	record, ok := kr.records[strings.ToLower(selector+"._domainkey."+domain)]
+	kr.lock.Unlock()
+	if !ok {
+		return "", 0, fmt.Errorf("no key record for %s._domainkey.%s", selector, domain)
+	}
+
+	tags := parseTags(record)
+	keyType := tags["k"]
+	if keyType == "" {
+		keyType = "rsa"
+	}
+	switch keyType {
+	case "rsa":
+		der, err := base64.StdEncoding.DecodeString(tags["p"])
+		if err != nil {
+			return "", 0, err
+		}
+		pub, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			pub, err = x509.ParsePKCS1PublicKey(der)
+			if err != nil {
+				return "", 0, err
+			}
+		}
+		rsaPub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return "", 0, fmt.Errorf("not an RSA public key")
+		}
+		return keyType, rsaPub.Size() * 8, nil
+	case "ed25519":
+		return keyType, 256, nil
+	default:
+		return keyType, 0, nil
+	}
+}
+
+// parseTags parses DKIM tag list (RFC 6376, Section 3.2). Whitespace is
+// removed from values.
+func parseTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(s, ";") {
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		tags[strings.TrimSpace(parts[0])] = strings.Join(strings.Fields(parts[1]), "")
+	}
+	return tags
+}
+
+// signatureTags returns tags of all DKIM-Signature fields in the order they
+// are passed to the verifier.
+func signatureTags(header textproto.Header) []map[string]string {
+	var sigs []map[string]string
+	for f := header.Fields(); f.Next(); {
+		if strings.EqualFold(f.Key(), "DKIM-Signature") {
+			sigs = append(sigs, parseTags(f.Value()))
+		}
+	}
+	return sigs
+}
+
+// fromDomains returns domains of all addresses in all From fields.
+//
+// Messages with multiple From fields or addresses are not rejected here
+// since the policy is checked for each domain.
+func fromDomains(header textproto.Header) ([]string, error) {
+	var (
+		domains []string
+		seen    = make(map[string]struct{})
+		fields  = 0
+	)
+	for f := header.FieldsByKey("From"); f.Next(); {
+		fields++
+		list, err := mail.ParseAddressList(f.Value())
+		if err != nil {
+			return nil, fmt.Errorf("malformed From header field: %s", strings.TrimPrefix(err.Error(), "mail: "))
+		}
+		if len(list) == 0 {
+			return nil, errors.New("missing address in From field")
+		}
+		for _, addr := range list {
+			_, domain, err := address.Split(addr.Address)
+			if err != nil || domain == "" {
+				return nil, fmt.Errorf("malformed From address: %s", addr.Address)
+			}
+			domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+			if _, ok := seen[domain]; ok {
+				continue
+			}
+			seen[domain] = struct{}{}
+			domains = append(domains, domain)
+		}
+	}
+	if fields == 0 {
+		return nil, errors.New("missing From header field")
+	}
+	return domains, nil
+}
+
+// lookupPolicy finds the signer policy for the domain or its closest parent
+// domain.
+func (c *Check) lookupPolicy(ctx context.Context, domain string) (signerPolicy, bool, error) {
+	for domain != "" {
+		val, ok, err := c.signerPolicy.Lookup(ctx, domain)
+		if err != nil {
+			return signerPolicy{}, false, err
+		}
+		if ok {
+			p, err := parseSignerPolicy(val)
+			if err != nil {
+				return signerPolicy{}, false, fmt.Errorf("invalid signer policy for %s: %w", domain, err)
+			}
+			return p, true, nil
+		}
+
+		dot := strings.IndexByte(domain, '.')
+		if dot == -1 {
+			break
+		}
+		domain = domain[dot+1:]
+	}
+	return signerPolicy{}, false, nil
+}
+
+// checkSignerPolicy checks whether the valid signatures satisfy the policies
+// for all From domains. It returns nil if there are no policies or they are
+// satisfied.
+//
+// Message without a usable From field is a violation since the policy
+// cannot be checked for it.
+func (d *dkimCheckState) checkSignerPolicy(ctx context.Context, header textproto.Header, keys []sigKey) error {
+	if d.c.signerPolicy == nil {
+		return nil
+	}
+
+	domains, err := fromDomains(header)
+	if err != nil {
+		return &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 20},
+			Message:      "Malformed From header field, cannot check the local DKIM policy",
+			CheckName:    "check.dkim",
+			Reason:       err.Error(),
+		}
+	}
+
+	for _, domain := range domains {
+		if err := d.checkDomainPolicy(ctx, domain, keys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDomainPolicy checks whether the valid signatures satisfy the policy
+// for the From domain.
+func (d *dkimCheckState) checkDomainPolicy(ctx context.Context, domain string, keys []sigKey) error {
+	policy, ok, err := d.c.lookupPolicy(ctx, domain)
+	if err != nil {
+		return exterrors.WithTemporary(
+			exterrors.WithFields(err, map[string]interface{}{
+				"check":    "check.dkim",
+				"smtp_msg": "Internal error during policy check",
+			}),
+			true,
+		)
+	}
+	if !ok {
+		return nil
+	}
+
+	reasons := make([]string, 0, len(keys))
+	for _, key := range keys {
+		ok, reason := policy.matches(domain, key)
+		if ok {
+			d.log.DebugMsg("signer policy satisfied", "from_domain", domain, "domain", key.domain)
+			return nil
+		}
+		reasons = append(reasons, reason)
+	}
+
+	reason := "no valid signatures"
+	if len(reasons) != 0 {
+		reason = strings.Join(reasons, "; ")
+	}
+	return &exterrors.SMTPError{
+		Code:         550,
+		EnhancedCode: exterrors.EnhancedCode{5, 7, 20},
+		Message:      "No DKIM signature required by the local policy for " + domain,
+		CheckName:    "check.dkim",
+		Reason:       reason,
+	}
+}
@@ -20,7 +20,6 @@ package domainbl
 
 import (
 	"io"
-	"log"
 	"net/url"
 
 	"github.com/emersion/go-message/mail"
@@ -38,9 +37,11 @@ func urlDomains(urls []string) []string {
 	return urls
 }
 
-func extractBodyDomains(r io.Reader) ([]string, error) {
-	var domains []string
-
+// WalkTextParts calls fn for each text part of the message, ctype is either
+// "text/plain" or "text/html". Inline parts without a known type are
+// considered to be plain text. If the message is not a valid MIME message,
+// the whole message is passed as a single text/plain part.
+func WalkTextParts(r io.Reader, fn func(ctype string, body io.Reader) error) error {
 	// Create a new mail reader
 	mr, err := mail.CreateReader(r)
 	if err != nil {
@@ -48,16 +49,16 @@ func extractBodyDomains(r io.Reader) ([]string, error) {
 		if rs, ok := r.(io.ReadSeeker); ok {
 			_, _ = rs.Seek(0, io.SeekStart)
 		}
-		return extractTextDomains(r)
+		return fn("text/plain", r)
 	}
 
 	// Read each mail's part
 	for {
 		p, err := mr.NextPart()
 		if err == io.EOF {
-			break
+			return nil
 		} else if err != nil {
-			return nil, err
+			return err
 		}
 
 		var ctype string
@@ -68,29 +69,39 @@ func extractBodyDomains(r io.Reader) ([]string, error) {
 				ctype = "text/plain"
 			}
 		case *mail.AttachmentHeader:
-			filename, _ := h.Filename()
-			log.Printf("Got attachment: %v\n", filename)
-
 			ctype, _, _ = h.ContentType()
 		}
 
-		var partDomains []string
-		switch ctype {
-		case "text/html":
-			partDomains, err = extractHTMLDomains(p.Body)
-		case "text/plain":
-			partDomains, err = extractTextDomains(p.Body)
-		default:
-			partDomains = partDomains[:0]
+		if ctype != "text/html" && ctype != "text/plain" {
+			continue
 		}
+		if err := fn(ctype, p.Body); err != nil {
+			return err
+		}
+	}
+}
 
-		if err != nil {
-			return nil, err
+func extractBodyDomains(r io.Reader) ([]string, error) {
+	var domains []string
+
+	err := WalkTextParts(r, func(ctype string, body io.Reader) error {
+		var (
+			partDomains []string
+			err         error
+		)
+		if ctype == "text/html" {
+			partDomains, err = extractHTMLDomains(body)
+		} else {
+			partDomains, err = extractTextDomains(body)
 		}
-		if len(partDomains) > 0 {
-			domains = append(domains, partDomains...)
+		if err != nil {
+			return err
 		}
+		domains = append(domains, partDomains...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-
 	return domains, nil
 }
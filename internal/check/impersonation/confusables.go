@@ -0,0 +1,125 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package impersonation
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// confusables maps non-ASCII characters to visually similar ASCII
+// characters. It is a small subset of the Unicode confusables list
+// (UTS #39) covering Cyrillic and Greek letters commonly used in lookalike
+// domains and display names.
+var confusables = map[rune]rune{
+	// Cyrillic.
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'з': '3', 'і': 'i', 'ї': 'i',
+	'ј': 'j', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o', 'п': 'n', 'р': 'p',
+	'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'ѕ': 's', 'һ': 'h', 'ԁ': 'd',
+	'ԛ': 'q', 'ԝ': 'w', 'ӏ': 'l', 'ь': 'b',
+
+	// Greek.
+	'α': 'a', 'β': 'b', 'γ': 'y', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k',
+	'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x', 'ω': 'w',
+
+	// Latin letters with similar shapes.
+	'ı': 'i', 'ɑ': 'a', 'ɡ': 'g', 'ℓ': 'l', 'ⅼ': 'l',
+}
+
+// asciiConfusables replaces ASCII sequences that look alike in common
+// fonts. It is applied only to domains since it is too aggressive for
+// personal names.
+var asciiConfusables = strings.NewReplacer(
+	"rn", "m",
+	"vv", "w",
+	"cl", "d",
+	"0", "o",
+	"1", "l",
+	"|", "l",
+)
+
+// foldConfusables lowercases the string, converts it to NFKC form (to fold
+// fullwidth and other compatibility characters) and replaces known
+// confusable characters with their ASCII counterparts.
+func foldConfusables(s string) string {
+	s = norm.NFKC.String(strings.ToLower(s))
+
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range s {
+		if r > unicode.MaxASCII {
+			if c, ok := confusables[r]; ok {
+				r = c
+			}
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// domainSkeleton returns the string that is identical for all domains that
+// look the same. domain should be in the U-label form.
+func domainSkeleton(domain string) string {
+	return asciiConfusables.Replace(foldConfusables(domain))
+}
+
+// normalizeName prepares the display name for the lookup in the names
+// table. "Last, First" form is converted to "First Last".
+func normalizeName(name string) string {
+	name = strings.NewReplacer(`"`, "", "'", "").Replace(name)
+	if parts := strings.Split(name, ","); len(parts) == 2 {
+		name = parts[1] + " " + parts[0]
+	}
+	return strings.Join(strings.Fields(foldConfusables(name)), " ")
+}
+
+// editDistance returns the Levenshtein distance between two strings.
+func editDistance(a, b string) int {
+	ar, br := []rune(a), []rune(b)
+
+	prev := make([]int, len(br)+1)
+	cur := make([]int, len(br)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ar); i++ {
+		cur[0] = i
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(br)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,359 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package impersonation
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	modName = "check.impersonation"
+
+	warningHeader = "X-Impersonation-Warning"
+
+	// minDistanceLen is the minimal length of the protected domain (without
+	// the TLD) for edit distance matching to be used. Short domains produce
+	// too many false positives.
+	minDistanceLen = 6
+)
+
+type protectedDomain struct {
+	name     string
+	skeleton string
+}
+
+func newProtectedDomain(name string) protectedDomain {
+	return protectedDomain{
+		name:     name,
+		skeleton: domainSkeleton(name),
+	}
+}
+
+// distanceMatching reports whether the domain is long enough to be matched
+// using the edit distance.
+func (d protectedDomain) distanceMatching() bool {
+	name := d.skeleton
+	if i := strings.LastIndexByte(name, '.'); i != -1 {
+		name = name[:i]
+	}
+	return utf8.RuneCountInString(name) >= minDistanceLen
+}
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	domains     []protectedDomain
+	names       module.Table
+	maxDistance int
+	addHeader   bool
+	warningText string
+
+	displayNameAction modconfig.FailAction
+	lookalikeAction   modconfig.FailAction
+	errAction         modconfig.FailAction
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var domains []string
+
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.StringList("protected_domains", false, true, nil, &domains)
+	cfg.Custom("display_names", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, modconfig.TableDirective, &c.names)
+	cfg.Int("max_distance", false, false, 1, &c.maxDistance)
+	cfg.Bool("add_header", false, true, &c.addHeader)
+	cfg.String("warning_text", false, false,
+		"This message comes from an external sender and may impersonate a trusted sender", &c.warningText)
+	cfg.Custom("display_name_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Quarantine: true}, nil
+		}, modconfig.FailActionDirective, &c.displayNameAction)
+	cfg.Custom("lookalike_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Quarantine: true}, nil
+		}, modconfig.FailActionDirective, &c.lookalikeAction)
+	cfg.Custom("error_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.errAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	for _, d := range domains {
+		name, err := normalizeDomain(d)
+		if err != nil {
+			return fmt.Errorf("%s: invalid protected domain %s: %w", modName, d, err)
+		}
+		c.domains = append(c.domains, newProtectedDomain(name))
+	}
+
+	return nil
+}
+
+// normalizeDomain converts the domain into the lowercase U-label form.
+func normalizeDomain(domain string) (string, error) {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	uDomain, err := dns.SelectIDNA(true, domain)
+	if err != nil {
+		return domain, err
+	}
+	return strings.ToLower(uDomain), nil
+}
+
+// isProtected reports whether the domain is one of protected domains or
+// their subdomains.
+func (c *Check) isProtected(domain string) bool {
+	for _, d := range c.domains {
+		if domain == d.name || strings.HasSuffix(domain, "."+d.name) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookalike returns the protected domain that looks like the specified
+// domain or an empty string if there is none.
+//
+// Both the domain itself and its registrable domain are compared, so
+// subdomains of lookalike domains (login.examp1e.org) are matched too.
+// Domains that contain a protected domain (example.org.attacker.test)
+// are also considered lookalikes.
+func (c *Check) lookalike(domain string) string {
+	skeletons := []string{domainSkeleton(domain)}
+	if orgDomain, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil && orgDomain != domain {
+		skeletons = append(skeletons, domainSkeleton(orgDomain))
+	}
+
+	for _, d := range c.domains {
+		for _, skeleton := range skeletons {
+			if skeleton == d.skeleton {
+				return d.name
+			}
+			if c.maxDistance <= 0 || !d.distanceMatching() {
+				continue
+			}
+			if editDistance(skeleton, d.skeleton) <= c.maxDistance {
+				return d.name
+			}
+		}
+		if strings.Contains("."+skeletons[0]+".", "."+d.skeleton+".") {
+			return d.name
+		}
+	}
+	return ""
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(_ context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(_ context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(_ context.Context, _ string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(_ context.Context, _ string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+// addrDomain returns the normalized domain part of the address.
+func addrDomain(addr string) (string, error) {
+	_, domain, err := address.Split(addr)
+	if err != nil {
+		return "", err
+	}
+	return normalizeDomain(domain)
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, _ buffer.Buffer) module.CheckResult {
+	if s.msgMeta.Conn == nil {
+		s.log.Msg("skipping locally generated message")
+		return module.CheckResult{}
+	}
+	if s.msgMeta.Conn.AuthUser != "" {
+		s.log.DebugMsg("skipping message from an authenticated user")
+		return module.CheckResult{}
+	}
+
+	fromHdr := hdr.Get("From")
+	if fromHdr == "" {
+		return module.CheckResult{}
+	}
+	from, err := mail.ParseAddress(fromHdr)
+	if err != nil {
+		return s.c.errAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 0},
+				Message:      "Malformed From header",
+				CheckName:    modName,
+				Err:          err,
+			}})
+	}
+	fromDomain, err := addrDomain(from.Address)
+	if err != nil {
+		s.log.Error("malformed From domain", err, "from", from.Address)
+	}
+
+	// Findings with monitor-only actions are merged separately so they do
+	// not turn enforced actions of other findings into monitor-only ones.
+	type findings struct {
+		res     module.CheckResult
+		reasons []string
+	}
+	var (
+		enforced, monitored findings
+		reasons             []string
+	)
+	apply := func(action modconfig.FailAction, reason string) {
+		s.log.Msg("possible impersonation", "from", from.Address, "reason", reason)
+		reasons = append(reasons, reason)
+
+		f := &enforced
+		if action.Monitor {
+			f = &monitored
+		}
+		f.reasons = append(f.reasons, reason)
+		f.res = action.Apply(module.CheckResult{
+			Reject:     f.res.Reject,
+			Quarantine: f.res.Quarantine,
+			Score:      f.res.Score,
+			Monitor:    f.res.Monitor,
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+				Message:      "Message appears to impersonate a trusted sender",
+				Reason:       strings.Join(f.reasons, "; "),
+				CheckName:    modName,
+				Misc: map[string]interface{}{
+					"from": from.Address,
+				},
+			},
+		})
+	}
+
+	if fromDomain != "" && !s.c.isProtected(fromDomain) {
+		if s.c.names != nil && from.Name != "" {
+			user, ok, err := s.c.names.Lookup(ctx, normalizeName(from.Name))
+			if err != nil {
+				return s.c.errAction.Apply(module.CheckResult{
+					Reason: &exterrors.SMTPError{
+						Code:         451,
+						EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+						Message:      "Internal error during policy check",
+						CheckName:    modName,
+						Err:          err,
+					}})
+			}
+			if ok {
+				apply(s.c.displayNameAction, fmt.Sprintf("display name %q matches local user %s", from.Name, user))
+			}
+		}
+
+		if d := s.c.lookalike(fromDomain); d != "" {
+			apply(s.c.lookalikeAction, fmt.Sprintf("From domain %s looks like %s", fromDomain, d))
+		}
+	}
+
+	if replyToHdr := hdr.Get("Reply-To"); replyToHdr != "" {
+		replyTo, err := mail.ParseAddressList(replyToHdr)
+		if err != nil {
+			s.log.Error("malformed Reply-To header", err)
+		}
+		for _, addr := range replyTo {
+			domain, err := addrDomain(addr.Address)
+			if err != nil || s.c.isProtected(domain) {
+				continue
+			}
+			if d := s.c.lookalike(domain); d != "" {
+				apply(s.c.lookalikeAction, fmt.Sprintf("Reply-To domain %s looks like %s", domain, d))
+				break
+			}
+		}
+	}
+
+	res := enforced.res
+	if len(enforced.reasons) == 0 {
+		res = monitored.res
+	}
+	if len(reasons) != 0 && s.c.addHeader {
+		res.Header = textproto.Header{}
+		res.Header.Add(warningHeader, s.c.warningText+" ("+strings.Join(reasons, "; ")+")")
+	}
+
+	return res
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,177 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package impersonation
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testCheck(t *testing.T) *Check {
+	c := &Check{
+		log: testutils.Logger(t, modName),
+		names: testutils.Table{M: map[string]string{
+			"john smith": "john@example.org",
+		}},
+		maxDistance:       1,
+		addHeader:         true,
+		warningText:       "Warning",
+		displayNameAction: modconfig.FailAction{Quarantine: true},
+		lookalikeAction:   modconfig.FailAction{Reject: true},
+	}
+	for _, d := range []string{"example.org", "bank.test"} {
+		c.domains = append(c.domains, newProtectedDomain(d))
+	}
+	return c
+}
+
+func runCheck(t *testing.T, c *Check, authUser string, fields ...string) module.CheckResult {
+	st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		ID:   "test",
+		Conn: &module.ConnState{AuthUser: authUser},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	hdr := textproto.Header{}
+	for i := 0; i < len(fields); i += 2 {
+		hdr.Add(fields[i], fields[i+1])
+	}
+	return st.CheckBody(context.Background(), hdr, buffer.MemoryBuffer{})
+}
+
+func TestLookalike(t *testing.T) {
+	c := testCheck(t)
+	for domain, expected := range map[string]string{
+		"example.org":            "example.org",
+		"examp1e.org":            "example.org",
+		"exarnple.org":           "example.org",
+		"exampie.org":            "example.org",
+		"examplee.org":           "example.org",
+		"еxample.org":            "example.org", // Cyrillic 'е'
+		"ｅxample.org":            "example.org", // Fullwidth 'e'
+		"bаnk.test":              "bank.test",   // Cyrillic 'а'
+		"bonk.test":              "",            // Too short for edit distance.
+		"login.examp1e.org":      "example.org",
+		"mail.exarnple.org":      "example.org",
+		"example.org.evil.test":  "example.org",
+		"bank.test.evil.test":    "bank.test",
+		"notexample.org.test":    "",
+		"unrelated.org":          "",
+		"example-payments.org":   "",
+		"totally-different.test": "",
+	} {
+		normalized, err := normalizeDomain(domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := c.lookalike(normalized); actual != expected {
+			t.Errorf("lookalike(%s) = %q, want %q", domain, actual, expected)
+		}
+	}
+}
+
+func TestNormalizeDomain_Punycode(t *testing.T) {
+	// xn--xample-2of.org is "еxample.org" with Cyrillic 'е'.
+	domain, err := normalizeDomain("XN--XAMPLE-2OF.ORG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if domain != "еxample.org" {
+		t.Fatalf("wrong U-label: %s", domain)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	test := func(name string, authUser string, reject, quarantine bool, fields ...string) {
+		t.Run(name, func(t *testing.T) {
+			res := runCheck(t, testCheck(t), authUser, fields...)
+			if res.Reject != reject {
+				t.Errorf("Reject = %v, want %v", res.Reject, reject)
+			}
+			if res.Quarantine != quarantine {
+				t.Errorf("Quarantine = %v, want %v", res.Quarantine, quarantine)
+			}
+			hasHeader := res.Header.Get(warningHeader) != ""
+			if hasHeader != (reject || quarantine) {
+				t.Errorf("Warning header present = %v, want %v", hasHeader, reject || quarantine)
+			}
+		})
+	}
+
+	test("clean", "", false, false,
+		"From", "Alice <alice@example.com>")
+	test("internal display name", "", false, false,
+		"From", "John Smith <john@example.org>")
+	test("display name", "", false, true,
+		"From", `"Smith, John" <ceo@freemail.test>`)
+	test("confusable display name", "", false, true,
+		"From", "=?utf-8?q?J=D0=BEhn_Smith?= <ceo@freemail.test>")
+	test("lookalike domain", "", true, false,
+		"From", "Alice <alice@examp1e.org>")
+	test("punycode lookalike domain", "", true, false,
+		"From", "Alice <alice@xn--xample-2of.org>")
+	test("display name and lookalike", "", true, true,
+		"From", "John Smith <john@exarnple.org>")
+	test("reply-to lookalike", "", true, false,
+		"From", "Alice <alice@example.com>",
+		"Reply-To", "Alice <alice@exampie.org>")
+	test("authenticated", "john", false, false,
+		"From", "John Smith <john@exarnple.org>")
+}
+
+func TestCheck_Header(t *testing.T) {
+	res := runCheck(t, testCheck(t), "", "From", "John Smith <ceo@freemail.test>")
+	val := res.Header.Get(warningHeader)
+	if !strings.HasPrefix(val, "Warning (") || !strings.Contains(val, "john@example.org") {
+		t.Fatalf("Unexpected header value: %s", val)
+	}
+
+	c := testCheck(t)
+	c.addHeader = false
+	res = runCheck(t, c, "", "From", "John Smith <ceo@freemail.test>")
+	if res.Header.Len() != 0 {
+		t.Fatal("Header should not be added")
+	}
+}
+
+func TestCheck_MonitorAction(t *testing.T) {
+	c := testCheck(t)
+	c.displayNameAction = modconfig.FailAction{Monitor: true}
+
+	// Monitor action for one finding does not affect others.
+	res := runCheck(t, c, "", "From", "John Smith <john@exarnple.org>")
+	if !res.Reject || res.Monitor {
+		t.Errorf("lookalike action is not enforced: %+v", res)
+	}
+
+	res = runCheck(t, c, "", "From", "John Smith <ceo@freemail.test>")
+	if !res.Monitor || res.Reason == nil {
+		t.Errorf("monitor-only finding is not reported: %+v", res)
+	}
+}
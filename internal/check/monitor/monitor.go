@@ -0,0 +1,151 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package monitor
+
+import (
+	"context"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const modName = "check.monitor"
+
+// Check wraps another check and marks all results it returns as
+// monitor-only. msgpipeline logs such results instead of rejecting or
+// quarantining the message.
+type Check struct {
+	instName   string
+	inlineArgs []string
+	log        log.Logger
+
+	wrapped module.Check
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	return &Check{
+		instName:   instName,
+		inlineArgs: inlineArgs,
+		log:        log.Logger{Name: modName},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var err error
+	if len(c.inlineArgs) != 0 {
+		// monitor dnsbl { ... }
+		// monitor &local_dnsbl
+		c.wrapped, err = modconfig.MessageCheck(cfg.Globals, c.inlineArgs, cfg.Block)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// monitor {
+	//     dnsbl { ... }
+	// }
+	if len(cfg.Block.Children) != 1 {
+		return config.NodeErr(cfg.Block, "exactly one check should be specified")
+	}
+	node := cfg.Block.Children[0]
+	c.wrapped, err = modconfig.MessageCheck(cfg.Globals, append([]string{node.Name}, node.Args...), node)
+	return err
+}
+
+// CheckConnection implements module.EarlyCheck. Errors returned by the
+// wrapped check are logged and discarded.
+func (c *Check) CheckConnection(ctx context.Context, state *smtp.ConnectionState) error {
+	early, ok := c.wrapped.(module.EarlyCheck)
+	if !ok {
+		return nil
+	}
+
+	if err := early.CheckConnection(ctx, state); err != nil {
+		c.log.Error("would have rejected", err)
+	}
+	return nil
+}
+
+type state struct {
+	c       *Check
+	wrapped module.CheckState
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	wrapped, err := c.wrapped.CheckStateForMsg(ctx, msgMeta)
+	if err != nil {
+		return nil, err
+	}
+	return &state{c: c, wrapped: wrapped}, nil
+}
+
+func (s *state) monitored(res module.CheckResult) module.CheckResult {
+	if res.Reason == nil {
+		return res
+	}
+
+	res.Monitor = true
+	if _, ok := exterrors.Fields(res.Reason)["check"]; !ok {
+		if mod, ok := s.c.wrapped.(module.Module); ok {
+			res.Reason = exterrors.WithFields(res.Reason, map[string]interface{}{
+				"check": mod.Name(),
+			})
+		}
+	}
+	return res
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return s.monitored(s.wrapped.CheckConnection(ctx))
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return s.monitored(s.wrapped.CheckSender(ctx, addr))
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return s.monitored(s.wrapped.CheckRcpt(ctx, addr))
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	return s.monitored(s.wrapped.CheckBody(ctx, hdr, body))
+}
+
+func (s *state) Close() error {
+	return s.wrapped.Close()
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,66 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package monitor
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestMonitor(t *testing.T) {
+	wrapped := testutils.Check{
+		SenderRes: module.CheckResult{
+			Reason: errors.New("no"),
+			Reject: true,
+		},
+		EarlyErr: errors.New("early no"),
+	}
+	c := Check{
+		log:     testutils.Logger(t, modName),
+		wrapped: &wrapped,
+	}
+
+	if err := c.CheckConnection(context.Background(), nil); err != nil {
+		t.Fatal("early check error is not discarded:", err)
+	}
+
+	st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	res := st.CheckConnection(context.Background())
+	if res.Monitor {
+		t.Fatal("Monitor flag is set for result without Reason")
+	}
+
+	res = st.CheckSender(context.Background(), "foo@example.org")
+	if !res.Monitor || !res.Reject {
+		t.Fatalf("wrong result flags: %+v", res)
+	}
+	if name := exterrors.Fields(res.Reason)["check"]; name != "test_check" {
+		t.Fatal("wrong check name in reason:", name)
+	}
+}
@@ -63,6 +63,11 @@
 // recipient (`RCPT TO:`) as well as the `To:` and `Cc` message headers. Table
 // definition is identical to `match_sender`.
 //
+// The `safelist` action for recipient addresses prevents the message from
+// being quarantined only for the matching recipient. It is used only if the
+// check is in the global check block and is matched against the final
+// recipient address (after rewriting).
+//
 // *Syntax:* match_host _table_
 //
 // Table to use for host IP address lookups, to be matched against the IP address
@@ -263,15 +263,6 @@ func (c *Check) CheckSafelist(ctx context.Context, msgMeta *module.MsgMetadata)
 		}
 	}
 
-	if !(result.Matches && result.Action == "safelist") {
-		for _, recipient := range msgMeta.OriginalRcpts {
-			result, _ = c.checkEmailTable(ctx, c.matchRecipient, "rcpt-to", recipient, c.emailNorm)
-			if result.Matches {
-				result.Type = "recipient"
-			}
-		}
-	}
-
 	if result.Matches && result.Action == "safelist" {
 		c.log.DebugMsg("message matches safelisted pattern", "type", result.Type, "pattern", result.Pattern, "value", result.Value, "in", ctx.Value(entrypointKey{}))
 		h := textproto.Header{}
@@ -286,6 +277,19 @@ func (c *Check) CheckSafelist(ctx context.Context, msgMeta *module.MsgMetadata)
 	return module.SafelistCheckResult{}
 }
 
+// CheckRcptSafelist implements module.RcptSafelistCheck. Recipient
+// patterns safelist the message only for the matching recipient.
+func (c *Check) CheckRcptSafelist(ctx context.Context, _ *module.MsgMetadata, rcptTo string) module.SafelistCheckResult {
+	ctx = context.WithValue(ctx, entrypointKey{}, "check-rcpt-safelist")
+	result, _ := c.checkEmailTable(ctx, c.matchRecipient, "rcpt-to", rcptTo, c.emailNorm)
+	if !(result.Matches && result.Action == "safelist") {
+		return module.SafelistCheckResult{}
+	}
+
+	c.log.DebugMsg("recipient matches safelisted pattern", "pattern", result.Pattern, "value", result.Value, "in", ctx.Value(entrypointKey{}))
+	return module.SafelistCheckResult{Safelist: true}
+}
+
 type entrypointKey struct{}
 
 // CheckConnection implements module.EarlyCheck, and allows rejecting connections from a host with a given IP address
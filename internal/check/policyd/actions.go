@@ -0,0 +1,171 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package policyd
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// splitAction splits the action into the upper-cased command and
+// the optional text.
+func splitAction(action string) (string, string) {
+	action = strings.TrimSpace(action)
+	parts := strings.SplitN(action, " ", 2)
+	if len(parts) == 1 {
+		return strings.ToUpper(parts[0]), ""
+	}
+	return strings.ToUpper(parts[0]), strings.TrimSpace(parts[1])
+}
+
+// cacheable reports whether the response can be reused for other messages.
+// Temporary failures are not cached.
+func cacheable(action string) bool {
+	cmd, _ := splitAction(action)
+	if strings.HasPrefix(cmd, "DEFER") || strings.HasPrefix(cmd, "4") {
+		return false
+	}
+	return true
+}
+
+// parseEnhancedCode parses the optional enhanced status code at the
+// beginning of text.
+func parseEnhancedCode(text string) (exterrors.EnhancedCode, string, bool) {
+	parts := strings.SplitN(text, " ", 2)
+	codeParts := strings.Split(parts[0], ".")
+	if len(codeParts) != 3 {
+		return exterrors.EnhancedCode{}, text, false
+	}
+
+	var code exterrors.EnhancedCode
+	for i, part := range codeParts {
+		num, err := strconv.Atoi(part)
+		if err != nil {
+			return exterrors.EnhancedCode{}, text, false
+		}
+		code[i] = num
+	}
+
+	if len(parts) == 1 {
+		return code, "", true
+	}
+	return code, strings.TrimSpace(parts[1]), true
+}
+
+// rejectResult returns the check result for a reject or defer action.
+//
+// reject_action applies only to permanent rejects. Temporary ones (e.g.
+// greylisting) are always returned as is since turning them into anything
+// else would let the message through.
+func (s *state) rejectResult(code int, enchCode exterrors.EnhancedCode, text, reason string) module.CheckResult {
+	if text == "" {
+		text = "Message rejected due to local policy"
+	}
+	res := module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         code,
+			EnhancedCode: enchCode,
+			Message:      text,
+			Reason:       reason,
+			CheckName:    modName,
+			Misc: map[string]interface{}{
+				"endpoint": s.c.endpoint,
+			},
+		},
+	}
+	if code/100 == 4 {
+		res.Reject = true
+		return res
+	}
+	return s.c.rejectAction.Apply(res)
+}
+
+// applyAction converts the action returned by the policy server into the
+// check result.
+func (s *state) applyAction(action string) module.CheckResult {
+	cmd, text := splitAction(action)
+
+	if code, err := strconv.Atoi(cmd); err == nil && len(cmd) == 3 {
+		switch cmd[0] {
+		case '4', '5':
+			enchCode, msg, ok := parseEnhancedCode(text)
+			if !ok {
+				enchCode = exterrors.EnhancedCode{int(cmd[0] - '0'), 7, 1}
+			}
+			return s.rejectResult(code, enchCode, msg, "reply code action")
+		case '2':
+			return module.CheckResult{}
+		}
+		s.log.Msg("invalid reply code, ignoring", "action", action)
+		return module.CheckResult{}
+	}
+
+	switch cmd {
+	case "OK", "DUNNO":
+		return module.CheckResult{}
+	case "REJECT":
+		enchCode, msg, ok := parseEnhancedCode(text)
+		if !ok {
+			enchCode = exterrors.EnhancedCode{5, 7, 1}
+		}
+		return s.rejectResult(554, enchCode, msg, "reject action")
+	case "DEFER", "DEFER_IF_PERMIT":
+		// DEFER_IF_PERMIT is commonly used for greylisting. There are no
+		// other restrictions evaluated after the check that could turn
+		// the result into a reject, so it is handled as a plain DEFER.
+		enchCode, msg, ok := parseEnhancedCode(text)
+		if !ok {
+			enchCode = exterrors.EnhancedCode{4, 7, 1}
+		}
+		return s.rejectResult(450, enchCode, msg, "defer action")
+	case "DEFER_IF_REJECT":
+		s.log.DebugMsg("DEFER_IF_REJECT action ignored", "text", text)
+		return module.CheckResult{}
+	case "HOLD":
+		return s.c.holdAction.Apply(module.CheckResult{
+			Reason: exterrors.WithFields(errors.New("policy server hold action"), map[string]interface{}{
+				"check":    modName,
+				"endpoint": s.c.endpoint,
+				"reason":   text,
+			}),
+		})
+	case "PREPEND":
+		var res module.CheckResult
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			s.log.Msg("malformed PREPEND action, ignoring", "action", action)
+			return res
+		}
+		res.Header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+		return res
+	case "WARN", "INFO":
+		s.log.Msg("policy server "+strings.ToLower(cmd), "text", text)
+		return module.CheckResult{}
+	case "DISCARD":
+		s.log.Msg("silent discard is not supported, rejecting message")
+		return s.rejectResult(550, exterrors.EnhancedCode{5, 7, 1}, text, "discard action")
+	default:
+		s.log.Msg("unsupported action ignored", "action", action)
+		return module.CheckResult{}
+	}
+}
@@ -0,0 +1,172 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package policyd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxIdleConns is the amount of connections to the policy server kept open
+// for reuse. Policy servers are expected to handle multiple requests
+// over a single connection.
+const maxIdleConns = 4
+
+// attr is a single name=value attribute of the policy delegation request.
+type attr struct {
+	name, value string
+}
+
+type client struct {
+	network, address string
+	timeout          time.Duration
+
+	idleLck sync.Mutex
+	idle    []*clientConn
+}
+
+type clientConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (cl *client) getConn(ctx context.Context) (*clientConn, bool, error) {
+	cl.idleLck.Lock()
+	if len(cl.idle) != 0 {
+		cc := cl.idle[len(cl.idle)-1]
+		cl.idle = cl.idle[:len(cl.idle)-1]
+		cl.idleLck.Unlock()
+		return cc, true, nil
+	}
+	cl.idleLck.Unlock()
+
+	dialer := net.Dialer{Timeout: cl.timeout}
+	conn, err := dialer.DialContext(ctx, cl.network, cl.address)
+	if err != nil {
+		return nil, false, err
+	}
+	return &clientConn{conn: conn, r: bufio.NewReader(conn)}, false, nil
+}
+
+func (cl *client) putConn(cc *clientConn) {
+	cl.idleLck.Lock()
+	defer cl.idleLck.Unlock()
+	if len(cl.idle) >= maxIdleConns {
+		cc.conn.Close()
+		return
+	}
+	cl.idle = append(cl.idle, cc)
+}
+
+func (cl *client) close() {
+	cl.idleLck.Lock()
+	defer cl.idleLck.Unlock()
+	for _, cc := range cl.idle {
+		cc.conn.Close()
+	}
+	cl.idle = nil
+}
+
+// Query sends the policy delegation request and returns the value of the
+// 'action' attribute from the response.
+func (cl *client) Query(ctx context.Context, attrs []attr) (string, error) {
+	cc, reused, err := cl.getConn(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	action, err := cc.query(ctx, cl.timeout, attrs)
+	if err != nil && reused {
+		// The server might have closed the idle connection, try again using
+		// a new one.
+		cc.conn.Close()
+		cc, _, err = cl.getConn(ctx)
+		if err != nil {
+			return "", err
+		}
+		action, err = cc.query(ctx, cl.timeout, attrs)
+	}
+	if err != nil {
+		cc.conn.Close()
+		return "", err
+	}
+
+	cl.putConn(cc)
+	return action, nil
+}
+
+func (cc *clientConn) query(ctx context.Context, timeout time.Duration, attrs []attr) (string, error) {
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := cc.conn.SetDeadline(deadline); err != nil {
+		return "", err
+	}
+
+	var req strings.Builder
+	for _, a := range attrs {
+		// Values can't contain line breaks, the protocol has no escaping.
+		value := strings.NewReplacer("\r", " ", "\n", " ").Replace(a.value)
+		req.WriteString(a.name)
+		req.WriteByte('=')
+		req.WriteString(value)
+		req.WriteByte('\n')
+	}
+	req.WriteByte('\n')
+
+	if _, err := cc.conn.Write([]byte(req.String())); err != nil {
+		return "", err
+	}
+
+	var (
+		action    string
+		gotAction bool
+	)
+	for {
+		line, err := cc.r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return "", fmt.Errorf("malformed response line: %q", line)
+		}
+		if parts[0] == "action" {
+			action = parts[1]
+			gotAction = true
+		}
+	}
+	if !gotAction {
+		return "", errors.New("response without action attribute")
+	}
+
+	return action, nil
+}
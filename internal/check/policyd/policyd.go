@@ -0,0 +1,401 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package policyd
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.policyd"
+
+const (
+	stateConnect = "CONNECT"
+	stateRcpt    = "RCPT"
+	stateData    = "END-OF-MESSAGE"
+)
+
+// connCacheTTL is the time the cached responses for the connection are kept
+// after the last use.
+const connCacheTTL = 10 * time.Minute
+
+type Check struct {
+	instName string
+	endpoint string
+	log      log.Logger
+
+	cl           *client
+	stages       map[string]bool
+	policyCtx    string
+	rejectAction modconfig.FailAction
+	holdAction   modconfig.FailAction
+	errAction    modconfig.FailAction
+
+	cacheLck sync.Mutex
+	cache    map[*module.ConnState]*connCache
+}
+
+// connCache contains the responses that depend only on connection
+// attributes and therefore can be reused for multiple messages received
+// over the same connection.
+//
+// Responses for RCPT and END-OF-MESSAGE requests are not cached since
+// policy servers commonly keep per-message state (e.g. quota or rate
+// limit counters).
+type connCache struct {
+	lastUse time.Time
+	connect *string
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	c := &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		cache:    map[*module.ConnState]*connCache{},
+	}
+	switch len(inlineArgs) {
+	case 1:
+		c.endpoint = inlineArgs[0]
+	case 0:
+	default:
+		return nil, fmt.Errorf("%s: unexpected amount of arguments, want 1 or 0", modName)
+	}
+	return c, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var (
+		stages  []string
+		timeout time.Duration
+	)
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("endpoint", false, false, c.endpoint, &c.endpoint)
+	cfg.EnumList("stages", false, false, []string{"connect", "rcpt", "data"}, []string{"rcpt"}, &stages)
+	cfg.String("policy_context", false, false, "", &c.policyCtx)
+	cfg.Duration("timeout", false, false, 10*time.Second, &timeout)
+	cfg.Custom("reject_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.rejectAction)
+	cfg.Custom("hold_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Quarantine: true}, nil
+		}, modconfig.FailActionDirective, &c.holdAction)
+	cfg.Custom("error_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.errAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if c.endpoint == "" {
+		return fmt.Errorf("%s: policy server endpoint is not set", modName)
+	}
+	endp, err := config.ParseEndpoint(c.endpoint)
+	if err != nil {
+		return fmt.Errorf("%s: %v", modName, err)
+	}
+	switch endp.Scheme {
+	case "tcp", "unix":
+	default:
+		return fmt.Errorf("%s: scheme unsupported: %v", modName, endp.Scheme)
+	}
+	if endp.Path != "" {
+		return fmt.Errorf("%s: stray path in endpoint: %v", modName, endp)
+	}
+
+	c.cl = &client{
+		network: endp.Network(),
+		address: endp.Address(),
+		timeout: timeout,
+	}
+	c.stages = make(map[string]bool, len(stages))
+	for _, stage := range stages {
+		c.stages[stage] = true
+	}
+
+	return nil
+}
+
+func (c *Check) Close() error {
+	c.cl.close()
+	return nil
+}
+
+// connCache returns the cache object for the connection, creating it if
+// necessary. Caller should hold cacheLck.
+func (c *Check) connCache(conn *module.ConnState) *connCache {
+	now := time.Now()
+	for k, v := range c.cache {
+		if now.Sub(v.lastUse) > connCacheTTL {
+			delete(c.cache, k)
+		}
+	}
+
+	cache := c.cache[conn]
+	if cache == nil {
+		cache = &connCache{}
+		c.cache[conn] = cache
+	}
+	cache.lastUse = now
+	return cache
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+
+	mailFrom  string
+	rcptCount int
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func tlsVersion(ver uint16) string {
+	switch ver {
+	case tls.VersionTLS10:
+		return "TLSv1"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	}
+	return ""
+}
+
+// attrs builds the attribute set for the policy delegation request.
+func (s *state) attrs(ctx context.Context, protoState, rcpt string, rcptCount, size int) []attr {
+	attrs := []attr{
+		{"request", "smtpd_access_policy"},
+		{"protocol_state", protoState},
+		{"protocol_name", "SMTP"},
+		{"helo_name", ""},
+		{"queue_id", s.msgMeta.ID},
+		{"sender", s.mailFrom},
+		{"recipient", rcpt},
+		{"recipient_count", strconv.Itoa(rcptCount)},
+		{"client_address", ""},
+		{"client_name", "unknown"},
+		{"reverse_client_name", "unknown"},
+		{"instance", s.msgMeta.ID},
+		{"size", strconv.Itoa(size)},
+	}
+	set := func(name, value string) {
+		for i := range attrs {
+			if attrs[i].name == name {
+				attrs[i].value = value
+				return
+			}
+		}
+		attrs = append(attrs, attr{name, value})
+	}
+
+	if s.c.policyCtx != "" {
+		set("policy_context", s.c.policyCtx)
+	}
+	if s.msgMeta.SMTPOpts.UTF8 {
+		set("smtputf8", "1")
+	}
+
+	conn := s.msgMeta.Conn
+	if conn == nil {
+		// Message is generated locally.
+		set("client_address", "127.0.0.1")
+		set("client_name", "localhost")
+		set("reverse_client_name", "localhost")
+		set("helo_name", "localhost")
+		return attrs
+	}
+
+	if conn.Proto != "" {
+		set("protocol_name", conn.Proto)
+	}
+	set("helo_name", conn.Hostname)
+
+	switch addr := conn.RemoteAddr.(type) {
+	case *net.TCPAddr:
+		if v4 := addr.IP.To4(); v4 != nil {
+			set("client_address", v4.String())
+		} else {
+			set("client_address", addr.IP.String())
+		}
+		set("client_port", strconv.Itoa(addr.Port))
+	}
+	if addr, ok := conn.LocalAddr.(*net.TCPAddr); ok {
+		set("server_address", addr.IP.String())
+		set("server_port", strconv.Itoa(addr.Port))
+	}
+
+	if conn.RDNSName != nil {
+		rdnsName, err := conn.RDNSName.GetContext(ctx)
+		if err == nil && rdnsName != nil {
+			name := strings.TrimSuffix(rdnsName.(string), ".")
+			set("client_name", name)
+			set("reverse_client_name", name)
+		}
+	}
+
+	if conn.AuthUser != "" {
+		set("sasl_username", conn.AuthUser)
+		set("sasl_sender", "")
+	}
+
+	if conn.TLS.HandshakeComplete {
+		set("encryption_protocol", tlsVersion(conn.TLS.Version))
+		set("encryption_cipher", tls.CipherSuiteName(conn.TLS.CipherSuite))
+		if len(conn.TLS.PeerCertificates) != 0 {
+			cert := conn.TLS.PeerCertificates[0]
+			fingerprint := sha256.Sum256(cert.Raw)
+			set("ccert_subject", cert.Subject.CommonName)
+			set("ccert_issuer", cert.Issuer.CommonName)
+			set("ccert_fingerprint", strings.ToUpper(hex.EncodeToString(fingerprint[:])))
+		}
+	}
+
+	return attrs
+}
+
+func (s *state) query(ctx context.Context, protoState, rcpt string, rcptCount, size int) (string, error) {
+	attrs := s.attrs(ctx, protoState, rcpt, rcptCount, size)
+	action, err := s.c.cl.Query(ctx, attrs)
+	if err != nil {
+		return "", err
+	}
+	s.log.DebugMsg("policy server response", "protocol_state", protoState, "rcpt", rcpt, "action", action)
+	return action, nil
+}
+
+func (s *state) ioError(err error) module.CheckResult {
+	return s.c.errAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 1},
+			Message:      "I/O error during policy check",
+			Err:          err,
+			CheckName:    modName,
+			Misc: map[string]interface{}{
+				"endpoint": s.c.endpoint,
+			},
+		},
+	})
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	if !s.c.stages["connect"] {
+		return module.CheckResult{}
+	}
+
+	// Attributes sent at the CONNECT stage don't depend on the message,
+	// so response can be reused for all messages in the connection.
+	if s.msgMeta.Conn != nil {
+		s.c.cacheLck.Lock()
+		cached := s.c.connCache(s.msgMeta.Conn).connect
+		s.c.cacheLck.Unlock()
+		if cached != nil {
+			s.log.DebugMsg("using cached response", "protocol_state", stateConnect, "action", *cached)
+			return s.applyAction(*cached)
+		}
+	}
+
+	action, err := s.query(ctx, stateConnect, "", 0, 0)
+	if err != nil {
+		return s.ioError(err)
+	}
+
+	if s.msgMeta.Conn != nil && cacheable(action) {
+		s.c.cacheLck.Lock()
+		s.c.connCache(s.msgMeta.Conn).connect = &action
+		s.c.cacheLck.Unlock()
+	}
+	return s.applyAction(action)
+}
+
+func (s *state) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	s.mailFrom = mailFrom
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
+	s.rcptCount++
+	if !s.c.stages["rcpt"] {
+		return module.CheckResult{}
+	}
+
+	// Like Postfix, recipient_count is not known until the end of message.
+	action, err := s.query(ctx, stateRcpt, rcptTo, 0, s.msgMeta.SMTPOpts.Size)
+	if err != nil {
+		return s.ioError(err)
+	}
+	return s.applyAction(action)
+}
+
+func (s *state) CheckBody(ctx context.Context, header textproto.Header, body buffer.Buffer) module.CheckResult {
+	if !s.c.stages["data"] {
+		return module.CheckResult{}
+	}
+
+	action, err := s.query(ctx, stateData, "", s.rcptCount, body.Len())
+	if err != nil {
+		return s.ioError(err)
+	}
+	return s.applyAction(action)
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,272 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package policyd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type policyServer struct {
+	l net.Listener
+
+	lck      sync.Mutex
+	requests []map[string]string
+	conns    int
+	respond  func(req map[string]string) string
+}
+
+func (ps *policyServer) serve(t *testing.T) {
+	for {
+		conn, err := ps.l.Accept()
+		if err != nil {
+			return
+		}
+		ps.lck.Lock()
+		ps.conns++
+		ps.lck.Unlock()
+
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			req := map[string]string{}
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				line = strings.TrimRight(line, "\n")
+				if line != "" {
+					parts := strings.SplitN(line, "=", 2)
+					req[parts[0]] = parts[1]
+					continue
+				}
+
+				ps.lck.Lock()
+				ps.requests = append(ps.requests, req)
+				action := ps.respond(req)
+				ps.lck.Unlock()
+
+				if _, err := conn.Write([]byte("action=" + action + "\n\n")); err != nil {
+					t.Log(err)
+					return
+				}
+				req = map[string]string{}
+			}
+		}()
+	}
+}
+
+func smtpCode(err error) int {
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) {
+		return 0
+	}
+	return smtpErr.Code
+}
+
+func testCheck(t *testing.T, respond func(req map[string]string) string, stages ...string) (*Check, *policyServer) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := &policyServer{l: l, respond: respond}
+	go ps.serve(t)
+	t.Cleanup(func() { l.Close() })
+
+	c := &Check{
+		endpoint: "tcp://" + l.Addr().String(),
+		log:      testutils.Logger(t, modName),
+		cl: &client{
+			network: "tcp",
+			address: l.Addr().String(),
+			timeout: 5 * time.Second,
+		},
+		stages:       map[string]bool{},
+		rejectAction: modconfig.FailAction{Reject: true},
+		cache:        map[*module.ConnState]*connCache{},
+	}
+	for _, stage := range stages {
+		c.stages[stage] = true
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, ps
+}
+
+func TestPolicyd(t *testing.T) {
+	c, ps := testCheck(t, func(req map[string]string) string {
+		switch req["protocol_state"] {
+		case stateConnect:
+			return "DUNNO"
+		case stateRcpt:
+			switch req["recipient"] {
+			case "reject@example.org":
+				return "REJECT 5.7.2 Go away"
+			case "defer@example.org":
+				return "DEFER_IF_PERMIT Greylisted"
+			case "prepend@example.org":
+				return "PREPEND X-Policy: hello"
+			case "code@example.org":
+				return "421 4.3.2 Try later"
+			}
+			return "OK"
+		case stateData:
+			return "dunno"
+		}
+		return "REJECT unknown state"
+	}, "connect", "rcpt", "data")
+
+	conn := &module.ConnState{Proto: "ESMTP"}
+	conn.Hostname = "mx.example.com"
+	conn.RemoteAddr = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 12345}
+
+	for i := 0; i < 2; i++ {
+		st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: "msg", Conn: conn})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res := st.CheckConnection(context.Background()); res.Reason != nil {
+			t.Fatal("unexpected connection check failure:", res.Reason)
+		}
+		st.CheckSender(context.Background(), "sender@example.com")
+
+		res := st.CheckRcpt(context.Background(), "reject@example.org")
+		if !res.Reject || smtpCode(res.Reason) != 554 ||
+			res.Reason.(*exterrors.SMTPError).EnhancedCode != (exterrors.EnhancedCode{5, 7, 2}) {
+			t.Fatalf("wrong result for REJECT: %+v", res)
+		}
+		res = st.CheckRcpt(context.Background(), "defer@example.org")
+		if !res.Reject || smtpCode(res.Reason) != 450 {
+			t.Fatalf("wrong result for DEFER_IF_PERMIT: %+v", res)
+		}
+		res = st.CheckRcpt(context.Background(), "code@example.org")
+		if !res.Reject || smtpCode(res.Reason) != 421 {
+			t.Fatalf("wrong result for reply code: %+v", res)
+		}
+		res = st.CheckRcpt(context.Background(), "prepend@example.org")
+		if res.Reason != nil || res.Header.Get("X-Policy") != "hello" {
+			t.Fatalf("wrong result for PREPEND: %+v", res)
+		}
+		res = st.CheckRcpt(context.Background(), "ok@example.org")
+		if res.Reason != nil {
+			t.Fatalf("wrong result for OK: %+v", res)
+		}
+
+		res = st.CheckBody(context.Background(), textproto.Header{}, buffer.MemoryBuffer{Slice: []byte("Hello!\r\n")})
+		if res.Reason != nil {
+			t.Fatalf("wrong result for END-OF-MESSAGE: %+v", res)
+		}
+		st.Close()
+	}
+
+	ps.lck.Lock()
+	defer ps.lck.Unlock()
+
+	// CONNECT response is cached so it is sent only once.
+	// 1 CONNECT + 2 * (5 RCPT + 1 END-OF-MESSAGE)
+	if len(ps.requests) != 13 {
+		t.Fatalf("wrong amount of requests: %d", len(ps.requests))
+	}
+	if ps.conns != 1 {
+		t.Fatalf("connection was not reused, %d connections made", ps.conns)
+	}
+
+	connReq := ps.requests[0]
+	if connReq["protocol_state"] != stateConnect ||
+		connReq["client_address"] != "192.0.2.1" ||
+		connReq["client_port"] != "12345" ||
+		connReq["helo_name"] != "mx.example.com" ||
+		connReq["protocol_name"] != "ESMTP" ||
+		connReq["request"] != "smtpd_access_policy" {
+		t.Fatalf("wrong CONNECT request: %v", connReq)
+	}
+	rcptReq := ps.requests[1]
+	if rcptReq["sender"] != "sender@example.com" ||
+		rcptReq["recipient"] != "reject@example.org" ||
+		rcptReq["recipient_count"] != "0" {
+		t.Fatalf("wrong RCPT request: %v", rcptReq)
+	}
+	dataReq := ps.requests[6]
+	if dataReq["protocol_state"] != stateData ||
+		dataReq["recipient_count"] != "5" ||
+		dataReq["size"] != "8" {
+		t.Fatalf("wrong END-OF-MESSAGE request: %v", dataReq)
+	}
+}
+
+func TestPolicyd_IOError(t *testing.T) {
+	c, _ := testCheck(t, nil, "rcpt")
+	c.cl.address = "127.0.0.1:1"
+	c.errAction = modconfig.FailAction{Reject: true}
+
+	st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: "msg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	res := st.CheckRcpt(context.Background(), "test@example.org")
+	if !res.Reject || smtpCode(res.Reason) != 451 {
+		t.Fatalf("wrong result for I/O error: %+v", res)
+	}
+}
+
+func TestPolicyd_DeferIgnoresRejectAction(t *testing.T) {
+	c, _ := testCheck(t, func(req map[string]string) string {
+		switch req["recipient"] {
+		case "reject@example.org":
+			return "REJECT"
+		case "code@example.org":
+			return "450 Try later"
+		}
+		return "DEFER_IF_PERMIT Greylisted"
+	}, "rcpt")
+	c.rejectAction = modconfig.FailAction{Quarantine: true}
+
+	st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: "msg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	res := st.CheckRcpt(context.Background(), "reject@example.org")
+	if res.Reject || !res.Quarantine {
+		t.Fatalf("reject_action is not applied to REJECT: %+v", res)
+	}
+	for _, rcpt := range []string{"defer@example.org", "code@example.org"} {
+		res = st.CheckRcpt(context.Background(), rcpt)
+		if !res.Reject || res.Quarantine || smtpCode(res.Reason) != 450 {
+			t.Fatalf("wrong result for %s: %+v", rcpt, res)
+		}
+	}
+}
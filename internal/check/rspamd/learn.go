@@ -0,0 +1,76 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rspamd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/foxcpp/maddy/framework/buffer"
+)
+
+// Learn implements module.SpamLearner using the learnspam and learnham
+// endpoints of the rspamd controller.
+func (c *Check) Learn(ctx context.Context, accountName string, spam bool, msg buffer.Buffer) error {
+	endpoint := "/learnham"
+	if spam {
+		endpoint = "/learnspam"
+	}
+
+	body, err := msg.Open()
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	r, err := http.NewRequestWithContext(ctx, "POST", c.controllerPath+endpoint, body)
+	if err != nil {
+		return err
+	}
+	r.ContentLength = int64(msg.Len())
+	r.Header.Add("User-Agent", "maddy")
+	if c.controllerPassword != "" {
+		r.Header.Add("Password", c.controllerPassword)
+	}
+	if c.tag != "" {
+		r.Header.Add("MTA-Tag", c.tag)
+	}
+	if c.settingsID != "" {
+		r.Header.Add("Settings-ID", c.settingsID)
+	}
+	// Used by rspamd for per-user statistics.
+	r.Header.Add("Deliver-To", accountName)
+
+	resp, err := c.client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// 208 is returned if the message was already learned with the same
+	// class.
+	if resp.StatusCode/100 != 2 {
+		errMsg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: HTTP %d: %s", modName, resp.StatusCode, errMsg)
+	}
+	c.log.DebugMsg("message learned", "account", accountName, "spam", spam, "status", resp.StatusCode)
+	return nil
+}
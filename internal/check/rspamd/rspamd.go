@@ -53,6 +53,9 @@ type Check struct {
 	tag        string
 	mtaName    string
 
+	controllerPath     string
+	controllerPassword string
+
 	ioErrAction       modconfig.FailAction
 	errorRespAction   modconfig.FailAction
 	addHdrAction      modconfig.FailAction
@@ -101,6 +104,8 @@ func (c *Check) Init(cfg *config.Map) error {
 	cfg.String("settings_id", false, false, "", &c.settingsID)
 	cfg.String("tag", false, false, "maddy", &c.tag)
 	cfg.String("hostname", true, false, "", &c.mtaName)
+	cfg.String("controller_path", false, false, "http://127.0.0.1:11334", &c.controllerPath)
+	cfg.String("controller_password", false, false, "", &c.controllerPassword)
 	cfg.Custom("io_error_action", false, false,
 		func() (interface{}, error) {
 			return modconfig.FailAction{}, nil
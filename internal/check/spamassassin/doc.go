@@ -95,4 +95,12 @@
 //
 // Use 0.0 to disable.
 //
+// ## Spam learning
+//
+// The module can be used in the spam_learner directive of a storage module to
+// submit messages classified by users using the TELL command. spamd needs to
+// be started with --allow-tell option. Username passed to spamd is selected
+// using spamd_user_type with the storage account name used instead of the
+// recipient address.
+//
 package spamassassin
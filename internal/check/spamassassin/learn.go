@@ -0,0 +1,108 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package spamassassin
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/buffer"
+)
+
+// tell sends the message to spamd using the TELL command and checks the
+// response status.
+func (c *Check) tell(ctx context.Context, user string, spam bool, msg buffer.Buffer) error {
+	dialer := &net.Dialer{Timeout: c.connTimeout}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if c.tlsConfig != nil {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: c.tlsConfig}).DialContext(ctx, c.network, c.spamdAddress)
+	} else {
+		conn, err = dialer.DialContext(ctx, c.network, c.spamdAddress)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(c.cmdTimeout)); err != nil {
+		return err
+	}
+
+	class := "ham"
+	if spam {
+		class = "spam"
+	}
+
+	body, err := msg.Open()
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "TELL SPAMC/1.5\r\n")
+	fmt.Fprintf(w, "Message-class: %s\r\n", class)
+	fmt.Fprintf(w, "Set: local\r\n")
+	fmt.Fprintf(w, "User: %s\r\n", user)
+	fmt.Fprintf(w, "Content-length: %d\r\n\r\n", msg.Len())
+	if _, err := io.Copy(w, body); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	// SPAMD/1.1 0 EX_OK
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	parts := strings.Fields(status)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "SPAMD/") {
+		return fmt.Errorf("malformed spamd response: %q", status)
+	}
+	if code, err := strconv.Atoi(parts[1]); err != nil || code != 0 {
+		return fmt.Errorf("spamd error: %s", strings.TrimSpace(status))
+	}
+	return nil
+}
+
+// Learn implements module.SpamLearner using the spamd TELL command.
+//
+// spamd needs to be started with --allow-tell for this to work.
+func (c *Check) Learn(ctx context.Context, accountName string, spam bool, msg buffer.Buffer) error {
+	user, err := c.userFor(accountName)
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	if err := c.tell(ctx, user, spam, msg); err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	c.log.DebugMsg("message learned", "account", accountName, "spamd_user", user, "spam", spam)
+	return nil
+}
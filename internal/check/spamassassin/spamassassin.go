@@ -21,6 +21,7 @@ package spamassassin
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net/url"
@@ -65,6 +66,14 @@ type Check struct {
 	*/
 
 	clientPool sync.Pool
+
+	// Used to connect to spamd for learning since TELL is not supported by
+	// the client library.
+	network      string
+	spamdAddress string
+	tlsConfig    *tls.Config
+	connTimeout  time.Duration
+	cmdTimeout   time.Duration
 }
 
 func New(modName, instName string, _, inlineArgs []string) (module.Module, error) {
@@ -173,6 +182,14 @@ func (c *Check) Init(cfg *config.Map) error {
 		return fmt.Errorf("%s: invalid address scheme", modName)
 	}
 
+	c.network = network
+	c.spamdAddress = spamdaddress
+	if useTLS {
+		c.tlsConfig = &tls.Config{InsecureSkipVerify: insecureTLS}
+	}
+	c.connTimeout = connTimeout
+	c.cmdTimeout = cmdTimeout
+
 	_, err = spamc.NewClient(network, spamdaddress, "", compression)
 	if err != nil {
 		return fmt.Errorf("%s: %s", modName, err)
@@ -279,23 +296,28 @@ func (r multiReaderLen) Len() int {
 	return r.combinedLen
 }
 
+// userFor returns the spamd user name to use for messages sent to the
+// specified address.
+func (c *Check) userFor(addr string) (string, error) {
+	switch c.spamdUserType {
+	case "username":
+		username, _, err := address.Split(addr)
+		if err != nil {
+			return "", err
+		}
+		return username, nil
+	case "email":
+		return addr, nil
+	default:
+		return c.spamdUser, nil
+	}
+}
+
 func (s *state) getSpamdUser() (string, error) {
-	spamdUser := s.c.spamdUser
 	if len(s.rcpt) == 1 {
-		switch s.c.spamdUserType {
-		case "unix":
-			// use as-is
-		case "username":
-			username, _, err := address.Split(s.rcpt[0])
-			if err != nil {
-				return "", err
-			}
-			spamdUser = username
-		case "email":
-			spamdUser = s.rcpt[0]
-		}
+		return s.c.userFor(s.rcpt[0])
 	}
-	return spamdUser, nil
+	return s.c.spamdUser, nil
 }
 
 func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
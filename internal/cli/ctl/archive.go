@@ -0,0 +1,379 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// archiveManifestName is the file in the archive directory that lists
+// mailboxes with the attributes that cannot be represented by the archive
+// format itself.
+const archiveManifestName = "mailboxes.json"
+
+type archiveMailbox struct {
+	Name       string `json:"name"`
+	Subscribed bool   `json:"subscribed,omitempty"`
+	SpecialUse string `json:"special_use,omitempty"`
+}
+
+type archiveMessage struct {
+	Flags []string
+	Date  time.Time
+	Body  imap.Literal
+}
+
+type accountReader interface {
+	Mailboxes() ([]archiveMailbox, error)
+	// Messages calls fn for each message in the mailbox. Messages are
+	// read one at a time.
+	Messages(mbox string, fn func(*archiveMessage) error) error
+}
+
+type accountWriter interface {
+	CreateMailbox(mbox archiveMailbox) error
+	AddMessage(mbox string, msg *archiveMessage) error
+}
+
+var specialUseAttrs = []string{
+	imap.AllAttr,
+	imap.ArchiveAttr,
+	imap.DraftsAttr,
+	imap.FlaggedAttr,
+	imap.JunkAttr,
+	imap.SentAttr,
+	imap.TrashAttr,
+}
+
+// userArchive reads and writes messages of a storage account.
+type userArchive struct {
+	u backend.User
+}
+
+func (a userArchive) Mailboxes() ([]archiveMailbox, error) {
+	all, err := a.u.ListMailboxes(false)
+	if err != nil {
+		return nil, err
+	}
+	subscribed, err := a.u.ListMailboxes(true)
+	if err != nil {
+		return nil, err
+	}
+	subs := make(map[string]struct{}, len(subscribed))
+	for _, info := range subscribed {
+		subs[info.Name] = struct{}{}
+	}
+
+	mboxes := make([]archiveMailbox, 0, len(all))
+	for _, info := range all {
+		mbox := archiveMailbox{Name: info.Name}
+		_, mbox.Subscribed = subs[info.Name]
+		for _, attr := range info.Attributes {
+			for _, special := range specialUseAttrs {
+				if strings.EqualFold(attr, special) {
+					mbox.SpecialUse = special
+				}
+			}
+		}
+		mboxes = append(mboxes, mbox)
+	}
+	sort.Slice(mboxes, func(i, j int) bool {
+		return mboxes[i].Name < mboxes[j].Name
+	})
+	return mboxes, nil
+}
+
+func (a userArchive) Messages(name string, fn func(*archiveMessage) error) error {
+	_, mbox, err := a.u.GetMailbox(name, true, nil)
+	if err != nil {
+		return err
+	}
+	defer mbox.Close()
+
+	section := &imap.BodySectionName{Peek: true}
+	seq, _ := imap.ParseSeqSet("1:*")
+	ch := make(chan *imap.Message, 1)
+	listErr := make(chan error, 1)
+	go func() {
+		listErr <- mbox.ListMessages(true, seq, []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, section.FetchItem()}, ch)
+	}()
+
+	var fnErr error
+	for msg := range ch {
+		if fnErr != nil {
+			// Drain the channel so ListMessages can finish.
+			continue
+		}
+		// Body is keyed by the requested section (with Peek set), so
+		// GetBody cannot be used.
+		var body imap.Literal
+		for _, l := range msg.Body {
+			body = l
+		}
+		if body == nil {
+			fnErr = fmt.Errorf("mailbox %s: no body returned for UID %d", name, msg.Uid)
+			continue
+		}
+		flags := make([]string, 0, len(msg.Flags))
+		for _, f := range msg.Flags {
+			if f != imap.RecentFlag {
+				flags = append(flags, f)
+			}
+		}
+		fnErr = fn(&archiveMessage{
+			Flags: flags,
+			Date:  msg.InternalDate,
+			Body:  body,
+		})
+	}
+	if err := <-listErr; err != nil {
+		return err
+	}
+	return fnErr
+}
+
+func (a userArchive) CreateMailbox(mbox archiveMailbox) error {
+	if !strings.EqualFold(mbox.Name, imap.InboxName) {
+		var err error
+		if suu, ok := a.u.(SpecialUseUser); ok && mbox.SpecialUse != "" {
+			err = suu.CreateMailboxSpecial(mbox.Name, mbox.SpecialUse)
+		} else {
+			err = a.u.CreateMailbox(mbox.Name)
+		}
+		if err != nil && !errors.Is(err, backend.ErrMailboxAlreadyExists) {
+			return err
+		}
+	}
+	if mbox.Subscribed {
+		return a.u.SetSubscribed(mbox.Name, true)
+	}
+	return nil
+}
+
+func (a userArchive) AddMessage(mbox string, msg *archiveMessage) error {
+	return a.u.CreateMessage(mbox, msg.Flags, msg.Date, msg.Body, nil)
+}
+
+// mboxArchive is a directory with one mbox file per mailbox. Hierarchy
+// of mailboxes is represented using subdirectories, i.e. Archive.2023
+// is stored in Archive/2023.mbox.
+type mboxArchive struct {
+	dir string
+	// single is set if the archive is a single mbox file that contains
+	// INBOX messages.
+	single bool
+}
+
+// mboxPathComponent escapes the part of the mailbox name so it can be
+// used as a file name.
+func mboxPathComponent(part string) string {
+	var sb strings.Builder
+	for _, ch := range []byte(part) {
+		if ch == '/' || ch == '\\' || ch == '%' || ch < 0x20 {
+			fmt.Fprintf(&sb, "%%%02X", ch)
+			continue
+		}
+		sb.WriteByte(ch)
+	}
+	s := sb.String()
+	if strings.Trim(s, ".") == "" {
+		// Do not produce "." and ".." file names.
+		return strings.ReplaceAll(s, ".", "%2E")
+	}
+	return s
+}
+
+func (a mboxArchive) mboxPath(name string) string {
+	if a.single {
+		return a.dir
+	}
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = mboxPathComponent(part)
+	}
+	return filepath.Join(a.dir, filepath.Join(parts...)+".mbox")
+}
+
+func (a mboxArchive) Mailboxes() ([]archiveMailbox, error) {
+	if a.single {
+		return []archiveMailbox{{Name: imap.InboxName, Subscribed: true}}, nil
+	}
+
+	var mboxes []archiveMailbox
+	err := filepath.WalkDir(a.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".mbox") {
+			return nil
+		}
+		rel, err := filepath.Rel(a.dir, strings.TrimSuffix(path, ".mbox"))
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		for i, part := range parts {
+			var sb strings.Builder
+			for j := 0; j < len(part); j++ {
+				if part[j] == '%' && j+2 < len(part) {
+					if ch, err := strconv.ParseUint(part[j+1:j+3], 16, 8); err == nil {
+						sb.WriteByte(byte(ch))
+						j += 2
+						continue
+					}
+				}
+				sb.WriteByte(part[j])
+			}
+			parts[i] = sb.String()
+		}
+		mboxes = append(mboxes, archiveMailbox{
+			Name:       strings.Join(parts, "."),
+			Subscribed: true,
+		})
+		return nil
+	})
+	return mboxes, err
+}
+
+func (a mboxArchive) Messages(name string, fn func(*archiveMessage) error) error {
+	f, err := os.Open(a.mboxPath(name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := newMboxReader(f)
+	for {
+		flags, date, body, err := r.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if date.IsZero() {
+			date = time.Now()
+		}
+		if err := fn(&archiveMessage{Flags: flags, Date: date, Body: body}); err != nil {
+			return err
+		}
+	}
+}
+
+func (a mboxArchive) CreateMailbox(mbox archiveMailbox) error {
+	path := a.mboxPath(mbox.Name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (a mboxArchive) AddMessage(mbox string, msg *archiveMessage) error {
+	f, err := os.OpenFile(a.mboxPath(mbox), os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	w := newMboxWriter(f)
+	if err := w.WriteMessage(msg.Flags, msg.Date, msg.Body); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readArchiveManifest(dir string) ([]archiveMailbox, error) {
+	f, err := os.Open(filepath.Join(dir, archiveManifestName))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var manifest struct {
+		Mailboxes []archiveMailbox `json:"mailboxes"`
+	}
+	if err := json.NewDecoder(f).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("%s: %w", archiveManifestName, err)
+	}
+	return manifest.Mailboxes, nil
+}
+
+func writeArchiveManifest(dir string, mboxes []archiveMailbox) error {
+	f, err := os.Create(filepath.Join(dir, archiveManifestName))
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(struct {
+		Mailboxes []archiveMailbox `json:"mailboxes"`
+	}{mboxes}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+type archiveStats struct {
+	Mailboxes int
+	Messages  int
+}
+
+// copyAccount copies mailboxes and messages from src to dst.
+func copyAccount(src accountReader, dst accountWriter, mboxes []archiveMailbox) (archiveStats, error) {
+	stats := archiveStats{}
+	for _, mbox := range mboxes {
+		if err := dst.CreateMailbox(mbox); err != nil {
+			return stats, fmt.Errorf("mailbox %s: %w", mbox.Name, err)
+		}
+		stats.Mailboxes++
+
+		err := src.Messages(mbox.Name, func(msg *archiveMessage) error {
+			if err := dst.AddMessage(mbox.Name, msg); err != nil {
+				return err
+			}
+			stats.Messages++
+			return nil
+		})
+		if err != nil {
+			return stats, fmt.Errorf("mailbox %s: %w", mbox.Name, err)
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,176 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/foxcpp/maddy/internal/storage/maildir"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestMboxRoundtrip(t *testing.T) {
+	msgs := []string{
+		"Subject: one\r\nStatus: RO\r\n\r\nFrom here\r\n>From there\r\n\r\n\r\n",
+		"Subject: two\r\n\r\n",
+		"Subject: three\r\n\r\nno newline",
+	}
+	expected := []string{
+		"Subject: one\r\n\r\nFrom here\r\n>From there\r\n\r\n\r\n",
+		"Subject: two\r\n\r\n",
+		"Subject: three\r\n\r\nno newline\r\n",
+	}
+	date := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var buf bytes.Buffer
+	w := newMboxWriter(&buf)
+	for _, msg := range msgs {
+		if err := w.WriteMessage([]string{imap.SeenFlag, imap.FlaggedFlag, "$Label1"}, date, strings.NewReader(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(buf.String(), "\nFrom ") != 2 || !strings.Contains(buf.String(), "\n>>From there\n") {
+		t.Fatalf("Separators are not quoted correctly:\n%s", buf.String())
+	}
+
+	r := newMboxReader(&buf)
+	for i, exp := range expected {
+		flags, msgDate, body, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body.String() != exp {
+			t.Errorf("Wrong body of message %d: %q", i, body.String())
+		}
+		if !msgDate.Equal(date) {
+			t.Errorf("Wrong date of message %d: %v", i, msgDate)
+		}
+		if !reflect.DeepEqual(flags, []string{imap.SeenFlag, imap.FlaggedFlag, "$Label1"}) {
+			t.Errorf("Wrong flags of message %d: %v", i, flags)
+		}
+	}
+	if _, _, _, err := r.Next(); err != io.EOF {
+		t.Fatal("Expected EOF, got", err)
+	}
+}
+
+type testMsg struct {
+	Flags []string
+	Date  time.Time
+	Body  string
+}
+
+func dumpAccount(t *testing.T, u backend.User) (map[string][]testMsg, []archiveMailbox) {
+	t.Helper()
+	src := userArchive{u: u}
+	mboxes, err := src.Mailboxes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := map[string][]testMsg{}
+	for _, mbox := range mboxes {
+		err := src.Messages(mbox.Name, func(msg *archiveMessage) error {
+			body, err := io.ReadAll(msg.Body)
+			if err != nil {
+				return err
+			}
+			sort.Strings(msg.Flags)
+			contents[mbox.Name] = append(contents[mbox.Name], testMsg{
+				Flags: msg.Flags,
+				Date:  msg.Date.UTC(),
+				Body:  string(body),
+			})
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return contents, mboxes
+}
+
+func TestExportImport(t *testing.T) {
+	dir := testutils.Dir(t)
+	src, err := maildir.OpenDir(filepath.Join(dir, "src"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Sent", "Archive.2023"} {
+		if err := src.CreateMailbox(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := src.SetSubscribed("Archive.2023", true); err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2021, 5, 6, 7, 8, 9, 0, time.UTC)
+	add := func(mbox string, flags []string, body string) {
+		if err := src.CreateMessage(mbox, flags, date, bytes.NewReader([]byte(body)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add(imap.InboxName, []string{imap.SeenFlag, "$Important"}, "Subject: one\r\n\r\nFrom me\r\n")
+	add(imap.InboxName, nil, "Subject: two\r\n\r\nHello\r\n")
+	add("Sent", []string{imap.SeenFlag, imap.AnsweredFlag}, "Subject: three\r\n\r\nBye\r\n")
+	add("Archive.2023", []string{imap.DeletedFlag}, "Subject: four\r\n\r\nOld\r\n")
+
+	expected, expectedMboxes := dumpAccount(t, src)
+
+	for _, format := range []string{"mbox", "maildir"} {
+		format := format
+		t.Run(format, func(t *testing.T) {
+			archive := filepath.Join(dir, format)
+			stats, err := exportAccount(src, archive, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Messages != 4 || stats.Mailboxes != 4 {
+				t.Fatalf("Wrong export stats: %+v", stats)
+			}
+
+			dst, err := maildir.OpenDir(filepath.Join(dir, format+"-dst"), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := importAccount(dst, archive, ""); err != nil {
+				t.Fatal(err)
+			}
+
+			actual, actualMboxes := dumpAccount(t, dst)
+			if !reflect.DeepEqual(actualMboxes, expectedMboxes) {
+				t.Errorf("Wrong mailboxes after import:\n%+v\n%+v", actualMboxes, expectedMboxes)
+			}
+			if !reflect.DeepEqual(actual, expected) {
+				t.Errorf("Wrong messages after import:\n%+v\n%+v", actual, expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "bayes",
+			Usage: "Bayesian spam classifier management",
+			Subcommands: []*cli.Command{
+				{
+					Name:      "train",
+					Usage:     "Train the classifier using existing messages",
+					ArgsUsage: "PATH...",
+					Description: `Add messages from mbox files or Maildir folders to the classifier model.
+
+Each PATH is either an mbox file or a Maildir folder (directory containing
+cur and new subdirectories). All messages are considered to be of the class
+specified using --spam or --ham flag.
+
+If --user is specified, the per-recipient model of that user is trained
+in addition to the global model (check.bayes with per_recipient enabled).
+
+Any module that supports learning from user actions (e.g. check.rspamd) can
+be trained this way too.
+`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_bayes",
+						},
+						&cli.BoolFlag{
+							Name:  "spam",
+							Usage: "Messages are spam",
+						},
+						&cli.BoolFlag{
+							Name:  "ham",
+							Usage: "Messages are not spam",
+						},
+						&cli.StringFlag{
+							Name:  "user",
+							Usage: "Train the per-recipient model of the user",
+						},
+						&cli.BoolFlag{
+							Name:    "quiet",
+							Aliases: []string{"q"},
+							Usage:   "Do not print the summary",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						learner, err := openSpamLearner(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(learner)
+						return bayesTrain(learner, ctx)
+					},
+				},
+			},
+		})
+}
+
+func openSpamLearner(ctx *cli.Context) (module.SpamLearner, error) {
+	globals, mod, err := getCfgBlockModule(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	learner, ok := mod.Instance.(module.SpamLearner)
+	if !ok {
+		return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s does not support learning", ctx.String("cfg-block")), 2)
+	}
+
+	if err := mod.Instance.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+
+	return learner, nil
+}
+
+// trainMessages submits all messages from the mbox file or Maildir folder
+// to the learner. The amount of submitted messages is returned.
+func trainMessages(ctx context.Context, learner module.SpamLearner, user string, spam bool, path string) (int, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	learn := func(msg buffer.Buffer) error {
+		if err := learner.Learn(ctx, user, spam, msg); err != nil {
+			return err
+		}
+		count++
+		return nil
+	}
+
+	if !info.IsDir() {
+		f, err := os.Open(path)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		r := newMboxReader(f)
+		for {
+			_, _, body, err := r.Next()
+			if err != nil {
+				if err == io.EOF {
+					return count, nil
+				}
+				return count, err
+			}
+			if err := learn(buffer.MemoryBuffer{Slice: body.Bytes()}); err != nil {
+				return count, err
+			}
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(path, "cur")); err != nil {
+		return 0, fmt.Errorf("%s: not a Maildir folder", path)
+	}
+	for _, sub := range []string{"cur", "new"} {
+		entries, err := os.ReadDir(filepath.Join(path, sub))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return count, err
+		}
+		for _, e := range entries {
+			if e.IsDir() || e.Name()[0] == '.' {
+				continue
+			}
+			body, err := os.ReadFile(filepath.Join(path, sub, e.Name()))
+			if err != nil {
+				return count, err
+			}
+			if err := learn(buffer.MemoryBuffer{Slice: body}); err != nil {
+				return count, fmt.Errorf("%s: %w", e.Name(), err)
+			}
+		}
+	}
+	return count, nil
+}
+
+func bayesTrain(learner module.SpamLearner, ctx *cli.Context) error {
+	if ctx.NArg() == 0 {
+		return cli.Exit("Error: at least one PATH is required", 2)
+	}
+	spam, ham := ctx.Bool("spam"), ctx.Bool("ham")
+	if spam == ham {
+		return cli.Exit("Error: exactly one of --spam and --ham is required", 2)
+	}
+
+	total := 0
+	for _, path := range ctx.Args().Slice() {
+		n, err := trainMessages(context.Background(), learner, ctx.String("user"), spam, path)
+		total += n
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	if !ctx.Bool("quiet") {
+		class := "ham"
+		if spam {
+			class = "spam"
+		}
+		fmt.Fprintf(os.Stderr, "Trained %d messages as %s.\n", total, class)
+	}
+	return nil
+}
@@ -0,0 +1,452 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+	"github.com/foxcpp/maddy/framework/module"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "blob",
+			Usage: "Message bodies storage management",
+			Description: `These subcommands operate on message bodies stored in msg_store
+of the IMAP storage backend.
+
+The corresponding storage backend should be configured in maddy.conf and be
+defined in a top-level configuration block. By default, the name of that
+block should be local_mailboxes but this can be changed using --cfg-block
+flag for subcommands.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "reencrypt",
+					Usage: "Encrypt stored message bodies using the active key",
+					Description: `Rewrite message bodies that are encrypted using a key other than the
+active_key of storage.blob.crypto.
+
+This can be used after a new key is added and made active to stop using old
+keys. Objects already encrypted using the active key are skipped, so the
+command can be interrupted and started again. It is safe to run while the
+server is running: new contents are written under a temporary key and then
+moved over the original object, so messages stay readable. This requires
+msg_store that can replace objects atomically (fs or s3).
+
+Old keys should be kept in the configuration until the command completes
+without errors.
+`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.IntFlag{
+							Name:  "jobs",
+							Usage: "Amount of objects to process in parallel",
+							Value: 4,
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return blobReencrypt(be, ctx)
+					},
+				},
+				{
+					Name:  "migrate",
+					Usage: "Copy message bodies to another blob store",
+					Description: `Copy message bodies referenced by the IMAP storage to another blob store
+and verify their checksums.
+
+Source and destination stores should be defined in top-level configuration
+blocks and are specified using their names. If --from is not specified, the
+msg_store of the IMAP storage is used.
+
+Objects that are already present in the destination store with the same
+checksum are skipped, so the command can be interrupted and started again.
+New messages may be delivered while the command is running, so it should be
+run again after the server is stopped and before the configuration is
+changed.
+
+With --cutover, the change to the msg_store directive in the IMAP storage
+configuration block needed to switch to the destination store is printed if
+all objects were copied successfully. Configuration file is not modified.
+`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.StringFlag{
+							Name:  "from",
+							Usage: "Configuration block of the source blob store",
+						},
+						&cli.StringFlag{
+							Name:     "to",
+							Usage:    "Configuration block of the destination blob store",
+							Required: true,
+						},
+						&cli.IntFlag{
+							Name:  "jobs",
+							Usage: "Amount of objects to process in parallel",
+							Value: 4,
+						},
+						&cli.BoolFlag{
+							Name:  "cutover",
+							Usage: "Print msg_store directive change after successful migration",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return blobMigrate(be, ctx)
+					},
+				},
+			},
+		})
+}
+
+// BlobStorage is implemented by storage backends that keep message bodies
+// in a module.BlobStore.
+type BlobStorage interface {
+	BlobStore() module.BlobStore
+	BlobKeys(ctx context.Context) ([]string, error)
+}
+
+func blobReencrypt(be module.Storage, ctx *cli.Context) error {
+	blobBe, ok := be.(BlobStorage)
+	if !ok {
+		return cli.Exit("Error: storage backend does not use a blob store for message bodies", 2)
+	}
+	store, ok := blobBe.BlobStore().(module.ReencryptableBlobStore)
+	if !ok {
+		return cli.Exit("Error: msg_store does not support re-encryption", 2)
+	}
+	jobs := ctx.Int("jobs")
+	if jobs < 1 {
+		return cli.Exit("Error: --jobs should be at least 1", 2)
+	}
+
+	keys, err := blobBe.BlobKeys(context.Background())
+	if err != nil {
+		return err
+	}
+
+	var (
+		keysCh      = make(chan string)
+		wg          sync.WaitGroup
+		lock        sync.Mutex
+		rewritten   int
+		failed      int
+		unsupported error
+	)
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keysCh {
+				didRewrite, err := store.Reencrypt(context.Background(), key)
+
+				lock.Lock()
+				switch {
+				case errors.Is(err, module.ErrNotReencryptable):
+					unsupported = err
+				case err != nil:
+					fmt.Fprintf(os.Stderr, "Failed to re-encrypt %s: %v\n", key, err)
+					failed++
+				case didRewrite:
+					rewritten++
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	for _, key := range keys {
+		lock.Lock()
+		stop := unsupported != nil
+		lock.Unlock()
+		if stop {
+			break
+		}
+		keysCh <- key
+	}
+	close(keysCh)
+	wg.Wait()
+
+	if unsupported != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", unsupported), 2)
+	}
+	if !ctx.Bool("quiet") {
+		fmt.Fprintf(os.Stderr, "Re-encrypted %d of %d objects.\n", rewritten, len(keys))
+	}
+	if failed != 0 {
+		return cli.Exit(fmt.Sprintf("Error: failed to re-encrypt %d objects", failed), 1)
+	}
+	return nil
+}
+
+func blobStoreFromBlock(name string) (module.BlobStore, error) {
+	mod, err := module.GetInstance(name)
+	if err != nil {
+		return nil, err
+	}
+	store, ok := mod.(module.BlobStore)
+	if !ok {
+		return nil, fmt.Errorf("configuration block %s is not a blob store", name)
+	}
+	return store, nil
+}
+
+func blobChecksum(ctx context.Context, store module.BlobStore, key string) ([]byte, error) {
+	r, err := store.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// migrateBlob copies the object from one store to another unless it is
+// already there. It reports whether the object was copied.
+func migrateBlob(ctx context.Context, from, to module.BlobStore, key string, mayExist bool) (bool, error) {
+	if mayExist {
+		// Any error (e.g. missing object) means the object should be copied.
+		dstSum, err := blobChecksum(ctx, to, key)
+		if err == nil {
+			srcSum, err := blobChecksum(ctx, from, key)
+			if err != nil {
+				return false, err
+			}
+			if bytes.Equal(srcSum, dstSum) {
+				return false, nil
+			}
+		}
+	}
+
+	r, err := from.Open(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	b, err := to.Create(ctx, key, module.UnknownBlobSize)
+	if err != nil {
+		return false, err
+	}
+
+	// Close without Sync discards partially written data.
+	h := sha256.New()
+	if _, err := io.Copy(b, io.TeeReader(r, h)); err != nil {
+		b.Close()
+		return false, err
+	}
+	if err := b.Sync(); err != nil {
+		b.Close()
+		return false, err
+	}
+	if err := b.Close(); err != nil {
+		return false, err
+	}
+
+	dstSum, err := blobChecksum(ctx, to, key)
+	if err != nil {
+		return false, fmt.Errorf("verify: %w", err)
+	}
+	if !bytes.Equal(h.Sum(nil), dstSum) {
+		return false, errors.New("verify: checksum mismatch")
+	}
+	return true, nil
+}
+
+func blobMigrate(be module.Storage, ctx *cli.Context) error {
+	blobBe, ok := be.(BlobStorage)
+	if !ok {
+		return cli.Exit("Error: storage backend does not use a blob store for message bodies", 2)
+	}
+	jobs := ctx.Int("jobs")
+	if jobs < 1 {
+		return cli.Exit("Error: --jobs should be at least 1", 2)
+	}
+
+	from := blobBe.BlobStore()
+	if name := ctx.String("from"); name != "" {
+		var err error
+		from, err = blobStoreFromBlock(name)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Error: %v", err), 2)
+		}
+	}
+	to, err := blobStoreFromBlock(ctx.String("to"))
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 2)
+	}
+
+	keys, err := blobBe.BlobKeys(context.Background())
+	if err != nil {
+		return err
+	}
+
+	// If the destination store can be listed, objects that are not there
+	// are copied without reading them twice.
+	existing := map[string]struct{}{}
+	err = module.ListBlobs(context.Background(), to, func(key string, _ time.Time) error {
+		existing[key] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		if !errors.Is(err, module.ErrNotListable) {
+			return err
+		}
+		existing = nil
+	}
+
+	var (
+		keysCh = make(chan string)
+		wg     sync.WaitGroup
+		lock   sync.Mutex
+		copied int
+		failed int
+	)
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keysCh {
+				mayExist := true
+				if existing != nil {
+					_, mayExist = existing[key]
+				}
+				didCopy, err := migrateBlob(context.Background(), from, to, key, mayExist)
+
+				lock.Lock()
+				switch {
+				case err != nil:
+					fmt.Fprintf(os.Stderr, "Failed to copy %s: %v\n", key, err)
+					failed++
+				case didCopy:
+					copied++
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	for _, key := range keys {
+		keysCh <- key
+	}
+	close(keysCh)
+	wg.Wait()
+
+	if !ctx.Bool("quiet") {
+		fmt.Fprintf(os.Stderr, "Copied %d of %d objects.\n", copied, len(keys))
+	}
+	if failed != 0 {
+		return cli.Exit(fmt.Sprintf("Error: failed to copy %d objects", failed), 1)
+	}
+
+	if ctx.Bool("cutover") {
+		change, err := msgStoreCutover(ctx.String("config"), ctx.String("cfg-block"), ctx.String("to"))
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+		}
+		fmt.Println(change)
+	}
+	return nil
+}
+
+// msgStoreCutover describes the change to the configuration needed to make
+// cfgBlock use storeBlock as msg_store.
+//
+// Configuration is not rewritten automatically since it may be split across
+// imported files and use macros or snippets.
+func msgStoreCutover(cfgPath, cfgBlock, storeBlock string) (string, error) {
+	f, err := os.Open(cfgPath)
+	if err != nil {
+		return "", err
+	}
+	nodes, err := parser.Read(f, f.Name())
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+
+	// Blocks are matched the same way as module instances are named,
+	// see RegisterModules.
+	var matches []*parser.Node
+	for i, n := range nodes {
+		if module.GetEndpoint(n.Name) != nil {
+			// Arguments are listen addresses, not names.
+			continue
+		}
+		names := n.Args
+		if len(names) == 0 {
+			names = []string{n.Name}
+		}
+		for _, name := range names {
+			if name == cfgBlock {
+				matches = append(matches, &nodes[i])
+				break
+			}
+		}
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("unknown configuration block: %s", cfgBlock)
+	}
+	if len(matches) > 1 {
+		return "", fmt.Errorf("%s:%d: configuration block name %s is ambiguous, also used at %s:%d",
+			matches[0].File, matches[0].Line, cfgBlock, matches[1].File, matches[1].Line)
+	}
+	block := matches[0]
+
+	directive := "msg_store &" + storeBlock
+	for _, child := range block.Children {
+		if child.Name == "msg_store" {
+			return fmt.Sprintf("%s:%d: replace msg_store directive with: %s", child.File, child.Line, directive), nil
+		}
+	}
+	return fmt.Sprintf("%s:%d: add to %s block: %s", block.File, block.Line, cfgBlock, directive), nil
+}
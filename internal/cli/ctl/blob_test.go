@@ -0,0 +1,87 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestMsgStoreCutover(t *testing.T) {
+	dir := testutils.Dir(t)
+	cfgPath := filepath.Join(dir, "maddy.conf")
+	cfg := `storage.blob.fs new_store {
+	root /tmp/messages
+}
+storage.imapsql local_mailboxes mboxes {
+	driver sqlite3
+	dsn imapsql.db
+	msg_store fs messages
+}
+storage.imapsql other_mailboxes {
+	driver sqlite3
+	dsn other.db
+}
+storage.imapsql dup {
+}
+table.static dup {
+}
+`
+	if err := os.WriteFile(cfgPath, []byte(cfg), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		block  string
+		change string
+		fail   bool
+	}{
+		{block: "local_mailboxes", change: cfgPath + ":7: replace msg_store directive with: msg_store &new_store"},
+		{block: "mboxes", change: cfgPath + ":7: replace msg_store directive with: msg_store &new_store"},
+		{block: "other_mailboxes", change: cfgPath + ":9: add to other_mailboxes block: msg_store &new_store"},
+		{block: "sqlite3", fail: true},
+		{block: "dup", fail: true},
+	} {
+		change, err := msgStoreCutover(cfgPath, tc.block, "new_store")
+		if tc.fail {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %q", tc.block, change)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.block, err)
+			continue
+		}
+		if change != tc.change {
+			t.Errorf("%s: unexpected change: %q", tc.block, change)
+		}
+	}
+
+	data, err := os.ReadFile(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != cfg {
+		t.Error("configuration file is modified")
+	}
+}
@@ -28,7 +28,7 @@ import (
 	"time"
 
 	"github.com/emersion/go-imap"
-	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/emersion/go-imap/backend"
 	"github.com/foxcpp/maddy/framework/module"
 	maddycli "github.com/foxcpp/maddy/internal/cli"
 	clitools2 "github.com/foxcpp/maddy/internal/cli/clitools"
@@ -409,6 +409,12 @@ func init() {
 	})
 }
 
+// DelMessagesMailbox is implemented by mailboxes that allow to remove
+// messages without setting the \Deleted flag first.
+type DelMessagesMailbox interface {
+	DelMessages(uid bool, seq *imap.SeqSet) error
+}
+
 func FormatAddress(addr *imap.Address) string {
 	return fmt.Sprintf("%s <%s@%s>", addr.PersonalName, addr.MailboxName, addr.HostName)
 }
@@ -625,8 +631,11 @@ func msgsRemove(be module.Storage, ctx *cli.Context) error {
 		}
 	}
 
-	mboxB := mbox.(*imapsql.Mailbox)
-	return mboxB.DelMessages(ctx.Bool("uid"), seq)
+	delMbox, ok := mbox.(DelMessagesMailbox)
+	if !ok {
+		return cli.Exit("Error: storage backend does not support messages removal", 2)
+	}
+	return delMbox.DelMessages(ctx.Bool("uid"), seq)
 }
 
 func msgsCopy(be module.Storage, ctx *cli.Context) error {
@@ -706,7 +715,10 @@ func msgsMove(be module.Storage, ctx *cli.Context) error {
 		return err
 	}
 
-	moveMbox := srcMbox.(*imapsql.Mailbox)
+	moveMbox, ok := srcMbox.(backend.MoveMailbox)
+	if !ok {
+		return cli.Exit("Error: storage backend does not support messages move", 2)
+	}
 
 	return moveMbox.MoveMessages(ctx.Bool("uid"), seq, tgtName)
 }
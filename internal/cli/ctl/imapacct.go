@@ -19,14 +19,21 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package ctl
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
 	"github.com/foxcpp/maddy/framework/module"
 	maddycli "github.com/foxcpp/maddy/internal/cli"
 	clitools2 "github.com/foxcpp/maddy/internal/cli/clitools"
+	"github.com/foxcpp/maddy/internal/storage/imapsql"
+	"github.com/foxcpp/maddy/internal/storage/maildir"
 	"github.com/urfave/cli/v2"
 )
 
@@ -181,10 +188,293 @@ APPENDLIMIT value (either global or per-account) cannot be larger than
 						return imapAcctAppendlimit(be, ctx)
 					},
 				},
+				{
+					Name:  "reindex",
+					Usage: "Update full-text search index",
+					Description: `Add messages that are not in the full-text search index yet to it.
+
+Normally, messages are indexed when they are delivered or appended. This
+command can be used to index messages stored before the index was enabled.
+With --rebuild, existing index entries are discarded and all messages
+are indexed again.
+
+If USERNAME is not specified, messages of all accounts are processed.
+`,
+					ArgsUsage: "[USERNAME]",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.BoolFlag{
+							Name:  "rebuild",
+							Usage: "Discard existing index entries",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return imapAcctReindex(be, ctx)
+					},
+				},
+				{
+					Name:  "fsck",
+					Usage: "Check consistency of message bodies storage",
+					Description: `Cross-reference messages in the database against objects in msg_store.
+
+Messages that refer to missing objects are reported. Messages whose objects
+could not be checked due to other msg_store errors are reported separately
+as unreadable. In both cases, the exit status is 1. If msg_store supports
+listing, objects not referenced by any message are reported as well if
+they were written more than --grace-period ago. With --delete-orphans, such
+objects are removed.
+
+Stores that do not track modification time of objects (such as table-based
+stores) report unreferenced objects only if --grace-period is 0. Do not use
+--delete-orphans with zero grace period while the server is running.
+
+With --summary, results are written to the specified file in JSON format
+(use - for standard output).
+`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.DurationFlag{
+							Name:  "grace-period",
+							Usage: "Minimal age of unreferenced objects to report",
+							Value: 24 * time.Hour,
+						},
+						&cli.BoolFlag{
+							Name:  "delete-orphans",
+							Usage: "Remove unreferenced objects",
+						},
+						&cli.StringFlag{
+							Name:  "summary",
+							Usage: "Write results in JSON format to the file",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return imapAcctFsck(be, ctx)
+					},
+				},
+				{
+					Name:  "retention",
+					Usage: "Remove old messages according to retention rules",
+					Description: `Apply retention rules configured for the storage.
+
+Messages placed in the mailbox earlier than the maximum age set for it are
+removed and connected IMAP clients are notified. Age is counted from the
+time a run first found the message in the mailbox, so new messages are
+not counted until a run without --dry-run records them.
+With --dry-run, messages are only counted.
+
+If USERNAME is not specified, all accounts are processed. Accounts that
+fail are reported and skipped.
+`,
+					ArgsUsage: "[USERNAME]",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.BoolFlag{
+							Name:  "dry-run",
+							Usage: "Only show messages that would be removed",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return imapAcctRetention(be, ctx)
+					},
+				},
+				{
+					Name:  "export",
+					Usage: "Export all mailboxes of the account",
+					Description: `Write all mailboxes of the account into the directory DIR.
+
+With --format mbox (default), each mailbox is written into a separate mbox
+file, nested mailboxes are placed into subdirectories (Archive.2023 is
+written to Archive/2023.mbox). Flags are stored in Status, X-Status and
+X-Keywords header fields, internal date is stored in the From_ line.
+
+With --format maildir, DIR is a Maildir++ directory compatible with
+Dovecot and storage.maildir.
+
+Subscriptions and special-use attributes of mailboxes are additionally
+written into mailboxes.json in DIR. DIR should not exist or be empty.
+Messages are read from the storage one at a time.
+`,
+					ArgsUsage: "USERNAME DIR",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.StringFlag{
+							Name:  "format",
+							Usage: "Archive format to use (mbox or maildir)",
+							Value: "mbox",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return imapAcctExport(be, ctx)
+					},
+				},
+				{
+					Name:  "import",
+					Usage: "Import mailboxes into the account",
+					Description: `Add messages from the archive at PATH to the account.
+
+PATH can be a directory created using 'imap-acct export', a Maildir++
+directory, a directory with .mbox files or a single mbox file. In the last
+case, messages are added to INBOX. The format is detected automatically
+unless --format is specified.
+
+Missing mailboxes are created. If mailboxes.json is present in the archive,
+it is used to restore subscriptions and special-use attributes. Messages
+are added to the existing ones, running the command twice will result in
+duplicate messages.
+`,
+					ArgsUsage: "USERNAME PATH",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.StringFlag{
+							Name:  "format",
+							Usage: "Archive format (mbox or maildir)",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return imapAcctImport(be, ctx)
+					},
+				},
+				{
+					Name:  "migrate",
+					Usage: "Copy messages from another IMAP server",
+					Description: `Copy all mailboxes of the account from the IMAP server specified using --host.
+
+Mailboxes, flags, internal dates, subscriptions and special-use attributes
+are copied. Hierarchy delimiter of the source server is replaced with the
+one used by the storage.
+
+The command can be run multiple times, only messages added to the source
+server since the previous run are copied. UIDVALIDITY and the last copied
+UID of each mailbox are stored in the file specified by --state (by default,
+imap_migrate/USERNAME.json in the state directory). If UIDVALIDITY of a
+source mailbox changes, all its messages are copied again. Flag changes of
+already copied messages are not synchronized.
+
+By default, the source server is authenticated to as USERNAME using
+LOGIN command. Use --user to specify a different username. If --admin-user is
+specified, the password is checked for that user and SASL PLAIN
+authorization identity is used to access the mailbox of --user (master user
+login).
+`,
+					ArgsUsage: "USERNAME",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.StringFlag{
+							Name:  "host",
+							Usage: "Address of the source server (host:port)",
+						},
+						&cli.StringFlag{
+							Name:  "tls",
+							Usage: "TLS mode to use for the source server (implicit, starttls or none)",
+							Value: "implicit",
+						},
+						&cli.BoolFlag{
+							Name:  "tls-insecure",
+							Usage: "Do not verify the source server certificate",
+						},
+						&cli.StringFlag{
+							Name:  "user",
+							Usage: "Username on the source server (defaults to USERNAME)",
+						},
+						&cli.StringFlag{
+							Name:  "admin-user",
+							Usage: "Authenticate as this user and access the mailbox of --user",
+						},
+						&cli.StringFlag{
+							Name:    "password",
+							Aliases: []string{"p"},
+							Usage:   "Use `PASSWORD` for the source server instead of reading it from stdin.\n\t\tWARNING: Provided only for debugging convenience. Don't leave your passwords in shell history!",
+							EnvVars: []string{"MADDY_MIGRATE_PASSWORD"},
+						},
+						&cli.StringFlag{
+							Name:  "state",
+							Usage: "File to store migration state in",
+						},
+						&cli.StringSliceFlag{
+							Name:  "exclude",
+							Usage: "Do not copy the mailbox (name on the source server)",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return imapAcctMigrate(be, ctx)
+					},
+				},
 			},
 		})
 }
 
+type FsckStorage interface {
+	Fsck(ctx context.Context, opts imapsql.FsckOptions) (*imapsql.FsckReport, error)
+}
+
+type RetentionStorage interface {
+	ApplyRetention(ctx context.Context, accountName string, dryRun bool) (*imapsql.RetentionReport, error)
+}
+
+type FTSIndexedStorage interface {
+	ReindexFTS(ctx context.Context, accountName string, rebuild bool) (int, error)
+}
+
 type SpecialUseUser interface {
 	CreateMailboxSpecial(name, specialUseAttr string) error
 }
@@ -290,3 +580,231 @@ func imapAcctRemove(be module.Storage, ctx *cli.Context) error {
 
 	return mbe.DeleteIMAPAcct(username)
 }
+
+func imapAcctReindex(be module.Storage, ctx *cli.Context) error {
+	ftsBe, ok := be.(FTSIndexedStorage)
+	if !ok {
+		return cli.Exit("Error: storage backend does not support full-text search index", 2)
+	}
+
+	indexed, err := ftsBe.ReindexFTS(context.Background(), ctx.Args().First(), ctx.Bool("rebuild"))
+	if err != nil {
+		return err
+	}
+
+	if !ctx.Bool("quiet") {
+		fmt.Fprintf(os.Stderr, "Indexed %d messages.\n", indexed)
+	}
+	return nil
+}
+
+func imapAcctRetention(be module.Storage, ctx *cli.Context) error {
+	retBe, ok := be.(RetentionStorage)
+	if !ok {
+		return cli.Exit("Error: storage backend does not support retention rules", 2)
+	}
+
+	report, err := retBe.ApplyRetention(context.Background(), ctx.Args().First(), ctx.Bool("dry-run"))
+	if report != nil {
+		for _, e := range report.Entries {
+			fmt.Printf("%s %s: %d messages (%s)\n", e.Account, e.Mailbox, e.Messages, e.Rule)
+		}
+		if !ctx.Bool("quiet") {
+			if report.DryRun {
+				total := 0
+				for _, e := range report.Entries {
+					total += e.Messages
+				}
+				fmt.Fprintf(os.Stderr, "%d messages would be removed.\n", total)
+			} else {
+				fmt.Fprintf(os.Stderr, "Removed %d messages.\n", report.Expunged)
+			}
+		}
+		if err == nil && report.Failed != 0 {
+			return cli.Exit(fmt.Sprintf("Error: failed to apply retention rules to %d accounts", report.Failed), 1)
+		}
+	}
+	return err
+}
+
+func imapAcctFsck(be module.Storage, ctx *cli.Context) error {
+	fsckBe, ok := be.(FsckStorage)
+	if !ok {
+		return cli.Exit("Error: storage backend does not support consistency checks", 2)
+	}
+
+	report, err := fsckBe.Fsck(context.Background(), imapsql.FsckOptions{
+		GracePeriod:   ctx.Duration("grace-period"),
+		DeleteOrphans: ctx.Bool("delete-orphans"),
+	})
+	if err != nil {
+		return err
+	}
+
+	if path := ctx.String("summary"); path != "" {
+		out := os.Stdout
+		if path != "-" {
+			out, err = os.Create(path)
+			if err != nil {
+				return err
+			}
+			defer out.Close()
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		for _, m := range report.Missing {
+			fmt.Printf("missing: %s %s %d %s\n", m.Account, m.Mailbox, m.UID, m.Key)
+		}
+		for _, m := range report.Unreadable {
+			fmt.Printf("unreadable: %s %s %d %s\n", m.Account, m.Mailbox, m.UID, m.Key)
+		}
+		for _, key := range report.Orphans {
+			fmt.Printf("orphan: %s\n", key)
+		}
+	}
+
+	if !ctx.Bool("quiet") {
+		if !report.Listing {
+			fmt.Fprintln(os.Stderr, "msg_store does not support listing, unreferenced objects were not checked.")
+		}
+		fmt.Fprintf(os.Stderr, "Checked %d messages: %d missing bodies, %d unreadable bodies, %d unreferenced objects, %d deleted.\n",
+			report.Messages, len(report.Missing), len(report.Unreadable), len(report.Orphans), report.Deleted)
+	}
+	if len(report.Missing) != 0 || len(report.Unreadable) != 0 {
+		return cli.Exit("", 1)
+	}
+	return nil
+}
+
+func imapAcctExport(be module.Storage, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+	dir := ctx.Args().Get(1)
+	if dir == "" {
+		return cli.Exit("Error: DIR is required", 2)
+	}
+
+	u, err := be.GetIMAPAcct(username)
+	if err != nil {
+		return err
+	}
+
+	stats, err := exportAccount(u, dir, ctx.String("format"))
+	if err != nil {
+		return err
+	}
+
+	if !ctx.Bool("quiet") {
+		fmt.Fprintf(os.Stderr, "Exported %d messages from %d mailboxes.\n", stats.Messages, stats.Mailboxes)
+	}
+	return nil
+}
+
+func exportAccount(u backend.User, dir, format string) (archiveStats, error) {
+	if ents, err := os.ReadDir(dir); err == nil && len(ents) != 0 {
+		return archiveStats{}, cli.Exit(fmt.Sprintf("Error: %s is not empty", dir), 2)
+	}
+
+	var dst accountWriter
+	switch format {
+	case "mbox":
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return archiveStats{}, err
+		}
+		dst = mboxArchive{dir: dir}
+	case "maildir":
+		mu, err := maildir.OpenDir(dir, true)
+		if err != nil {
+			return archiveStats{}, err
+		}
+		dst = userArchive{u: mu}
+	default:
+		return archiveStats{}, cli.Exit(fmt.Sprintf("Error: unknown archive format: %s", format), 2)
+	}
+
+	src := userArchive{u: u}
+	mboxes, err := src.Mailboxes()
+	if err != nil {
+		return archiveStats{}, err
+	}
+	if err := writeArchiveManifest(dir, mboxes); err != nil {
+		return archiveStats{}, err
+	}
+
+	return copyAccount(src, dst, mboxes)
+}
+
+func imapAcctImport(be module.Storage, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+	path := ctx.Args().Get(1)
+	if path == "" {
+		return cli.Exit("Error: PATH is required", 2)
+	}
+
+	u, err := be.GetIMAPAcct(username)
+	if err != nil {
+		return err
+	}
+
+	stats, err := importAccount(u, path, ctx.String("format"))
+	if err != nil {
+		return err
+	}
+
+	if !ctx.Bool("quiet") {
+		fmt.Fprintf(os.Stderr, "Imported %d messages into %d mailboxes.\n", stats.Messages, stats.Mailboxes)
+	}
+	return nil
+}
+
+func importAccount(u backend.User, path, format string) (archiveStats, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return archiveStats{}, err
+	}
+	if format == "" {
+		format = "mbox"
+		if _, err := os.Stat(filepath.Join(path, "cur")); err == nil {
+			format = "maildir"
+		}
+	}
+
+	var src accountReader
+	switch format {
+	case "mbox":
+		src = mboxArchive{dir: path, single: !info.IsDir()}
+	case "maildir":
+		mu, err := maildir.OpenDir(path, false)
+		if err != nil {
+			return archiveStats{}, err
+		}
+		src = userArchive{u: mu}
+	default:
+		return archiveStats{}, cli.Exit(fmt.Sprintf("Error: unknown archive format: %s", format), 2)
+	}
+
+	var mboxes []archiveMailbox
+	if info.IsDir() {
+		mboxes, err = readArchiveManifest(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return archiveStats{}, err
+		}
+	}
+	if mboxes == nil {
+		mboxes, err = src.Mailboxes()
+		if err != nil {
+			return archiveStats{}, err
+		}
+	}
+
+	return copyAccount(src, userArchive{u: u}, mboxes)
+}
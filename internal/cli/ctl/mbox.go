@@ -0,0 +1,302 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// Messages are written in mboxrd format: lines that look like a message
+// separator (optionally quoted already) get one more '>' prepended.
+// Flags are stored in Status, X-Status and X-Keywords header fields
+// understood by most mbox-based software. Internal date is stored in the
+// From_ line.
+
+const mboxDateLayout = "Mon Jan _2 15:04:05 2006"
+
+var mboxFlagLetters = []struct {
+	flag   string
+	letter byte
+	xstat  bool
+}{
+	{imap.SeenFlag, 'R', false},
+	{imap.AnsweredFlag, 'A', true},
+	{imap.FlaggedFlag, 'F', true},
+	{imap.DraftFlag, 'T', true},
+	{imap.DeletedFlag, 'D', true},
+}
+
+// isMboxMetaField reports whether the header line starts a field that
+// stores mbox metadata and should not be copied as a part of the message.
+func isMboxMetaField(line []byte) bool {
+	colon := bytes.IndexByte(line, ':')
+	if colon == -1 {
+		return false
+	}
+	switch strings.ToLower(string(line[:colon])) {
+	case "status", "x-status", "x-keywords":
+		return true
+	}
+	return false
+}
+
+func isMboxFromLine(line []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From "))
+}
+
+type mboxWriter struct {
+	w *bufio.Writer
+}
+
+func newMboxWriter(w io.Writer) *mboxWriter {
+	return &mboxWriter{w: bufio.NewWriter(w)}
+}
+
+func (w *mboxWriter) WriteMessage(flags []string, date time.Time, body io.Reader) error {
+	if date.IsZero() {
+		date = time.Now()
+	}
+	if _, err := w.w.WriteString("From MAILER-DAEMON " + date.UTC().Format(mboxDateLayout) + "\n"); err != nil {
+		return err
+	}
+
+	status := []byte{}
+	xstatus := []byte{}
+	var keywords []string
+	for _, f := range flags {
+		known := false
+		for _, l := range mboxFlagLetters {
+			if strings.EqualFold(f, l.flag) {
+				if l.xstat {
+					xstatus = append(xstatus, l.letter)
+				} else {
+					status = append(status, l.letter)
+				}
+				known = true
+				break
+			}
+		}
+		if !known && !strings.HasPrefix(f, "\\") {
+			keywords = append(keywords, f)
+		}
+	}
+	// Imported messages are not new.
+	status = append(status, 'O')
+	w.w.WriteString("Status: " + string(status) + "\n")
+	if len(xstatus) != 0 {
+		w.w.WriteString("X-Status: " + string(xstatus) + "\n")
+	}
+	if len(keywords) != 0 {
+		w.w.WriteString("X-Keywords: " + strings.Join(keywords, " ") + "\n")
+	}
+
+	r := bufio.NewReader(body)
+	inHeader := true
+	skipField := false
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) != 0 {
+			line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+
+			if inHeader {
+				if len(line) == 0 {
+					inHeader = false
+				} else if line[0] == ' ' || line[0] == '\t' {
+					if skipField {
+						continue
+					}
+				} else {
+					skipField = isMboxMetaField(line)
+					if skipField {
+						continue
+					}
+				}
+			}
+
+			if isMboxFromLine(line) {
+				w.w.WriteByte('>')
+			}
+			w.w.Write(line)
+			if _, err := w.w.WriteString("\n"); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return err
+		}
+	}
+	// Empty line separating messages.
+	_, err := w.w.WriteString("\n")
+	return err
+}
+
+func (w *mboxWriter) Flush() error {
+	return w.w.Flush()
+}
+
+type mboxReader struct {
+	r *bufio.Reader
+
+	// The From_ line of the next message, if it was already read.
+	fromLine []byte
+	eof      bool
+}
+
+func newMboxReader(r io.Reader) *mboxReader {
+	return &mboxReader{r: bufio.NewReader(r)}
+}
+
+func (r *mboxReader) readLine() ([]byte, error) {
+	line, err := r.r.ReadBytes('\n')
+	if err != nil && (!errors.Is(err, io.EOF) || len(line) == 0) {
+		return nil, err
+	}
+	return bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r")), nil
+}
+
+func parseMboxDate(fromLine []byte) time.Time {
+	// From sender Mon Jan _2 15:04:05 2006 [extra]
+	fields := strings.Fields(string(fromLine))
+	if len(fields) < 7 {
+		return time.Time{}
+	}
+	date, err := time.Parse(mboxDateLayout, strings.Join(fields[2:7], " "))
+	if err != nil {
+		return time.Time{}
+	}
+	return date
+}
+
+func parseMboxFlags(status, xstatus, keywords string) []string {
+	flags := []string{}
+	for _, l := range mboxFlagLetters {
+		if l.xstat && strings.IndexByte(xstatus, l.letter) != -1 ||
+			!l.xstat && strings.IndexByte(status, l.letter) != -1 {
+			flags = append(flags, l.flag)
+		}
+	}
+	for _, kw := range strings.FieldsFunc(keywords, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == ','
+	}) {
+		flags = append(flags, kw)
+	}
+	return flags
+}
+
+// Next reads the next message. Message body is returned with CRLF line
+// endings and without mbox metadata fields. io.EOF is returned if there
+// are no more messages.
+func (r *mboxReader) Next() (flags []string, date time.Time, body *bytes.Buffer, err error) {
+	for r.fromLine == nil {
+		if r.eof {
+			return nil, time.Time{}, nil, io.EOF
+		}
+		line, err := r.readLine()
+		if err != nil {
+			return nil, time.Time{}, nil, err
+		}
+		if bytes.HasPrefix(line, []byte("From ")) {
+			r.fromLine = line
+		}
+	}
+
+	date = parseMboxDate(r.fromLine)
+	r.fromLine = nil
+
+	var (
+		status, xstatus, keywords string
+		metaField                 *string
+		pendingEmpty              = 0
+		inHeader                  = true
+	)
+	body = &bytes.Buffer{}
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				return nil, time.Time{}, nil, err
+			}
+			r.eof = true
+			break
+		}
+		if bytes.HasPrefix(line, []byte("From ")) {
+			r.fromLine = line
+			break
+		}
+
+		if inHeader {
+			switch {
+			case len(line) == 0:
+				inHeader = false
+			case line[0] == ' ' || line[0] == '\t':
+				if metaField != nil {
+					*metaField += " " + strings.TrimSpace(string(line))
+					continue
+				}
+			default:
+				metaField = nil
+				if isMboxMetaField(line) {
+					colon := bytes.IndexByte(line, ':')
+					value := strings.TrimSpace(string(line[colon+1:]))
+					switch strings.ToLower(string(line[:colon])) {
+					case "status":
+						metaField = &status
+					case "x-status":
+						metaField = &xstatus
+					case "x-keywords":
+						metaField = &keywords
+					}
+					*metaField += value
+					continue
+				}
+			}
+		}
+
+		// Empty lines are delayed so the one separating messages is not
+		// included into the message.
+		if len(line) == 0 && !inHeader {
+			pendingEmpty++
+			continue
+		}
+		for ; pendingEmpty > 0; pendingEmpty-- {
+			body.WriteString("\r\n")
+		}
+		if isMboxFromLine(line) {
+			line = line[1:]
+		}
+		body.Write(line)
+		body.WriteString("\r\n")
+	}
+	// The last empty line separates messages.
+	for ; pendingEmpty > 1; pendingEmpty-- {
+		body.WriteString("\r\n")
+	}
+
+	return parseMboxFlags(status, xstatus, keywords), date, body, nil
+}
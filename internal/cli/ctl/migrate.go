@@ -0,0 +1,416 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-sasl"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	clitools2 "github.com/foxcpp/maddy/internal/cli/clitools"
+	"github.com/urfave/cli/v2"
+)
+
+// migrateBatchSize is the amount of messages fetched from the source
+// server using one command.
+const migrateBatchSize = 50
+
+type migrateMailboxState struct {
+	UIDValidity uint32 `json:"uid_validity"`
+	// Messages with UIDs up to LastUID are already copied.
+	LastUID uint32 `json:"last_uid"`
+}
+
+// migrateState is stored between runs of 'imap-acct migrate' so only new
+// messages are copied.
+type migrateState struct {
+	path string
+
+	Mailboxes map[string]migrateMailboxState `json:"mailboxes"`
+}
+
+func loadMigrateState(path string) (*migrateState, error) {
+	state := &migrateState{
+		path:      path,
+		Mailboxes: map[string]migrateMailboxState{},
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return state, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(state); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if state.Mailboxes == nil {
+		state.Mailboxes = map[string]migrateMailboxState{}
+	}
+	return state, nil
+}
+
+func (s *migrateState) save() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(s); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
+
+type imapMigration struct {
+	c     *client.Client
+	dst   userArchive
+	state *migrateState
+
+	dstDelim string
+	exclude  map[string]struct{}
+	log      io.Writer
+
+	stats archiveStats
+}
+
+// dstName converts the mailbox name to use the hierarchy delimiter of the
+// destination storage.
+func (m *imapMigration) dstName(name, srcDelim string) string {
+	if strings.EqualFold(name, imap.InboxName) {
+		return imap.InboxName
+	}
+	if srcDelim == "" || srcDelim == m.dstDelim {
+		return name
+	}
+	parts := strings.Split(name, srcDelim)
+	for i, part := range parts {
+		parts[i] = strings.ReplaceAll(part, m.dstDelim, "_")
+	}
+	return strings.Join(parts, m.dstDelim)
+}
+
+func (m *imapMigration) run() error {
+	subs := map[string]struct{}{}
+	ch := make(chan *imap.MailboxInfo, 10)
+	listErr := make(chan error, 1)
+	go func() {
+		listErr <- m.c.Lsub("", "*", ch)
+	}()
+	for info := range ch {
+		subs[info.Name] = struct{}{}
+	}
+	if err := <-listErr; err != nil {
+		return fmt.Errorf("LSUB: %w", err)
+	}
+
+	var mboxes []*imap.MailboxInfo
+	ch = make(chan *imap.MailboxInfo, 10)
+	go func() {
+		listErr <- m.c.List("", "*", ch)
+	}()
+	for info := range ch {
+		mboxes = append(mboxes, info)
+	}
+	if err := <-listErr; err != nil {
+		return fmt.Errorf("LIST: %w", err)
+	}
+	sort.Slice(mboxes, func(i, j int) bool {
+		return mboxes[i].Name < mboxes[j].Name
+	})
+
+	for _, info := range mboxes {
+		if _, ok := m.exclude[info.Name]; ok {
+			continue
+		}
+
+		mbox := archiveMailbox{Name: m.dstName(info.Name, info.Delimiter)}
+		_, mbox.Subscribed = subs[info.Name]
+		noSelect := false
+		for _, attr := range info.Attributes {
+			if strings.EqualFold(attr, imap.NoSelectAttr) {
+				noSelect = true
+			}
+			for _, special := range specialUseAttrs {
+				if strings.EqualFold(attr, special) {
+					mbox.SpecialUse = special
+				}
+			}
+		}
+
+		if err := m.dst.CreateMailbox(mbox); err != nil {
+			return fmt.Errorf("mailbox %s: %w", mbox.Name, err)
+		}
+		m.stats.Mailboxes++
+		if noSelect {
+			continue
+		}
+
+		if err := m.mailbox(info.Name, mbox.Name); err != nil {
+			return fmt.Errorf("mailbox %s: %w", info.Name, err)
+		}
+	}
+	return nil
+}
+
+func (m *imapMigration) mailbox(srcName, dstName string) error {
+	status, err := m.c.Select(srcName, true)
+	if err != nil {
+		return err
+	}
+
+	st := m.state.Mailboxes[srcName]
+	if st.UIDValidity != status.UidValidity {
+		if st.UIDValidity != 0 {
+			fmt.Fprintf(m.log, "UIDVALIDITY of %s changed, copying all messages again\n", srcName)
+		}
+		st = migrateMailboxState{UIDValidity: status.UidValidity}
+	}
+	defer func() {
+		m.state.Mailboxes[srcName] = st
+	}()
+	if status.Messages == 0 {
+		return nil
+	}
+
+	seq := new(imap.SeqSet)
+	seq.AddRange(st.LastUID+1, 0)
+	found, err := m.c.UidSearch(&imap.SearchCriteria{Uid: seq})
+	if err != nil {
+		return err
+	}
+	// n:* matches the last message even if its UID is lower than n.
+	uids := found[:0]
+	for _, uid := range found {
+		if uid > st.LastUID {
+			uids = append(uids, uid)
+		}
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+
+	section := &imap.BodySectionName{Peek: true}
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, section.FetchItem()}
+	for len(uids) != 0 {
+		batch := uids
+		if len(batch) > migrateBatchSize {
+			batch = batch[:migrateBatchSize]
+		}
+		uids = uids[len(batch):]
+
+		seq := new(imap.SeqSet)
+		seq.AddNum(batch...)
+		ch := make(chan *imap.Message, 1)
+		fetchErr := make(chan error, 1)
+		go func() {
+			fetchErr <- m.c.UidFetch(seq, items, ch)
+		}()
+
+		// Servers usually return messages in UID order, but this is not
+		// required. LastUID is advanced only over the contiguous range of
+		// copied messages so nothing is lost if the copy is interrupted.
+		copied := make(map[uint32]struct{}, len(batch))
+		next := 0
+		var addErr error
+		for msg := range ch {
+			if addErr != nil {
+				continue
+			}
+			body := msg.GetBody(section)
+			if body == nil {
+				addErr = fmt.Errorf("no body returned for UID %d", msg.Uid)
+				continue
+			}
+			flags := make([]string, 0, len(msg.Flags))
+			for _, f := range msg.Flags {
+				if f != imap.RecentFlag {
+					flags = append(flags, f)
+				}
+			}
+			addErr = m.dst.AddMessage(dstName, &archiveMessage{
+				Flags: flags,
+				Date:  msg.InternalDate,
+				Body:  body,
+			})
+			if addErr != nil {
+				continue
+			}
+			m.stats.Messages++
+
+			copied[msg.Uid] = struct{}{}
+			for ; next < len(batch); next++ {
+				if _, ok := copied[batch[next]]; !ok {
+					break
+				}
+				st.LastUID = batch[next]
+			}
+		}
+		if err := <-fetchErr; err != nil {
+			return err
+		}
+		if addErr != nil {
+			return addErr
+		}
+		// Messages missing from the response were expunged concurrently.
+		st.LastUID = batch[len(batch)-1]
+
+		m.state.Mailboxes[srcName] = st
+		if err := m.state.save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dialMigrateSource(addr, tlsMode string, insecure bool) (*client.Client, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: insecure,
+	}
+
+	switch tlsMode {
+	case "implicit":
+		return client.DialTLS(addr, tlsConfig)
+	case "starttls":
+		c, err := client.Dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Logout()
+			return nil, err
+		}
+		return c, nil
+	case "none":
+		return client.Dial(addr)
+	default:
+		return nil, cli.Exit(fmt.Sprintf("Error: unknown TLS mode: %s", tlsMode), 2)
+	}
+}
+
+// migrateLogin authenticates to the source server. If adminUser is set,
+// SASL PLAIN is used to authenticate as adminUser acting on behalf of
+// username (master user login).
+func migrateLogin(c *client.Client, username, adminUser, password string) error {
+	if adminUser == "" {
+		return c.Login(username, password)
+	}
+	return c.Authenticate(sasl.NewPlainClient(username, adminUser, password))
+}
+
+func migrateAccount(c *client.Client, dst backend.User, state *migrateState, exclude []string, log io.Writer) (archiveStats, error) {
+	m := imapMigration{
+		c:        c,
+		dst:      userArchive{u: dst},
+		state:    state,
+		dstDelim: ".",
+		exclude:  make(map[string]struct{}, len(exclude)),
+		log:      log,
+	}
+	for _, name := range exclude {
+		m.exclude[name] = struct{}{}
+	}
+	if mboxes, err := dst.ListMailboxes(false); err == nil && len(mboxes) != 0 && mboxes[0].Delimiter != "" {
+		m.dstDelim = mboxes[0].Delimiter
+	}
+
+	err := m.run()
+	if saveErr := state.save(); err == nil {
+		err = saveErr
+	}
+	return m.stats, err
+}
+
+func imapAcctMigrate(be module.Storage, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+	addr := ctx.String("host")
+	if addr == "" {
+		return cli.Exit("Error: --host is required", 2)
+	}
+
+	u, err := be.GetIMAPAcct(username)
+	if err != nil {
+		return err
+	}
+
+	statePath := ctx.String("state")
+	if statePath == "" {
+		statePath = filepath.Join(config.StateDirectory, "imap_migrate", url.PathEscape(username)+".json")
+	}
+	state, err := loadMigrateState(statePath)
+	if err != nil {
+		return err
+	}
+
+	srcUser := ctx.String("user")
+	if srcUser == "" {
+		srcUser = username
+	}
+	pass := ctx.String("password")
+	if pass == "" {
+		pass, err = clitools2.ReadPassword("Enter password for the source server")
+		if err != nil {
+			return err
+		}
+	}
+
+	c, err := dialMigrateSource(addr, ctx.String("tls"), ctx.Bool("tls-insecure"))
+	if err != nil {
+		return err
+	}
+	defer c.Logout()
+	if err := migrateLogin(c, srcUser, ctx.String("admin-user"), pass); err != nil {
+		return err
+	}
+
+	stats, err := migrateAccount(c, u, state, ctx.StringSlice("exclude"), os.Stderr)
+	if !ctx.Bool("quiet") {
+		fmt.Fprintf(os.Stderr, "Copied %d new messages, %d mailboxes processed.\n", stats.Messages, stats.Mailboxes)
+	}
+	return err
+}
@@ -0,0 +1,124 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+	"github.com/foxcpp/maddy/internal/storage/maildir"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type migrateTestBackend struct {
+	u backend.User
+}
+
+func (be migrateTestBackend) Login(_ *imap.ConnInfo, username, password string) (backend.User, error) {
+	if username != "user" || password != "pass" {
+		return nil, backend.ErrInvalidCredentials
+	}
+	return be.u, nil
+}
+
+func TestMigrate(t *testing.T) {
+	dir := testutils.Dir(t)
+	src, err := maildir.OpenDir(filepath.Join(dir, "src"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.CreateMailbox("Sent"); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SetSubscribed("Sent", true); err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2021, 5, 6, 7, 8, 9, 0, time.UTC)
+	add := func(mbox string, flags []string, body string) {
+		t.Helper()
+		if err := src.CreateMessage(mbox, flags, date, bytes.NewReader([]byte(body)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// go-imap client converts keywords to lower case.
+	add(imap.InboxName, []string{imap.SeenFlag, "$label1"}, "Subject: one\r\n\r\nHello\r\n")
+	add("Sent", []string{imap.SeenFlag}, "Subject: two\r\n\r\nBye\r\n")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := server.New(migrateTestBackend{u: src})
+	srv.AllowInsecureAuth = true
+	go srv.Serve(l)
+	defer srv.Close()
+
+	dst, err := maildir.OpenDir(filepath.Join(dir, "dst"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statePath := filepath.Join(dir, "state.json")
+
+	migrate := func(expected int) {
+		t.Helper()
+		c, err := client.Dial(l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Logout()
+		if err := migrateLogin(c, "user", "", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		state, err := loadMigrateState(statePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats, err := migrateAccount(c, dst, state, nil, io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Messages != expected {
+			t.Fatalf("Expected %d messages to be copied, got %d", expected, stats.Messages)
+		}
+	}
+
+	migrate(2)
+	// Nothing changed, nothing should be copied.
+	migrate(0)
+	add(imap.InboxName, nil, "Subject: three\r\n\r\nNew\r\n")
+	migrate(1)
+
+	expected, expectedMboxes := dumpAccount(t, src)
+	actual, actualMboxes := dumpAccount(t, dst)
+	if !reflect.DeepEqual(actualMboxes, expectedMboxes) {
+		t.Errorf("Wrong mailboxes after migration:\n%+v\n%+v", actualMboxes, expectedMboxes)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Wrong messages after migration:\n%+v\n%+v", actual, expected)
+	}
+}
@@ -0,0 +1,311 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package cmdworker implements a pool of long-running worker processes
+// exchanging line-delimited JSON requests and responses over stdin and
+// stdout.
+//
+// It is used by command-based modules (check.command, imap.filter.command)
+// to avoid starting a new process for each message.
+package cmdworker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+// ErrTimeout is returned by Pool.Do if the worker does not respond in time.
+var ErrTimeout = errors.New("cmdworker: worker timed out")
+
+// stopTimeout is the time worker has to exit after its stdin is closed.
+const stopTimeout = 5 * time.Second
+
+type worker struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *os.File
+	reader *bufio.Reader
+
+	// done is closed when the process exits.
+	done chan struct{}
+}
+
+func startWorker(cmdName string, args []string, logger log.Logger) (*worker, error) {
+	cmd := exec.Command(cmdName, args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	// Not using StdoutPipe and StderrPipe since they are closed by Wait
+	// which is called concurrently with reads.
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		stdin.Close()
+		return nil, err
+	}
+	cmd.Stdout = stdoutW
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		stdin.Close()
+		stdoutR.Close()
+		stdoutW.Close()
+		return nil, err
+	}
+	cmd.Stderr = stderrW
+
+	if err := cmd.Start(); err != nil {
+		stdin.Close()
+		stdoutR.Close()
+		stdoutW.Close()
+		stderrR.Close()
+		stderrW.Close()
+		return nil, err
+	}
+	stdoutW.Close()
+	stderrW.Close()
+	go logStderr(stderrR, cmd.Process.Pid, logger)
+
+	w := &worker{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: stdoutR,
+		reader: bufio.NewReader(stdoutR),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		_ = cmd.Wait()
+		close(w.done)
+	}()
+	return w, nil
+}
+
+// logStderr writes lines from the worker stderr to the log until the
+// process exits.
+func logStderr(r *os.File, pid int, logger log.Logger) {
+	defer r.Close()
+	br := bufio.NewReader(r)
+	for {
+		// Long lines are logged in parts instead of being buffered.
+		line, _, err := br.ReadLine()
+		if len(line) != 0 {
+			logger.Msg("worker stderr", "pid", pid, "line", string(line))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (w *worker) exited() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+type result struct {
+	resp *Response
+	err  error
+}
+
+// do sends the request and reads the response. If an error is returned, the
+// worker state is unknown and it should not be used anymore.
+func (w *worker) do(ctx context.Context, req *Request, timeout time.Duration) (*Response, error) {
+	line, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	line = append(line, '\n')
+
+	resCh := make(chan result, 1)
+	go func() {
+		if _, err := w.stdin.Write(line); err != nil {
+			resCh <- result{err: fmt.Errorf("cmdworker: write request: %w", err)}
+			return
+		}
+		respLine, err := w.reader.ReadBytes('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			resCh <- result{err: fmt.Errorf("cmdworker: read response: %w", err)}
+			return
+		}
+		resp := &Response{}
+		if err := json.Unmarshal(respLine, resp); err != nil {
+			resCh <- result{err: fmt.Errorf("cmdworker: malformed response: %w", err)}
+			return
+		}
+		resCh <- result{resp: resp}
+	}()
+
+	var timeoutCh <-chan time.Time
+	if timeout != 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	select {
+	case res := <-resCh:
+		return res.resp, res.err
+	case <-timeoutCh:
+		return nil, ErrTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// kill terminates the process. It also unblocks the goroutine waiting for
+// the response, if any.
+func (w *worker) kill(logger log.Logger) {
+	if err := w.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		logger.Error("failed to kill worker", err, "pid", w.cmd.Process.Pid)
+	}
+	w.stdin.Close()
+	w.stdout.Close()
+}
+
+// stop asks the worker to exit by closing its stdin and kills it if it does
+// not exit in time.
+func (w *worker) stop(logger log.Logger) {
+	w.stdin.Close()
+	select {
+	case <-w.done:
+		w.stdout.Close()
+	case <-time.After(stopTimeout):
+		w.kill(logger)
+	}
+}
+
+// Pool is a set of worker processes running the same command. Workers are
+// started on demand and restarted automatically if they exit or fail to
+// handle a request.
+type Pool struct {
+	cmd     string
+	args    []string
+	timeout time.Duration
+	log     log.Logger
+
+	// Contains size elements, nil for workers not started yet.
+	workers chan *worker
+}
+
+// NewPool creates a pool of at most size workers. timeout is the time
+// allowed for the worker to handle a single request, 0 means no limit.
+func NewPool(cmd string, args []string, size int, timeout time.Duration, log log.Logger) *Pool {
+	p := &Pool{
+		cmd:     cmd,
+		args:    args,
+		timeout: timeout,
+		log:     log,
+		workers: make(chan *worker, size),
+	}
+	for i := 0; i < size; i++ {
+		p.workers <- nil
+	}
+	return p
+}
+
+// get returns a free worker, starting a new one if necessary. started is
+// true if the worker was just started.
+func (p *Pool) get(ctx context.Context) (w *worker, started bool, err error) {
+	select {
+	case w = <-p.workers:
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+
+	if w != nil && !w.exited() {
+		return w, false, nil
+	}
+	if w != nil {
+		p.log.Msg("worker exited, restarting", "pid", w.cmd.Process.Pid)
+		w.kill(p.log)
+	}
+
+	w, err = startWorker(p.cmd, p.args, p.log)
+	if err != nil {
+		p.workers <- nil
+		return nil, false, err
+	}
+	p.log.DebugMsg("worker started", "pid", w.cmd.Process.Pid)
+	return w, true, nil
+}
+
+// Do sends the request to a free worker and returns its response. It
+// blocks if all workers are busy.
+//
+// If the worker fails to handle the request (e.g. times out or
+// sends a malformed response), it is terminated and the error is returned.
+// A new worker is started for the next request.
+//
+// The request is sent again to a new worker only if the idle worker closed
+// its stdin before the request was written, so it could not act on it.
+// Requests are never retried once they were delivered since the worker may
+// have already acted on them.
+func (p *Pool) Do(ctx context.Context, req *Request) (*Response, error) {
+	resp, retry, err := p.do(ctx, req)
+	if retry {
+		resp, _, err = p.do(ctx, req)
+	}
+	return resp, err
+}
+
+func (p *Pool) do(ctx context.Context, req *Request) (resp *Response, retry bool, err error) {
+	w, started, err := p.get(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	resp, err = w.do(ctx, req, p.timeout)
+	if err != nil {
+		p.log.Error("worker failed, terminating", err, "pid", w.cmd.Process.Pid)
+		w.kill(p.log)
+		p.workers <- nil
+		// EPIPE is returned only by the write, the request was not
+		// delivered then.
+		return nil, errors.Is(err, syscall.EPIPE) && !started, err
+	}
+
+	p.workers <- w
+	return resp, false, nil
+}
+
+// Close stops all workers. It waits for running requests to complete.
+func (p *Pool) Close() error {
+	for i := 0; i < cap(p.workers); i++ {
+		if w := <-p.workers; w != nil {
+			w.stop(p.log)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmdworker
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testPool(t *testing.T, script string, timeout time.Duration) *Pool {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh:", err)
+	}
+	p := NewPool("sh", []string{"-c", script}, 1, timeout, testutils.Logger(t, "cmdworker"))
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func TestPool(t *testing.T) {
+	// Responds with the number of requests handled by the process.
+	p := testPool(t, `
+		n=0
+		while read -r line; do
+			n=$((n+1))
+			echo '{"action": "score", "score": '$n'}'
+		done`, 5*time.Second)
+
+	for i := 1; i <= 3; i++ {
+		resp, err := p.Do(context.Background(), &Request{Type: TypeCheck})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Score != float64(i) {
+			t.Fatalf("request %d: wrong score: %v, the process was restarted?", i, resp.Score)
+		}
+	}
+}
+
+func TestPool_Restart(t *testing.T) {
+	// Handles one request and exits. stdin is closed before the response is
+	// sent so the next request fails to be written and is retried.
+	p := testPool(t, `read -r line; exec 0<&-; echo '{"folder": "Junk"}'`, 5*time.Second)
+
+	for i := 0; i < 3; i++ {
+		resp, err := p.Do(context.Background(), &Request{Type: TypeFilter})
+		if err != nil {
+			t.Fatal("worker is not restarted:", err)
+		}
+		if resp.Folder != "Junk" {
+			t.Fatalf("wrong folder: %v", resp.Folder)
+		}
+	}
+}
+
+func TestPool_NoRetryAfterDelivery(t *testing.T) {
+	// Exits after reading the request without responding.
+	counter := filepath.Join(testutils.Dir(t), "counter")
+	p := testPool(t, `read -r line; echo >> '`+counter+`'`, 5*time.Second)
+
+	if _, err := p.Do(context.Background(), &Request{Type: TypeCheck}); err == nil {
+		t.Fatal("expected error")
+	}
+	data, err := os.ReadFile(counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "\n"); n != 1 {
+		t.Fatalf("request was handled %d times", n)
+	}
+}
+
+func TestPool_Stderr(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh:", err)
+	}
+
+	lines := make(chan string, 10)
+	logger := log.Logger{Out: log.FuncOutput(func(_ time.Time, _ bool, str string) {
+		lines <- str
+	}, func() error { return nil })}
+	p := NewPool("sh", []string{"-c", `while read -r line; do echo 'bad things happened' >&2; echo '{}'; done`},
+		1, 5*time.Second, logger)
+	defer p.Close()
+
+	if _, err := p.Do(context.Background(), &Request{Type: TypeCheck}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		select {
+		case line := <-lines:
+			if strings.Contains(line, "bad things happened") {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("stderr output is not logged")
+		}
+	}
+}
+
+func TestPool_Timeout(t *testing.T) {
+	p := testPool(t, `
+		while read -r line; do
+			case "$line" in
+			*slow*) sleep 10 ;;
+			esac
+			echo '{}'
+		done`, 200*time.Millisecond)
+
+	_, err := p.Do(context.Background(), &Request{Type: TypeCheck, MsgID: "slow"})
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatal("expected timeout error, got", err)
+	}
+
+	// The hung worker is replaced with a new one.
+	if _, err := p.Do(context.Background(), &Request{Type: TypeCheck, MsgID: "fast"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPool_MalformedResponse(t *testing.T) {
+	p := testPool(t, `while read -r line; do echo 'not json'; done`, 5*time.Second)
+
+	if _, err := p.Do(context.Background(), &Request{Type: TypeCheck}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestResponse_FailAction(t *testing.T) {
+	for _, test := range []struct {
+		resp   Response
+		ok     bool
+		reject bool
+		score  float64
+		code   int
+		fail   bool
+	}{
+		{resp: Response{}},
+		{resp: Response{Action: "accept"}},
+		{resp: Response{Action: "ignore"}, ok: true},
+		{resp: Response{Action: "reject"}, ok: true, reject: true},
+		{resp: Response{Action: "reject", SMTPCode: 451, SMTPEnhancedCode: "4.7.1", SMTPMessage: "Try later"}, ok: true, reject: true, code: 451},
+		{resp: Response{Action: "score", Score: 2.5}, ok: true, score: 2.5},
+		{resp: Response{Action: "reject", SMTPCode: 250}, fail: true},
+		{resp: Response{Action: "explode"}, fail: true},
+	} {
+		action, ok, err := test.resp.FailAction()
+		if test.fail {
+			if err == nil {
+				t.Errorf("%+v: expected error", test.resp)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: unexpected error: %v", test.resp, err)
+			continue
+		}
+		if ok != test.ok || action.Reject != test.reject || action.Score != test.score {
+			t.Errorf("%+v: wrong action: %+v (ok = %v)", test.resp, action, ok)
+		}
+		if test.code != 0 && (action.ReasonOverride == nil || action.ReasonOverride.Code != test.code) {
+			t.Errorf("%+v: wrong reason override: %+v", test.resp, action.ReasonOverride)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmdworker
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// Request types.
+const (
+	TypeCheck  = "check"
+	TypeLearn  = "learn"
+	TypeFilter = "filter"
+)
+
+// Values of the 'mode' directive.
+const (
+	ModeExec   = "exec"
+	ModeWorker = "worker"
+)
+
+// Values of the 'body' directive.
+const (
+	BodyInline = "inline"
+	BodyPath   = "path"
+)
+
+// Request is sent to the worker process as a single line of JSON.
+type Request struct {
+	Type string `json:"type"`
+
+	// Check stage, set only for "check" requests.
+	Stage string `json:"stage,omitempty"`
+
+	MsgID      string   `json:"msg_id,omitempty"`
+	SourceIP   string   `json:"source_ip,omitempty"`
+	SourceHost string   `json:"source_host,omitempty"`
+	SourceRDNS string   `json:"source_rdns,omitempty"`
+	AuthUser   string   `json:"auth_user,omitempty"`
+	Sender     string   `json:"sender,omitempty"`
+	Rcpts      []string `json:"rcpts,omitempty"`
+
+	// Currently handled address for "sender" and "rcpt" check stages.
+	Address string `json:"address,omitempty"`
+
+	AccountName    string `json:"account_name,omitempty"`
+	RcptTo         string `json:"rcpt_to,omitempty"`
+	OriginalRcptTo string `json:"original_rcpt_to,omitempty"`
+	Verdict        string `json:"verdict,omitempty"`
+
+	// Message header in the RFC 5322 format.
+	Header string `json:"header,omitempty"`
+
+	// Message body, either inline (encoded using base64 in JSON) or
+	// as a path to a file.
+	Body     []byte `json:"body,omitempty"`
+	BodyPath string `json:"body_path,omitempty"`
+}
+
+// SetConn fills information about the message source from msgMeta.
+func (r *Request) SetConn(msgMeta *module.MsgMetadata) {
+	r.MsgID = msgMeta.ID
+	if msgMeta.Conn == nil {
+		return
+	}
+	r.AuthUser = msgMeta.Conn.AuthUser
+	r.SourceHost = msgMeta.Conn.Hostname
+	if tcpAddr, ok := msgMeta.Conn.RemoteAddr.(*net.TCPAddr); ok {
+		r.SourceIP = tcpAddr.IP.String()
+	}
+	if msgMeta.Conn.RDNSName != nil {
+		if rdnsName, err := msgMeta.Conn.RDNSName.Get(); err == nil && rdnsName != nil {
+			r.SourceRDNS, _ = rdnsName.(string)
+		}
+	}
+}
+
+// SetBody adds the message to the request. If the body is passed using a
+// path and it is not stored in a file, it is written into a temporary file.
+// Returned function should be called to remove it after the request is
+// completed.
+func (r *Request) SetBody(mode string, hdr textproto.Header, body buffer.Buffer) (func(), error) {
+	var hdrBuf bytes.Buffer
+	if err := textproto.WriteHeader(&hdrBuf, hdr); err != nil {
+		return nil, err
+	}
+	r.Header = hdrBuf.String()
+
+	if mode == BodyPath {
+		if fb, ok := body.(buffer.FileBuffer); ok {
+			r.BodyPath = fb.Path
+			return func() {}, nil
+		}
+
+		f, err := os.CreateTemp("", "maddy-body-")
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		remove := func() { os.Remove(f.Name()) }
+
+		bodyR, err := body.Open()
+		if err != nil {
+			remove()
+			return nil, err
+		}
+		defer bodyR.Close()
+		if _, err := io.Copy(f, bodyR); err != nil {
+			remove()
+			return nil, err
+		}
+		r.BodyPath = f.Name()
+		return remove, nil
+	}
+
+	bodyR, err := body.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer bodyR.Close()
+	r.Body, err = io.ReadAll(bodyR)
+	if err != nil {
+		return nil, err
+	}
+	return func() {}, nil
+}
+
+// Response is read from the worker process as a single line of JSON.
+type Response struct {
+	// Error reported by the worker. The request is considered failed
+	// if it is not empty.
+	Error string `json:"error,omitempty"`
+
+	// Check action: "accept" (or empty), "ignore", "reject", "quarantine"
+	// or "score".
+	Action           string  `json:"action,omitempty"`
+	Score            float64 `json:"score,omitempty"`
+	SMTPCode         int     `json:"smtp_code,omitempty"`
+	SMTPEnhancedCode string  `json:"smtp_enhanced_code,omitempty"`
+	SMTPMessage      string  `json:"smtp_message,omitempty"`
+	Reason           string  `json:"reason,omitempty"`
+
+	// Header fields to prepend to the message header.
+	Header map[string][]string `json:"header,omitempty"`
+
+	// IMAP folder and flags for "filter" requests.
+	Folder string   `json:"folder,omitempty"`
+	Flags  []string `json:"flags,omitempty"`
+}
+
+// FailAction converts the response action into modconfig.FailAction.
+// ok is false if the message is accepted.
+func (r *Response) FailAction() (action modconfig.FailAction, ok bool, err error) {
+	args := []string{r.Action}
+	switch r.Action {
+	case "", "accept":
+		return modconfig.FailAction{}, false, nil
+	case "reject", "quarantine":
+		if r.SMTPCode != 0 {
+			args = append(args, strconv.Itoa(r.SMTPCode))
+			if r.SMTPEnhancedCode != "" {
+				args = append(args, r.SMTPEnhancedCode)
+				if r.SMTPMessage != "" {
+					args = append(args, r.SMTPMessage)
+				}
+			}
+		}
+	case "score":
+		args = append(args, strconv.FormatFloat(r.Score, 'f', -1, 64))
+	}
+
+	action, err = modconfig.ParseActionDirective(args)
+	if err != nil {
+		return modconfig.FailAction{}, false, fmt.Errorf("invalid action %q: %w", strings.Join(args, " "), err)
+	}
+	return action, true, nil
+}
+
+// MessageHeader returns header fields from the response in the stable
+// order.
+func (r *Response) MessageHeader() textproto.Header {
+	keys := make([]string, 0, len(r.Header))
+	for key := range r.Header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	hdr := textproto.Header{}
+	for _, key := range keys {
+		for _, value := range r.Header[key] {
+			hdr.Add(key, value)
+		}
+	}
+	return hdr
+}
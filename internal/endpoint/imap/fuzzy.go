@@ -0,0 +1,140 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// FuzzySearchMailbox is implemented by mailboxes that support the
+// FUZZY search key modifier (RFC 6203).
+type FuzzySearchMailbox interface {
+	SearchMessagesFuzzy(uid bool, criteria *imap.SearchCriteria) ([]uint32, error)
+}
+
+// fuzzySearch implements the SEARCH=FUZZY extension by replacing the SEARCH
+// command handler.
+//
+// FUZZY modifier applies to the whole search if it is used for any key.
+// Relevancy scores are not reported since ESEARCH is not supported.
+type fuzzySearch struct{}
+
+func (fuzzySearch) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{"SEARCH=FUZZY"}
+	}
+	return nil
+}
+
+func (fuzzySearch) Command(name string) imapserver.HandlerFactory {
+	if name != "SEARCH" {
+		return nil
+	}
+	return func() imapserver.Handler {
+		return &fuzzySearchHandler{}
+	}
+}
+
+type fuzzySearchHandler struct {
+	commands.Search
+	fuzzy bool
+}
+
+// searchKeyArgs contains the amount of arguments for search keys that have
+// them.
+var searchKeyArgs = map[string]int{
+	"BCC": 1, "BEFORE": 1, "BODY": 1, "CC": 1, "FROM": 1, "KEYWORD": 1,
+	"LARGER": 1, "ON": 1, "SENTBEFORE": 1, "SENTON": 1, "SENTSINCE": 1,
+	"SINCE": 1, "SMALLER": 1, "SUBJECT": 1, "TEXT": 1, "TO": 1,
+	"UNKEYWORD": 1, "UID": 1, "HEADER": 2,
+}
+
+// stripFuzzy removes FUZZY modifiers from the search key list.
+func stripFuzzy(fields []interface{}) ([]interface{}, bool) {
+	var (
+		res   = make([]interface{}, 0, len(fields))
+		fuzzy bool
+		skip  int
+	)
+	for _, f := range fields {
+		if skip > 0 {
+			// Key argument, may legitimately contain the "FUZZY" string.
+			skip--
+			res = append(res, f)
+			continue
+		}
+
+		switch f := f.(type) {
+		case string:
+			key := strings.ToUpper(f)
+			if key == "FUZZY" {
+				fuzzy = true
+				continue
+			}
+			skip = searchKeyArgs[key]
+		case []interface{}:
+			nested, nestedFuzzy := stripFuzzy(f)
+			fuzzy = fuzzy || nestedFuzzy
+			res = append(res, nested)
+			continue
+		}
+		res = append(res, f)
+	}
+	return res, fuzzy
+}
+
+func (cmd *fuzzySearchHandler) Parse(fields []interface{}) error {
+	fields, cmd.fuzzy = stripFuzzy(fields)
+	return cmd.Search.Parse(fields)
+}
+
+func (cmd *fuzzySearchHandler) handle(uid bool, conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+
+	var (
+		ids []uint32
+		err error
+	)
+	if fsm, ok := ctx.Mailbox.(FuzzySearchMailbox); ok && cmd.fuzzy {
+		ids, err = fsm.SearchMessagesFuzzy(uid, cmd.Criteria)
+	} else {
+		ids, err = ctx.Mailbox.SearchMessages(uid, cmd.Criteria)
+	}
+	if err != nil {
+		return err
+	}
+
+	return conn.WriteResp(&responses.Search{Ids: ids})
+}
+
+func (cmd *fuzzySearchHandler) Handle(conn imapserver.Conn) error {
+	return cmd.handle(false, conn)
+}
+
+func (cmd *fuzzySearchHandler) UidHandle(conn imapserver.Conn) error {
+	return cmd.handle(true, conn)
+}
@@ -0,0 +1,41 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStripFuzzy(t *testing.T) {
+	test := func(in, out []interface{}, fuzzy bool) {
+		t.Helper()
+		res, resFuzzy := stripFuzzy(in)
+		if !reflect.DeepEqual(res, out) || resFuzzy != fuzzy {
+			t.Errorf("stripFuzzy(%v) = %v, %v; want %v, %v", in, res, resFuzzy, out, fuzzy)
+		}
+	}
+
+	test([]interface{}{"BODY", "test"}, []interface{}{"BODY", "test"}, false)
+	test([]interface{}{"FUZZY", "BODY", "test"}, []interface{}{"BODY", "test"}, true)
+	test([]interface{}{"BODY", "fuzzy"}, []interface{}{"BODY", "fuzzy"}, false)
+	test([]interface{}{"HEADER", "X-Test", "FUZZY", "UNSEEN"}, []interface{}{"HEADER", "X-Test", "FUZZY", "UNSEEN"}, false)
+	test([]interface{}{"UNSEEN", []interface{}{"fuzzy", "TEXT", "x"}},
+		[]interface{}{"UNSEEN", []interface{}{"TEXT", "x"}}, true)
+}
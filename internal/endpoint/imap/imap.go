@@ -231,6 +231,8 @@ func (endp *Endpoint) enableExtensions() error {
 			endp.serv.Enable(i18nlevel.NewExtension())
 		case "SORT":
 			endp.serv.Enable(sortthread.NewSortExtension())
+		case "SEARCH=FUZZY":
+			endp.serv.Enable(fuzzySearch{})
 		}
 		if strings.HasPrefix(ext, "THREAD") {
 			endp.serv.Enable(sortthread.NewThreadExtension())
@@ -0,0 +1,184 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package fts
+
+import (
+	"bufio"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-message"
+	_ "github.com/emersion/go-message/charset"
+	"golang.org/x/net/html"
+)
+
+// Document is the searchable text extracted from a message.
+type Document struct {
+	// Decoded values of all header fields of the top-level message.
+	Header string
+	// Text of all text/plain and text/html parts (including ones from
+	// attached messages), converted to UTF-8.
+	Body string
+	// Set if the body text was cut at the size limit and some of
+	// it is missing from Body.
+	Truncated bool
+}
+
+type extractor struct {
+	body      strings.Builder
+	remaining int
+}
+
+func (e *extractor) full() bool {
+	return e.remaining <= 0
+}
+
+func (e *extractor) write(s string) {
+	if e.full() {
+		return
+	}
+	if len(s) > e.remaining {
+		s = s[:e.remaining]
+	}
+	e.body.WriteString(s)
+	e.body.WriteByte('\n')
+	e.remaining -= len(s)
+}
+
+// Extract reads the message from r and returns the text that should be
+// indexed for it.
+//
+// At most maxBodySize bytes of body text are collected, the remaining
+// text is not indexed. Parts using unknown charsets and malformed parts
+// are skipped, error is returned only if the message header cannot be
+// parsed at all.
+func Extract(r io.Reader, maxBodySize int) (Document, error) {
+	e := extractor{remaining: maxBodySize}
+
+	ent, err := message.Read(bufio.NewReader(r))
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		return Document{}, err
+	}
+
+	doc := Document{
+		Header: headerText(ent.Header),
+	}
+	e.entity(ent)
+	doc.Body = e.body.String()
+	doc.Truncated = e.full()
+
+	return doc, nil
+}
+
+func headerText(h message.Header) string {
+	var sb strings.Builder
+	fields := h.Fields()
+	for fields.Next() {
+		val, err := fields.Text()
+		if err != nil {
+			val = fields.Value()
+		}
+		sb.WriteString(val)
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+func (e *extractor) entity(ent *message.Entity) {
+	if mr := ent.MultipartReader(); mr != nil {
+		for !e.full() {
+			part, err := mr.NextPart()
+			if err != nil {
+				// Either io.EOF or a broken part. Later parts can't be
+				// reliably read in the latter case too.
+				return
+			}
+			e.entity(part)
+		}
+		return
+	}
+
+	disp, dispParams, _ := ent.Header.ContentDisposition()
+	if name := dispParams["filename"]; name != "" {
+		e.write(name)
+	}
+
+	mediaType, ctParams, _ := ent.Header.ContentType()
+	if name := ctParams["name"]; name != "" && name != dispParams["filename"] {
+		e.write(name)
+	}
+	if disp == "attachment" && mediaType != "message/rfc822" {
+		return
+	}
+
+	switch {
+	case mediaType == "text/html":
+		e.htmlText(ent.Body)
+	case mediaType == "" || strings.HasPrefix(mediaType, "text/"):
+		e.plainText(ent.Body)
+	case mediaType == "message/rfc822":
+		nested, err := message.Read(bufio.NewReader(ent.Body))
+		if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+			return
+		}
+		e.write(headerText(nested.Header))
+		e.entity(nested)
+	}
+}
+
+func (e *extractor) plainText(r io.Reader) {
+	var sb strings.Builder
+	if _, err := io.Copy(&sb, io.LimitReader(r, int64(e.remaining))); err != nil && sb.Len() == 0 {
+		return
+	}
+	e.write(sb.String())
+}
+
+func (e *extractor) htmlText(r io.Reader) {
+	ht := html.NewTokenizer(r)
+	skip := 0
+	for !e.full() {
+		switch ht.Next() {
+		case html.ErrorToken:
+			return
+		case html.StartTagToken:
+			name, _ := ht.TagName()
+			switch string(name) {
+			case "script", "style", "head":
+				skip++
+			}
+		case html.EndTagToken:
+			name, _ := ht.TagName()
+			switch string(name) {
+			case "script", "style", "head":
+				if skip > 0 {
+					skip--
+				}
+			}
+		case html.TextToken:
+			if skip != 0 {
+				continue
+			}
+			text := strings.TrimSpace(string(ht.Text()))
+			if text != "" {
+				e.write(text)
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package fts implements text extraction and tokenization used to build
+// full-text search indexes for stored messages.
+//
+// The package does not care about how the index is stored, it only defines
+// what text is considered searchable and how it is split into terms so
+// both indexing and query code agree on it.
+package fts
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// MinTermLen is the minimal length of a term (in characters) that is
+	// stored in the index. Shorter words are skipped.
+	MinTermLen = 2
+
+	// MaxTermLen is the maximal length of a term (in bytes). Longer
+	// words are truncated to that length.
+	MaxTermLen = 64
+)
+
+func isTermRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.Is(unicode.Mn, r)
+}
+
+// NormalizeTerm converts a single word into the form used in the index.
+//
+// It returns an empty string if the word should not be indexed.
+func NormalizeTerm(word string) string {
+	if utf8.RuneCountInString(word) < MinTermLen {
+		return ""
+	}
+
+	word = strings.ToLower(word)
+	if len(word) > MaxTermLen {
+		cut := MaxTermLen
+		for cut > 0 && !utf8.RuneStart(word[cut]) {
+			cut--
+		}
+		word = word[:cut]
+	}
+	return word
+}
+
+// Terms splits the text into a set of normalized terms.
+//
+// Returned slice contains each term only once, in order of first
+// appearance.
+func Terms(text string) []string {
+	var (
+		terms []string
+		seen  = make(map[string]struct{})
+	)
+	for _, word := range strings.FieldsFunc(text, func(r rune) bool {
+		return !isTermRune(r)
+	}) {
+		term := NormalizeTerm(word)
+		if term == "" {
+			continue
+		}
+		if _, ok := seen[term]; ok {
+			continue
+		}
+		seen[term] = struct{}{}
+		terms = append(terms, term)
+	}
+	return terms
+}
+
+// QueryTerms splits the search string into a list of terms that all need to
+// be present in the document for it to match.
+//
+// ok is false if the search string contains words that cannot be looked up
+// in the index (e.g. too short ones) and so the query cannot be answered
+// using the index alone.
+func QueryTerms(query string) (terms []string, ok bool) {
+	words := strings.FieldsFunc(query, func(r rune) bool {
+		return !isTermRune(r)
+	})
+	if len(words) == 0 {
+		return nil, false
+	}
+	for _, word := range words {
+		term := NormalizeTerm(word)
+		if term == "" {
+			return nil, false
+		}
+		terms = append(terms, term)
+	}
+	return terms, true
+}
@@ -0,0 +1,133 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package fts
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTerms(t *testing.T) {
+	test := func(text string, expected []string) {
+		t.Helper()
+		actual := Terms(text)
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Terms(%q) = %q, want %q", text, actual, expected)
+		}
+	}
+
+	test("", nil)
+	test("a", nil)
+	test("Hello, world!", []string{"hello", "world"})
+	test("hello HELLO Hello", []string{"hello"})
+	test("re: x-mailer v2.0", []string{"re", "mailer", "v2"})
+	test("Grüße aus Köln", []string{"grüße", "aus", "köln"})
+	test(strings.Repeat("a", 70), []string{strings.Repeat("a", MaxTermLen)})
+}
+
+func TestQueryTerms(t *testing.T) {
+	terms, ok := QueryTerms("Quarterly Report")
+	if !ok || !reflect.DeepEqual(terms, []string{"quarterly", "report"}) {
+		t.Errorf("unexpected result: %q, %v", terms, ok)
+	}
+
+	if _, ok := QueryTerms("a report"); ok {
+		t.Error("query with a short word should not be answered using index")
+	}
+	if _, ok := QueryTerms("--"); ok {
+		t.Error("query without words should not be answered using index")
+	}
+}
+
+func TestExtract(t *testing.T) {
+	msg := "Subject: =?UTF-8?Q?Gr=C3=BC=C3=9Fe?=\r\n" +
+		"From: Alice <alice@example.org>\r\n" +
+		"Content-Type: multipart/mixed; boundary=BOUNDARY\r\n" +
+		"\r\n" +
+		"--BOUNDARY\r\n" +
+		"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"Caf=E9 meeting\r\n" +
+		"--BOUNDARY\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"<html><head><style>.secret{}</style></head><body><p>Agenda</p></body></html>\r\n" +
+		"--BOUNDARY\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Disposition: attachment; filename=budget.xlsx\r\n" +
+		"\r\n" +
+		"binarydata\r\n" +
+		"--BOUNDARY--\r\n"
+
+	doc, err := Extract(strings.NewReader(msg), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.Truncated {
+		t.Error("document is marked as truncated")
+	}
+
+	headerTerms := Terms(doc.Header)
+	bodyTerms := Terms(doc.Body)
+
+	contains := func(terms []string, term string) bool {
+		for _, t := range terms {
+			if t == term {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, term := range []string{"grüße", "alice", "example"} {
+		if !contains(headerTerms, term) {
+			t.Errorf("header terms %q do not contain %q", headerTerms, term)
+		}
+	}
+	for _, term := range []string{"café", "meeting", "agenda", "budget", "xlsx"} {
+		if !contains(bodyTerms, term) {
+			t.Errorf("body terms %q do not contain %q", bodyTerms, term)
+		}
+	}
+	for _, term := range []string{"secret", "binarydata"} {
+		if contains(bodyTerms, term) {
+			t.Errorf("body terms %q contain %q", bodyTerms, term)
+		}
+	}
+}
+
+func TestExtract_Limit(t *testing.T) {
+	msg := "Subject: test\r\n" +
+		"\r\n" +
+		"first second third\r\n"
+
+	doc, err := Extract(strings.NewReader(msg), 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if terms := Terms(doc.Body); !reflect.DeepEqual(terms, []string{"first", "second"}) {
+		t.Errorf("unexpected terms: %q", terms)
+	}
+	if !doc.Truncated {
+		t.Error("document is not marked as truncated")
+	}
+}
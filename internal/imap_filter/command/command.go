@@ -21,6 +21,7 @@ package command
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -28,12 +29,14 @@ import (
 	"os"
 	"os/exec"
 	"regexp"
+	"time"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/cmdworker"
 )
 
 const modName = "imap.filter.command"
@@ -46,9 +49,18 @@ type Check struct {
 
 	cmd     string
 	cmdArgs []string
+
+	// Set if the command is run as a pool of long-running workers
+	// ('mode worker').
+	pool     *cmdworker.Pool
+	bodyMode string
 }
 
 func (c *Check) IMAPFilter(accountName string, rcptTo string, msgMeta *module.MsgMetadata, hdr textproto.Header, body buffer.Buffer) (folder string, flags []string, err error) {
+	if c.pool != nil {
+		return c.runWorker(accountName, rcptTo, msgMeta, hdr, body)
+	}
+
 	cmd, args := c.expandCommand(msgMeta, accountName, rcptTo, hdr)
 
 	var buf bytes.Buffer
@@ -91,8 +103,45 @@ func (c *Check) Init(cfg *config.Map) error {
 		return fmt.Errorf("command: %w", err)
 	}
 
-	_, err := cfg.Process()
-	return err
+	var (
+		mode          string
+		workers       int
+		workerTimeout time.Duration
+	)
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Enum("mode", false, false, []string{cmdworker.ModeExec, cmdworker.ModeWorker}, cmdworker.ModeExec, &mode)
+	cfg.Int("workers", false, false, 4, &workers)
+	cfg.Duration("worker_timeout", false, false, 30*time.Second, &workerTimeout)
+	cfg.Enum("body", false, false, []string{cmdworker.BodyInline, cmdworker.BodyPath}, cmdworker.BodyInline, &c.bodyMode)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if mode == cmdworker.ModeWorker {
+		if workers <= 0 {
+			return fmt.Errorf("%s: workers should be positive", modName)
+		}
+		c.pool = cmdworker.NewPool(c.cmd, c.cmdArgs, workers, workerTimeout, c.log)
+	}
+
+	return nil
+}
+
+func (c *Check) Close() error {
+	if c.pool == nil {
+		return nil
+	}
+	return c.pool.Close()
+}
+
+// originalRcpt returns the recipient address as it was specified by the
+// client, before any rewriting.
+func originalRcpt(msgMeta *module.MsgMetadata, rcptTo string) string {
+	oldestOriginalRcpt := rcptTo
+	for originalRcpt, ok := rcptTo, true; ok; originalRcpt, ok = msgMeta.OriginalRcpts[originalRcpt] {
+		oldestOriginalRcpt = originalRcpt
+	}
+	return oldestOriginalRcpt
 }
 
 func (c *Check) expandCommand(msgMeta *module.MsgMetadata, accountName string, rcptTo string, hdr textproto.Header) (string, []string) {
@@ -139,11 +188,7 @@ func (c *Check) expandCommand(msgMeta *module.MsgMetadata, accountName string, r
 			case "{rcpt_to}":
 				return rcptTo
 			case "{original_rcpt_to}":
-				oldestOriginalRcpt := rcptTo
-				for originalRcpt, ok := rcptTo, true; ok; originalRcpt, ok = msgMeta.OriginalRcpts[originalRcpt] {
-					oldestOriginalRcpt = originalRcpt
-				}
-				return oldestOriginalRcpt
+				return originalRcpt(msgMeta, rcptTo)
 			case "{subject}":
 				return hdr.Get("Subject")
 			case "{account_name}":
@@ -202,6 +247,34 @@ func (c *Check) run(cmdName string, args []string, stdin io.Reader) (string, []s
 	return folder, flags, nil
 }
 
+func (c *Check) runWorker(accountName string, rcptTo string, msgMeta *module.MsgMetadata, hdr textproto.Header, body buffer.Buffer) (string, []string, error) {
+	req := &cmdworker.Request{
+		Type:           cmdworker.TypeFilter,
+		Sender:         msgMeta.OriginalFrom,
+		AccountName:    accountName,
+		RcptTo:         rcptTo,
+		OriginalRcptTo: originalRcpt(msgMeta, rcptTo),
+	}
+	req.SetConn(msgMeta)
+	cleanup, err := req.SetBody(c.bodyMode, hdr, body)
+	if err != nil {
+		return "", nil, err
+	}
+	defer cleanup()
+
+	resp, err := c.pool.Do(context.Background(), req)
+	if err != nil {
+		return "", nil, err
+	}
+	if resp.Error != "" {
+		return "", nil, errors.New(resp.Error)
+	}
+
+	c.log.Debugf("folder: %s, extra flags: %v", resp.Folder, resp.Flags)
+
+	return resp.Folder, resp.Flags, nil
+}
+
 func init() {
 	module.Register(modName, New)
 }
@@ -118,6 +118,38 @@ func (gs groupState) RewriteBody(ctx context.Context, h *textproto.Header, body
 	return nil
 }
 
+// ReplaceBody implements module.BodyReplacer by running ReplaceBody for
+// all states that implement it.
+func (gs groupState) ReplaceBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	var replaced buffer.Buffer
+	for _, state := range gs.states {
+		replacer, ok := state.(module.BodyReplacer)
+		if !ok {
+			continue
+		}
+
+		current := body
+		if replaced != nil {
+			current = replaced
+		}
+		newBody, err := replacer.ReplaceBody(ctx, h, current)
+		if err != nil {
+			if replaced != nil {
+				replaced.Remove()
+			}
+			return nil, err
+		}
+		if newBody == nil {
+			continue
+		}
+		if replaced != nil {
+			replaced.Remove()
+		}
+		replaced = newBody
+	}
+	return replaced, nil
+}
+
 func (gs groupState) Close() error {
 	// We still try close all state objects to minimize
 	// resource leaks when Close fails for one object..
@@ -20,7 +20,11 @@ package msgpipeline
 
 import (
 	"context"
+	"fmt"
 	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/emersion/go-message/textproto"
@@ -57,6 +61,40 @@ type checkRunner struct {
 	safelistRequiresAuthResults bool
 
 	mergedRes module.CheckResult
+
+	// Sum of scores reported by checks using 'score' action and
+	// per-check contributions for the X-Spam-Score header.
+	score      float64
+	scoreTests map[string]float64
+	scoreLock  sync.Mutex
+
+	// Quarantine flag set by checks reporting authentication results or
+	// malware and the score reported by authentication checks. They are
+	// applied even for recipients that allowlist or safelist the sender.
+	strictQuarantine bool
+	authScore        float64
+
+	// Add X-Maddy-Monitor header for results of monitor-only checks.
+	monitorHeader bool
+}
+
+// scoreThresholds are the 'quarantine_score' and 'reject_score' values
+// configured for a pipeline block. nil means the threshold is not set.
+type scoreThresholds struct {
+	quarantine *float64
+	reject     *float64
+}
+
+// merge returns thresholds from st, falling back to values from parent
+// for unset ones.
+func (st scoreThresholds) merge(parent scoreThresholds) scoreThresholds {
+	if st.quarantine == nil {
+		st.quarantine = parent.quarantine
+	}
+	if st.reject == nil {
+		st.reject = parent.reject
+	}
+	return st
 }
 
 func newCheckRunner(msgMeta *module.MsgMetadata, log log.Logger, r dns.Resolver) *checkRunner {
@@ -67,6 +105,7 @@ func newCheckRunner(msgMeta *module.MsgMetadata, log log.Logger, r dns.Resolver)
 		resolver:             r,
 		dmarcVerify:          dmarc.NewVerifier(r),
 		states:               make(map[module.Check]module.CheckState),
+		scoreTests:           make(map[string]float64),
 	}
 }
 
@@ -181,6 +220,8 @@ func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner fun
 		rejectCheck  string
 		setRejectErr sync.Once
 
+		strictQuarantine bool
+
 		wg sync.WaitGroup
 	}{}
 
@@ -197,10 +238,11 @@ func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner fun
 			}()
 
 			subCheckRes := runner(state)
+			isAuthRes := len(subCheckRes.AuthResult) != 0
 
 			// We check the length because we don't want to take locks
 			// when it is not necessary.
-			if len(subCheckRes.AuthResult) != 0 {
+			if isAuthRes {
 				data.authResLock.Lock()
 				cr.mergedRes.AuthResult = append(cr.mergedRes.AuthResult, subCheckRes.AuthResult...)
 				data.authResLock.Unlock()
@@ -226,15 +268,31 @@ func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner fun
 				data.headerLock.Unlock()
 			}
 
+			if subCheckRes.Monitor {
+				data.headerLock.Lock()
+				cr.monitorResult(subCheckRes)
+				data.headerLock.Unlock()
+				return
+			}
+
+			if subCheckRes.Score != 0 {
+				cr.addScore(subCheckRes.Reason, subCheckRes.Score, isAuthRes)
+			}
+
 			if subCheckRes.Quarantine {
 				data.setQuarantineErr.Do(func() {
 					data.quarantineErr = subCheckRes.Reason
 				})
+				if isAuthRes || subCheckRes.Malware {
+					data.authResLock.Lock()
+					data.strictQuarantine = true
+					data.authResLock.Unlock()
+				}
 			} else if subCheckRes.Reject {
 				data.setRejectErr.Do(func() {
 					data.rejectErr = subCheckRes.Reason
 				})
-			} else if subCheckRes.Reason != nil {
+			} else if subCheckRes.Reason != nil && subCheckRes.Score == 0 {
 				// 'action ignore' case. There is Reason, but action.Apply set
 				// both Reject and Quarantine to false. Log the reason for
 				// purposes of deployment testing.
@@ -252,10 +310,78 @@ func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner fun
 		cr.log.Error("quarantined", data.quarantineErr)
 		cr.mergedRes.Quarantine = true
 	}
+	if data.strictQuarantine {
+		cr.strictQuarantine = true
+	}
 
 	return nil
 }
 
+// monitorResult records the result of a monitor-only check without
+// applying it. Caller should hold the lock protecting mergedRes.Header.
+func (cr *checkRunner) monitorResult(res module.CheckResult) {
+	var action, desc string
+	switch {
+	case res.Reject:
+		action, desc = "reject", "would have rejected"
+	case res.Quarantine:
+		action, desc = "quarantine", "would have quarantined"
+	case res.Score != 0:
+		action, desc = "score", "would have added score "+formatScore(res.Score)
+	default:
+		return
+	}
+
+	name, _ := exterrors.Fields(res.Reason)["check"].(string)
+	if name == "" {
+		name = "unknown"
+	}
+
+	cr.log.Error(desc, res.Reason, "check", name)
+	checkMonitored.WithLabelValues(name, action).Inc()
+
+	if cr.monitorHeader {
+		reason := strings.ReplaceAll(res.Reason.Error(), "\n", " ")
+		cr.mergedRes.Header.Add("X-Maddy-Monitor", desc+": "+name+": "+reason)
+	}
+}
+
+func (cr *checkRunner) addScore(reason error, score float64, isAuthRes bool) {
+	name, _ := exterrors.Fields(reason)["check"].(string)
+	if name == "" {
+		name = "unknown"
+	}
+
+	cr.scoreLock.Lock()
+	defer cr.scoreLock.Unlock()
+	cr.score += score
+	cr.scoreTests[name] += score
+	if isAuthRes {
+		cr.authScore += score
+	}
+	cr.log.DebugMsg("score added", "check", name, "score", score, "total", cr.score)
+}
+
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
+
+// scoreHeader formats the X-Spam-Score header field value, listing
+// checks that contributed to the total score.
+func (cr *checkRunner) scoreHeader() string {
+	names := make([]string, 0, len(cr.scoreTests))
+	for name := range cr.scoreTests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tests := make([]string, 0, len(names))
+	for _, name := range names {
+		tests = append(tests, name+"="+formatScore(cr.scoreTests[name]))
+	}
+	return fmt.Sprintf("%s tests=[%s]", formatScore(cr.score), strings.Join(tests, ", "))
+}
+
 func (cr *checkRunner) checkSafelist(ctx context.Context, checks []module.Check, msgMeta *module.MsgMetadata) {
 	for _, check := range checks {
 		safelistCheck, ok := check.(module.SafelistCheck)
@@ -289,6 +415,39 @@ func (cr *checkRunner) checkSafelist(ctx context.Context, checks []module.Check,
 	}
 }
 
+// checkRcptSafelist runs checks implementing module.RcptSafelistCheck for
+// the recipient and returns the merged result. Unlike checkSafelist, it
+// does not change results for the whole message, the result is applied
+// only to the recipient by applyRcptResults.
+//
+// Header fields returned by checks are not used since the message is
+// delivered to other recipients too.
+func (cr *checkRunner) checkRcptSafelist(ctx context.Context, checks []module.Check, rcptTo string) module.SafelistCheckResult {
+	var merged module.SafelistCheckResult
+	for _, check := range checks {
+		safelistCheck, ok := check.(module.RcptSafelistCheck)
+		if !ok {
+			continue
+		}
+		safelistResult := safelistCheck.CheckRcptSafelist(ctx, cr.msgMeta, rcptTo)
+		if !safelistResult.Safelist {
+			continue
+		}
+
+		if merged.Safelist {
+			merged.RequiresAuthResults = merged.RequiresAuthResults && safelistResult.RequiresAuthResults
+		} else {
+			merged.RequiresAuthResults = safelistResult.RequiresAuthResults
+		}
+		merged.Safelist = true
+
+		if !merged.RequiresAuthResults {
+			break
+		}
+	}
+	return merged
+}
+
 func (cr *checkRunner) checkConnSender(ctx context.Context, checks []module.Check, mailFrom string) error {
 	cr.mailFrom = mailFrom
 	cr.mailFromReceived = true
@@ -341,43 +500,106 @@ func (cr *checkRunner) checkBody(ctx context.Context, checks []module.Check, hea
 	})
 }
 
-func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) error {
+func (cr *checkRunner) applyResults(hostname string, header *textproto.Header, thresholds scoreThresholds) error {
 	if cr.mergedRes.Quarantine {
 		cr.msgMeta.Quarantine = true
 	}
 
-	if cr.doDMARC {
-		dmarcRes, policy := cr.dmarcVerify.Apply(cr.mergedRes.AuthResult)
-		cr.mergedRes.AuthResult = append(cr.mergedRes.AuthResult, &dmarcRes.Authres)
-		switch policy {
-		case dmarc.PolicyReject:
-			code := 550
-			enchCode := exterrors.EnhancedCode{5, 7, 1}
-			if dmarcRes.Authres.Value == authres.ResultTempError {
-				code = 450
-				enchCode[0] = 4
-			}
-			return &exterrors.SMTPError{
-				Code:         code,
-				EnhancedCode: enchCode,
-				Message:      "DMARC check failed",
-				CheckName:    "dmarc",
-				Misc: map[string]interface{}{
-					"reason":      dmarcRes.Authres.Reason,
-					"dkim_res":    dmarcRes.DKIMResult.Value,
-					"dkim_domain": dmarcRes.DKIMResult.Domain,
-					"spf_res":     dmarcRes.SPFResult.Value,
-					"spf_from":    dmarcRes.SPFResult.From,
-				},
-			}
-		case dmarc.PolicyQuarantine:
-			cr.msgMeta.Quarantine = true
+	scoreQuarantine, scoreRejectErr := cr.scoreVerdict(thresholds)
+	if scoreRejectErr != nil {
+		return scoreRejectErr
+	}
+	if scoreQuarantine {
+		cr.msgMeta.Quarantine = true
+		cr.log.Msg("quarantined", "reason", "score threshold reached", "check", "score",
+			"score", cr.score, "threshold", *thresholds.quarantine)
+	}
+
+	dmarcQuarantine, dmarcRejectErr := cr.dmarcVerdict()
+	if dmarcRejectErr != nil {
+		return dmarcRejectErr
+	}
+	if dmarcQuarantine {
+		cr.msgMeta.Quarantine = true
+	}
+
+	cr.addHeaders(hostname, header)
+	return nil
+}
 
-			// Mimick the message structure for regular checks.
-			cr.log.Msg("quarantined", "reason", dmarcRes.Authres.Reason, "check", "dmarc")
+// scoreVerdict compares the total score against thresholds. It returns
+// true if the quarantine threshold is reached and the rejection error if
+// the reject threshold is reached.
+func (cr *checkRunner) scoreVerdict(thresholds scoreThresholds) (bool, error) {
+	if len(cr.scoreTests) == 0 {
+		return false, nil
+	}
+
+	if thresholds.reject != nil && cr.score >= *thresholds.reject {
+		return false, &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Message rejected due to a high spam score",
+			CheckName:    "score",
+			Misc: map[string]interface{}{
+				"score":     cr.score,
+				"threshold": *thresholds.reject,
+				"tests":     cr.scoreHeader(),
+			},
+		}
+	}
+	return thresholds.quarantine != nil && cr.score >= *thresholds.quarantine, nil
+}
+
+// authScoreVerdict reports whether the score added by checks reporting
+// authentication results reaches the quarantine threshold.
+func (cr *checkRunner) authScoreVerdict(thresholds scoreThresholds) bool {
+	if len(cr.scoreTests) == 0 {
+		return false
+	}
+	return thresholds.quarantine != nil && cr.authScore >= *thresholds.quarantine
+}
+
+// dmarcVerdict applies the DMARC policy and adds the DMARC result to
+// Authentication-Results. It should be called only once per message.
+func (cr *checkRunner) dmarcVerdict() (bool, error) {
+	if !cr.doDMARC {
+		return false, nil
+	}
+
+	dmarcRes, policy := cr.dmarcVerify.Apply(cr.mergedRes.AuthResult)
+	cr.mergedRes.AuthResult = append(cr.mergedRes.AuthResult, &dmarcRes.Authres)
+	switch policy {
+	case dmarc.PolicyReject:
+		code := 550
+		enchCode := exterrors.EnhancedCode{5, 7, 1}
+		if dmarcRes.Authres.Value == authres.ResultTempError {
+			code = 450
+			enchCode[0] = 4
+		}
+		return false, &exterrors.SMTPError{
+			Code:         code,
+			EnhancedCode: enchCode,
+			Message:      "DMARC check failed",
+			CheckName:    "dmarc",
+			Misc: map[string]interface{}{
+				"reason":      dmarcRes.Authres.Reason,
+				"dkim_res":    dmarcRes.DKIMResult.Value,
+				"dkim_domain": dmarcRes.DKIMResult.Domain,
+				"spf_res":     dmarcRes.SPFResult.Value,
+				"spf_from":    dmarcRes.SPFResult.From,
+			},
 		}
+	case dmarc.PolicyQuarantine:
+		// Mimick the message structure for regular checks.
+		cr.log.Msg("quarantined", "reason", dmarcRes.Authres.Reason, "check", "dmarc")
+		return true, nil
 	}
+	return false, nil
+}
 
+// addHeaders adds header fields with check results to the message header.
+func (cr *checkRunner) addHeaders(hostname string, header *textproto.Header) {
 	// After results for all checks are checked, authRes will be populated with values
 	// we should put into Authentication-Results header.
 	if len(cr.mergedRes.AuthResult) != 0 {
@@ -392,11 +614,23 @@ func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) e
 		header.AddRaw(formatted)
 	}
 
+	if len(cr.scoreTests) != 0 {
+		header.Set("X-Spam-Score", cr.scoreHeader())
+	}
+
 	if cr.msgMeta.Quarantine {
 		header.Set("X-Spam-Flag", "Yes")
 	}
+}
 
-	return nil
+// commit notifies check states implementing module.CommitCheckState that
+// the message is committed.
+func (cr *checkRunner) commit(ctx context.Context) {
+	for _, state := range cr.states {
+		if commitState, ok := state.(module.CommitCheckState); ok {
+			commitState.CheckCommit(ctx)
+		}
+	}
 }
 
 func (cr *checkRunner) close() {
@@ -19,11 +19,15 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package msgpipeline
 
 import (
+	"context"
 	"errors"
+	"reflect"
+	"sort"
 	"testing"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
@@ -446,3 +450,270 @@ func TestMsgPipeline_RcptCheck_Errors(t *testing.T) {
 			check_.UnclosedStates, sourceCheck.UnclosedStates, globalCheck.UnclosedStates)
 	}
 }
+
+func TestMsgPipeline_Score(t *testing.T) {
+	scoreVal := func(f float64) *float64 { return &f }
+
+	target := testutils.Target{}
+	check1, check2 := testutils.Check{
+		SenderRes: module.CheckResult{
+			Reason: &exterrors.SMTPError{CheckName: "check1"},
+			Score:  2,
+		},
+	}, testutils.Check{
+		BodyRes: module.CheckResult{
+			Reason: &exterrors.SMTPError{CheckName: "check2"},
+			Score:  3.5,
+		},
+	}
+	rcpt := &rcptBlock{
+		targets: []module.DeliveryTarget{&target},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&check1, &check2},
+			globalScores: scoreThresholds{reject: scoreVal(10)},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				scores:      scoreThresholds{quarantine: scoreVal(5)},
+				perRcpt:     map[string]*rcptBlock{},
+				defaultRcpt: rcpt,
+			},
+		},
+		Hostname: "TEST-HOST",
+		Log:      testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "whatever@whatever", []string{"whatever@whatever"})
+
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+	msg := target.Messages[0]
+	if !msg.MsgMeta.Quarantine {
+		t.Fatalf("message is not quarantined when it should")
+	}
+	if score := msg.Header.Get("X-Spam-Score"); score != "5.5 tests=[check1=2, check2=3.5]" {
+		t.Fatalf("wrong X-Spam-Score value: %s", score)
+	}
+
+	// Per-destination threshold overrides the global one.
+	rcpt.scores.reject = scoreVal(5)
+	_, err := testutils.DoTestDeliveryErr(t, &d, "whatever@whatever", []string{"whatever@whatever"})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+
+	if check1.UnclosedStates != 0 || check2.UnclosedStates != 0 {
+		t.Fatalf("checks state objects leak or double-closed, alive counters: %v, %v", check1.UnclosedStates, check2.UnclosedStates)
+	}
+}
+
+func TestMsgPipeline_Monitor(t *testing.T) {
+	target := testutils.Target{}
+	check1, check2 := testutils.Check{
+		RcptRes: module.CheckResult{
+			Reason:  &exterrors.SMTPError{Message: "bad rcpt", CheckName: "check1"},
+			Reject:  true,
+			Monitor: true,
+		},
+	}, testutils.Check{
+		BodyRes: module.CheckResult{
+			Reason:     &exterrors.SMTPError{Message: "bad body", CheckName: "check2"},
+			Quarantine: true,
+			Monitor:    true,
+		},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks:  []module.Check{&check1, &check2},
+			monitorHeader: true,
+			perSource:     map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Hostname: "TEST-HOST",
+		Log:      testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "whatever@whatever", []string{"whatever@whatever"})
+
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+	msg := target.Messages[0]
+	if msg.MsgMeta.Quarantine {
+		t.Fatalf("message is quarantined when it shouldn't")
+	}
+
+	var fields []string
+	for field := msg.Header.FieldsByKey("X-Maddy-Monitor"); field.Next(); {
+		fields = append(fields, field.Value())
+	}
+	sort.Strings(fields)
+	want := []string{
+		"would have quarantined: check2: bad body",
+		"would have rejected: check1: bad rcpt",
+	}
+	if !reflect.DeepEqual(fields, want) {
+		t.Fatalf("wrong X-Maddy-Monitor fields, want %v, got %v", want, fields)
+	}
+
+	if check1.UnclosedStates != 0 || check2.UnclosedStates != 0 {
+		t.Fatalf("checks state objects leak or double-closed, alive counters: %v, %v", check1.UnclosedStates, check2.UnclosedStates)
+	}
+}
+
+type rcptSafelistCheck struct {
+	testutils.Check
+	rcpt string
+}
+
+func (c *rcptSafelistCheck) CheckRcptSafelist(_ context.Context, _ *module.MsgMetadata, rcptTo string) module.SafelistCheckResult {
+	return module.SafelistCheckResult{
+		Safelist:            rcptTo == c.rcpt,
+		RequiresAuthResults: true,
+	}
+}
+
+func TestMsgPipeline_RcptSafelist(t *testing.T) {
+	target := testutils.Target{}
+	check1, check2 := testutils.Check{
+		ConnRes: module.CheckResult{
+			Reason:     &exterrors.SMTPError{CheckName: "check1"},
+			Quarantine: true,
+		},
+		SenderRes: module.CheckResult{
+			Reason: &exterrors.SMTPError{CheckName: "check1"},
+			Score:  3,
+		},
+	}, testutils.Check{
+		BodyRes: module.CheckResult{
+			Reason:     &exterrors.SMTPError{CheckName: "check2"},
+			Quarantine: true,
+		},
+	}
+	safelist := rcptSafelistCheck{rcpt: "friend@example.org"}
+	pipeline := func(checks ...module.Check) *MsgPipeline {
+		return &MsgPipeline{
+			msgpipelineCfg: msgpipelineCfg{
+				globalChecks: checks,
+				perSource:    map[string]sourceBlock{},
+				defaultSource: sourceBlock{
+					perRcpt: map[string]*rcptBlock{},
+					defaultRcpt: &rcptBlock{
+						targets: []module.DeliveryTarget{&target},
+					},
+				},
+			},
+			Hostname: "TEST-HOST",
+			Log:      testutils.Logger(t, "msgpipeline"),
+		}
+	}
+
+	d := pipeline(&check1, &safelist, &check2, spfPassCheck())
+	testutils.DoTestDelivery(t, d, "whatever@example.com", []string{"friend@example.org", "stranger@example.org"})
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+	msgMeta := target.Messages[0].MsgMeta
+	if msgMeta.IsQuarantined("friend@example.org") {
+		t.Errorf("message should not be quarantined for friend")
+	}
+	if !msgMeta.IsQuarantined("stranger@example.org") {
+		t.Errorf("message should be quarantined for stranger")
+	}
+
+	// Safelist requires authentication results.
+	d = pipeline(&check1, &safelist, &check2)
+	testutils.DoTestDelivery(t, d, "whatever@example.com", []string{"friend@example.org"})
+	if len(target.Messages) != 2 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 2, len(target.Messages))
+	}
+	if !target.Messages[1].MsgMeta.IsQuarantined("friend@example.org") {
+		t.Errorf("message from unauthenticated sender should be quarantined for friend")
+	}
+
+	// Rejections are not overridden.
+	check2.BodyRes = module.CheckResult{
+		Reason: &exterrors.SMTPError{CheckName: "check2"},
+		Reject: true,
+	}
+	d = pipeline(&check1, &safelist, &check2, spfPassCheck())
+	if _, err := testutils.DoTestDeliveryErr(t, d, "whatever@example.com", []string{"friend@example.org"}); err == nil {
+		t.Fatal("expected error")
+	}
+
+	if check1.UnclosedStates != 0 || check2.UnclosedStates != 0 || safelist.UnclosedStates != 0 {
+		t.Fatalf("checks state objects leak or double-closed, alive counters: %v, %v, %v",
+			check1.UnclosedStates, check2.UnclosedStates, safelist.UnclosedStates)
+	}
+}
+
+type commitCheck struct {
+	testutils.Check
+	commits int
+}
+
+type commitCheckState struct {
+	module.CheckState
+	c *commitCheck
+}
+
+func (c *commitCheck) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	state, err := c.Check.CheckStateForMsg(ctx, msgMeta)
+	if err != nil {
+		return nil, err
+	}
+	return &commitCheckState{CheckState: state, c: c}, nil
+}
+
+func (s *commitCheckState) CheckCommit(context.Context) {
+	s.c.commits++
+}
+
+func TestMsgPipeline_CheckCommit(t *testing.T) {
+	target := testutils.Target{}
+	check := commitCheck{}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&check},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Hostname: "TEST-HOST",
+		Log:      testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "whatever@whatever", []string{"whatever@whatever"})
+	if check.commits != 1 {
+		t.Fatalf("CheckCommit is called %d times, want 1", check.commits)
+	}
+
+	check.BodyRes = module.CheckResult{
+		Reason: &exterrors.SMTPError{CheckName: "check"},
+		Reject: true,
+	}
+	if _, err := testutils.DoTestDeliveryErr(t, &d, "whatever@whatever", []string{"whatever@whatever"}); err == nil {
+		t.Fatal("expected error")
+	}
+	if check.commits != 1 {
+		t.Fatalf("CheckCommit is called for the rejected message")
+	}
+
+	if check.UnclosedStates != 0 {
+		t.Fatalf("check state objects leak or double-closed, alive counter: %v", check.UnclosedStates)
+	}
+}
@@ -40,10 +40,13 @@ type sourceIn struct {
 type msgpipelineCfg struct {
 	globalChecks    []module.Check
 	globalModifiers modify.Group
+	globalScores    scoreThresholds
+	rcptPrefs       module.Table
 	sourceIn        []sourceIn
 	perSource       map[string]sourceBlock
 	defaultSource   sourceBlock
 	doDMARC         bool
+	monitorHeader   bool
 }
 
 func parseMsgPipelineRootCfg(globals map[string]interface{}, nodes []config.Node) (msgpipelineCfg, error) {
@@ -68,6 +71,14 @@ func parseMsgPipelineRootCfg(globals map[string]interface{}, nodes []config.Node
 			}
 
 			cfg.globalModifiers.Modifiers = append(cfg.globalModifiers.Modifiers, globalModifiers.Modifiers...)
+		case "quarantine_score", "reject_score":
+			if err := parseScoreDirective(node, &cfg.globalScores); err != nil {
+				return msgpipelineCfg{}, err
+			}
+		case "rcpt_preferences":
+			if err := modconfig.ModuleFromNode("table", node.Args, node, globals, &cfg.rcptPrefs); err != nil {
+				return msgpipelineCfg{}, err
+			}
 		case "source_in":
 			var tbl module.Table
 			if err := modconfig.ModuleFromNode("table", node.Args, config.Node{}, globals, &tbl); err != nil {
@@ -129,6 +140,19 @@ func parseMsgPipelineRootCfg(globals map[string]interface{}, nodes []config.Node
 			case 0:
 				cfg.doDMARC = true
 			}
+		case "monitor_header":
+			switch len(node.Args) {
+			case 1:
+				switch node.Args[0] {
+				case "yes":
+					cfg.monitorHeader = true
+				case "no":
+				default:
+					return msgpipelineCfg{}, config.NodeErr(node, "invalid argument for monitor_header")
+				}
+			case 0:
+				cfg.monitorHeader = true
+			}
 		case "deliver_to", "reroute", "destination_in", "destination", "default_destination", "reject":
 			othersRaw = append(othersRaw, node)
 		default:
@@ -179,6 +203,10 @@ func parseMsgPipelineSrcCfg(globals map[string]interface{}, nodes []config.Node)
 			}
 
 			src.modifiers.Modifiers = append(src.modifiers.Modifiers, modifiers.Modifiers...)
+		case "quarantine_score", "reject_score":
+			if err := parseScoreDirective(node, &src.scores); err != nil {
+				return sourceBlock{}, err
+			}
 		case "destination_in":
 			var tbl module.Table
 			if err := modconfig.ModuleFromNode("table", node.Args, config.Node{}, globals, &tbl); err != nil {
@@ -273,6 +301,10 @@ func parseMsgPipelineRcptCfg(globals map[string]interface{}, nodes []config.Node
 			}
 
 			rcpt.modifiers.Modifiers = append(rcpt.modifiers.Modifiers, modifiers.Modifiers...)
+		case "quarantine_score", "reject_score":
+			if err := parseScoreDirective(node, &rcpt.scores); err != nil {
+				return nil, err
+			}
 		case "deliver_to":
 			if rcpt.rejectErr != nil {
 				return nil, config.NodeErr(node, "can't use 'reject' and 'deliver_to' together")
@@ -315,6 +347,26 @@ func parseMsgPipelineRcptCfg(globals map[string]interface{}, nodes []config.Node
 	return &rcpt, nil
 }
 
+func parseScoreDirective(node config.Node, scores *scoreThresholds) error {
+	if len(node.Args) != 1 {
+		return config.NodeErr(node, "expected exactly 1 argument")
+	}
+	if len(node.Children) != 0 {
+		return config.NodeErr(node, "can't declare block here")
+	}
+	val, err := strconv.ParseFloat(node.Args[0], 64)
+	if err != nil {
+		return config.NodeErr(node, "invalid score: %v", err)
+	}
+
+	if node.Name == "quarantine_score" {
+		scores.quarantine = &val
+	} else {
+		scores.reject = &val
+	}
+	return nil
+}
+
 func parseRejectDirective(node config.Node) (*exterrors.SMTPError, error) {
 	code := 554
 	enchCode := exterrors.EnhancedCode{5, 7, 0}
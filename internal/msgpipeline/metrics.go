@@ -39,9 +39,19 @@ var (
 		},
 		[]string{"check"},
 	)
+	checkMonitored = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "check",
+			Name:      "monitored",
+			Help:      "Number of times a monitor-only check returned a result that was not applied, labeled by the action that would have been taken",
+		},
+		[]string{"check", "action"},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(checkReject)
 	prometheus.MustRegister(checkQuarantined)
+	prometheus.MustRegister(checkMonitored)
 }
@@ -22,6 +22,7 @@ import (
 	"errors"
 	"testing"
 
+	"github.com/emersion/go-message/textproto"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/modify"
 	"github.com/foxcpp/maddy/internal/testutils"
@@ -707,3 +708,40 @@ func TestMsgPipeline_RcptModifier_Errors(t *testing.T) {
 			mod.UnclosedStates, globalMod.UnclosedStates, sourceMod.UnclosedStates)
 	}
 }
+
+func TestMsgPipeline_BodyReplacer(t *testing.T) {
+	target := testutils.Target{}
+	modifier := testutils.Modifier{
+		InstName: "test_modifier",
+		NewBody:  []byte("replaced body\r\n"),
+		AddHdr:   textproto.Header{},
+	}
+	modifier.AddHdr.Add("X-Test", "1")
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalModifiers: modify.Group{
+				Modifiers: []module.Modifier{modifier},
+			},
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"rcpt1@example.com"})
+
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+	if string(target.Messages[0].Body) != "replaced body\r\n" {
+		t.Fatalf("body is not replaced: %q", target.Messages[0].Body)
+	}
+	if target.Messages[0].Header.Get("X-Test") != "1" {
+		t.Fatalf("RewriteBody was not called")
+	}
+}
@@ -71,6 +71,7 @@ type rcptIn struct {
 
 type sourceBlock struct {
 	checks      []module.Check
+	scores      scoreThresholds
 	modifiers   modify.Group
 	rejectErr   error
 	rcptIn      []rcptIn
@@ -80,6 +81,7 @@ type sourceBlock struct {
 
 type rcptBlock struct {
 	checks    []module.Check
+	scores    scoreThresholds
 	modifiers modify.Group
 	rejectErr error
 	targets   []module.DeliveryTarget
@@ -127,6 +129,7 @@ func (d *MsgPipeline) Start(ctx context.Context, msgMeta *module.MsgMetadata, ma
 	}
 	dd.checkRunner = newCheckRunner(msgMeta, dd.log, d.Resolver)
 	dd.checkRunner.doDMARC = d.doDMARC
+	dd.checkRunner.monitorHeader = d.monitorHeader
 
 	if msgMeta.OriginalRcpts == nil {
 		msgMeta.OriginalRcpts = map[string]string{}
@@ -279,6 +282,23 @@ type msgpipelineDelivery struct {
 	deliveries  map[module.DeliveryTarget]*delivery
 	msgMeta     *module.MsgMetadata
 	checkRunner *checkRunner
+
+	// Body created by modifiers implementing module.BodyReplacer. It is
+	// removed after the delivery is committed or aborted.
+	replacedBody buffer.Buffer
+
+	// Final recipient addresses, their preferences from the
+	// rcpt_preferences table (nil if there are none) and results of
+	// per-recipient safelist checks.
+	rcpts          []string
+	rcptPrefs      map[string]*rcptPrefs
+	rcptSafelist   map[string]module.SafelistCheckResult
+	perRcptResults bool
+
+	// rejectKey value shared by all recipients, see checkRejectKeys.
+	rejectKey       string
+	rejectKeySet    bool
+	mixedRejectKeys bool
 }
 
 func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string) error {
@@ -310,6 +330,14 @@ func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string) error {
 	dd.log.Debugln("per-source rcpt modifiers:", to, "=>", newTo)
 	resultTo = newTo
 
+	type finalRcpt struct {
+		to       string
+		block    *rcptBlock
+		prefs    *rcptPrefs
+		safelist module.SafelistCheckResult
+	}
+	var finalRcpts []finalRcpt
+
 	for _, to = range resultTo {
 		wrapErr := func(err error) error {
 			return exterrors.WithFields(err, map[string]interface{}{
@@ -349,30 +377,66 @@ func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string) error {
 				})
 			}
 
-			if originalTo != to {
-				dd.msgMeta.OriginalRcpts[to] = originalTo
+			prefs, err := dd.lookupRcptPrefs(ctx, to)
+			if err != nil {
+				return wrapErr(err)
+			}
+			if prefs != nil && listMatches(prefs.block, senderAddrs(dd.sourceAddr, "")) {
+				return wrapErr(blockedErr())
+			}
+
+			finalRcpts = append(finalRcpts, finalRcpt{
+				to:       to,
+				block:    rcptBlock,
+				prefs:    prefs,
+				safelist: dd.checkRunner.checkRcptSafelist(ctx, dd.d.globalChecks, to),
+			})
+		}
+	}
+
+	// Recipients are added to targets only after all of them are known to
+	// be accepted, see checkRejectKeys.
+	keys := make([]string, 0, len(finalRcpts))
+	for _, rcpt := range finalRcpts {
+		keys = append(keys, rejectKey(rcpt.prefs, rcpt.safelist))
+	}
+	if err := dd.checkRejectKeys(keys); err != nil {
+		return err
+	}
+
+	for _, rcpt := range finalRcpts {
+		to := rcpt.to
+		wrapErr := func(err error) error {
+			return exterrors.WithFields(err, map[string]interface{}{
+				"effective_rcpt": to,
+			})
+		}
+
+		dd.addFinalRcpt(to, rcpt.prefs, rcpt.safelist)
+
+		if originalTo != to {
+			dd.msgMeta.OriginalRcpts[to] = originalTo
+		}
+
+		for _, tgt := range rcpt.block.targets {
+			// Do not wrap errors coming from nested pipeline target delivery since
+			// that pipeline itself will insert effective_rcpt field and could do
+			// its own rewriting - we do not want to hide it from the admin in
+			// error messages.
+			wrapErr := wrapErr
+			if _, ok := tgt.(*MsgPipeline); ok {
+				wrapErr = func(err error) error { return err }
+			}
+
+			delivery, err := dd.getDelivery(ctx, tgt)
+			if err != nil {
+				return wrapErr(err)
 			}
 
-			for _, tgt := range rcptBlock.targets {
-				// Do not wrap errors coming from nested pipeline target delivery since
-				// that pipeline itself will insert effective_rcpt field and could do
-				// its own rewriting - we do not want to hide it from the admin in
-				// error messages.
-				wrapErr := wrapErr
-				if _, ok := tgt.(*MsgPipeline); ok {
-					wrapErr = func(err error) error { return err }
-				}
-
-				delivery, err := dd.getDelivery(ctx, tgt)
-				if err != nil {
-					return wrapErr(err)
-				}
-
-				if err := delivery.AddRcpt(ctx, to); err != nil {
-					return wrapErr(err)
-				}
-				delivery.recipients = append(delivery.recipients, originalTo)
+			if err := delivery.AddRcpt(ctx, to); err != nil {
+				return wrapErr(err)
 			}
+			delivery.recipients = append(delivery.recipients, originalTo)
 		}
 	}
 
@@ -380,17 +444,9 @@ func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string) error {
 }
 
 func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
-	if err := dd.checkRunner.checkBody(ctx, dd.d.globalChecks, header, body); err != nil {
+	if err := dd.checkBody(ctx, header, body); err != nil {
 		return err
 	}
-	if err := dd.checkRunner.checkBody(ctx, dd.sourceBlock.checks, header, body); err != nil {
-		return err
-	}
-	for blk := range dd.rcptModifiersState {
-		if err := dd.checkRunner.checkBody(ctx, blk.checks, header, body); err != nil {
-			return err
-		}
-	}
 
 	if dd.d.FirstPipeline {
 		// Add Received *after* checks to make sure they see the message literally
@@ -404,7 +460,18 @@ func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header
 		header.Add("Received", received)
 	}
 
-	if err := dd.checkRunner.applyResults(dd.d.Hostname, &header); err != nil {
+	if dd.perRcptResults {
+		if err := dd.applyRcptResults(dd.d.Hostname, &header); err != nil {
+			return err
+		}
+	} else {
+		if err := dd.checkRunner.applyResults(dd.d.Hostname, &header, dd.scoreThresholds()); err != nil {
+			return err
+		}
+	}
+
+	body, err := dd.replaceBody(ctx, &header, body)
+	if err != nil {
 		return err
 	}
 
@@ -431,6 +498,40 @@ func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header
 	return nil
 }
 
+// checkBody runs body checks for all pipeline blocks used for the
+// message.
+func (dd *msgpipelineDelivery) checkBody(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	if err := dd.checkRunner.checkBody(ctx, dd.d.globalChecks, header, body); err != nil {
+		return err
+	}
+	if err := dd.checkRunner.checkBody(ctx, dd.sourceBlock.checks, header, body); err != nil {
+		return err
+	}
+	for blk := range dd.rcptModifiersState {
+		if err := dd.checkRunner.checkBody(ctx, blk.checks, header, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scoreThresholds returns score thresholds to apply to the message.
+// Per-destination values take precedence over per-source ones which in
+// turn take precedence over global ones. If the message is handled by
+// multiple destination blocks, the lowest threshold is used.
+func (dd *msgpipelineDelivery) scoreThresholds() scoreThresholds {
+	var rcptScores scoreThresholds
+	for blk := range dd.rcptModifiersState {
+		if q := blk.scores.quarantine; q != nil && (rcptScores.quarantine == nil || *q < *rcptScores.quarantine) {
+			rcptScores.quarantine = q
+		}
+		if r := blk.scores.reject; r != nil && (rcptScores.reject == nil || *r < *rcptScores.reject) {
+			rcptScores.reject = r
+		}
+	}
+	return rcptScores.merge(dd.sourceBlock.scores.merge(dd.d.globalScores))
+}
+
 // statusCollector wraps StatusCollector and adds reverse translation
 // of recipients for all statuses.]
 //
@@ -470,6 +571,12 @@ func (dd *msgpipelineDelivery) BodyNonAtomic(ctx context.Context, c module.Statu
 		return
 	}
 
+	body, err := dd.replaceBody(ctx, &header, body)
+	if err != nil {
+		setStatusAll(err)
+		return
+	}
+
 	// Run modifiers after Authentication-Results addition to make
 	// sure signatures, etc will cover it.
 	if err := dd.globalModifiersState.RewriteBody(ctx, &header, body); err != nil {
@@ -506,7 +613,10 @@ func (dd *msgpipelineDelivery) BodyNonAtomic(ctx context.Context, c module.Statu
 }
 
 func (dd msgpipelineDelivery) Commit(ctx context.Context) error {
-	dd.close()
+	// Check states are closed only after the commit so they can be
+	// notified about it.
+	defer dd.close()
+	defer dd.removeReplacedBody()
 
 	for _, delivery := range dd.deliveries {
 		if err := delivery.Commit(ctx); err != nil {
@@ -514,9 +624,51 @@ func (dd msgpipelineDelivery) Commit(ctx context.Context) error {
 			return err
 		}
 	}
+
+	dd.checkRunner.commit(ctx)
 	return nil
 }
 
+// replaceBody runs ReplaceBody for all modifiers that implement
+// module.BodyReplacer and returns the body to use for further processing.
+func (dd *msgpipelineDelivery) replaceBody(ctx context.Context, header *textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	states := make([]module.ModifierState, 0, 2+len(dd.rcptModifiersState))
+	states = append(states, dd.globalModifiersState, dd.sourceModifiersState)
+	for _, state := range dd.rcptModifiersState {
+		states = append(states, state)
+	}
+
+	for _, state := range states {
+		replacer, ok := state.(module.BodyReplacer)
+		if !ok {
+			continue
+		}
+
+		newBody, err := replacer.ReplaceBody(ctx, header, body)
+		if err != nil {
+			return nil, err
+		}
+		if newBody == nil {
+			continue
+		}
+
+		dd.removeReplacedBody()
+		dd.replacedBody = newBody
+		body = newBody
+	}
+	return body, nil
+}
+
+func (dd *msgpipelineDelivery) removeReplacedBody() {
+	if dd.replacedBody == nil {
+		return
+	}
+	if err := dd.replacedBody.Remove(); err != nil {
+		dd.log.Error("failed to remove replaced body", err)
+	}
+	dd.replacedBody = nil
+}
+
 func (dd *msgpipelineDelivery) close() {
 	dd.checkRunner.close()
 
@@ -533,6 +685,7 @@ func (dd *msgpipelineDelivery) close() {
 
 func (dd msgpipelineDelivery) Abort(ctx context.Context) error {
 	dd.close()
+	defer dd.removeReplacedBody()
 
 	var lastErr error
 	for _, delivery := range dd.deliveries {
@@ -0,0 +1,407 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/dmarc"
+)
+
+type quarantineMode int
+
+const (
+	// Put quarantined messages into the Junk folder.
+	quarantineJunk quarantineMode = iota
+	// Reject quarantined messages.
+	quarantineReject
+	// Deliver quarantined messages as usual.
+	quarantineNone
+)
+
+// rcptPrefs are per-recipient spam filtering preferences looked up from
+// the 'rcpt_preferences' table.
+type rcptPrefs struct {
+	scores     scoreThresholds
+	quarantine quarantineMode
+
+	// Sender addresses and domains (in the address.ForLookup form).
+	allow []string
+	block []string
+}
+
+// parseRcptPrefs parses the preferences table value in the form
+// "quarantine_score=5 reject_score=10 quarantine=junk allow=example.org block=spam@example.com".
+//
+// Lists are specified by repeating the option since table.file uses commas
+// to separate multiple values.
+func parseRcptPrefs(s string) (rcptPrefs, error) {
+	var prefs rcptPrefs
+	for _, opt := range strings.Fields(s) {
+		parts := strings.SplitN(opt, "=", 2)
+		if len(parts) != 2 {
+			return prefs, fmt.Errorf("malformed option: %s", opt)
+		}
+		key, val := parts[0], parts[1]
+
+		switch key {
+		case "quarantine_score", "reject_score":
+			score, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				return prefs, fmt.Errorf("invalid %s: %w", key, err)
+			}
+			if key == "quarantine_score" {
+				prefs.scores.quarantine = &score
+			} else {
+				prefs.scores.reject = &score
+			}
+		case "quarantine":
+			switch val {
+			case "junk":
+				prefs.quarantine = quarantineJunk
+			case "reject":
+				prefs.quarantine = quarantineReject
+			case "none":
+				prefs.quarantine = quarantineNone
+			default:
+				return prefs, fmt.Errorf("unknown quarantine mode: %s", val)
+			}
+		case "allow", "block":
+			var err error
+			if strings.Contains(val, "@") {
+				val, err = address.ForLookup(val)
+			} else {
+				val, err = dns.ForLookup(val)
+			}
+			if err != nil {
+				return prefs, fmt.Errorf("invalid %s entry: %s: %w", key, val, err)
+			}
+			if key == "allow" {
+				prefs.allow = append(prefs.allow, val)
+			} else {
+				prefs.block = append(prefs.block, val)
+			}
+		default:
+			return prefs, fmt.Errorf("unknown option: %s", key)
+		}
+	}
+	return prefs, nil
+}
+
+// listMatches reports whether any of the addresses (in the
+// address.ForLookup form) matches the list entry. Entries are either full
+// addresses or domains.
+func listMatches(list []string, addrs []string) bool {
+	for _, addr := range addrs {
+		_, domain, err := address.Split(addr)
+		if err != nil {
+			continue
+		}
+		for _, entry := range list {
+			if entry == addr || entry == domain {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lookupRcptPrefs returns preferences for the recipient or nil if there
+// are none.
+func (dd *msgpipelineDelivery) lookupRcptPrefs(ctx context.Context, rcptTo string) (*rcptPrefs, error) {
+	if dd.d.rcptPrefs == nil {
+		return nil, nil
+	}
+
+	key, err := address.ForLookup(rcptTo)
+	if err != nil {
+		return nil, nil
+	}
+
+	var vals []string
+	if multi, ok := dd.d.rcptPrefs.(module.MultiTable); ok {
+		vals, err = multi.LookupMulti(ctx, key)
+	} else {
+		var (
+			val   string
+			found bool
+		)
+		val, found, err = dd.d.rcptPrefs.Lookup(ctx, key)
+		if found {
+			vals = []string{val}
+		}
+	}
+	if err != nil {
+		return nil, exterrors.WithTemporary(
+			exterrors.WithFields(err, map[string]interface{}{
+				"reason": "rcpt_preferences lookup failed",
+			}),
+			true,
+		)
+	}
+	if len(vals) == 0 {
+		return nil, nil
+	}
+
+	prefs, err := parseRcptPrefs(strings.Join(vals, " "))
+	if err != nil {
+		dd.log.Error("malformed recipient preferences, ignoring", err, "rcpt", rcptTo)
+		return nil, nil
+	}
+	return &prefs, nil
+}
+
+// senderAddrs returns the envelope sender and the From header field
+// addresses in the address.ForLookup form.
+func senderAddrs(mailFrom, fromHeader string) []string {
+	var addrs []string
+	if clean, err := address.ForLookup(mailFrom); err == nil && clean != "" {
+		addrs = append(addrs, clean)
+	}
+	if fromHeader == "" {
+		return addrs
+	}
+	if from, err := mail.ParseAddress(fromHeader); err == nil {
+		if clean, err := address.ForLookup(from.Address); err == nil && clean != "" {
+			addrs = append(addrs, clean)
+		}
+	}
+	return addrs
+}
+
+// authenticatedSenders returns sender addresses (see senderAddrs) with
+// the domain authenticated by SPF or DKIM, using relaxed alignment as in
+// DMARC. The From header field address is used only if the message has
+// exactly one.
+func (dd *msgpipelineDelivery) authenticatedSenders(header textproto.Header) []string {
+	var fromHeader string
+	if _, err := dmarc.ExtractFromDomain(header); err == nil {
+		fromHeader = header.Get("From")
+	}
+
+	var addrs []string
+	for _, addr := range senderAddrs(dd.sourceAddr, fromHeader) {
+		_, domain, err := address.Split(addr)
+		if err != nil || domain == "" {
+			continue
+		}
+		res := dmarc.EvaluateAlignment(domain, &dmarc.Record{}, dd.checkRunner.mergedRes.AuthResult)
+		if res.SPFAligned || res.DKIMAligned {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func blockedErr() error {
+	return &exterrors.SMTPError{
+		Code:         550,
+		EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+		Message:      "Sender is blocked by the recipient",
+		CheckName:    "rcpt_preferences",
+	}
+}
+
+func deferredErr() error {
+	return &exterrors.SMTPError{
+		Code:         452,
+		EnhancedCode: exterrors.EnhancedCode{4, 5, 3},
+		Message:      "Recipient has different filtering preferences, send the message to it separately",
+		CheckName:    "rcpt_preferences",
+	}
+}
+
+// rejectKey describes recipient preferences and safelist results that
+// affect whether the message is rejected for the recipient. The message
+// can be rejected after DATA only for all recipients at once so all
+// recipients of a transaction should have the same key.
+func rejectKey(prefs *rcptPrefs, safelist module.SafelistCheckResult) string {
+	if prefs == nil {
+		prefs = &rcptPrefs{}
+	}
+
+	key := "block=" + strings.Join(prefs.block, ",")
+	if prefs.scores.reject != nil {
+		key += " reject_score=" + formatScore(*prefs.scores.reject)
+	}
+	if prefs.quarantine == quarantineReject {
+		// Everything that affects quarantine matters too.
+		key += " quarantine=reject allow=" + strings.Join(prefs.allow, ",")
+		if prefs.scores.quarantine != nil {
+			key += " quarantine_score=" + formatScore(*prefs.scores.quarantine)
+		}
+		if safelist.Safelist {
+			key += " safelist=" + strconv.FormatBool(safelist.RequiresAuthResults)
+		}
+	}
+	return key
+}
+
+// checkRejectKeys makes sure recipients can be accepted in the same
+// transaction as recipients accepted before. keys are rejectKey values
+// for all final recipients the recipient address passed to AddRcpt
+// resolves to.
+//
+// It returns an error asking the client to retry the recipient later in a
+// separate transaction if the keys are different. The first recipient is
+// always accepted. If its final recipients have different keys, all
+// following recipients are deferred.
+func (dd *msgpipelineDelivery) checkRejectKeys(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if !dd.rejectKeySet {
+		dd.rejectKeySet = true
+		dd.rejectKey = keys[0]
+		for _, key := range keys[1:] {
+			if key != dd.rejectKey {
+				dd.mixedRejectKeys = true
+			}
+		}
+		return nil
+	}
+
+	if dd.mixedRejectKeys {
+		return deferredErr()
+	}
+	for _, key := range keys {
+		if key != dd.rejectKey {
+			return deferredErr()
+		}
+	}
+	return nil
+}
+
+// addFinalRcpt saves preferences and the safelist result of the final
+// recipient for use in Body.
+func (dd *msgpipelineDelivery) addFinalRcpt(rcptTo string, prefs *rcptPrefs, safelist module.SafelistCheckResult) {
+	if _, ok := dd.rcptPrefs[rcptTo]; ok {
+		return
+	}
+	if dd.rcptPrefs == nil {
+		dd.rcptPrefs = make(map[string]*rcptPrefs)
+		dd.rcptSafelist = make(map[string]module.SafelistCheckResult)
+	}
+	dd.rcptPrefs[rcptTo] = prefs
+	dd.rcptSafelist[rcptTo] = safelist
+	dd.rcpts = append(dd.rcpts, rcptTo)
+	if prefs != nil || safelist.Safelist {
+		dd.perRcptResults = true
+	}
+}
+
+// applyRcptResults is the per-recipient version of checkRunner.applyResults
+// that is used if any recipient has preferences or the message is
+// safelisted for it.
+//
+// Recipients that allowlist the sender or have the message safelisted
+// ignore quarantine by checks and scores of checks not reporting
+// authentication results. Rejections, quarantine by authentication
+// checks, malware checks and DMARC policy are applied for all recipients.
+//
+// Since checkRejectKeys makes sure all recipients would get the same
+// rejection, the message is rejected if it is rejected for any recipient.
+func (dd *msgpipelineDelivery) applyRcptResults(hostname string, header *textproto.Header) error {
+	cr := dd.checkRunner
+
+	dmarcQuarantine, dmarcErr := cr.dmarcVerdict()
+	if dmarcErr != nil {
+		return dmarcErr
+	}
+
+	senders := senderAddrs(dd.sourceAddr, header.Get("From"))
+	authSenders := dd.authenticatedSenders(*header)
+	globalThresholds := dd.scoreThresholds()
+
+	// Safelist checks with RequiresAuthResults match the envelope sender.
+	envelopeAuthenticated := false
+	if clean, err := address.ForLookup(dd.sourceAddr); err == nil && clean != "" {
+		envelopeAuthenticated = listMatches(authSenders, []string{clean})
+	}
+
+	rcptQuarantine := make(map[string]bool, len(dd.rcpts))
+	allQuarantined := true
+	for _, rcpt := range dd.rcpts {
+		prefs := dd.rcptPrefs[rcpt]
+		safelist := dd.rcptSafelist[rcpt]
+
+		if prefs != nil && listMatches(prefs.block, senders) {
+			return blockedErr()
+		}
+
+		thresholds := globalThresholds
+		mode := quarantineJunk
+		if prefs != nil {
+			thresholds = prefs.scores.merge(globalThresholds)
+			mode = prefs.quarantine
+		}
+
+		scoreQuarantine, scoreErr := cr.scoreVerdict(thresholds)
+		if scoreErr != nil {
+			return scoreErr
+		}
+
+		quarantine := dmarcQuarantine || cr.strictQuarantine
+		switch {
+		case safelist.Safelist && (!safelist.RequiresAuthResults || envelopeAuthenticated):
+			cr.log.Msg("message is safelisted for the recipient", "rcpt", rcpt)
+			quarantine = quarantine || cr.authScoreVerdict(thresholds)
+		case prefs != nil && listMatches(prefs.allow, authSenders):
+			cr.log.Msg("sender is allowlisted by the recipient", "rcpt", rcpt)
+			quarantine = quarantine || cr.authScoreVerdict(thresholds)
+		default:
+			quarantine = quarantine || cr.mergedRes.Quarantine || scoreQuarantine
+		}
+
+		if quarantine {
+			switch mode {
+			case quarantineReject:
+				return &exterrors.SMTPError{
+					Code:         550,
+					EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+					Message:      "Message rejected as spam by the recipient preferences",
+					CheckName:    "rcpt_preferences",
+				}
+			case quarantineNone:
+				quarantine = false
+				cr.log.Msg("quarantine disabled by the recipient", "rcpt", rcpt)
+			default:
+				cr.log.Msg("quarantined for the recipient", "rcpt", rcpt)
+			}
+		}
+
+		allQuarantined = allQuarantined && quarantine
+		rcptQuarantine[rcpt] = quarantine
+	}
+
+	dd.msgMeta.RcptQuarantine = rcptQuarantine
+	dd.msgMeta.Quarantine = allQuarantined
+
+	cr.addHeaders(hostname, header)
+	return nil
+}
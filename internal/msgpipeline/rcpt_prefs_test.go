@@ -0,0 +1,260 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func rcptPrefsPipeline(t *testing.T, tgt module.DeliveryTarget, prefs map[string]string, checks ...module.Check) *MsgPipeline {
+	scoreVal := 5.0
+	return &MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: checks,
+			globalScores: scoreThresholds{quarantine: &scoreVal},
+			rcptPrefs:    testutils.Table{M: prefs},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{tgt},
+				},
+			},
+		},
+		Hostname: "TEST-HOST",
+		Log:      testutils.Logger(t, "msgpipeline"),
+	}
+}
+
+// spfPassCheck reports SPF pass for the example.com domain.
+func spfPassCheck() *testutils.Check {
+	return &testutils.Check{
+		SenderRes: module.CheckResult{
+			AuthResult: []authres.Result{
+				&authres.SPFResult{Value: authres.ResultPass, From: "example.com"},
+			},
+		},
+	}
+}
+
+func TestMsgPipeline_RcptPrefs_Score(t *testing.T) {
+	target := testutils.Target{}
+	check := testutils.Check{
+		BodyRes: module.CheckResult{
+			Reason: &exterrors.SMTPError{CheckName: "check1"},
+			Score:  6,
+		},
+	}
+	d := rcptPrefsPipeline(t, &target, map[string]string{
+		"alice@example.org": "quarantine_score=10",
+		"carol@example.org": "quarantine=none",
+	}, &check)
+
+	testutils.DoTestDelivery(t, d, "sender@example.com", []string{
+		"alice@example.org", "bob@example.org", "carol@example.org",
+	})
+
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+	msgMeta := target.Messages[0].MsgMeta
+	for rcpt, quarantine := range map[string]bool{
+		"alice@example.org": false,
+		"bob@example.org":   true,
+		"carol@example.org": false,
+	} {
+		if msgMeta.IsQuarantined(rcpt) != quarantine {
+			t.Errorf("wrong quarantine flag for %s, want %v", rcpt, quarantine)
+		}
+	}
+	if msgMeta.Quarantine {
+		t.Errorf("message-level quarantine flag should not be set")
+	}
+
+	if check.UnclosedStates != 0 {
+		t.Fatalf("check state objects leak or double-closed, alive counter: %v", check.UnclosedStates)
+	}
+}
+
+func TestMsgPipeline_RcptPrefs_Allowlist(t *testing.T) {
+	target := testutils.Target{}
+	check := testutils.Check{
+		BodyRes: module.CheckResult{
+			Reason:     &exterrors.SMTPError{CheckName: "check1"},
+			Quarantine: true,
+		},
+	}
+	prefs := map[string]string{
+		"alice@example.org": "allow=example.com",
+		"carol@example.org": "allow=friend@example.com",
+	}
+	d := rcptPrefsPipeline(t, &target, prefs, &check, spfPassCheck())
+
+	testutils.DoTestDelivery(t, d, "sender@example.com", []string{
+		"alice@example.org", "bob@example.org", "carol@example.org",
+	})
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+	msgMeta := target.Messages[0].MsgMeta
+	for rcpt, quarantine := range map[string]bool{
+		"alice@example.org": false,
+		"bob@example.org":   true,
+		"carol@example.org": true,
+	} {
+		if msgMeta.IsQuarantined(rcpt) != quarantine {
+			t.Errorf("wrong quarantine flag for %s, want %v", rcpt, quarantine)
+		}
+	}
+
+	// Sender is not authenticated.
+	d = rcptPrefsPipeline(t, &target, prefs, &check)
+	testutils.DoTestDelivery(t, d, "sender@example.com", []string{"alice@example.org"})
+	if len(target.Messages) != 2 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 2, len(target.Messages))
+	}
+	if !target.Messages[1].MsgMeta.IsQuarantined("alice@example.org") {
+		t.Errorf("message from unauthenticated sender should be quarantined for alice")
+	}
+
+	// Malware is quarantined regardless of the allow list.
+	malware := testutils.Check{
+		BodyRes: module.CheckResult{
+			Reason:     &exterrors.SMTPError{CheckName: "check2"},
+			Quarantine: true,
+			Malware:    true,
+		},
+	}
+	d = rcptPrefsPipeline(t, &target, prefs, &malware, spfPassCheck())
+	testutils.DoTestDelivery(t, d, "sender@example.com", []string{"alice@example.org"})
+	if len(target.Messages) != 3 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 3, len(target.Messages))
+	}
+	if !target.Messages[2].MsgMeta.IsQuarantined("alice@example.org") {
+		t.Errorf("message with malware should be quarantined for alice")
+	}
+
+	// Rejections are not overridden.
+	reject := testutils.Check{
+		BodyRes: module.CheckResult{
+			Reason: &exterrors.SMTPError{CheckName: "check3"},
+			Reject: true,
+		},
+	}
+	d = rcptPrefsPipeline(t, &target, prefs, &reject, spfPassCheck())
+	if _, err := testutils.DoTestDeliveryErr(t, d, "sender@example.com", []string{"alice@example.org"}); err == nil {
+		t.Fatal("expected error")
+	}
+	if len(target.Messages) != 3 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 3, len(target.Messages))
+	}
+}
+
+func TestMsgPipeline_RcptPrefs_Defer(t *testing.T) {
+	target := testutils.Target{}
+	d := rcptPrefsPipeline(t, &target, map[string]string{
+		"alice@example.org": "quarantine_score=3",
+		"carol@example.org": "reject_score=10",
+	}, &testutils.Check{})
+
+	// Preferences of alice and bob can not cause rejection, carol has
+	// to be retried separately.
+	_, err := testutils.DoTestDeliveryErr(t, d, "sender@example.com", []string{
+		"alice@example.org", "bob@example.org", "carol@example.org",
+	})
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 452 {
+		t.Fatalf("expected 452 error, got %v", err)
+	}
+
+	testutils.DoTestDelivery(t, d, "sender@example.com", []string{"alice@example.org", "bob@example.org"})
+	testutils.DoTestDelivery(t, d, "sender@example.com", []string{"carol@example.org"})
+	if len(target.Messages) != 2 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 2, len(target.Messages))
+	}
+}
+
+func TestMsgPipeline_RcptPrefs_Block(t *testing.T) {
+	target := testutils.Target{}
+	d := rcptPrefsPipeline(t, &target, map[string]string{
+		"alice@example.org": "block=sender@example.com",
+	}, &testutils.Check{})
+
+	_, err := testutils.DoTestDeliveryErr(t, d, "sender@example.com", []string{"alice@example.org"})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	testutils.DoTestDelivery(t, d, "other@example.com", []string{"alice@example.org"})
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+}
+
+func TestMsgPipeline_RcptPrefs_QuarantineReject(t *testing.T) {
+	target := testutils.Target{}
+	check := testutils.Check{
+		BodyRes: module.CheckResult{
+			Reason:     &exterrors.SMTPError{CheckName: "check1"},
+			Quarantine: true,
+		},
+	}
+	d := rcptPrefsPipeline(t, &target, map[string]string{
+		"alice@example.org": "quarantine=reject",
+	}, &check)
+
+	_, err := testutils.DoTestDeliveryErr(t, d, "sender@example.com", []string{"alice@example.org"})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if len(target.Messages) != 0 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 0, len(target.Messages))
+	}
+}
+
+func TestParseRcptPrefs(t *testing.T) {
+	prefs, err := parseRcptPrefs("quarantine_score=5 reject_score=10.5 quarantine=reject allow=Friend@Example.com allow=example.net block=EXAMPLE.ORG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *prefs.scores.quarantine != 5 || *prefs.scores.reject != 10.5 {
+		t.Error("wrong score thresholds")
+	}
+	if prefs.quarantine != quarantineReject {
+		t.Error("wrong quarantine mode")
+	}
+	if len(prefs.allow) != 2 || prefs.allow[0] != "friend@example.com" || prefs.allow[1] != "example.net" {
+		t.Error("wrong allow list:", prefs.allow)
+	}
+	if len(prefs.block) != 1 || prefs.block[0] != "example.org" {
+		t.Error("wrong block list:", prefs.block)
+	}
+
+	for _, val := range []string{"foo", "quarantine=maybe", "reject_score=x", "unknown=1"} {
+		if _, err := parseRcptPrefs(val); err == nil {
+			t.Errorf("expected error for %q", val)
+		}
+	}
+}
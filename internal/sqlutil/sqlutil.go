@@ -0,0 +1,51 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package sqlutil contains helpers for modules that keep their own tables
+// in SQL databases.
+package sqlutil
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Rebind converts ? placeholders in the query to the syntax used by the
+// driver.
+//
+// Only PostgreSQL ($1, $2, ...) needs conversion, queries for other drivers
+// are returned as is.
+func Rebind(driver, query string) string {
+	if driver != "postgres" {
+		return query
+	}
+
+	var (
+		sb strings.Builder
+		n  = 1
+	)
+	for _, r := range query {
+		if r == '?' {
+			sb.WriteString("$" + strconv.Itoa(n))
+			n++
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
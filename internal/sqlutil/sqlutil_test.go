@@ -0,0 +1,31 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sqlutil
+
+import "testing"
+
+func TestRebind(t *testing.T) {
+	const query = `SELECT a FROM t WHERE b = ? AND c IN (?, ?)`
+	if res := Rebind("sqlite3", query); res != query {
+		t.Errorf("query changed for sqlite3: %s", res)
+	}
+	if res := Rebind("postgres", query); res != `SELECT a FROM t WHERE b = $1 AND c IN ($2, $3)` {
+		t.Errorf("wrong query for postgres: %s", res)
+	}
+}
@@ -0,0 +1,486 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cache
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const modName = "storage.blob.cache"
+
+// Objects being written to the cache use this file name prefix until they are
+// complete.
+const tmpPrefix = ".tmp-"
+
+type entry struct {
+	name string
+	size int64
+}
+
+// fill tracks cache fills in progress for an object.
+type fill struct {
+	// gen is incremented when the object is replaced or deleted. Fills
+	// started before that are discarded since they may contain stale or
+	// removed data.
+	gen uint64
+	// active is the amount of fills in progress.
+	active int
+}
+
+// Store wraps another BlobStore to keep recently used objects on the local
+// disk.
+type Store struct {
+	instName string
+	log      log.Logger
+
+	storage module.BlobStore
+	dir     string
+	maxSize int64
+
+	lock sync.Mutex
+	// lru contains *entry values, most recently used at the front.
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+	// fills contains objects that are being written to the cache. Entries
+	// are removed once all fills for an object are completed.
+	fills map[string]*fill
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: expected 0 arguments", modName)
+	}
+	return &Store{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+		fills:    map[string]*fill{},
+	}, nil
+}
+
+func (s *Store) Name() string {
+	return modName
+}
+
+func (s *Store) InstanceName() string {
+	return s.instName
+}
+
+func (s *Store) Init(cfg *config.Map) error {
+	var maxSize int
+	cfg.Custom("msg_store", false, true, nil, func(m *config.Map, node config.Node) (interface{}, error) {
+		var store module.BlobStore
+		err := modconfig.ModuleFromNode("storage.blob", node.Args,
+			node, m.Globals, &store)
+		return store, err
+	}, &s.storage)
+	cfg.String("cache_dir", false, false, filepath.Join(config.StateDirectory, "blob_cache"), &s.dir)
+	cfg.DataSize("max_size", false, false, 1024*1024*1024, &maxSize)
+	cfg.Bool("debug", true, false, &s.log.Debug)
+
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	s.maxSize = int64(maxSize)
+
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	if err := s.loadEntries(); err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+
+	return nil
+}
+
+// loadEntries populates the LRU list using objects left in cache_dir.
+func (s *Store) loadEntries() error {
+	dirents, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	type fileInfo struct {
+		entry
+		atime time.Time
+	}
+	var files []fileInfo
+	for _, d := range dirents {
+		if d.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(d.Name(), tmpPrefix) {
+			// Left after crash.
+			os.Remove(filepath.Join(s.dir, d.Name()))
+			continue
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, fileInfo{
+			entry: entry{name: d.Name(), size: info.Size()},
+			atime: info.ModTime(),
+		})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].atime.After(files[j].atime)
+	})
+	for _, f := range files {
+		e := f.entry
+		s.entries[e.name] = s.lru.PushBack(&e)
+		s.size += e.size
+	}
+	s.evict()
+
+	s.log.DebugMsg("loaded cache entries", "count", s.lru.Len(), "size", s.size)
+	return nil
+}
+
+func cacheName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Store) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+// evict removes least recently used entries until the cache fits into
+// max_size. Lock should be held.
+func (s *Store) evict() {
+	for s.size > s.maxSize {
+		back := s.lru.Back()
+		if back == nil {
+			return
+		}
+		s.remove(back.Value.(*entry).name)
+	}
+}
+
+// remove removes the entry. Lock should be held.
+func (s *Store) remove(name string) {
+	elem, ok := s.entries[name]
+	if !ok {
+		return
+	}
+	e := elem.Value.(*entry)
+	s.lru.Remove(elem)
+	delete(s.entries, name)
+	s.size -= e.size
+	if err := os.Remove(s.path(name)); err != nil && !os.IsNotExist(err) {
+		s.log.Error("failed to remove cache entry", err, name)
+	}
+}
+
+// invalidate removes the cached copy of the object and makes fills that
+// are in progress for it discarded. Lock should be held.
+func (s *Store) invalidate(name string) {
+	if f := s.fills[name]; f != nil {
+		f.gen++
+	}
+	s.remove(name)
+}
+
+// endFill releases the fill started by startFill. Lock should be held.
+func (s *Store) endFill(name string) {
+	f := s.fills[name]
+	f.active--
+	if f.active == 0 {
+		delete(s.fills, name)
+	}
+}
+
+// commit moves the completely written temporary file into cache.
+//
+// replace indicates that the object was just written to msg_store, other
+// fills in progress are discarded then. tmp can be nil in this case.
+func (s *Store) commit(tmp *os.File, name string, size int64, gen uint64, replace bool) {
+	filling := tmp != nil
+	var tmpPath string
+	if tmp != nil {
+		tmpPath = tmp.Name()
+		if err := tmp.Close(); err != nil {
+			s.log.Error("failed to write cache entry", err, name)
+			os.Remove(tmpPath)
+			tmp = nil
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	valid := tmp != nil && gen == s.fills[name].gen && size <= s.maxSize
+	if filling {
+		s.endFill(name)
+	}
+	if replace {
+		s.invalidate(name)
+	}
+	if !valid {
+		if tmp != nil {
+			os.Remove(tmpPath)
+		}
+		return
+	}
+
+	s.remove(name)
+	if err := os.Rename(tmpPath, s.path(name)); err != nil {
+		s.log.Error("failed to add cache entry", err, name)
+		os.Remove(tmpPath)
+		return
+	}
+	s.entries[name] = s.lru.PushFront(&entry{name: name, size: size})
+	s.size += size
+	s.evict()
+}
+
+// startFill creates a temporary file for the new cache entry. nil is
+// returned if it cannot be created, object is then not cached.
+//
+// If the file is returned, the fill should be completed using commit or
+// abandoned using cacheWriter.abort.
+func (s *Store) startFill(name string) (*os.File, uint64) {
+	s.lock.Lock()
+	f := s.fills[name]
+	if f == nil {
+		f = &fill{}
+		s.fills[name] = f
+	}
+	f.active++
+	gen := f.gen
+	s.lock.Unlock()
+
+	tmp, err := os.CreateTemp(s.dir, tmpPrefix)
+	if err != nil {
+		s.log.Error("failed to create cache entry", err)
+		s.lock.Lock()
+		s.endFill(name)
+		s.lock.Unlock()
+		return nil, 0
+	}
+	return tmp, gen
+}
+
+// cacheWriter writes data into a temporary file for the cache entry and stops
+// doing so on the first error or if the object is too big.
+type cacheWriter struct {
+	s    *Store
+	name string
+	f    *os.File
+	gen  uint64
+	size int64
+}
+
+func (w *cacheWriter) write(p []byte) {
+	if w.f == nil {
+		return
+	}
+	w.size += int64(len(p))
+	if w.size > w.s.maxSize {
+		w.abort()
+		return
+	}
+	if _, err := w.f.Write(p); err != nil {
+		w.s.log.Error("failed to write cache entry", err)
+		w.abort()
+	}
+}
+
+func (w *cacheWriter) abort() {
+	if w.f == nil {
+		return
+	}
+	w.f.Close()
+	os.Remove(w.f.Name())
+	w.f = nil
+
+	w.s.lock.Lock()
+	w.s.endFill(w.name)
+	w.s.lock.Unlock()
+}
+
+func (w *cacheWriter) start() {
+	w.f, w.gen = w.s.startFill(w.name)
+}
+
+func (w *cacheWriter) commit(replace bool) {
+	if w.f == nil && !replace {
+		return
+	}
+	w.s.commit(w.f, w.name, w.size, w.gen, replace)
+	w.f = nil
+}
+
+type cacheBlob struct {
+	module.Blob
+	w      cacheWriter
+	synced bool
+}
+
+func (b *cacheBlob) Write(p []byte) (int, error) {
+	n, err := b.Blob.Write(p)
+	b.w.write(p[:n])
+	return n, err
+}
+
+func (b *cacheBlob) Sync() error {
+	if err := b.Blob.Sync(); err != nil {
+		return err
+	}
+	b.synced = true
+	return nil
+}
+
+func (b *cacheBlob) Close() error {
+	err := b.Blob.Close()
+	if b.synced && err == nil {
+		b.w.commit(true)
+	} else {
+		b.w.abort()
+	}
+	return err
+}
+
+func (s *Store) Create(ctx context.Context, key string, blobSize int64) (module.Blob, error) {
+	b, err := s.storage.Create(ctx, key, blobSize)
+	if err != nil {
+		return nil, err
+	}
+
+	name := cacheName(key)
+
+	// Previous version of the object (if any) is stale now.
+	s.lock.Lock()
+	s.invalidate(name)
+	s.lock.Unlock()
+
+	cb := &cacheBlob{
+		Blob: b,
+		w:    cacheWriter{s: s, name: name},
+	}
+	if blobSize <= s.maxSize {
+		cb.w.start()
+	}
+	return cb, nil
+}
+
+type fillReader struct {
+	io.ReadCloser
+	w   cacheWriter
+	eof bool
+}
+
+func (r *fillReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.w.write(p[:n])
+	if errors.Is(err, io.EOF) {
+		r.eof = true
+	} else if err != nil {
+		r.w.abort()
+	}
+	return n, err
+}
+
+func (r *fillReader) Close() error {
+	err := r.ReadCloser.Close()
+	// Partially read objects are not cached.
+	if r.eof && err == nil {
+		r.w.commit(false)
+	} else {
+		r.w.abort()
+	}
+	return err
+}
+
+func (s *Store) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	name := cacheName(key)
+
+	s.lock.Lock()
+	if elem, ok := s.entries[name]; ok {
+		f, err := os.Open(s.path(name))
+		if err == nil {
+			s.lru.MoveToFront(elem)
+			s.lock.Unlock()
+			return f, nil
+		}
+		s.log.Error("failed to open cache entry", err, name)
+		s.remove(name)
+	}
+	s.lock.Unlock()
+
+	r, err := s.storage.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	fr := &fillReader{
+		ReadCloser: r,
+		w:          cacheWriter{s: s, name: name},
+	}
+	fr.w.start()
+	return fr, nil
+}
+
+func (s *Store) Delete(ctx context.Context, keys []string) error {
+	s.lock.Lock()
+	for _, key := range keys {
+		s.invalidate(cacheName(key))
+	}
+	s.lock.Unlock()
+
+	return s.storage.Delete(ctx, keys)
+}
+
+// ListBlobs lists objects in msg_store, cached copies are not included.
+func (s *Store) ListBlobs(ctx context.Context, fn func(key string, modTime time.Time) error) error {
+	return module.ListBlobs(ctx, s.storage, fn)
+}
+
+// Reencrypt rewrites the object in msg_store. Cached copy is kept since the
+// contents read through msg_store do not change.
+func (s *Store) Reencrypt(ctx context.Context, key string) (bool, error) {
+	return module.ReencryptBlob(ctx, s.storage, key)
+}
+
+func init() {
+	var _ module.ListableBlobStore = &Store{}
+	var _ module.ReencryptableBlobStore = &Store{}
+	module.Register(modName, New)
+}
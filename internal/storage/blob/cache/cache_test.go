@@ -0,0 +1,244 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/storage/blob"
+	_ "github.com/foxcpp/maddy/internal/storage/blob/fs"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type cacheStoreTest struct {
+	*Store
+	root string
+}
+
+func newTestStore(t *testing.T, root, maxSize string) *cacheStoreTest {
+	st, err := New(modName, "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = st.Init(config.NewMap(map[string]interface{}{}, config.Node{
+		Children: []config.Node{
+			{
+				Name: "msg_store",
+				Args: []string{"fs", filepath.Join(root, "store")},
+			},
+			{
+				Name: "cache_dir",
+				Args: []string{filepath.Join(root, "cache")},
+			},
+			{
+				Name: "max_size",
+				Args: []string{maxSize},
+			},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &cacheStoreTest{Store: st.(*Store), root: root}
+}
+
+func TestCache(t *testing.T) {
+	blob.TestStore(t, func() module.BlobStore {
+		return newTestStore(t, testutils.Dir(t), "1M")
+	}, func(store module.BlobStore) {
+		os.RemoveAll(store.(*cacheStoreTest).root)
+	})
+}
+
+func writeBlob(t *testing.T, s module.BlobStore, key, contents string) {
+	t.Helper()
+	b, err := s.Create(context.Background(), key, int64(len(contents)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(b, contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readBlob(t *testing.T, s module.BlobStore, key string) string {
+	t.Helper()
+	r, err := s.Open(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func (s *cacheStoreTest) cached(key string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.entries[cacheName(key)]
+	return ok
+}
+
+func TestCache_Eviction(t *testing.T) {
+	st := newTestStore(t, testutils.Dir(t), "100B")
+	defer os.RemoveAll(st.root)
+
+	body := strings.Repeat("a", 40)
+	writeBlob(t, st, "1", body)
+	writeBlob(t, st, "2", body)
+	if !st.cached("1") || !st.cached("2") {
+		t.Fatal("written objects are not cached")
+	}
+
+	// Make "1" most recently used.
+	if readBlob(t, st, "1") != body {
+		t.Fatal("wrong contents")
+	}
+	writeBlob(t, st, "3", body)
+	if st.cached("2") {
+		t.Error("least recently used object was not evicted")
+	}
+	if !st.cached("1") || !st.cached("3") {
+		t.Error("recently used objects were evicted")
+	}
+	if st.size != 80 {
+		t.Errorf("wrong cache size: %d", st.size)
+	}
+
+	// Read-through.
+	if readBlob(t, st, "2") != body {
+		t.Fatal("wrong contents")
+	}
+	if !st.cached("2") {
+		t.Error("object was not cached on read")
+	}
+
+	writeBlob(t, st, "big", strings.Repeat("b", 200))
+	if st.cached("big") {
+		t.Error("object bigger than max_size was cached")
+	}
+	if !st.cached("2") {
+		t.Error("object was evicted for uncacheable object")
+	}
+}
+
+func TestCache_Delete(t *testing.T) {
+	st := newTestStore(t, testutils.Dir(t), "1M")
+	defer os.RemoveAll(st.root)
+
+	writeBlob(t, st, "1", "hello")
+	if err := st.Delete(context.Background(), []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	if st.cached("1") {
+		t.Error("deleted object is still cached")
+	}
+	if _, err := st.Open(context.Background(), "1"); !errors.Is(err, module.ErrNoSuchBlob) {
+		t.Error("expected ErrNoSuchBlob, got", err)
+	}
+
+	// Cache is restored on restart.
+	writeBlob(t, st, "2", "hello")
+	st2 := newTestStore(t, st.root, "1M")
+	if !st2.cached("2") {
+		t.Error("cache entries were not loaded")
+	}
+	if err := os.RemoveAll(filepath.Join(st.root, "store")); err != nil {
+		t.Fatal(err)
+	}
+	if readBlob(t, st2, "2") != "hello" {
+		t.Error("wrong contents")
+	}
+}
+
+func TestCache_CreateDuringFill(t *testing.T) {
+	st := newTestStore(t, testutils.Dir(t), "1M")
+	defer os.RemoveAll(st.root)
+
+	// Object is not in the cache yet.
+	writeBlob(t, st.storage, "1", "old")
+
+	r, err := st.Open(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+
+	writeBlob(t, st, "1", "new")
+
+	// Fill is completed after the object is replaced.
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if readBlob(t, st, "1") != "new" {
+		t.Error("stale contents are cached")
+	}
+}
+
+func TestCache_FillDuringOtherChange(t *testing.T) {
+	st := newTestStore(t, testutils.Dir(t), "1M")
+	defer os.RemoveAll(st.root)
+
+	writeBlob(t, st.storage, "1", "hello")
+
+	r, err := st.Open(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes to other objects do not affect the fill.
+	writeBlob(t, st, "2", "hello")
+	if err := st.Delete(context.Background(), []string{"2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !st.cached("1") {
+		t.Error("object was not cached on read")
+	}
+	if len(st.fills) != 0 {
+		t.Error("completed fills are not removed:", st.fills)
+	}
+}
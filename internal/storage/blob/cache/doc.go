@@ -0,0 +1,63 @@
+// Package cache implements local disk cache for blob storage
+//
+//
+// # Local disk cache (storage.blob.cache)
+//
+// This module keeps recently written and read objects of another blob
+// storage module on the local disk. It is useful for remote stores such as
+// storage.blob.s3 where recently delivered messages are likely to be fetched
+// again soon.
+//
+// Writes go through to the underlying store, objects are added to the cache
+// only after they were successfully saved there. Cache entries are removed
+// when objects are deleted. Least recently used entries are evicted once the
+// cache grows beyond max_size.
+//
+// ```
+// storage.blob.cache {
+// 	msg_store s3 { ... }
+// 	cache_dir /var/cache/maddy/blobs
+// 	max_size 2G
+// }
+// ```
+//
+// The cache stores objects as they are returned by msg_store. To keep
+// message bodies encrypted on the local disk, place it under
+// storage.blob.crypto:
+// ```
+// storage.blob.crypto {
+// 	msg_store cache {
+// 		msg_store s3 { ... }
+// 	}
+// 	crypto_static_key "..."
+// }
+// ```
+//
+// ## Configuration directives
+//
+// *Syntax*: msg_store _store_ ++
+// *Default*: not specified
+//
+// REQUIRED.
+//
+// Module to use for actual storage of message bodies.
+//
+// See *maddy-blob*(5) for details.
+//
+// *Syntax*: cache_dir _path_ ++
+// *Default*: StateDirectory/blob_cache
+//
+// Directory to store cached objects in. Each cache instance should
+// use a separate directory.
+//
+// *Syntax*: max_size _size_ ++
+// *Default*: 1G
+//
+// Maximum total size of cached objects. Objects bigger than that are never
+// cached.
+//
+// *Syntax*: debug _boolean_ ++
+// *Default*: global directive value
+//
+// Enable verbose logging.
+package cache
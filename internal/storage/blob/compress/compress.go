@@ -0,0 +1,274 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package compress
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+const modName = "storage.blob.compress"
+
+// Compressed objects start with the magic followed by a single byte
+// identifying the algorithm. Message bodies never start with a NUL byte so
+// objects without the header are read as is.
+var magic = []byte{0x00, 'M', 'Z', 'C'}
+
+const (
+	algoZstd byte = 1
+	algoLZ4  byte = 2
+)
+
+var algoIDs = map[string]byte{
+	"zstd": algoZstd,
+	"lz4":  algoLZ4,
+}
+
+// Store wraps another BlobStore to transparently add compression.
+type Store struct {
+	instName string
+	log      log.Logger
+
+	storage module.BlobStore
+
+	algo  byte
+	level int
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: expected 0 arguments", modName)
+	}
+	return &Store{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (s *Store) Name() string {
+	return modName
+}
+
+func (s *Store) InstanceName() string {
+	return s.instName
+}
+
+func (s *Store) Init(cfg *config.Map) error {
+	var compression []string
+	cfg.Custom("msg_store", false, false, func() (interface{}, error) {
+		var store module.BlobStore
+		err := modconfig.ModuleFromNode("storage.blob", []string{"fs", "messages"},
+			config.Node{}, nil, &store)
+		return store, err
+	}, func(m *config.Map, node config.Node) (interface{}, error) {
+		var store module.BlobStore
+		err := modconfig.ModuleFromNode("storage.blob", node.Args,
+			node, m.Globals, &store)
+		return store, err
+	}, &s.storage)
+	cfg.StringList("compression", false, false, []string{"zstd"}, &compression)
+
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	switch compression[0] {
+	case "zstd", "lz4":
+		s.algo = algoIDs[compression[0]]
+		if len(compression) == 2 {
+			var err error
+			s.level, err = strconv.Atoi(compression[1])
+			if err != nil {
+				return errors.New("storage.blob.compress: first argument for lz4 and zstd is compression level")
+			}
+		}
+		if len(compression) > 2 {
+			return errors.New("storage.blob.compress: expected at most 2 arguments")
+		}
+	case "off":
+		if len(compression) > 1 {
+			return errors.New("storage.blob.compress: expected at most 1 arguments")
+		}
+	default:
+		return errors.New("storage.blob.compress: unknown compression algorithm")
+	}
+
+	return nil
+}
+
+func (s *Store) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	r, err := s.storage.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := make([]byte, len(magic)+1)
+	n, err := io.ReadFull(r, hdr)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		r.Close()
+		return nil, err
+	}
+	if n < len(hdr) || !bytes.Equal(hdr[:len(magic)], magic) {
+		// Object stored before compression was enabled.
+		return struct {
+			io.Reader
+			io.Closer
+		}{Reader: io.MultiReader(bytes.NewReader(hdr[:n]), r), Closer: r}, nil
+	}
+
+	switch hdr[len(magic)] {
+	case algoZstd:
+		dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		return &zstdReadCloser{Decoder: dec, r: r}, nil
+	case algoLZ4:
+		return struct {
+			io.Reader
+			io.Closer
+		}{Reader: lz4.NewReader(r), Closer: r}, nil
+	default:
+		r.Close()
+		return nil, fmt.Errorf("%s: unknown compression algorithm in object header: %d", modName, hdr[len(magic)])
+	}
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+	r io.Closer
+}
+
+func (z *zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return z.r.Close()
+}
+
+type compressBlob struct {
+	b       module.Blob
+	w       io.WriteCloser
+	didSync bool
+}
+
+func (b *compressBlob) Sync() error {
+	// Compressor is flushed in Sync instead of Close because
+	// backend may not actually check the error of Close.
+	if b.didSync {
+		panic("storage.blob.compress: Sync called twice for a blob object")
+	}
+	b.didSync = true
+
+	if err := b.w.Close(); err != nil {
+		return err
+	}
+	return b.b.Sync()
+}
+
+func (b *compressBlob) Write(p []byte) (n int, err error) {
+	return b.w.Write(p)
+}
+
+func (b *compressBlob) Close() error {
+	if !b.didSync {
+		b.b.Close()
+		return fmt.Errorf("storage.blob.compress: blob closed without Sync")
+	}
+	return b.b.Close()
+}
+
+func (s *Store) compressor(w io.Writer) (io.WriteCloser, error) {
+	switch s.algo {
+	case algoZstd:
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if s.level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(s.level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	case algoLZ4:
+		lz4w := lz4.NewWriter(w)
+		lz4w.CompressionLevel = s.level
+		return lz4w, nil
+	default:
+		panic("storage.blob.compress: unexpected algorithm")
+	}
+}
+
+func (s *Store) Create(ctx context.Context, key string, blobSize int64) (module.Blob, error) {
+	if s.algo == 0 {
+		return s.storage.Create(ctx, key, blobSize)
+	}
+
+	// Size of the compressed object is not known in advance.
+	b, err := s.storage.Create(ctx, key, module.UnknownBlobSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := b.Write(append(append([]byte{}, magic...), s.algo)); err != nil {
+		b.Close()
+		return nil, err
+	}
+
+	w, err := s.compressor(b)
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+
+	return &compressBlob{
+		b: b,
+		w: w,
+	}, nil
+}
+
+func (s *Store) Delete(ctx context.Context, keys []string) error {
+	return s.storage.Delete(ctx, keys)
+}
+
+// Reencrypt rewrites the object in msg_store, which is normally
+// storage.blob.crypto since data should be compressed before encryption.
+// Compressed data is not changed.
+func (s *Store) Reencrypt(ctx context.Context, key string) (bool, error) {
+	return module.ReencryptBlob(ctx, s.storage, key)
+}
+
+// ListBlobs lists objects in msg_store. Compressed objects are stored under
+// the same keys.
+func (s *Store) ListBlobs(ctx context.Context, fn func(key string, modTime time.Time) error) error {
+	return module.ListBlobs(ctx, s.storage, fn)
+}
+
+func init() {
+	var _ module.ReencryptableBlobStore = &Store{}
+	var _ module.ListableBlobStore = &Store{}
+	module.Register(modName, New)
+}
@@ -0,0 +1,159 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package compress
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/storage/blob"
+	_ "github.com/foxcpp/maddy/internal/storage/blob/crypto"
+	_ "github.com/foxcpp/maddy/internal/storage/blob/fs"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type compressStoreTest struct {
+	*Store
+	root string
+}
+
+func newTestStore(t *testing.T, root string, compression []string, msgStore config.Node) *compressStoreTest {
+	st := &Store{instName: "test"}
+	err := st.Init(config.NewMap(map[string]interface{}{}, config.Node{
+		Children: []config.Node{
+			msgStore,
+			{
+				Name: "compression",
+				Args: compression,
+			},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &compressStoreTest{Store: st, root: root}
+}
+
+func TestCompress(t *testing.T) {
+	for _, algo := range []string{"zstd", "lz4"} {
+		algo := algo
+		t.Run(algo, func(t *testing.T) {
+			blob.TestStore(t, func() module.BlobStore {
+				root := testutils.Dir(t)
+				return newTestStore(t, root, []string{algo}, config.Node{
+					Name: "msg_store",
+					Args: []string{"fs", root},
+				})
+			}, func(store module.BlobStore) {
+				os.RemoveAll(store.(*compressStoreTest).root)
+			})
+		})
+	}
+}
+
+func TestCompress_Crypto(t *testing.T) {
+	blob.TestStore(t, func() module.BlobStore {
+		root := testutils.Dir(t)
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+		return newTestStore(t, root, []string{"zstd", "3"}, config.Node{
+			Name: "msg_store",
+			Args: []string{"crypto"},
+			Children: []config.Node{
+				{
+					Name: "msg_store",
+					Args: []string{"fs", root},
+				},
+				{
+					Name: "crypto_static_key",
+					Args: []string{base64.StdEncoding.EncodeToString(key)},
+				},
+			},
+		})
+	}, func(store module.BlobStore) {
+		os.RemoveAll(store.(*compressStoreTest).root)
+	})
+}
+
+func TestCompress_Legacy(t *testing.T) {
+	root := testutils.Dir(t)
+	st := newTestStore(t, root, []string{"zstd"}, config.Node{
+		Name: "msg_store",
+		Args: []string{"fs", root},
+	})
+
+	body := strings.Repeat("Subject: test\r\n\r\nHello!\r\n", 100)
+	for key, contents := range map[string]string{
+		"legacy": body,
+		"short":  "Hi",
+		"empty":  "",
+	} {
+		if err := os.WriteFile(filepath.Join(root, key), []byte(contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := st.Open(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != contents {
+			t.Errorf("%s: unexpected contents: %q", key, data)
+		}
+	}
+
+	b, err := st.Create(context.Background(), "new", int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(b, body); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := os.ReadFile(filepath.Join(root, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) >= len(body) {
+		t.Errorf("object is not compressed: %d bytes stored for %d bytes body", len(stored), len(body))
+	}
+	if !strings.HasPrefix(string(stored), string(magic)) {
+		t.Errorf("object does not start with the header: %q", stored[:5])
+	}
+}
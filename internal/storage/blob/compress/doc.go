@@ -0,0 +1,48 @@
+// Package compress implements compressed blob storage
+//
+//
+// # Compressed storage (storage.blob.compress)
+//
+// This module can be used to add compression support to any other blob
+// storage module.
+//
+// Each stored object starts with a small header identifying the compression
+// algorithm used. Objects without the header (e.g. stored before compression
+// was enabled) are read as is.
+//
+// ```
+// storage.blob.compress {
+// 	msg_store s3 { ... }
+// 	compression zstd
+// }
+// ```
+//
+// To use together with storage.blob.crypto, compress should wrap crypto so
+// that message bodies are compressed before encryption:
+// ```
+// storage.blob.compress {
+// 	msg_store crypto {
+// 		msg_store fs messages
+// 		crypto_static_key "..."
+// 	}
+// }
+// ```
+//
+// ## Configuration directives
+//
+// *Syntax*: msg_store _store_ ++
+// *Default*: fs messages/
+//
+// Module to use for actual storage of compressed message bodies.
+//
+// See *maddy-blob*(5) for details.
+//
+// *Syntax*: compression off ++
+// compression _algorithm_ ++
+// compression _algorithm_ _level_ ++
+// *Default*: zstd
+//
+// Compression algorithm to use for new objects. Supported algorithms: lz4,
+// zstd. 'off' disables compression for new objects but existing objects are
+// still decompressed.
+package compress
@@ -19,12 +19,17 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package crypto
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"os/exec"
 	"runtime"
+	"strings"
+	"time"
 
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
@@ -36,6 +41,12 @@ import (
 
 const modName = "storage.blob.crypto"
 
+// Objects encrypted using a named key start with the magic followed by the
+// key ID length (1 byte) and the key ID. DARE streams never start with a NUL
+// byte so objects without the header are decrypted using the legacy key
+// (crypto_static_key or crypto_passphrase).
+var keyIDMagic = []byte{0x00, 'M', 'K', 'I'}
+
 // CryptoStore wraps another BlobStore to transparently add encryption.
 type CryptoStore struct {
 	instName string
@@ -43,6 +54,10 @@ type CryptoStore struct {
 
 	storage module.BlobStore
 
+	// keys contains named keys, key with an empty ID is never stored here.
+	keys      map[string][]byte
+	activeKey string
+
 	cryptoPassphrase string
 	cryptoStaticKey  []byte
 	cryptoTime       uint32
@@ -57,6 +72,7 @@ func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
 	return &CryptoStore{
 		instName: instName,
 		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		keys:     map[string][]byte{},
 	}, nil
 }
 
@@ -73,9 +89,55 @@ var (
 	errBothKeyTypes = errors.New("cannot specify both passphrase and static key")
 )
 
+// loadKey reads the base64-encoded key from the source specified by
+// arguments of the key directive.
+func loadKey(args []string) ([]byte, error) {
+	if len(args) < 2 {
+		return nil, errors.New("expected at least 2 arguments")
+	}
+
+	var encoded []byte
+	switch args[0] {
+	case "static":
+		if len(args) != 2 {
+			return nil, errors.New("static: expected 1 argument")
+		}
+		encoded = []byte(args[1])
+	case "file":
+		if len(args) != 2 {
+			return nil, errors.New("file: expected 1 argument")
+		}
+		var err error
+		encoded, err = os.ReadFile(args[1])
+		if err != nil {
+			return nil, err
+		}
+	case "command":
+		cmd := exec.Command(args[1], args[2:]...)
+		cmd.Stderr = os.Stderr
+		var err error
+		encoded, err = cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("command: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown key source: %s", args[0])
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, errStaticKeyLen
+	}
+	return key, nil
+}
+
 func (s *CryptoStore) Init(cfg *config.Map) error {
 	var (
 		cryptoStaticKey string
+		activeKey       string
 	)
 	cfg.Custom("msg_store", false, false, func() (interface{}, error) {
 		var store module.BlobStore
@@ -90,6 +152,25 @@ func (s *CryptoStore) Init(cfg *config.Map) error {
 	}, &s.storage)
 
 	cfg.String("crypto_static_key", false, false, "", &cryptoStaticKey)
+	cfg.Callback("key", func(m *config.Map, node config.Node) error {
+		if len(node.Args) == 0 {
+			return config.NodeErr(node, "expected at least 3 arguments")
+		}
+		id := node.Args[0]
+		if id == "" || len(id) > 255 {
+			return config.NodeErr(node, "key ID should be 1 to 255 bytes long")
+		}
+		if _, ok := s.keys[id]; ok {
+			return config.NodeErr(node, "duplicate key ID: %s", id)
+		}
+		key, err := loadKey(node.Args[1:])
+		if err != nil {
+			return config.NodeErr(node, "%v", err)
+		}
+		s.keys[id] = key
+		return nil
+	})
+	cfg.String("active_key", false, false, "", &activeKey)
 
 	// In practice the following options will probably never be used. To derive a secure key, the passphrase needs to be
 	// run through a KDF with a unique salt for every encrypt/decrypt operation, and the KDF is (by design) very slow --
@@ -118,9 +199,29 @@ func (s *CryptoStore) Init(cfg *config.Map) error {
 		s.log.DebugMsg("using static key for table storage crypto")
 	} else if s.cryptoPassphrase != "" {
 		s.log.DebugMsg("using passphrase for table storage crypto")
-	} else {
+	} else if len(s.keys) == 0 {
 		s.log.DebugMsg("using no crypto for table storage")
 	}
+
+	switch {
+	case activeKey != "":
+		if _, ok := s.keys[activeKey]; !ok {
+			return fmt.Errorf("%s: unknown active_key: %s", modName, activeKey)
+		}
+		s.activeKey = activeKey
+	case s.cryptoStaticKey != nil || s.cryptoPassphrase != "":
+		// Keep using the legacy key for new objects.
+	case len(s.keys) == 1:
+		for id := range s.keys {
+			s.activeKey = id
+		}
+	case len(s.keys) > 1:
+		return fmt.Errorf("%s: active_key is required if multiple keys are defined", modName)
+	}
+	if s.activeKey != "" {
+		s.log.DebugMsg("using named key for new objects", "key_id", s.activeKey)
+	}
+
 	cpus := runtime.NumCPU()
 	if cpus > 255 {
 		cpus = 255
@@ -130,15 +231,54 @@ func (s *CryptoStore) Init(cfg *config.Map) error {
 	return nil
 }
 
-func (s *CryptoStore) cryptoKey(key string) []byte {
+// cryptoKey returns the key to use for the object.
+//
+// Empty keyID means the legacy key. nil is returned if no legacy key is
+// configured and objects are stored as is.
+func (s *CryptoStore) cryptoKey(keyID, key string) ([]byte, error) {
+	if keyID != "" {
+		k, ok := s.keys[keyID]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown key ID: %s", modName, keyID)
+		}
+		return k, nil
+	}
+
 	if s.cryptoStaticKey != nil {
-		return s.cryptoStaticKey
+		return s.cryptoStaticKey, nil
 	} else if s.cryptoPassphrase != "" {
 		salt := []byte(key)
-		return argon2.IDKey([]byte(s.cryptoPassphrase), salt, s.cryptoTime, s.cryptoMemory*1024, s.cryptoThreads, 32)
+		return argon2.IDKey([]byte(s.cryptoPassphrase), salt, s.cryptoTime, s.cryptoMemory*1024, s.cryptoThreads, 32), nil
 	} else {
-		return nil
+		return nil, nil
+	}
+}
+
+// readKeyID reads the key ID header from the object, if any.
+//
+// Returned reader contains the remaining object contents.
+func readKeyID(r io.Reader) (string, io.Reader, error) {
+	hdr := make([]byte, len(keyIDMagic)+1)
+	n, err := io.ReadFull(r, hdr)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", nil, err
 	}
+	if n < len(hdr) || !bytes.Equal(hdr[:len(keyIDMagic)], keyIDMagic) {
+		return "", io.MultiReader(bytes.NewReader(hdr[:n]), r), nil
+	}
+
+	keyID := make([]byte, hdr[len(keyIDMagic)])
+	if _, err := io.ReadFull(r, keyID); err != nil {
+		return "", nil, fmt.Errorf("%s: malformed key ID header: %w", modName, err)
+	}
+	return string(keyID), r, nil
+}
+
+func keyIDHeader(keyID string) []byte {
+	hdr := make([]byte, 0, len(keyIDMagic)+1+len(keyID))
+	hdr = append(hdr, keyIDMagic...)
+	hdr = append(hdr, byte(len(keyID)))
+	return append(hdr, keyID...)
 }
 
 func (s *CryptoStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
@@ -147,14 +287,28 @@ func (s *CryptoStore) Open(ctx context.Context, key string) (io.ReadCloser, erro
 		return nil, err
 	}
 
-	cryptoKey := s.cryptoKey(key)
+	keyID, body, err := readKeyID(r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	cryptoKey, err := s.cryptoKey(keyID, key)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
 	if cryptoKey == nil {
-		return r, nil
+		return struct {
+			io.Reader
+			io.Closer
+		}{Reader: body, Closer: r}, nil
 	}
-	decrypted, err := sio.DecryptReader(r, sio.Config{
+	decrypted, err := sio.DecryptReader(body, sio.Config{
 		Key: cryptoKey,
 	})
 	if err != nil {
+		r.Close()
 		return nil, err
 	}
 
@@ -181,7 +335,10 @@ func (b *cryptoBlob) Sync() error {
 
 	b.didSync = true
 
-	return b.w.Close()
+	if err := b.w.Close(); err != nil {
+		return err
+	}
+	return b.b.Sync()
 }
 
 func (b *cryptoBlob) Write(p []byte) (n int, err error) {
@@ -189,6 +346,9 @@ func (b *cryptoBlob) Write(p []byte) (n int, err error) {
 }
 
 func (b *cryptoBlob) Close() error {
+	if err := b.b.Close(); err != nil {
+		return err
+	}
 	if !b.didSync {
 		return fmt.Errorf("storage.blob.crypto: blob closed without Sync")
 	}
@@ -197,28 +357,55 @@ func (b *cryptoBlob) Close() error {
 }
 
 func (s *CryptoStore) Create(ctx context.Context, key string, blobSize int64) (module.Blob, error) {
+	return s.create(ctx, key, key, blobSize)
+}
+
+// create creates the object encrypted for key under storeKey in the
+// underlying store. They differ only when the object is written to
+// a temporary location first.
+func (s *CryptoStore) create(ctx context.Context, storeKey, key string, blobSize int64) (module.Blob, error) {
+	cryptoKey, err := s.cryptoKey(s.activeKey, key)
+	if err != nil {
+		return nil, err
+	}
+	if cryptoKey == nil {
+		return s.storage.Create(ctx, storeKey, blobSize)
+	}
+
+	var hdr []byte
+	if s.activeKey != "" {
+		hdr = keyIDHeader(s.activeKey)
+	}
 
 	if blobSize != module.UnknownBlobSize {
 		encSize, err := sio.EncryptedSize(uint64(blobSize))
 		if err != nil {
 			return nil, err
 		}
-		blobSize = int64(encSize)
+		blobSize = int64(encSize) + int64(len(hdr))
 	}
 
-	b, err := s.storage.Create(ctx, key, blobSize)
+	b, err := s.storage.Create(ctx, storeKey, blobSize)
 	if err != nil {
 		return nil, err
 	}
 
-	cryptoKey := s.cryptoKey(key)
-	if cryptoKey == nil {
-		return b, nil
+	if hdr != nil {
+		if _, err := b.Write(hdr); err != nil {
+			b.Close()
+			return nil, err
+		}
 	}
 
-	w, err := sio.EncryptWriter(b, sio.Config{
+	// Writer is wrapped so sio does not close the blob, it is committed
+	// using Sync instead.
+	w, err := sio.EncryptWriter(struct{ io.Writer }{b}, sio.Config{
 		Key: cryptoKey,
 	})
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
 
 	return &cryptoBlob{
 		b: b,
@@ -226,11 +413,87 @@ func (s *CryptoStore) Create(ctx context.Context, key string, blobSize int64) (m
 	}, nil
 }
 
+// Reencrypt rewrites the object using the active key if it was encrypted
+// using a different one. It reports whether the object was rewritten.
+//
+// New contents are written under a temporary key and then moved over the
+// original object so it is never left partially written. Underlying store
+// should implement module.RenamableBlobStore for that.
+func (s *CryptoStore) Reencrypt(ctx context.Context, key string) (bool, error) {
+	rn, ok := s.storage.(module.RenamableBlobStore)
+	if !ok {
+		return false, fmt.Errorf("%s: msg_store cannot replace objects atomically: %w", modName, module.ErrNotReencryptable)
+	}
+
+	r, err := s.storage.Open(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	keyID, body, err := readKeyID(r)
+	if err != nil {
+		return false, err
+	}
+	if keyID == s.activeKey {
+		return false, nil
+	}
+
+	cryptoKey, err := s.cryptoKey(keyID, key)
+	if err != nil {
+		return false, err
+	}
+	if cryptoKey != nil {
+		body, err = sio.DecryptReader(body, sio.Config{
+			Key: cryptoKey,
+		})
+		if err != nil {
+			return false, err
+		}
+	}
+
+	tmpKey := key + ".reencrypt"
+	if err := s.writeTemp(ctx, tmpKey, key, body); err != nil {
+		if err := s.storage.Delete(ctx, []string{tmpKey}); err != nil {
+			s.log.Error("failed to remove temporary object", err, tmpKey)
+		}
+		return false, err
+	}
+	r.Close()
+
+	if err := rn.Rename(ctx, tmpKey, key); err != nil {
+		if err := s.storage.Delete(ctx, []string{tmpKey}); err != nil {
+			s.log.Error("failed to remove temporary object", err, tmpKey)
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *CryptoStore) writeTemp(ctx context.Context, tmpKey, key string, body io.Reader) error {
+	b, err := s.create(ctx, tmpKey, key, module.UnknownBlobSize)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	if _, err := io.Copy(b, body); err != nil {
+		return err
+	}
+	return b.Sync()
+}
+
 func (s *CryptoStore) Delete(ctx context.Context, keys []string) error {
 	return s.storage.Delete(ctx, keys)
 }
 
+// ListBlobs lists objects in msg_store. Only object contents are encrypted,
+// keys are stored as is.
+func (s *CryptoStore) ListBlobs(ctx context.Context, fn func(key string, modTime time.Time) error) error {
+	return module.ListBlobs(ctx, s.storage, fn)
+}
+
 func init() {
-	var _ module.BlobStore = &CryptoStore{}
+	var _ module.ReencryptableBlobStore = &CryptoStore{}
+	var _ module.ListableBlobStore = &CryptoStore{}
 	module.Register(modName, New)
 }
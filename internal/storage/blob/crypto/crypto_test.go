@@ -19,9 +19,13 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package crypto
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"io"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/foxcpp/maddy/framework/config"
@@ -68,3 +72,113 @@ func TestCrypto(t *testing.T) {
 	})
 
 }
+
+func TestCrypto_KeyRotation(t *testing.T) {
+	root := testutils.Dir(t)
+	ctx := context.Background()
+
+	genKey := func() string {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(key)
+	}
+	oldKey, newKey := genKey(), genKey()
+	newKeyPath := filepath.Join(root, "new.key")
+	if err := os.WriteFile(newKeyPath, []byte(newKey+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	newStore := func(directives ...config.Node) *CryptoStore {
+		st, err := New(modName, "test", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		directives = append(directives, config.Node{
+			Name: "msg_store",
+			Args: []string{"fs", filepath.Join(root, "messages")},
+		})
+		if err := st.Init(config.NewMap(map[string]interface{}{}, config.Node{
+			Children: directives,
+		})); err != nil {
+			t.Fatal(err)
+		}
+		return st.(*CryptoStore)
+	}
+	put := func(st *CryptoStore, key, body string) {
+		t.Helper()
+		b, err := st.Create(ctx, key, int64(len(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(b, body); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(st *CryptoStore, key, body string) {
+		t.Helper()
+		r, err := st.Open(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != body {
+			t.Errorf("unexpected body for %s: %q", key, data)
+		}
+	}
+
+	legacy := newStore(config.Node{Name: "crypto_static_key", Args: []string{oldKey}})
+	put(legacy, "a", "Message A")
+
+	rotated := newStore(
+		config.Node{Name: "crypto_static_key", Args: []string{oldKey}},
+		config.Node{Name: "key", Args: []string{"old", "static", oldKey}},
+		config.Node{Name: "key", Args: []string{"new", "file", newKeyPath}},
+		config.Node{Name: "active_key", Args: []string{"new"}},
+	)
+	check(rotated, "a", "Message A")
+	put(rotated, "b", "Message B")
+	check(rotated, "b", "Message B")
+
+	stored, err := os.ReadFile(filepath.Join(root, "messages", "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(stored, keyIDHeader("new")) {
+		t.Errorf("object does not start with the key ID header")
+	}
+
+	for key, expected := range map[string]bool{"a": true, "b": false} {
+		rewritten, err := rotated.Reencrypt(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rewritten != expected {
+			t.Errorf("Reencrypt(%s) = %v, want %v", key, rewritten, expected)
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(root, "messages"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected only 2 objects in the underlying store, got %d", len(entries))
+	}
+
+	// Legacy key is no longer needed.
+	onlyNew := newStore(config.Node{Name: "key", Args: []string{"new", "static", newKey}})
+	check(onlyNew, "a", "Message A")
+	check(onlyNew, "b", "Message B")
+}
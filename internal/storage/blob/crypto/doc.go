@@ -36,4 +36,30 @@
 // ```
 // head -c 32 /dev/urandom | base64
 // ```
+//
+// *Syntax:* key _id_ static _key_ ++
+// key _id_ file _path_ ++
+// key _id_ command _executable_ _args..._
+//
+// Define a named key. Multiple keys can be defined to allow key rotation:
+// new objects are encrypted using active_key while existing objects are
+// decrypted using the key they were encrypted with. ID of that key is
+// stored with each object.
+//
+// Key should be a base64-encoded string that decodes to 32 bytes. It can be
+// specified directly, read from a file or from the standard output of a
+// command (e.g. a script that retrieves it from a key management service).
+// Files and commands are read once on start-up.
+//
+// *Syntax:* active_key _id_ ++
+// *Default:* crypto_static_key or the only defined key
+//
+// Key to use for new objects. Objects encrypted using other keys can be
+// migrated to it using 'maddy blob reencrypt'. Each object is written under
+// a temporary key and then moved over the original one, so this requires
+// msg_store to support atomic replacement of objects (fs and s3 do).
+//
+// Objects stored using crypto_static_key do not have key ID attached and
+// crypto_static_key should be kept in the configuration until they are
+// re-encrypted.
 package crypto
@@ -0,0 +1,409 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dedup
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const modName = "storage.blob.dedup"
+
+const lockStripes = 64
+
+// Store wraps another BlobStore to store identical blobs only once.
+//
+// Each blob is stored in the underlying store using the hex-encoded SHA-256
+// of its contents as a key. The SQL database maps blob keys to content hashes
+// and tracks the amount of keys referring to each hash.
+type Store struct {
+	instName string
+	log      log.Logger
+
+	storage   module.BlobStore
+	db        *sql.DB
+	refs      refStore
+	bufferDir string
+	memLimit  int64
+
+	// Reference counts are kept consistent by database transactions. Locks
+	// additionally serialize writes and deletions of the same object within
+	// the process so two first-time writes of the same contents do not race.
+	locks [lockStripes]sync.Mutex
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: expected 0 arguments", modName)
+	}
+	return &Store{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (s *Store) Name() string {
+	return modName
+}
+
+func (s *Store) InstanceName() string {
+	return s.instName
+}
+
+func (s *Store) Init(cfg *config.Map) error {
+	var (
+		driver string
+		dsn    []string
+	)
+	cfg.Custom("msg_store", false, false, func() (interface{}, error) {
+		var store module.BlobStore
+		err := modconfig.ModuleFromNode("storage.blob", []string{"fs", "messages"},
+			config.Node{}, nil, &store)
+		return store, err
+	}, func(m *config.Map, node config.Node) (interface{}, error) {
+		var store module.BlobStore
+		err := modconfig.ModuleFromNode("storage.blob", node.Args,
+			node, m.Globals, &store)
+		return store, err
+	}, &s.storage)
+	cfg.String("driver", false, false, "sqlite3", &driver)
+	cfg.StringList("dsn", false, false, []string{filepath.Join(config.StateDirectory, "blob_refs.db")}, &dsn)
+	cfg.String("buffer_dir", false, false, filepath.Join(config.StateDirectory, "buffer"), &s.bufferDir)
+	cfg.Int64("memory_buffer_limit", false, false, 1*1024*1024, &s.memLimit)
+
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	db, err := sql.Open(driver, strings.Join(dsn, " "))
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	if driver == "sqlite3" {
+		// Avoid "database is locked" errors for concurrent transactions.
+		db.SetMaxOpenConns(1)
+	}
+	s.db = db
+	s.refs = refStore{db: db, driver: driver}
+	if err := s.refs.initSchema(); err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+
+	if err := os.MkdirAll(s.bufferDir, 0o700); err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+
+	return nil
+}
+
+func (s *Store) Close() error {
+	if s.db == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+func (s *Store) lock(digest string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(digest))
+	l := &s.locks[h.Sum32()%lockStripes]
+	l.Lock()
+	return l.Unlock
+}
+
+func (s *Store) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	digest, ok, err := s.refs.digest(ctx, s.db, key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, module.ErrNoSuchBlob
+	}
+
+	return s.storage.Open(ctx, digest)
+}
+
+// link points the key to the contents with the specified digest, storing
+// the contents in the underlying store if it is not already there. The
+// reference to the contents the key pointed to before is released.
+func (s *Store) link(ctx context.Context, key, digest string, buf buffer.Buffer) error {
+	unlock := s.lock(digest)
+	defer unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	oldDigest, hadKey, err := s.refs.digest(ctx, tx, key)
+	if err != nil {
+		return err
+	}
+	if hadKey && oldDigest == digest {
+		return nil
+	}
+
+	created, err := s.refs.acquire(ctx, tx, digest)
+	if err != nil {
+		return err
+	}
+	if created {
+		if err := s.writeObject(ctx, digest, buf); err != nil {
+			return err
+		}
+	}
+	if err := s.refs.setDigest(ctx, tx, key, digest); err != nil {
+		return err
+	}
+	if hadKey {
+		if err := s.release(ctx, tx, oldDigest); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// release drops a reference to the contents with the specified digest and
+// deletes them from the underlying store if it was the last one.
+//
+// Object is deleted before the transaction is committed so a concurrent
+// link with the same contents waits for it and writes the object again.
+func (s *Store) release(ctx context.Context, tx *sql.Tx, digest string) error {
+	last, err := s.refs.release(ctx, tx, digest)
+	if err != nil {
+		return err
+	}
+	if !last {
+		return nil
+	}
+	return s.storage.Delete(ctx, []string{digest})
+}
+
+func (s *Store) writeObject(ctx context.Context, digest string, buf buffer.Buffer) error {
+	r, err := buf.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	b, err := s.storage.Create(ctx, digest, int64(buf.Len()))
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	if _, err := io.Copy(b, r); err != nil {
+		return err
+	}
+	return b.Sync()
+}
+
+type bufferResult struct {
+	buf    buffer.Buffer
+	digest string
+	err    error
+}
+
+type dedupBlob struct {
+	s       *Store
+	ctx     context.Context
+	key     string
+	pw      *io.PipeWriter
+	resCh   chan bufferResult
+	didSync bool
+}
+
+func (b *dedupBlob) Write(p []byte) (n int, err error) {
+	return b.pw.Write(p)
+}
+
+func (b *dedupBlob) Sync() error {
+	// Contents are linked in Sync instead of Close because
+	// backend may not actually check the error of Close.
+	if b.didSync {
+		panic("storage.blob.dedup: Sync called twice for a blob object")
+	}
+	b.didSync = true
+
+	if err := b.pw.Close(); err != nil {
+		return err
+	}
+	res := <-b.resCh
+	if res.err != nil {
+		return res.err
+	}
+	defer func() {
+		if err := res.buf.Remove(); err != nil {
+			b.s.log.Error("failed to remove buffer", err, b.key)
+		}
+	}()
+
+	return b.s.link(b.ctx, b.key, res.digest, res.buf)
+}
+
+func (b *dedupBlob) Close() error {
+	if !b.didSync {
+		b.pw.CloseWithError(errors.New("storage.blob.dedup: blob closed without Sync"))
+		if res := <-b.resCh; res.err == nil {
+			res.buf.Remove()
+		}
+		return fmt.Errorf("storage.blob.dedup: blob closed without Sync")
+	}
+	return nil
+}
+
+func (s *Store) Create(ctx context.Context, key string, blobSize int64) (module.Blob, error) {
+	pr, pw := io.Pipe()
+	resCh := make(chan bufferResult, 1)
+
+	go func() {
+		h := sha256.New()
+		r := io.TeeReader(pr, h)
+
+		var (
+			buf buffer.Buffer
+			err error
+		)
+		if blobSize != module.UnknownBlobSize && blobSize <= s.memLimit {
+			buf, err = buffer.BufferInMemory(r)
+		} else {
+			buf, err = buffer.BufferInFile(r, s.bufferDir)
+		}
+		if err != nil {
+			pr.CloseWithError(err)
+		}
+		resCh <- bufferResult{
+			buf:    buf,
+			digest: hex.EncodeToString(h.Sum(nil)),
+			err:    err,
+		}
+	}()
+
+	return &dedupBlob{
+		s:     s,
+		ctx:   ctx,
+		key:   key,
+		pw:    pw,
+		resCh: resCh,
+	}, nil
+}
+
+// unlink removes the key reference and deletes the contents from the
+// underlying store if it was the last reference to them.
+func (s *Store) unlink(ctx context.Context, key string) error {
+	digest, ok, err := s.refs.digest(ctx, s.db, key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+
+	unlock := s.lock(digest)
+	defer unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	// Key could be re-created with different contents before the lock was
+	// taken, the transaction sees the current mapping.
+	digest, ok, err = s.refs.digest(ctx, tx, key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	if err := s.refs.removeKey(ctx, tx, key); err != nil {
+		return err
+	}
+	if err := s.release(ctx, tx, digest); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) Delete(ctx context.Context, keys []string) error {
+	var lastErr error
+	for _, k := range keys {
+		lastErr = s.unlink(ctx, k)
+		if lastErr != nil {
+			s.log.Error("failed to delete blob", lastErr, k)
+		}
+	}
+	return lastErr
+}
+
+// Reencrypt rewrites the object holding the contents of the key. Since the
+// object is shared by all keys with the same contents, it is rewritten only
+// for the first of them.
+func (s *Store) Reencrypt(ctx context.Context, key string) (bool, error) {
+	digest, ok, err := s.refs.digest(ctx, s.db, key)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, module.ErrNoSuchBlob
+	}
+
+	unlock := s.lock(digest)
+	defer unlock()
+	return module.ReencryptBlob(ctx, s.storage, digest)
+}
+
+func (s *Store) ListBlobs(ctx context.Context, fn func(key string, modTime time.Time) error) error {
+	// Keys are read before calling fn so it can use the store.
+	keys, err := s.refs.keys(ctx)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := fn(k.key, k.created); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	var _ module.ReencryptableBlobStore = &Store{}
+	var _ module.ListableBlobStore = &Store{}
+	module.Register(modName, New)
+}
@@ -0,0 +1,181 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dedup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/storage/blob"
+	_ "github.com/foxcpp/maddy/internal/storage/blob/fs"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type dedupStoreTest struct {
+	*Store
+	root string
+}
+
+func newTestStore(t *testing.T) *dedupStoreTest {
+	root := testutils.Dir(t)
+
+	st := &Store{instName: "test"}
+	err := st.Init(config.NewMap(map[string]interface{}{}, config.Node{
+		Children: []config.Node{
+			{
+				Name: "msg_store",
+				Args: []string{"fs", filepath.Join(root, "messages")},
+			},
+			{
+				Name: "dsn",
+				Args: []string{filepath.Join(root, "refs.db")},
+			},
+			{
+				Name: "buffer_dir",
+				Args: []string{filepath.Join(root, "buffer")},
+			},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &dedupStoreTest{Store: st, root: root}
+}
+
+func TestDedup(t *testing.T) {
+	blob.TestStore(t, func() module.BlobStore {
+		return newTestStore(t)
+	}, func(store module.BlobStore) {
+		store.(*dedupStoreTest).Close()
+		os.RemoveAll(store.(*dedupStoreTest).root)
+	})
+}
+
+func TestDedup_SharedObject(t *testing.T) {
+	st := newTestStore(t)
+	defer st.Close()
+	ctx := context.Background()
+
+	put := func(key, body string) {
+		t.Helper()
+		b, err := st.Create(ctx, key, int64(len(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(b, body); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	objects := func() int {
+		t.Helper()
+		entries, err := os.ReadDir(filepath.Join(st.root, "messages"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+	check := func(key, body string) {
+		t.Helper()
+		r, err := st.Open(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != body {
+			t.Errorf("unexpected body for %s: %q", key, data)
+		}
+	}
+
+	body := strings.Repeat("Hello, world!\r\n", 100)
+	put("a", body)
+	put("b", body)
+	put("c", "Something else\r\n")
+	if n := objects(); n != 2 {
+		t.Errorf("expected 2 objects in the underlying store, got %d", n)
+	}
+
+	if err := st.Delete(ctx, []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Open(ctx, "a"); !errors.Is(err, module.ErrNoSuchBlob) {
+		t.Errorf("expected ErrNoSuchBlob for deleted key, got %v", err)
+	}
+	check("b", body)
+	if n := objects(); n != 2 {
+		t.Errorf("expected 2 objects in the underlying store, got %d", n)
+	}
+
+	if err := st.Delete(ctx, []string{"b", "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := objects(); n != 0 {
+		t.Errorf("expected no objects in the underlying store, got %d", n)
+	}
+
+	// Re-creating a key releases the contents it referred to.
+	put("d", body)
+	put("e", body)
+	put("d", body)
+	put("d", "Something else\r\n")
+	check("d", "Something else\r\n")
+	check("e", body)
+	if n := objects(); n != 2 {
+		t.Errorf("expected 2 objects in the underlying store, got %d", n)
+	}
+	put("e", "Something else\r\n")
+	if n := objects(); n != 1 {
+		t.Errorf("expected 1 object in the underlying store, got %d", n)
+	}
+
+	// Keys are listed with the time they were written.
+	err := st.ListBlobs(ctx, func(key string, modTime time.Time) error {
+		if time.Since(modTime) > time.Minute || time.Until(modTime) > time.Minute {
+			t.Errorf("wrong modification time for %s: %v", key, modTime)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Delete(ctx, []string{"d", "e"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := objects(); n != 0 {
+		t.Errorf("expected no objects in the underlying store, got %d", n)
+	}
+}
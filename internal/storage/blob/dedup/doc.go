@@ -0,0 +1,59 @@
+// Package dedup implements deduplicating blob storage
+//
+//
+// # Deduplicating storage (storage.blob.dedup)
+//
+// This module can be used to store identical message bodies only once in any
+// other blob storage module. It is useful when messages are often delivered
+// to many local recipients since each of them normally gets a separate copy
+// of the message body.
+//
+// Each blob is stored in the underlying storage using the hex-encoded SHA-256
+// hash of its contents as a key. Mapping of blob keys to hashes and reference
+// counts are kept in an SQL database and updated in a single transaction, the
+// underlying object is removed only when the last key referring to it is
+// deleted or re-created with different contents.
+//
+// ```
+// storage.blob.dedup {
+// 	msg_store fs messages
+// 	driver sqlite3
+// 	dsn blob_refs.db
+// }
+// ```
+//
+// If used together with storage.blob.crypto, dedup should wrap crypto and not
+// the other way around. Encrypted blobs never have the same contents.
+//
+// ## Configuration directives
+//
+// *Syntax*: msg_store _store_ ++
+// *Default*: fs messages/
+//
+// Module to use for actual storage of message bodies.
+//
+// See *maddy-blob*(5) for details.
+//
+// *Syntax*: driver _string_ ++
+// *Default*: sqlite3
+//
+// SQL driver to use for key mappings and reference counts. Supported values
+// are sqlite3 and postgres.
+//
+// *Syntax*: dsn _string_ ++
+// *Default*: blob_refs.db in the state directory
+//
+// Data Source Name for the database.
+//
+// *Syntax*: buffer_dir _path_ ++
+// *Default*: StateDirectory/buffer
+//
+// Directory used to temporarily store large message bodies while their hash
+// is computed.
+//
+// *Syntax*: memory_buffer_limit _bytes_ ++
+// *Default*: 1048576
+//
+// Message bodies of known size smaller than this are buffered in memory
+// instead of buffer_dir.
+package dedup
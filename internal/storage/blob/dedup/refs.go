@@ -0,0 +1,160 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright 2021, Steve Blinch <dev@blinch.ca>, Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dedup
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/sqlutil"
+)
+
+// refStore keeps key mappings and reference counts in the SQL database.
+type refStore struct {
+	db     *sql.DB
+	driver string
+}
+
+func (s *refStore) rebind(query string) string {
+	return sqlutil.Rebind(s.driver, query)
+}
+
+func (s *refStore) initSchema() error {
+	_, err := s.db.Exec(`
+		CREATE TABLE IF NOT EXISTS dedupKeys (
+			blobKey VARCHAR(255) PRIMARY KEY NOT NULL,
+			digest CHAR(64) NOT NULL,
+			created BIGINT NOT NULL
+		)`)
+	if err != nil {
+		return fmt.Errorf("create table dedupKeys: %w", err)
+	}
+	_, err = s.db.Exec(`
+		CREATE TABLE IF NOT EXISTS dedupObjects (
+			digest CHAR(64) PRIMARY KEY NOT NULL,
+			refs BIGINT NOT NULL
+		)`)
+	if err != nil {
+		return fmt.Errorf("create table dedupObjects: %w", err)
+	}
+	return nil
+}
+
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// digest returns the content hash the key refers to.
+func (s *refStore) digest(ctx context.Context, q querier, key string) (string, bool, error) {
+	var digest string
+	err := q.QueryRowContext(ctx, s.rebind(`SELECT digest FROM dedupKeys WHERE blobKey = ?`), key).Scan(&digest)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return digest, true, nil
+}
+
+type keyInfo struct {
+	key     string
+	created time.Time
+}
+
+// keys returns all keys stored in the table along with the time they were
+// last written.
+func (s *refStore) keys(ctx context.Context) ([]keyInfo, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT blobKey, created FROM dedupKeys`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []keyInfo
+	for rows.Next() {
+		var (
+			key     string
+			created int64
+		)
+		if err := rows.Scan(&key, &created); err != nil {
+			return nil, err
+		}
+		keys = append(keys, keyInfo{key: key, created: time.Unix(created, 0)})
+	}
+	return keys, rows.Err()
+}
+
+// acquire increments the reference count for the digest. It returns true if
+// there were no references to it before.
+func (s *refStore) acquire(ctx context.Context, tx *sql.Tx, digest string) (bool, error) {
+	// UPDATE and then INSERT if nothing was updated, so the same queries
+	// work with all supported databases.
+	res, err := tx.ExecContext(ctx, s.rebind(`UPDATE dedupObjects SET refs = refs + 1 WHERE digest = ?`), digest)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 0 {
+		return false, err
+	}
+	_, err = tx.ExecContext(ctx, s.rebind(`INSERT INTO dedupObjects(digest, refs) VALUES (?, 1)`), digest)
+	return true, err
+}
+
+// release decrements the reference count for the digest. It returns true if
+// that was the last reference, the row is removed in this case.
+func (s *refStore) release(ctx context.Context, tx *sql.Tx, digest string) (bool, error) {
+	_, err := tx.ExecContext(ctx, s.rebind(`UPDATE dedupObjects SET refs = refs - 1 WHERE digest = ?`), digest)
+	if err != nil {
+		return false, err
+	}
+
+	var refs int64
+	err = tx.QueryRowContext(ctx, s.rebind(`SELECT refs FROM dedupObjects WHERE digest = ?`), digest).Scan(&refs)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	if err == nil && refs > 0 {
+		return false, nil
+	}
+
+	_, err = tx.ExecContext(ctx, s.rebind(`DELETE FROM dedupObjects WHERE digest = ?`), digest)
+	return true, err
+}
+
+// setDigest points the key to the digest.
+func (s *refStore) setDigest(ctx context.Context, tx *sql.Tx, key, digest string) error {
+	now := time.Now().Unix()
+	res, err := tx.ExecContext(ctx, s.rebind(`UPDATE dedupKeys SET digest = ?, created = ? WHERE blobKey = ?`), digest, now, key)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 0 {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, s.rebind(`INSERT INTO dedupKeys(blobKey, digest, created) VALUES (?, ?, ?)`), key, digest, now)
+	return err
+}
+
+func (s *refStore) removeKey(ctx context.Context, tx *sql.Tx, key string) error {
+	_, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM dedupKeys WHERE blobKey = ?`), key)
+	return err
+}
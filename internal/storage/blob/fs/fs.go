@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/module"
@@ -89,7 +90,40 @@ func (s *FSStore) Delete(_ context.Context, keys []string) error {
 	return nil
 }
 
+func (s *FSStore) Rename(_ context.Context, oldKey, newKey string) error {
+	err := os.Rename(filepath.Join(s.root, oldKey), filepath.Join(s.root, newKey))
+	if os.IsNotExist(err) {
+		return module.ErrNoSuchBlob
+	}
+	return err
+}
+
+func (s *FSStore) ListBlobs(_ context.Context, fn func(key string, modTime time.Time) error) error {
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Removed while listing.
+				continue
+			}
+			return err
+		}
+		if err := fn(e.Name(), info.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func init() {
-	var _ module.BlobStore = &FSStore{}
+	var _ module.ListableBlobStore = &FSStore{}
+	var _ module.RenamableBlobStore = &FSStore{}
 	module.Register(FSStore{}.Name(), New)
 }
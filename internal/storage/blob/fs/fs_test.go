@@ -1,8 +1,13 @@
 package fs
 
 import (
+	"context"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/storage/blob"
@@ -17,3 +22,30 @@ func TestFS(t *testing.T) {
 		os.RemoveAll(store.(*FSStore).root)
 	})
 }
+
+func TestFS_ListBlobs(t *testing.T) {
+	dir := testutils.Dir(t)
+	store := &FSStore{instName: "test", root: dir}
+
+	for _, key := range []string{"b", "a", "c"} {
+		if err := os.WriteFile(filepath.Join(dir, key), []byte(key), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "subdir"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	err := store.ListBlobs(context.Background(), func(key string, _ time.Time) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"a", "b", "c"}) {
+		t.Errorf("unexpected keys: %v", keys)
+	}
+}
@@ -0,0 +1,67 @@
+// Package mirror implements replicated blob storage
+//
+//
+// # Replicated storage (storage.blob.mirror)
+//
+// This module writes each object to multiple blob storage modules
+// (replicas), e.g. local filesystem and S3 in another region.
+//
+// ```
+// storage.blob.mirror {
+// 	replica fs messages
+// 	replica s3 { ... }
+// 	write_quorum 1
+// }
+// ```
+//
+// Writes are considered successful if at least write_quorum replicas
+// stored the object. Partially written objects are removed from replicas
+// that failed, objects are then copied to them by the background repair
+// pass.
+//
+// Reads are served by the first replica (in the configuration order) that
+// returns the object. Replicas that failed recently are tried last.
+// Replicas that are known to miss the object are not used until it is
+// repaired.
+//
+// Repair pass also lists objects in all replicas that support listing and
+// copies objects missing from some of them. Object should be missing during
+// two consecutive passes to be copied so objects that are being written are
+// not touched. Objects that failed to be deleted from some replicas are
+// deleted again by the repair pass instead of being copied. This is tracked
+// in memory only, so objects deleted while some replica was unavailable may
+// still be resurrected if the server is restarted before that, use
+// storage.imapsql consistency check to remove them.
+//
+// ## Configuration directives
+//
+// *Syntax*: replica _store_ ++
+// *Default*: not specified
+//
+// Module to use for storage of message bodies. Should be specified at least
+// two times.
+//
+// See *maddy-blob*(5) for details.
+//
+// *Syntax*: write_quorum _integer_ ++
+// *Default*: amount of replicas
+//
+// Minimal amount of replicas that should store the object for write to
+// succeed.
+//
+// *Syntax*: failure_backoff _duration_ ++
+// *Default*: 1m
+//
+// Replicas that failed to serve a read are tried after all other replicas
+// for this time.
+//
+// *Syntax*: repair_interval _duration_ ++
+// *Default*: 1h
+//
+// How often to run the repair pass. 0 disables it.
+//
+// *Syntax*: debug _boolean_ ++
+// *Default*: global directive value
+//
+// Enable verbose logging.
+package mirror
@@ -0,0 +1,67 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package mirror
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	replicaHealthy = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "maddy",
+			Subsystem: "blob_mirror",
+			Name:      "replica_healthy",
+			Help:      "Whether the last read from the replica succeeded",
+		},
+		[]string{"module", "replica"},
+	)
+	replicaWriteFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "blob_mirror",
+			Name:      "replica_write_failures",
+			Help:      "Amount of objects that failed to be written to the replica",
+		},
+		[]string{"module", "replica"},
+	)
+	replicaRepaired = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "blob_mirror",
+			Name:      "repaired_objects",
+			Help:      "Amount of objects copied to the replica by the repair pass",
+		},
+		[]string{"module", "replica"},
+	)
+	replicaLagging = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "maddy",
+			Subsystem: "blob_mirror",
+			Name:      "lagging_objects",
+			Help:      "Amount of objects known to be missing from some replicas",
+		},
+		[]string{"module"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(replicaHealthy)
+	prometheus.MustRegister(replicaWriteFailures)
+	prometheus.MustRegister(replicaRepaired)
+	prometheus.MustRegister(replicaLagging)
+}
@@ -0,0 +1,479 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const modName = "storage.blob.mirror"
+
+type replica struct {
+	idx   int
+	store module.BlobStore
+
+	// failedAt is the time of the last read error, zero if the replica is
+	// considered healthy. Protected by Store.lock.
+	failedAt time.Time
+}
+
+func (r *replica) String() string {
+	return strconv.Itoa(r.idx)
+}
+
+// Store writes objects to multiple BlobStores.
+type Store struct {
+	instName string
+	log      log.Logger
+
+	replicas       []*replica
+	quorum         int
+	failureBackoff time.Duration
+
+	lock sync.Mutex
+	// lagging contains objects that are known to be missing from some
+	// replicas, e.g. because write to them failed.
+	lagging map[string]map[int]struct{}
+	// undeleted contains objects that failed to be removed from some
+	// replicas. Repair retries the removal instead of copying them back
+	// to other replicas.
+	undeleted map[string]map[int]struct{}
+	// deleteGen is incremented on each Delete, repair uses it to detect
+	// objects deleted while they were copied.
+	deleteGen uint64
+
+	repairStop   chan struct{}
+	repairCtx    context.Context
+	repairCancel context.CancelFunc
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: expected 0 arguments", modName)
+	}
+	return &Store{
+		instName:  instName,
+		log:       log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		lagging:   map[string]map[int]struct{}{},
+		undeleted: map[string]map[int]struct{}{},
+	}, nil
+}
+
+func (s *Store) Name() string {
+	return modName
+}
+
+func (s *Store) InstanceName() string {
+	return s.instName
+}
+
+func (s *Store) Init(cfg *config.Map) error {
+	var repairInterval time.Duration
+	cfg.Callback("replica", func(m *config.Map, node config.Node) error {
+		var store module.BlobStore
+		if err := modconfig.ModuleFromNode("storage.blob", node.Args,
+			node, m.Globals, &store); err != nil {
+			return err
+		}
+		s.replicas = append(s.replicas, &replica{
+			idx:   len(s.replicas),
+			store: store,
+		})
+		return nil
+	})
+	cfg.Int("write_quorum", false, false, 0, &s.quorum)
+	cfg.Duration("failure_backoff", false, false, 1*time.Minute, &s.failureBackoff)
+	cfg.Duration("repair_interval", false, false, 1*time.Hour, &repairInterval)
+	cfg.Bool("debug", true, false, &s.log.Debug)
+
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if len(s.replicas) < 2 {
+		return fmt.Errorf("%s: at least two replicas are required", modName)
+	}
+	if s.quorum == 0 {
+		s.quorum = len(s.replicas)
+	}
+	if s.quorum < 1 || s.quorum > len(s.replicas) {
+		return fmt.Errorf("%s: write_quorum should be between 1 and the amount of replicas", modName)
+	}
+	for _, r := range s.replicas {
+		replicaHealthy.WithLabelValues(s.instName, r.String()).Set(1)
+	}
+
+	s.repairCtx, s.repairCancel = context.WithCancel(context.Background())
+	if repairInterval != 0 && !module.NoRun {
+		s.repairStop = make(chan struct{})
+		go s.repairWorker(repairInterval)
+	}
+
+	return nil
+}
+
+func (s *Store) markLagging(key string, idx int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	set := s.lagging[key]
+	if set == nil {
+		set = map[int]struct{}{}
+		s.lagging[key] = set
+	}
+	set[idx] = struct{}{}
+	replicaLagging.WithLabelValues(s.instName).Set(float64(len(s.lagging)))
+}
+
+func (s *Store) markUndeleted(key string, idx int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	set := s.undeleted[key]
+	if set == nil {
+		set = map[int]struct{}{}
+		s.undeleted[key] = set
+	}
+	set[idx] = struct{}{}
+}
+
+// readOrder returns replicas in the order they should be tried for reading
+// the object: healthy replicas first, replicas that failed recently last.
+// Replicas that are known to have no up-to-date copy of the object (it is
+// lagging or was deleted) are not returned.
+func (s *Store) readOrder(key string) []*replica {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	order := make([]*replica, 0, len(s.replicas))
+	var failed []*replica
+	for _, r := range s.replicas {
+		if _, ok := s.lagging[key][r.idx]; ok {
+			continue
+		}
+		if _, ok := s.undeleted[key][r.idx]; ok {
+			continue
+		}
+		if !r.failedAt.IsZero() && time.Since(r.failedAt) < s.failureBackoff {
+			failed = append(failed, r)
+			continue
+		}
+		order = append(order, r)
+	}
+	return append(order, failed...)
+}
+
+func (s *Store) setHealthy(r *replica, healthy bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	wasHealthy := r.failedAt.IsZero()
+	if healthy {
+		r.failedAt = time.Time{}
+	} else {
+		r.failedAt = time.Now()
+	}
+	if wasHealthy != healthy {
+		val := 0.0
+		if healthy {
+			val = 1
+		}
+		replicaHealthy.WithLabelValues(s.instName, r.String()).Set(val)
+	}
+}
+
+func (s *Store) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	var (
+		lastErr  error
+		notFound []*replica
+	)
+	for _, r := range s.readOrder(key) {
+		rd, err := r.store.Open(ctx, key)
+		if err == nil {
+			s.setHealthy(r, true)
+			for _, nf := range notFound {
+				s.log.Msg("object is missing from replica", "key", key, "replica", nf)
+				s.markLagging(key, nf.idx)
+			}
+			return rd, nil
+		}
+		if errors.Is(err, module.ErrNoSuchBlob) {
+			notFound = append(notFound, r)
+			continue
+		}
+
+		s.log.Error("replica read failed", err, "key", key, "replica", r)
+		s.setHealthy(r, false)
+		lastErr = err
+	}
+
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, module.ErrNoSuchBlob
+}
+
+type mirrorBlob struct {
+	s   *Store
+	key string
+	// blobs contains nil for replicas that failed.
+	blobs   []module.Blob
+	lastErr error
+	didSync bool
+}
+
+func (b *mirrorBlob) alive() int {
+	n := 0
+	for _, blob := range b.blobs {
+		if blob != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (b *mirrorBlob) fail(i int, err error) {
+	b.s.log.Error("replica write failed", err, "key", b.key, "replica", i)
+	replicaWriteFailures.WithLabelValues(b.s.instName, strconv.Itoa(i)).Inc()
+	b.s.discard(b.key, i, b.blobs[i])
+	b.blobs[i] = nil
+	b.lastErr = err
+}
+
+// discard closes the partially written object and removes it from the
+// replica so it is not served in place of the complete one.
+func (s *Store) discard(key string, idx int, blob module.Blob) {
+	blob.Close()
+	if err := s.replicas[idx].store.Delete(context.Background(), []string{key}); err != nil {
+		s.log.Error("failed to remove partial object", err, "key", key, "replica", idx)
+	}
+}
+
+func (b *mirrorBlob) Write(p []byte) (int, error) {
+	for i, blob := range b.blobs {
+		if blob == nil {
+			continue
+		}
+		n, err := blob.Write(p)
+		if err == nil && n < len(p) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			b.fail(i, err)
+		}
+	}
+	if b.alive() < b.s.quorum {
+		return 0, b.lastErr
+	}
+	return len(p), nil
+}
+
+func (b *mirrorBlob) Sync() error {
+	if b.didSync {
+		panic("storage.blob.mirror: Sync called twice for a blob object")
+	}
+	b.didSync = true
+
+	errs := make([]error, len(b.blobs))
+	var wg sync.WaitGroup
+	for i, blob := range b.blobs {
+		if blob == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, blob module.Blob) {
+			defer wg.Done()
+			errs[i] = blob.Sync()
+		}(i, blob)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			b.fail(i, err)
+		}
+	}
+	if b.alive() < b.s.quorum {
+		return fmt.Errorf("%s: write quorum not reached: %w", modName, b.lastErr)
+	}
+
+	for i, blob := range b.blobs {
+		if blob == nil {
+			b.s.markLagging(b.key, i)
+		}
+	}
+	return nil
+}
+
+func (b *mirrorBlob) Close() error {
+	for _, blob := range b.blobs {
+		if blob == nil {
+			continue
+		}
+		if err := blob.Close(); err != nil {
+			b.s.log.Error("replica close failed", err, "key", b.key)
+		}
+	}
+	if !b.didSync {
+		return fmt.Errorf("%s: blob closed without Sync", modName)
+	}
+	return nil
+}
+
+func (s *Store) Create(ctx context.Context, key string, blobSize int64) (module.Blob, error) {
+	s.lock.Lock()
+	delete(s.undeleted, key)
+	s.lock.Unlock()
+
+	b := &mirrorBlob{
+		s:     s,
+		key:   key,
+		blobs: make([]module.Blob, len(s.replicas)),
+	}
+	for i, r := range s.replicas {
+		blob, err := r.store.Create(ctx, key, blobSize)
+		if err != nil {
+			s.log.Error("replica create failed", err, "key", key, "replica", r)
+			replicaWriteFailures.WithLabelValues(s.instName, r.String()).Inc()
+			b.lastErr = err
+			continue
+		}
+		b.blobs[i] = blob
+	}
+
+	if b.alive() < s.quorum {
+		for i, blob := range b.blobs {
+			if blob != nil {
+				s.discard(key, i, blob)
+			}
+		}
+		return nil, fmt.Errorf("%s: write quorum not reached: %w", modName, b.lastErr)
+	}
+	return b, nil
+}
+
+func (s *Store) Delete(ctx context.Context, keys []string) error {
+	s.lock.Lock()
+	s.deleteGen++
+	for _, key := range keys {
+		delete(s.lagging, key)
+	}
+	replicaLagging.WithLabelValues(s.instName).Set(float64(len(s.lagging)))
+	s.lock.Unlock()
+
+	var lastErr error
+	for _, r := range s.replicas {
+		if err := r.store.Delete(ctx, keys); err != nil {
+			s.log.Error("replica delete failed", err, "replica", r)
+			for _, key := range keys {
+				s.markUndeleted(key, r.idx)
+			}
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// ListBlobs returns objects stored in any of the listable replicas.
+func (s *Store) ListBlobs(ctx context.Context, fn func(key string, modTime time.Time) error) error {
+	listed := map[string]time.Time{}
+	listable := false
+	for _, r := range s.replicas {
+		l, ok := r.store.(module.ListableBlobStore)
+		if !ok {
+			continue
+		}
+		err := l.ListBlobs(ctx, func(key string, modTime time.Time) error {
+			if prev, ok := listed[key]; !ok || modTime.After(prev) {
+				listed[key] = modTime
+			}
+			return nil
+		})
+		if errors.Is(err, module.ErrNotListable) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		listable = true
+	}
+	if !listable {
+		return module.ErrNotListable
+	}
+
+	for key, modTime := range listed {
+		if err := fn(key, modTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reencrypt passes the call to all replicas that support it.
+func (s *Store) Reencrypt(ctx context.Context, key string) (bool, error) {
+	supported := false
+	rewritten := false
+	for _, r := range s.replicas {
+		re, ok := r.store.(module.ReencryptableBlobStore)
+		if !ok {
+			continue
+		}
+		ok, err := re.Reencrypt(ctx, key)
+		if errors.Is(err, module.ErrNotReencryptable) {
+			continue
+		}
+		if errors.Is(err, module.ErrNoSuchBlob) {
+			supported = true
+			continue
+		}
+		if err != nil {
+			return rewritten, err
+		}
+		supported = true
+		rewritten = rewritten || ok
+	}
+	if !supported {
+		return false, module.ErrNotReencryptable
+	}
+	return rewritten, nil
+}
+
+func (s *Store) Close() error {
+	if s.repairStop != nil {
+		s.repairCancel()
+		s.repairStop <- struct{}{}
+		<-s.repairStop
+	}
+	return nil
+}
+
+func init() {
+	var _ module.ListableBlobStore = &Store{}
+	var _ module.ReencryptableBlobStore = &Store{}
+	module.Register(modName, New)
+}
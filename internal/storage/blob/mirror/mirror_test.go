@@ -0,0 +1,303 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package mirror
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/storage/blob"
+	_ "github.com/foxcpp/maddy/internal/storage/blob/fs"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type mirrorStoreTest struct {
+	*Store
+	root string
+}
+
+func newTestStore(t *testing.T, root string, replicas int, quorum string) *mirrorStoreTest {
+	st, err := New(modName, "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var children []config.Node
+	for i := 0; i < replicas; i++ {
+		children = append(children, config.Node{
+			Name: "replica",
+			Args: []string{"fs", filepath.Join(root, strconv.Itoa(i))},
+		})
+	}
+	children = append(children, config.Node{
+		Name: "write_quorum",
+		Args: []string{quorum},
+	})
+
+	if err := st.Init(config.NewMap(map[string]interface{}{}, config.Node{
+		Children: children,
+	})); err != nil {
+		t.Fatal(err)
+	}
+	return &mirrorStoreTest{Store: st.(*Store), root: root}
+}
+
+func TestMirror(t *testing.T) {
+	blob.TestStore(t, func() module.BlobStore {
+		return newTestStore(t, testutils.Dir(t), 2, "2")
+	}, func(store module.BlobStore) {
+		os.RemoveAll(store.(*mirrorStoreTest).root)
+	})
+}
+
+// brokenStore fails all operations.
+type brokenStore struct{}
+
+var errBroken = errors.New("replica is broken")
+
+func (brokenStore) Name() string         { return "broken" }
+func (brokenStore) InstanceName() string { return "" }
+
+func (brokenStore) Init(*config.Map) error { return nil }
+
+func (brokenStore) Open(context.Context, string) (io.ReadCloser, error) {
+	return nil, errBroken
+}
+
+func (brokenStore) Create(context.Context, string, int64) (module.Blob, error) {
+	return nil, errBroken
+}
+
+func (brokenStore) Delete(context.Context, []string) error {
+	return errBroken
+}
+
+// shortWriteStore stores only the first byte of each object and fails
+// the write.
+type shortWriteStore struct {
+	module.BlobStore
+}
+
+type shortWriteBlob struct {
+	module.Blob
+}
+
+func (b shortWriteBlob) Write(p []byte) (int, error) {
+	if len(p) > 1 {
+		n, _ := b.Blob.Write(p[:1])
+		return n, errBroken
+	}
+	return b.Blob.Write(p)
+}
+
+func (s shortWriteStore) Create(ctx context.Context, key string, blobSize int64) (module.Blob, error) {
+	b, err := s.BlobStore.Create(ctx, key, blobSize)
+	if err != nil {
+		return nil, err
+	}
+	return shortWriteBlob{Blob: b}, nil
+}
+
+// noDeleteStore fails to delete objects.
+type noDeleteStore struct {
+	module.BlobStore
+}
+
+func (noDeleteStore) Delete(context.Context, []string) error {
+	return errBroken
+}
+
+func writeBlob(s module.BlobStore, key, contents string) error {
+	b, err := s.Create(context.Background(), key, int64(len(contents)))
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(b, contents); err != nil {
+		b.Close()
+		return err
+	}
+	if err := b.Sync(); err != nil {
+		b.Close()
+		return err
+	}
+	return b.Close()
+}
+
+func readBlob(t *testing.T, s module.BlobStore, key string) string {
+	t.Helper()
+	r, err := s.Open(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestMirror_Quorum(t *testing.T) {
+	st := newTestStore(t, testutils.Dir(t), 3, "2")
+	defer os.RemoveAll(st.root)
+
+	working := st.replicas[0].store
+	st.replicas[0].store = brokenStore{}
+
+	if err := writeBlob(st, "1", "hello"); err != nil {
+		t.Fatal("write failed with quorum reached:", err)
+	}
+	if readBlob(t, st, "1") != "hello" {
+		t.Fatal("wrong contents")
+	}
+	if !st.replicas[0].failedAt.IsZero() {
+		t.Error("lagging replica is used for reading")
+	}
+	if _, ok := st.lagging["1"][0]; !ok {
+		t.Error("failed replica is not marked as lagging")
+	}
+
+	st.replicas[1].store = brokenStore{}
+	if err := writeBlob(st, "2", "hello"); err == nil {
+		t.Fatal("write succeeded without quorum")
+	}
+
+	// Broken replica is repaired.
+	st.replicas[0].store = working
+	st.replicas[1].store = working
+	repaired, _, err := st.Repair(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repaired != 1 {
+		t.Error("wrong amount of repaired objects:", repaired)
+	}
+	if len(st.lagging) != 0 {
+		t.Error("lagging objects left after repair:", st.lagging)
+	}
+	if readBlob(t, working, "1") != "hello" {
+		t.Error("wrong contents after repair")
+	}
+}
+
+func TestMirror_Repair(t *testing.T) {
+	st := newTestStore(t, testutils.Dir(t), 2, "1")
+	defer os.RemoveAll(st.root)
+
+	// Object written to one replica directly, e.g. replica was added later.
+	if err := writeBlob(st.replicas[1].store, "1", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.replicas[0].store.Open(context.Background(), "1"); !errors.Is(err, module.ErrNoSuchBlob) {
+		t.Fatal("unexpected error:", err)
+	}
+
+	// Reads fall back to other replicas.
+	if readBlob(t, st, "1") != "hello" {
+		t.Fatal("wrong contents")
+	}
+	// Read marked it as lagging, clear that to check listing.
+	st.lagging = map[string]map[int]struct{}{}
+
+	repaired, missing, err := st.Repair(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repaired != 0 {
+		t.Fatal("object is repaired during first pass")
+	}
+	repaired, _, err = st.Repair(context.Background(), missing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repaired != 1 {
+		t.Fatal("wrong amount of repaired objects:", repaired)
+	}
+	if readBlob(t, st.replicas[0].store, "1") != "hello" {
+		t.Error("wrong contents after repair")
+	}
+}
+
+func TestMirror_PartialWrite(t *testing.T) {
+	st := newTestStore(t, testutils.Dir(t), 2, "1")
+	defer os.RemoveAll(st.root)
+
+	working := st.replicas[0].store
+	st.replicas[0].store = shortWriteStore{BlobStore: working}
+
+	if err := writeBlob(st, "1", "hello"); err != nil {
+		t.Fatal("write failed with quorum reached:", err)
+	}
+	if _, err := working.Open(context.Background(), "1"); !errors.Is(err, module.ErrNoSuchBlob) {
+		t.Fatal("partial object is not removed:", err)
+	}
+}
+
+func TestMirror_FailedDelete(t *testing.T) {
+	st := newTestStore(t, testutils.Dir(t), 2, "2")
+	defer os.RemoveAll(st.root)
+
+	if err := writeBlob(st, "1", "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	working := st.replicas[1].store
+	st.replicas[1].store = noDeleteStore{BlobStore: working}
+	if err := st.Delete(context.Background(), []string{"1"}); err == nil {
+		t.Fatal("delete succeeded")
+	}
+	if _, err := st.Open(context.Background(), "1"); !errors.Is(err, module.ErrNoSuchBlob) {
+		t.Fatal("deleted object is readable:", err)
+	}
+
+	// Object is not copied back to the replica it was deleted from.
+	_, missing, err := st.Repair(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repaired, _, err := st.Repair(context.Background(), missing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repaired != 0 {
+		t.Fatal("deleted object is resurrected")
+	}
+	if _, err := st.replicas[0].store.Open(context.Background(), "1"); !errors.Is(err, module.ErrNoSuchBlob) {
+		t.Fatal("deleted object is resurrected:", err)
+	}
+
+	// Delete is retried once replica works again.
+	st.replicas[1].store = working
+	if _, _, err := st.Repair(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := working.Open(context.Background(), "1"); !errors.Is(err, module.ErrNoSuchBlob) {
+		t.Fatal("object is not deleted by repair:", err)
+	}
+	if len(st.undeleted) != 0 {
+		t.Error("undeleted objects left after repair:", st.undeleted)
+	}
+}
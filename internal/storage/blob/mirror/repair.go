@@ -0,0 +1,277 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package mirror
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// listMissing returns objects that are stored in some listable replicas
+// but not in others. Replicas that cannot be listed are not checked.
+func (s *Store) listMissing(ctx context.Context) (map[string]map[int]struct{}, error) {
+	var (
+		listed []int
+		sets   = make([]map[string]struct{}, len(s.replicas))
+		all    = map[string]struct{}{}
+	)
+	for i, r := range s.replicas {
+		l, ok := r.store.(module.ListableBlobStore)
+		if !ok {
+			continue
+		}
+		set := map[string]struct{}{}
+		err := l.ListBlobs(ctx, func(key string, _ time.Time) error {
+			set[key] = struct{}{}
+			all[key] = struct{}{}
+			return nil
+		})
+		if errors.Is(err, module.ErrNotListable) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = set
+		listed = append(listed, i)
+	}
+
+	missing := map[string]map[int]struct{}{}
+	for key := range all {
+		for _, i := range listed {
+			if _, ok := sets[i][key]; ok {
+				continue
+			}
+			if missing[key] == nil {
+				missing[key] = map[int]struct{}{}
+			}
+			missing[key][i] = struct{}{}
+		}
+	}
+	return missing, nil
+}
+
+// retryDeletes removes objects that failed to be deleted from some
+// replicas earlier.
+func (s *Store) retryDeletes(ctx context.Context) {
+	pending := map[string][]int{}
+	s.lock.Lock()
+	for key, idxs := range s.undeleted {
+		for i := range idxs {
+			pending[key] = append(pending[key], i)
+		}
+	}
+	s.lock.Unlock()
+
+	for key, idxs := range pending {
+		for _, i := range idxs {
+			if err := s.replicas[i].store.Delete(ctx, []string{key}); err != nil {
+				s.log.Error("replica delete failed", err, "key", key, "replica", i)
+				continue
+			}
+
+			s.lock.Lock()
+			delete(s.undeleted[key], i)
+			if len(s.undeleted[key]) == 0 {
+				delete(s.undeleted, key)
+			}
+			s.lock.Unlock()
+		}
+	}
+}
+
+// Repair copies objects missing from some replicas from other replicas.
+//
+// Objects that failed to be written to some replicas are repaired
+// immediately. Objects found missing by listing the replicas are repaired
+// only if they were also missing during the previous call (passed as
+// prevMissing) so objects that are being written right now are not
+// touched.
+//
+// Objects that failed to be deleted from some replicas are deleted again
+// and never copied to other replicas.
+//
+// Returned map should be passed as prevMissing to the next call.
+func (s *Store) Repair(ctx context.Context, prevMissing map[string]map[int]struct{}) (repaired int, missing map[string]map[int]struct{}, err error) {
+	s.retryDeletes(ctx)
+
+	missing, err = s.listMissing(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	toRepair := map[string]map[int]struct{}{}
+	s.lock.Lock()
+	for key, idxs := range s.lagging {
+		toRepair[key] = map[int]struct{}{}
+		for i := range idxs {
+			toRepair[key][i] = struct{}{}
+		}
+	}
+	for key := range missing {
+		if _, ok := s.undeleted[key]; ok {
+			delete(missing, key)
+		}
+	}
+	s.lock.Unlock()
+	for key, idxs := range missing {
+		for i := range idxs {
+			if _, ok := prevMissing[key][i]; !ok {
+				continue
+			}
+			if toRepair[key] == nil {
+				toRepair[key] = map[int]struct{}{}
+			}
+			toRepair[key][i] = struct{}{}
+		}
+	}
+
+	for key, targets := range toRepair {
+		if err := ctx.Err(); err != nil {
+			return repaired, missing, err
+		}
+		for i := range targets {
+			done, err := s.repairObject(ctx, key, i)
+			if err != nil {
+				s.log.Error("failed to repair object", err, "key", key, "replica", i)
+				continue
+			}
+			if done {
+				repaired++
+				replicaRepaired.WithLabelValues(s.instName, s.replicas[i].String()).Inc()
+			}
+			s.clearLagging(key, i)
+			delete(missing[key], i)
+		}
+	}
+
+	return repaired, missing, nil
+}
+
+func (s *Store) clearLagging(key string, idx int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.lagging[key], idx)
+	if len(s.lagging[key]) == 0 {
+		delete(s.lagging, key)
+	}
+	replicaLagging.WithLabelValues(s.instName).Set(float64(len(s.lagging)))
+}
+
+// openSource opens the object from any replica except target.
+func (s *Store) openSource(ctx context.Context, key string, target int) (io.ReadCloser, error) {
+	var lastErr error
+	for _, r := range s.readOrder(key) {
+		if r.idx == target {
+			continue
+		}
+		rd, err := r.store.Open(ctx, key)
+		if err == nil {
+			return rd, nil
+		}
+		if !errors.Is(err, module.ErrNoSuchBlob) {
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, module.ErrNoSuchBlob
+}
+
+// repairObject copies the object to the target replica. false is returned
+// if the object no longer exists.
+func (s *Store) repairObject(ctx context.Context, key string, target int) (bool, error) {
+	s.lock.Lock()
+	gen := s.deleteGen
+	s.lock.Unlock()
+
+	src, err := s.openSource(ctx, key, target)
+	if err != nil {
+		if errors.Is(err, module.ErrNoSuchBlob) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer src.Close()
+
+	dst := s.replicas[target].store
+	b, err := dst.Create(ctx, key, module.UnknownBlobSize)
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(b, src); err != nil {
+		b.Close()
+		return false, err
+	}
+	if err := b.Sync(); err != nil {
+		b.Close()
+		return false, err
+	}
+	if err := b.Close(); err != nil {
+		return false, err
+	}
+
+	s.lock.Lock()
+	deleted := gen != s.deleteGen
+	s.lock.Unlock()
+	if deleted {
+		// Object might have been deleted while it was copied, make sure it is
+		// not resurrected.
+		rd, err := s.openSource(ctx, key, target)
+		if errors.Is(err, module.ErrNoSuchBlob) {
+			return false, dst.Delete(ctx, []string{key})
+		}
+		if err != nil {
+			return false, err
+		}
+		rd.Close()
+	}
+
+	s.log.DebugMsg("repaired object", "key", key, "replica", target)
+	return true, nil
+}
+
+func (s *Store) repairWorker(interval time.Duration) {
+	var prevMissing map[string]map[int]struct{}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			repaired, missing, err := s.Repair(s.repairCtx, prevMissing)
+			if err != nil {
+				s.log.Error("repair failed", err)
+				continue
+			}
+			prevMissing = missing
+			if repaired != 0 {
+				s.log.Msg("repaired objects", "count", repaired)
+			}
+		case <-s.repairStop:
+			s.repairStop <- struct{}{}
+			return
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// multipartBlob uploads the object using multipart upload. Up to
+// part_size bytes are buffered in memory for each part being uploaded.
+//
+// Objects smaller than a single part are uploaded using PutObject.
+type multipartBlob struct {
+	s    *Store
+	ctx  context.Context
+	name string
+
+	buf      []byte
+	uploadID string
+	nextPart int
+
+	// sem limits the amount of parts uploaded in parallel.
+	sem chan struct{}
+	wg  sync.WaitGroup
+
+	lock  sync.Mutex
+	parts []minio.CompletePart
+	err   error
+
+	didSync bool
+}
+
+func (s *Store) newMultipartBlob(ctx context.Context, name string) *multipartBlob {
+	return &multipartBlob{
+		s:        s,
+		ctx:      ctx,
+		name:     name,
+		nextPart: 1,
+		sem:      make(chan struct{}, s.uploadParallelism),
+	}
+}
+
+func (b *multipartBlob) uploadErr() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.err
+}
+
+// retry runs f until it succeeds, up to part_retries additional times.
+func (b *multipartBlob) retry(what string, f func() error) error {
+	var err error
+	for attempt := 0; attempt <= b.s.partRetries; attempt++ {
+		if attempt != 0 {
+			b.s.log.Error("upload failed, retrying", err, "key", b.name, "op", what, "attempt", attempt)
+			select {
+			case <-time.After(time.Duration(attempt) * time.Second):
+			case <-b.ctx.Done():
+				return b.ctx.Err()
+			}
+		}
+		err = f()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (b *multipartBlob) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) != 0 {
+		if err := b.uploadErr(); err != nil {
+			return written, err
+		}
+
+		n := b.s.partSize - len(b.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		b.grow(n)
+		b.buf = append(b.buf, p[:n]...)
+		p = p[n:]
+		written += n
+
+		if len(b.buf) == b.s.partSize {
+			if err := b.flushPart(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// grow makes sure the buffer has space for n more bytes.
+//
+// Buffer is grown as data is written instead of being allocated up front
+// since most messages are much smaller than part_size. It is never grown
+// beyond part_size.
+func (b *multipartBlob) grow(n int) {
+	if cap(b.buf)-len(b.buf) >= n {
+		return
+	}
+	newCap := 2 * cap(b.buf)
+	if newCap < len(b.buf)+n {
+		newCap = len(b.buf) + n
+	}
+	if newCap > b.s.partSize {
+		newCap = b.s.partSize
+	}
+	buf := make([]byte, len(b.buf), newCap)
+	copy(buf, b.buf)
+	b.buf = buf
+}
+
+// flushPart starts the upload of the buffered part.
+func (b *multipartBlob) flushPart() error {
+	if b.uploadID == "" {
+		err := b.retry("NewMultipartUpload", func() error {
+			var err error
+			b.uploadID, err = b.s.core.NewMultipartUpload(b.ctx, b.s.bucketName, b.name, b.s.putOptions())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("s3 NewMultipartUpload: %w", err)
+		}
+	}
+
+	data := b.buf
+	partID := b.nextPart
+	b.buf = nil
+	b.nextPart++
+
+	b.sem <- struct{}{}
+	b.wg.Add(1)
+	go func() {
+		defer func() {
+			<-b.sem
+			b.wg.Done()
+		}()
+
+		var part minio.ObjectPart
+		err := b.retry("PutObjectPart", func() error {
+			var err error
+			part, err = b.s.core.PutObjectPart(b.ctx, b.s.bucketName, b.name, b.uploadID,
+				partID, bytes.NewReader(data), int64(len(data)), "", "", b.s.customerSSE())
+			return err
+		})
+
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if err != nil {
+			if b.err == nil {
+				b.err = fmt.Errorf("s3 PutObjectPart: %w", err)
+			}
+			return
+		}
+		b.parts = append(b.parts, minio.CompletePart{
+			PartNumber: partID,
+			ETag:       part.ETag,
+		})
+	}()
+	return nil
+}
+
+func (b *multipartBlob) abort() {
+	if b.uploadID == "" {
+		return
+	}
+	b.wg.Wait()
+	// Upload might have been aborted due to context cancellation so
+	// don't use it here.
+	if err := b.s.core.AbortMultipartUpload(context.Background(), b.s.bucketName, b.name, b.uploadID); err != nil {
+		b.s.log.Error("failed to abort multipart upload", err, "key", b.name, "upload_id", b.uploadID)
+	}
+	b.uploadID = ""
+}
+
+func (b *multipartBlob) Sync() error {
+	if b.didSync {
+		panic("storage.blob.s3: Sync called twice for a blob object")
+	}
+	b.didSync = true
+
+	if b.uploadID == "" {
+		// Object fits into a single part.
+		err := b.retry("PutObject", func() error {
+			_, err := b.s.cl.PutObject(b.ctx, b.s.bucketName, b.name,
+				bytes.NewReader(b.buf), int64(len(b.buf)), b.s.putOptions())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("s3 PutObject: %w", err)
+		}
+		return nil
+	}
+
+	if len(b.buf) != 0 {
+		if err := b.flushPart(); err != nil {
+			b.abort()
+			return err
+		}
+	}
+	b.wg.Wait()
+	if err := b.uploadErr(); err != nil {
+		b.abort()
+		return err
+	}
+
+	sort.Slice(b.parts, func(i, j int) bool {
+		return b.parts[i].PartNumber < b.parts[j].PartNumber
+	})
+	err := b.retry("CompleteMultipartUpload", func() error {
+		_, err := b.s.core.CompleteMultipartUpload(b.ctx, b.s.bucketName, b.name, b.uploadID,
+			b.parts, b.s.putOptions())
+		return err
+	})
+	if err != nil {
+		b.abort()
+		return fmt.Errorf("s3 CompleteMultipartUpload: %w", err)
+	}
+	b.uploadID = ""
+	return nil
+}
+
+func (b *multipartBlob) Close() error {
+	if !b.didSync {
+		b.abort()
+	}
+	return nil
+}
+
+// customerSSE returns encryption settings that should be specified for each
+// part and for reads. Only SSE-C requires that.
+func (s *Store) customerSSE() encrypt.ServerSide {
+	if s.sse != nil && s.sse.Type() == encrypt.SSEC {
+		return s.sse
+	}
+	return nil
+}
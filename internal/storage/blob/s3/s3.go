@@ -2,15 +2,20 @@ package s3
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
 )
 
 const modName = "storage.blob.s3"
@@ -21,9 +26,17 @@ type Store struct {
 
 	endpoint string
 	cl       *minio.Client
+	core     minio.Core
 
 	bucketName   string
 	objectPrefix string
+
+	partSize          int
+	uploadParallelism int
+	partRetries       int
+
+	sse          encrypt.ServerSide
+	storageClass string
 }
 
 func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
@@ -43,6 +56,7 @@ func (s *Store) Init(cfg *config.Map) error {
 		accessKeyID     string
 		secretAccessKey string
 		location        string
+		sse             []string
 	)
 	cfg.String("endpoint", false, true, "", &s.endpoint)
 	cfg.Bool("secure", false, true, &secure)
@@ -51,6 +65,11 @@ func (s *Store) Init(cfg *config.Map) error {
 	cfg.String("bucket", false, true, "", &s.bucketName)
 	cfg.String("region", false, false, "", &location)
 	cfg.String("object_prefix", false, false, "", &s.objectPrefix)
+	cfg.DataSize("part_size", false, false, 16*1024*1024, &s.partSize)
+	cfg.Int("upload_parallelism", false, false, 4, &s.uploadParallelism)
+	cfg.Int("part_retries", false, false, 3, &s.partRetries)
+	cfg.StringList("sse", false, false, nil, &sse)
+	cfg.String("storage_class", false, false, "", &s.storageClass)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
@@ -58,6 +77,21 @@ func (s *Store) Init(cfg *config.Map) error {
 	if s.endpoint == "" {
 		return fmt.Errorf("%s: endpoint not set", modName)
 	}
+	// S3 does not permit parts smaller than 5 MiB, except for the last one.
+	if s.partSize < 5*1024*1024 {
+		return fmt.Errorf("%s: part_size should be at least 5M", modName)
+	}
+	if s.uploadParallelism < 1 {
+		return fmt.Errorf("%s: upload_parallelism should be at least 1", modName)
+	}
+	if s.partRetries < 0 {
+		return fmt.Errorf("%s: part_retries should not be negative", modName)
+	}
+	var err error
+	s.sse, err = parseSSE(sse)
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
 
 	cl, err := minio.New(s.endpoint, &minio.Options{
 		Creds:  credentials.NewStaticV4(accessKeyID, secretAccessKey, ""),
@@ -69,9 +103,52 @@ func (s *Store) Init(cfg *config.Map) error {
 	}
 
 	s.cl = cl
+	s.core = minio.Core{Client: cl}
 	return nil
 }
 
+func parseSSE(args []string) (encrypt.ServerSide, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+
+	switch args[0] {
+	case "off":
+		if len(args) != 1 {
+			return nil, errors.New("sse: unexpected arguments")
+		}
+		return nil, nil
+	case "s3":
+		if len(args) != 1 {
+			return nil, errors.New("sse: unexpected arguments")
+		}
+		return encrypt.NewSSE(), nil
+	case "kms":
+		if len(args) != 2 {
+			return nil, errors.New("sse: key ID is required for kms")
+		}
+		return encrypt.NewSSEKMS(args[1], nil)
+	case "customer":
+		if len(args) != 2 {
+			return nil, errors.New("sse: key is required for customer")
+		}
+		key, err := base64.StdEncoding.DecodeString(args[1])
+		if err != nil {
+			return nil, fmt.Errorf("sse: %w", err)
+		}
+		return encrypt.NewSSEC(key)
+	default:
+		return nil, fmt.Errorf("sse: unknown mode: %s", args[0])
+	}
+}
+
+func (s *Store) putOptions() minio.PutObjectOptions {
+	return minio.PutObjectOptions{
+		ServerSideEncryption: s.sse,
+		StorageClass:         s.storageClass,
+	}
+}
+
 func (s *Store) Name() string {
 	return modName
 }
@@ -114,20 +191,15 @@ func (b *s3blob) Close() error {
 }
 
 func (s *Store) Create(ctx context.Context, key string, blobSize int64) (module.Blob, error) {
+	if blobSize == module.UnknownBlobSize {
+		return s.newMultipartBlob(ctx, s.objectPrefix+key), nil
+	}
+
 	pr, pw := io.Pipe()
 	errCh := make(chan error, 1)
 
 	go func() {
-		partSize := uint64(0)
-		if blobSize == module.UnknownBlobSize {
-			// Without this, minio-go will allocate 500 MiB buffer which
-			// is a little too much.
-			// https://github.com/minio/minio-go/issues/1478
-			partSize = 1 * 1024 * 1024 /* 1 MiB */
-		}
-		_, err := s.cl.PutObject(ctx, s.bucketName, s.objectPrefix+key, pr, blobSize, minio.PutObjectOptions{
-			PartSize: partSize,
-		})
+		_, err := s.cl.PutObject(ctx, s.bucketName, s.objectPrefix+key, pr, blobSize, s.putOptions())
 		if err != nil {
 			if err := pr.CloseWithError(fmt.Errorf("s3 PutObject: %w", err)); err != nil {
 				panic(err)
@@ -143,7 +215,9 @@ func (s *Store) Create(ctx context.Context, key string, blobSize int64) (module.
 }
 
 func (s *Store) Open(ctx context.Context, key string) (io.ReadCloser, error) {
-	obj, err := s.cl.GetObject(ctx, s.bucketName, s.objectPrefix+key, minio.GetObjectOptions{})
+	obj, err := s.cl.GetObject(ctx, s.bucketName, s.objectPrefix+key, minio.GetObjectOptions{
+		ServerSideEncryption: s.customerSSE(),
+	})
 	if err != nil {
 		resp := minio.ToErrorResponse(err)
 		if resp.StatusCode == http.StatusNotFound {
@@ -165,7 +239,55 @@ func (s *Store) Delete(ctx context.Context, keys []string) error {
 	return lastErr
 }
 
+// Rename copies the object on the server side and removes the original one.
+// New object becomes visible at once when the copy completes.
+func (s *Store) Rename(ctx context.Context, oldKey, newKey string) error {
+	dst := minio.CopyDestOptions{
+		Bucket:     s.bucketName,
+		Object:     s.objectPrefix + newKey,
+		Encryption: s.sse,
+	}
+	if s.storageClass != "" {
+		// Storage class is not copied from the source object.
+		dst.ReplaceMetadata = true
+		dst.UserMetadata = map[string]string{"X-Amz-Storage-Class": s.storageClass}
+	}
+	_, err := s.cl.CopyObject(ctx, dst, minio.CopySrcOptions{
+		Bucket:     s.bucketName,
+		Object:     s.objectPrefix + oldKey,
+		Encryption: s.customerSSE(),
+	})
+	if err != nil {
+		resp := minio.ToErrorResponse(err)
+		if resp.StatusCode == http.StatusNotFound {
+			return module.ErrNoSuchBlob
+		}
+		return fmt.Errorf("s3 CopyObject: %w", err)
+	}
+	return s.cl.RemoveObject(ctx, s.bucketName, s.objectPrefix+oldKey, minio.RemoveObjectOptions{})
+}
+
+func (s *Store) ListBlobs(ctx context.Context, fn func(key string, modTime time.Time) error) error {
+	// Cancellation stops the listing goroutine if fn fails.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for obj := range s.cl.ListObjects(ctx, s.bucketName, minio.ListObjectsOptions{
+		Prefix:    s.objectPrefix,
+		Recursive: true,
+	}) {
+		if obj.Err != nil {
+			return fmt.Errorf("s3 ListObjects: %w", obj.Err)
+		}
+		if err := fn(strings.TrimPrefix(obj.Key, s.objectPrefix), obj.LastModified); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func init() {
-	var _ module.BlobStore = &Store{}
+	var _ module.ListableBlobStore = &Store{}
+	var _ module.RenamableBlobStore = &Store{}
 	module.Register(modName, New)
 }
@@ -1,6 +1,10 @@
 package s3
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
 	"net/http/httptest"
 	"testing"
 
@@ -69,3 +73,130 @@ func TestFS(t *testing.T) {
 		ts.Close()
 	}
 }
+
+func newMultipartStore(t *testing.T) (*Store, func()) {
+	backend := s3mem.New()
+	ts := httptest.NewServer(gofakes3.New(backend).Server())
+	if err := backend.CreateBucket("maddy-test"); err != nil {
+		t.Fatal(err)
+	}
+
+	st := &Store{instName: "test"}
+	err := st.Init(config.NewMap(map[string]interface{}{}, config.Node{
+		Children: []config.Node{
+			{Name: "endpoint", Args: []string{ts.Listener.Addr().String()}},
+			{Name: "secure", Args: []string{"false"}},
+			{Name: "access_key", Args: []string{"access-key"}},
+			{Name: "secret_key", Args: []string{"secret-key"}},
+			{Name: "bucket", Args: []string{"maddy-test"}},
+			{Name: "part_size", Args: []string{"5M"}},
+			{Name: "upload_parallelism", Args: []string{"2"}},
+		},
+	}))
+	if err != nil {
+		ts.Close()
+		t.Fatal(err)
+	}
+	return st, ts.Close
+}
+
+func TestS3_Multipart(t *testing.T) {
+	st, cleanup := newMultipartStore(t)
+	defer cleanup()
+
+	for name, size := range map[string]int{
+		"small": 1024,
+		"exact": 10 * 1024 * 1024,
+		"large": 12*1024*1024 + 17,
+	} {
+		body := make([]byte, size)
+		if _, err := rand.Read(body); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := st.Create(context.Background(), name, module.UnknownBlobSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Write in chunks not aligned with part size.
+		for rest := body; len(rest) != 0; {
+			n := 1000 * 1000
+			if n > len(rest) {
+				n = len(rest)
+			}
+			if _, err := b.Write(rest[:n]); err != nil {
+				t.Fatal(name, err)
+			}
+			rest = rest[n:]
+		}
+		if err := b.Sync(); err != nil {
+			t.Fatal(name, err)
+		}
+		if err := b.Close(); err != nil {
+			t.Fatal(name, err)
+		}
+
+		r, err := st.Open(context.Background(), name)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		stored, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if !bytes.Equal(stored, body) {
+			t.Errorf("%s: stored object differs (%d bytes stored, %d bytes written)", name, len(stored), len(body))
+		}
+	}
+}
+
+func TestS3_MultipartSmallBuffer(t *testing.T) {
+	st, cleanup := newMultipartStore(t)
+	defer cleanup()
+
+	b := st.newMultipartBlob(context.Background(), "small")
+	defer b.Close()
+	if _, err := b.Write(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	if cap(b.buf) >= st.partSize {
+		t.Errorf("part buffer is preallocated: %d bytes for 1024 bytes written", cap(b.buf))
+	}
+	if b.uploadID != "" {
+		t.Error("multipart upload started before the first part is filled")
+	}
+}
+
+func TestS3_MultipartAbort(t *testing.T) {
+	st, cleanup := newMultipartStore(t)
+	defer cleanup()
+
+	b, err := st.Create(context.Background(), "aborted", module.UnknownBlobSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Write(make([]byte, 6*1024*1024)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	uploads, err := st.core.ListMultipartUploads(context.Background(), "maddy-test", "", "", "", "", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads.Uploads) != 0 {
+		t.Errorf("upload is not aborted: %+v", uploads.Uploads)
+	}
+
+	r, err := st.Open(context.Background(), "aborted")
+	if err == nil {
+		_, err = io.ReadAll(r)
+		r.Close()
+	}
+	if err == nil {
+		t.Error("aborted object is readable")
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"time"
 
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
@@ -156,7 +157,20 @@ func (s *Store) Delete(ctx context.Context, keys []string) error {
 	return lastErr
 }
 
+func (s *Store) ListBlobs(_ context.Context, fn func(key string, modTime time.Time) error) error {
+	keys, err := s.backend.Keys()
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := fn(k, time.Time{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func init() {
-	var _ module.BlobStore = &Store{}
+	var _ module.ListableBlobStore = &Store{}
 	module.Register(modName, New)
 }
@@ -24,7 +24,9 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
@@ -310,7 +312,25 @@ func (s *Store) Delete(ctx context.Context, keys []string) error {
 	return lastErr
 }
 
+func (s *Store) ListBlobs(_ context.Context, fn func(key string, modTime time.Time) error) error {
+	keys, err := s.storage.Keys()
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		// Skip chunks, only the key with chunk count corresponds to the
+		// object.
+		if strings.Contains(k, "/") {
+			continue
+		}
+		if err := fn(k, time.Time{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func init() {
-	var _ module.BlobStore = &Store{}
+	var _ module.ListableBlobStore = &Store{}
 	module.Register(modName, New)
 }
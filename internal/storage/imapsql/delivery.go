@@ -101,13 +101,33 @@ func (d *delivery) AddRcpt(ctx context.Context, rcptTo string) error {
 func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
 	defer trace.StartRegion(ctx, "sql/Body").End()
 
-	if !d.msgMeta.Quarantine && d.store.filters != nil {
-		for rcpt, rcptData := range d.addedRcpts {
-			folder, flags, err := d.store.filters.IMAPFilter(rcpt, rcptData.rcptTo, d.msgMeta, header, body)
+	for rcpt, rcptData := range d.addedRcpts {
+		quarantined := d.msgMeta.IsQuarantined(rcptData.rcptTo)
+		switch {
+		case quarantined && !d.msgMeta.Quarantine:
+			// Quarantined only for that recipient.
+			d.d.UserMailbox(rcpt, d.store.junkMbox, nil)
+			continue
+		case quarantined:
+			continue
+		}
+
+		folder := ""
+		var flags []string
+		if d.store.filters != nil {
+			var err error
+			folder, flags, err = d.store.filters.IMAPFilter(rcpt, rcptData.rcptTo, d.msgMeta, header, body)
 			if err != nil {
 				d.store.Log.Error("IMAPFilter failed", err, "rcpt", rcpt)
-				continue
+				folder, flags = "", nil
 			}
+		}
+		if folder == "" && d.msgMeta.Quarantine {
+			// Not quarantined for that recipient, but SpecialMailbox
+			// below will route the message into Junk for everybody else.
+			folder = imap.InboxName
+		}
+		if folder != "" || flags != nil {
 			d.d.UserMailbox(rcpt, folder, flags)
 		}
 	}
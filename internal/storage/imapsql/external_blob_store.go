@@ -22,14 +22,49 @@ func (e ExtBlob) Write(p []byte) (n int, err error) {
 
 type WriteExtBlob struct {
 	module.Blob
+
+	key      string
+	synced   bool
+	observer blobObserver
 }
 
-func (w WriteExtBlob) Read(p []byte) (n int, err error) {
+func (w *WriteExtBlob) Read(p []byte) (n int, err error) {
 	panic("not implemented")
 }
 
+func (w *WriteExtBlob) Sync() error {
+	if err := w.Blob.Sync(); err != nil {
+		return err
+	}
+	w.synced = true
+	return nil
+}
+
+func (w *WriteExtBlob) Close() error {
+	if err := w.Blob.Close(); err != nil {
+		return err
+	}
+	if w.synced && w.observer != nil {
+		w.observer.blobStored(w.key)
+	}
+	return nil
+}
+
+// blobObserver is notified about changes to the set of stored blobs.
+//
+// Methods can be called while go-imap-sql holds a database transaction
+// so they should not access the database synchronously.
+type blobObserver interface {
+	// blobStored is called after the blob is completely written.
+	blobStored(key string)
+	// blobsDeleted is called after blobs are removed from the store.
+	blobsDeleted(keys []string)
+}
+
 type ExtBlobStore struct {
 	Base module.BlobStore
+
+	observer blobObserver
 }
 
 func (e ExtBlobStore) Create(key string, objSize int64) (imapsql.ExtStoreObj, error) {
@@ -41,7 +76,7 @@ func (e ExtBlobStore) Create(key string, objSize int64) (imapsql.ExtStoreObj, er
 			Err:         err,
 		}
 	}
-	return WriteExtBlob{Blob: blob}, nil
+	return &WriteExtBlob{Blob: blob, key: key, observer: e.observer}, nil
 }
 
 func (e ExtBlobStore) Open(key string) (imapsql.ExtStoreObj, error) {
@@ -64,5 +99,8 @@ func (e ExtBlobStore) Delete(keys []string) error {
 			Err: err,
 		}
 	}
+	if e.observer != nil {
+		e.observer.blobsDeleted(keys)
+	}
 	return nil
 }
@@ -0,0 +1,304 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// FsckOptions controls the behavior of the consistency check.
+type FsckOptions struct {
+	// Unreferenced objects are considered orphaned only if they were
+	// written more than GracePeriod ago. This prevents removal of objects
+	// for messages that are being delivered right now.
+	//
+	// If the store does not track modification times, unreferenced objects
+	// are considered orphaned only if GracePeriod is zero.
+	GracePeriod time.Duration
+
+	// DeleteOrphans enables removal of orphaned objects.
+	DeleteOrphans bool
+}
+
+// MessageRef identifies a message and the msg_store object it refers to.
+type MessageRef struct {
+	Account string `json:"account"`
+	Mailbox string `json:"mailbox"`
+	UID     uint32 `json:"uid"`
+	Key     string `json:"key"`
+}
+
+// FsckReport contains results of the consistency check.
+type FsckReport struct {
+	Started  time.Time `json:"started"`
+	Duration float64   `json:"duration_seconds"`
+
+	// Listing is false if msg_store does not support listing and
+	// unreferenced objects were not checked.
+	Listing bool `json:"listing"`
+
+	Messages        int `json:"messages"`
+	StoredBlobs     int `json:"stored_blobs"`
+	ReferencedBlobs int `json:"referenced_blobs"`
+
+	Orphans []string     `json:"orphans"`
+	Deleted int          `json:"deleted"`
+	Missing []MessageRef `json:"missing"`
+	// Messages whose body could not be checked due to msg_store errors
+	// other than a missing object (e.g. network or permission errors).
+	Unreadable []MessageRef `json:"unreadable"`
+}
+
+// Fsck cross-references messages in the database against objects in
+// msg_store.
+func (store *Storage) Fsck(ctx context.Context, opts FsckOptions) (*FsckReport, error) {
+	return store.fsck(ctx, opts, nil)
+}
+
+func (store *Storage) listBlobs(ctx context.Context) (map[string]time.Time, error) {
+	l, ok := store.blobStore.(module.ListableBlobStore)
+	if !ok {
+		return nil, nil
+	}
+
+	stored := map[string]time.Time{}
+	err := l.ListBlobs(ctx, func(key string, modTime time.Time) error {
+		stored[key] = modTime
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, module.ErrNotListable) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return stored, nil
+}
+
+func (store *Storage) blobRefs(ctx context.Context) ([]MessageRef, map[string]struct{}, error) {
+	rows, err := store.Back.DB.QueryContext(ctx, `
+		SELECT users.username, mboxes.name, msgs.msgId, msgs.extBodyKey
+		FROM msgs
+		INNER JOIN mboxes
+		ON msgs.mboxId = mboxes.id
+		INNER JOIN users
+		ON mboxes.uid = users.id
+		WHERE msgs.extBodyKey IS NOT NULL`)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var (
+		refs       []MessageRef
+		referenced = map[string]struct{}{}
+	)
+	for rows.Next() {
+		var ref MessageRef
+		if err := rows.Scan(&ref.Account, &ref.Mailbox, &ref.UID, &ref.Key); err != nil {
+			return nil, nil, err
+		}
+		refs = append(refs, ref)
+		referenced[ref.Key] = struct{}{}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	// Objects of expunged messages are tracked in extKeys until they are
+	// deleted.
+	keyRows, err := store.Back.DB.QueryContext(ctx, `SELECT id FROM extKeys`)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer keyRows.Close()
+	for keyRows.Next() {
+		var key string
+		if err := keyRows.Scan(&key); err != nil {
+			return nil, nil, err
+		}
+		referenced[key] = struct{}{}
+	}
+	return refs, referenced, keyRows.Err()
+}
+
+// fsck implements Fsck. If firstSeen is not nil, it is used to remember
+// when unreferenced objects without known modification time were first
+// seen so they can be considered orphaned after the grace period.
+func (store *Storage) fsck(ctx context.Context, opts FsckOptions, firstSeen map[string]time.Time) (*FsckReport, error) {
+	report := &FsckReport{
+		Started: time.Now(),
+	}
+
+	// Objects are listed before querying the database so objects of messages
+	// delivered in between are not considered orphaned.
+	stored, err := store.listBlobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report.Listing = stored != nil
+	report.StoredBlobs = len(stored)
+
+	refs, referenced, err := store.blobRefs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report.Messages = len(refs)
+	report.ReferencedBlobs = len(referenced)
+
+	const (
+		blobOK = iota
+		blobMissing
+		blobUnreadable
+	)
+	status := map[string]int{}
+	for _, ref := range refs {
+		st, ok := status[ref.Key]
+		if !ok {
+			if _, ok := stored[ref.Key]; ok {
+				st = blobOK
+			} else {
+				// Not listed (or listing is not supported) - check directly,
+				// object may have been created after listing.
+				r, err := store.blobStore.Open(ctx, ref.Key)
+				switch {
+				case err == nil:
+					r.Close()
+					st = blobOK
+				case errors.Is(err, module.ErrNoSuchBlob):
+					st = blobMissing
+				default:
+					store.Log.Error("fsck: failed to open object", err, "key", ref.Key)
+					st = blobUnreadable
+				}
+			}
+			status[ref.Key] = st
+		}
+		switch st {
+		case blobMissing:
+			report.Missing = append(report.Missing, ref)
+		case blobUnreadable:
+			report.Unreadable = append(report.Unreadable, ref)
+		}
+	}
+
+	now := time.Now()
+	for key, modTime := range stored {
+		if _, ok := referenced[key]; ok {
+			continue
+		}
+
+		if modTime.IsZero() && firstSeen != nil {
+			seen, ok := firstSeen[key]
+			if !ok {
+				firstSeen[key] = now
+				seen = now
+			}
+			modTime = seen
+		}
+		if modTime.IsZero() {
+			if opts.GracePeriod != 0 {
+				continue
+			}
+		} else if now.Sub(modTime) < opts.GracePeriod {
+			continue
+		}
+
+		report.Orphans = append(report.Orphans, key)
+	}
+	if firstSeen != nil {
+		for key := range firstSeen {
+			if _, ok := stored[key]; !ok {
+				delete(firstSeen, key)
+				continue
+			}
+			if _, ok := referenced[key]; ok {
+				delete(firstSeen, key)
+			}
+		}
+	}
+	sort.Strings(report.Orphans)
+
+	if opts.DeleteOrphans && len(report.Orphans) != 0 {
+		if err := store.blobStore.Delete(ctx, report.Orphans); err != nil {
+			return nil, err
+		}
+		report.Deleted = len(report.Orphans)
+		if store.fts != nil {
+			store.fts.blobsDeleted(report.Orphans)
+		}
+		for _, key := range report.Orphans {
+			delete(firstSeen, key)
+		}
+	}
+
+	report.Duration = time.Since(report.Started).Seconds()
+	return report, nil
+}
+
+func (store *Storage) fsckWorker(interval time.Duration, opts FsckOptions) {
+	firstSeen := map[string]time.Time{}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			store.runFsck(opts, firstSeen)
+		case <-store.fsckStop:
+			store.fsckStop <- struct{}{}
+			return
+		}
+	}
+}
+
+func (store *Storage) runFsck(opts FsckOptions, firstSeen map[string]time.Time) {
+	store.Log.Debugln("running consistency check...")
+	report, err := store.fsck(context.Background(), opts, firstSeen)
+	if err != nil {
+		store.Log.Error("consistency check failed", err)
+		return
+	}
+
+	fsckOrphans.WithLabelValues(store.instName).Set(float64(len(report.Orphans)))
+	fsckMissing.WithLabelValues(store.instName).Set(float64(len(report.Missing)))
+	fsckUnreadable.WithLabelValues(store.instName).Set(float64(len(report.Unreadable)))
+	fsckDeleted.WithLabelValues(store.instName).Add(float64(report.Deleted))
+	fsckLastRun.WithLabelValues(store.instName).Set(float64(report.Started.Unix()))
+
+	for _, m := range report.Missing {
+		store.Log.Msg("message body is missing", "account", m.Account, "mbox", m.Mailbox, "uid", m.UID, "key", m.Key)
+	}
+	for _, m := range report.Unreadable {
+		store.Log.Msg("message body cannot be checked", "account", m.Account, "mbox", m.Mailbox, "uid", m.UID, "key", m.Key)
+	}
+	store.Log.Msg("consistency check done",
+		"messages", report.Messages,
+		"stored_blobs", report.StoredBlobs,
+		"orphans", len(report.Orphans),
+		"deleted", report.Deleted,
+		"missing", len(report.Missing),
+		"unreadable", len(report.Unreadable),
+		"duration", report.Duration)
+}
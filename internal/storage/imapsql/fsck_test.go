@@ -0,0 +1,150 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	_ "github.com/foxcpp/maddy/internal/storage/blob/fs"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type failingOpenStore struct {
+	module.BlobStore
+	key string
+}
+
+func (s failingOpenStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	if key == s.key {
+		return nil, errors.New("connection reset")
+	}
+	return s.BlobStore.Open(ctx, key)
+}
+
+func TestFsck(t *testing.T) {
+	dir := testutils.Dir(t)
+	msgDir := filepath.Join(dir, "messages")
+
+	mod, err := New("storage.imapsql", "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := mod.(*Storage)
+	store.Log = testutils.Logger(t, "imapsql")
+	err = store.Init(config.NewMap(map[string]interface{}{}, config.Node{
+		Children: []config.Node{
+			{Name: "driver", Args: []string{"sqlite3"}},
+			{Name: "dsn", Args: []string{filepath.Join(dir, "test.db")}},
+			{Name: "msg_store", Args: []string{"fs", msgDir}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	u, err := store.GetOrCreateIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := u.CreateMessage("INBOX", nil, time.Now(), bytes.NewBufferString("Subject: test\r\n\r\nHello\r\n"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := store.BlobKeys(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 keys, got %v", keys)
+	}
+
+	// Body of one message is lost.
+	if err := os.Remove(filepath.Join(msgDir, keys[0])); err != nil {
+		t.Fatal(err)
+	}
+	// Leftovers of a failed delivery and a delivery in progress.
+	old := time.Now().Add(-48 * time.Hour)
+	for _, key := range []string{"old-orphan", "new-orphan"} {
+		if err := os.WriteFile(filepath.Join(msgDir, key), []byte("test"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(filepath.Join(msgDir, "old-orphan"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := store.Fsck(context.Background(), FsckOptions{
+		GracePeriod:   24 * time.Hour,
+		DeleteOrphans: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !report.Listing || report.Messages != 2 || report.StoredBlobs != 3 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+	if !reflect.DeepEqual(report.Orphans, []string{"old-orphan"}) || report.Deleted != 1 {
+		t.Errorf("unexpected orphans: %v (deleted: %d)", report.Orphans, report.Deleted)
+	}
+	if len(report.Missing) != 1 || report.Missing[0].Key != keys[0] ||
+		report.Missing[0].Account != "test@example.org" || report.Missing[0].Mailbox != "INBOX" {
+		t.Errorf("unexpected missing bodies: %+v", report.Missing)
+	}
+
+	if _, err := os.Stat(filepath.Join(msgDir, "old-orphan")); !os.IsNotExist(err) {
+		t.Errorf("orphaned object is not deleted: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(msgDir, "new-orphan")); err != nil {
+		t.Errorf("recent object is deleted: %v", err)
+	}
+	if len(report.Unreadable) != 0 {
+		t.Errorf("unexpected unreadable bodies: %+v", report.Unreadable)
+	}
+
+	// Transient errors are not reported as missing bodies. The wrapper
+	// does not support listing, so all objects are opened.
+	store.blobStore = failingOpenStore{BlobStore: store.blobStore, key: keys[1]}
+	report, err = store.Fsck(context.Background(), FsckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Missing) != 1 || report.Missing[0].Key != keys[0] {
+		t.Errorf("unexpected missing bodies: %+v", report.Missing)
+	}
+	if len(report.Unreadable) != 1 || report.Unreadable[0].Key != keys[1] {
+		t.Errorf("unexpected unreadable bodies: %+v", report.Unreadable)
+	}
+}
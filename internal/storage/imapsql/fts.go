@@ -0,0 +1,491 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/fts"
+	"github.com/foxcpp/maddy/internal/sqlutil"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+// ftsQueueSize is the amount of index updates that can be pending before
+// new ones are dropped. Dropped documents are picked up by the next
+// catch-up pass.
+const ftsQueueSize = 256
+
+type ftsJob struct {
+	// Blob to index.
+	key          string
+	compressAlgo string
+
+	// Blobs to remove from the index.
+	removed []string
+}
+
+// ftsIndex maintains the full-text search index for message bodies.
+//
+// Index is keyed by the external blob key, so copies of the same message
+// share index entries. Index is updated asynchronously by a background
+// goroutine since blob store notifications come from within go-imap-sql
+// transactions and we can't write to the same database there.
+type ftsIndex struct {
+	db          *sql.DB
+	driver      string
+	blobs       module.BlobStore
+	maxTextSize int
+	log         log.Logger
+
+	// compressAlgo is used for new blobs. Set to the go-imap-sql
+	// CompressAlgo option value.
+	compressAlgo string
+
+	queue chan ftsJob
+	// Set to 1 if a job was dropped because queue was full.
+	missed  int32
+	stop    chan struct{}
+	stopped sync.WaitGroup
+}
+
+func (idx *ftsIndex) rebind(query string) string {
+	return sqlutil.Rebind(idx.driver, query)
+}
+
+func (idx *ftsIndex) initSchema() error {
+	_, err := idx.db.Exec(`
+		CREATE TABLE IF NOT EXISTS ftsDocs (
+			extBodyKey VARCHAR(255) PRIMARY KEY NOT NULL
+		)`)
+	if err != nil {
+		return fmt.Errorf("create table ftsDocs: %w", err)
+	}
+	_, err = idx.db.Exec(`
+		CREATE TABLE IF NOT EXISTS ftsTerms (
+			term VARCHAR(64) NOT NULL,
+			inHeader INTEGER NOT NULL,
+			extBodyKey VARCHAR(255) NOT NULL,
+
+			PRIMARY KEY(term, inHeader, extBodyKey)
+		)`)
+	if err != nil {
+		return fmt.Errorf("create table ftsTerms: %w", err)
+	}
+	_, err = idx.db.Exec(`
+		CREATE TABLE IF NOT EXISTS ftsTruncDocs (
+			extBodyKey VARCHAR(255) PRIMARY KEY NOT NULL
+		)`)
+	if err != nil {
+		return fmt.Errorf("create table ftsTruncDocs: %w", err)
+	}
+
+	_, err = idx.db.Exec(`
+		CREATE INDEX IF NOT EXISTS ftsTerms_key
+		ON ftsTerms(extBodyKey)`)
+	// MySQL does not support "IF NOT EXISTS", but MariaDB does.
+	if err != nil && idx.driver == "mysql" {
+		_, err = idx.db.Exec(`
+			CREATE INDEX ftsTerms_key
+			ON ftsTerms(extBodyKey)`)
+		if err != nil && strings.HasPrefix(err.Error(), "Error 1061: Duplicate key name") {
+			err = nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("create index ftsTerms_key: %w", err)
+	}
+
+	return nil
+}
+
+func (idx *ftsIndex) start() {
+	idx.queue = make(chan ftsJob, ftsQueueSize)
+	idx.stop = make(chan struct{})
+	idx.stopped.Add(1)
+	go idx.worker()
+}
+
+func (idx *ftsIndex) close() {
+	close(idx.stop)
+	idx.stopped.Wait()
+}
+
+func (idx *ftsIndex) enqueue(job ftsJob) {
+	select {
+	case idx.queue <- job:
+	default:
+		atomic.StoreInt32(&idx.missed, 1)
+		idx.log.DebugMsg("index queue is full, postponing update", "key", job.key)
+	}
+}
+
+// blobStored is called by ExtBlobStore after a new blob is completely
+// written.
+func (idx *ftsIndex) blobStored(key string) {
+	idx.enqueue(ftsJob{key: key, compressAlgo: idx.compressAlgo})
+}
+
+// blobsDeleted is called by ExtBlobStore after blobs are removed.
+func (idx *ftsIndex) blobsDeleted(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	idx.enqueue(ftsJob{removed: keys})
+}
+
+func (idx *ftsIndex) worker() {
+	defer idx.stopped.Done()
+
+	for {
+		select {
+		case job := <-idx.queue:
+			idx.runJob(job)
+		case <-idx.stop:
+			// Finish updates that are already queued so short-lived
+			// processes (e.g. maddy CLI) do not leave them unindexed.
+			for {
+				select {
+				case job := <-idx.queue:
+					idx.runJob(job)
+				default:
+					return
+				}
+			}
+		}
+
+		if len(idx.queue) == 0 && atomic.CompareAndSwapInt32(&idx.missed, 1, 0) {
+			if _, err := idx.indexPending(context.Background(), nil); err != nil {
+				idx.log.Error("catch-up indexing failed", err)
+			}
+		}
+	}
+}
+
+func (idx *ftsIndex) runJob(job ftsJob) {
+	ctx := context.Background()
+	if job.removed != nil {
+		if err := idx.remove(ctx, job.removed); err != nil {
+			idx.log.Error("failed to remove blobs from index", err)
+		}
+		return
+	}
+
+	if err := idx.indexBlob(ctx, job.key, job.compressAlgo); err != nil {
+		if errors.Is(err, module.ErrNoSuchBlob) {
+			// Removed before we got to it.
+			return
+		}
+		idx.log.Error("failed to index blob", err, "key", job.key)
+	}
+}
+
+func decompressReader(algo string, r io.Reader) (io.Reader, func(), error) {
+	switch algo {
+	case "":
+		return r, func() {}, nil
+	case "lz4":
+		return lz4.NewReader(r), func() {}, nil
+	case "zstd":
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return dec, dec.Close, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported compression algorithm: %s", algo)
+	}
+}
+
+func (idx *ftsIndex) indexBlob(ctx context.Context, key, compressAlgo string) error {
+	blob, err := idx.blobs.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	r, closeR, err := decompressReader(compressAlgo, blob)
+	if err != nil {
+		return err
+	}
+	defer closeR()
+
+	doc, err := fts.Extract(r, idx.maxTextSize)
+	if err != nil {
+		return err
+	}
+
+	return idx.store(ctx, key, fts.Terms(doc.Header), fts.Terms(doc.Body), doc.Truncated)
+}
+
+func (idx *ftsIndex) store(ctx context.Context, key string, headerTerms, bodyTerms []string, truncated bool) error {
+	tx, err := idx.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	if _, err := tx.Exec(idx.rebind(`DELETE FROM ftsTerms WHERE extBodyKey = ?`), key); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(idx.rebind(`DELETE FROM ftsDocs WHERE extBodyKey = ?`), key); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(idx.rebind(`DELETE FROM ftsTruncDocs WHERE extBodyKey = ?`), key); err != nil {
+		return err
+	}
+
+	addTerm, err := tx.Prepare(idx.rebind(`INSERT INTO ftsTerms(term, inHeader, extBodyKey) VALUES (?, ?, ?)`))
+	if err != nil {
+		return err
+	}
+	defer addTerm.Close()
+	for _, term := range headerTerms {
+		if _, err := addTerm.Exec(term, 1, key); err != nil {
+			return err
+		}
+	}
+	for _, term := range bodyTerms {
+		if _, err := addTerm.Exec(term, 0, key); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(idx.rebind(`INSERT INTO ftsDocs(extBodyKey) VALUES (?)`), key); err != nil {
+		return err
+	}
+	if truncated {
+		if _, err := tx.Exec(idx.rebind(`INSERT INTO ftsTruncDocs(extBodyKey) VALUES (?)`), key); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (idx *ftsIndex) remove(ctx context.Context, keys []string) error {
+	tx, err := idx.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	for _, key := range keys {
+		if _, err := tx.Exec(idx.rebind(`DELETE FROM ftsTerms WHERE extBodyKey = ?`), key); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(idx.rebind(`DELETE FROM ftsDocs WHERE extBodyKey = ?`), key); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(idx.rebind(`DELETE FROM ftsTruncDocs WHERE extBodyKey = ?`), key); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// indexPending indexes all blobs referenced by messages that are not
+// in the index yet. If userID is not nil, only messages of that user
+// are considered.
+func (idx *ftsIndex) indexPending(ctx context.Context, userID *uint64) (int, error) {
+	query := `
+		SELECT DISTINCT msgs.extBodyKey, msgs.compressAlgo
+		FROM msgs
+		INNER JOIN mboxes ON mboxes.id = msgs.mboxId
+		WHERE msgs.extBodyKey IS NOT NULL
+		AND msgs.extBodyKey NOT IN (SELECT extBodyKey FROM ftsDocs)`
+	var args []interface{}
+	if userID != nil {
+		query += ` AND mboxes.uid = ?`
+		args = append(args, *userID)
+	}
+
+	type pendingBlob struct {
+		key          string
+		compressAlgo string
+	}
+	var pending []pendingBlob
+
+	// Collect the list first, so we do not keep the read transaction open
+	// while writing to the index (SQLite does not like that).
+	rows, err := idx.db.QueryContext(ctx, idx.rebind(query), args...)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var (
+			key  string
+			algo sql.NullString
+		)
+		if err := rows.Scan(&key, &algo); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pending = append(pending, pendingBlob{key: key, compressAlgo: algo.String})
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, err
+	}
+	rows.Close()
+
+	indexed := 0
+	for _, blob := range pending {
+		if err := ctx.Err(); err != nil {
+			return indexed, err
+		}
+		if err := idx.indexBlob(ctx, blob.key, blob.compressAlgo); err != nil {
+			idx.log.Error("failed to index blob", err, "key", blob.key)
+			continue
+		}
+		indexed++
+	}
+
+	return indexed, nil
+}
+
+// clear removes all index entries. If userID is not nil, only entries for
+// blobs referenced by that user messages are removed.
+func (idx *ftsIndex) clear(ctx context.Context, userID *uint64) error {
+	if userID == nil {
+		if _, err := idx.db.ExecContext(ctx, `DELETE FROM ftsTerms`); err != nil {
+			return err
+		}
+		if _, err := idx.db.ExecContext(ctx, `DELETE FROM ftsTruncDocs`); err != nil {
+			return err
+		}
+		_, err := idx.db.ExecContext(ctx, `DELETE FROM ftsDocs`)
+		return err
+	}
+
+	userKeys := `
+		SELECT msgs.extBodyKey
+		FROM msgs
+		INNER JOIN mboxes ON mboxes.id = msgs.mboxId
+		WHERE mboxes.uid = ?`
+	if _, err := idx.db.ExecContext(ctx, idx.rebind(`DELETE FROM ftsTerms WHERE extBodyKey IN (`+userKeys+`)`), *userID); err != nil {
+		return err
+	}
+	if _, err := idx.db.ExecContext(ctx, idx.rebind(`DELETE FROM ftsTruncDocs WHERE extBodyKey IN (`+userKeys+`)`), *userID); err != nil {
+		return err
+	}
+	_, err := idx.db.ExecContext(ctx, idx.rebind(`DELETE FROM ftsDocs WHERE extBodyKey IN (`+userKeys+`)`), *userID)
+	return err
+}
+
+// escapeLike escapes LIKE pattern metacharacters using '!' as an escape
+// character. '!' is used instead of backslash because MySQL treats backslash
+// specially inside string literals.
+func escapeLike(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
+
+type ftsQuery struct {
+	text   string
+	inBody bool // BODY (true) or TEXT (false) search key
+}
+
+// matchingUIDs returns UIDs of indexed messages in the mailbox that match
+// all queries. It is enough for each query term to be a part of an indexed
+// word, terms can appear in any order.
+//
+// Terms are looked up only among the ones of the mailbox messages (using
+// the ftsTerms_key index) since substring patterns cannot use the primary
+// key and would scan terms of all messages otherwise.
+func (idx *ftsIndex) matchingUIDs(mboxID uint64, queries []ftsQuery) ([]uint32, error) {
+	var (
+		sb   strings.Builder
+		args = []interface{}{mboxID}
+	)
+	sb.WriteString(`SELECT msgId FROM msgs WHERE mboxId = ?`)
+
+	for _, q := range queries {
+		terms, ok := fts.QueryTerms(q.text)
+		if !ok {
+			return nil, errors.New("imapsql: query cannot be answered using index")
+		}
+
+		for _, term := range terms {
+			sb.WriteString(` AND EXISTS (SELECT 1 FROM ftsTerms WHERE ftsTerms.extBodyKey = msgs.extBodyKey`)
+			sb.WriteString(` AND term LIKE ? ESCAPE '!'`)
+			args = append(args, "%"+escapeLike(term)+"%")
+			if q.inBody {
+				sb.WriteString(` AND inHeader = 0`)
+			}
+			sb.WriteString(`)`)
+		}
+	}
+	sb.WriteString(` ORDER BY msgId`)
+
+	return idx.queryUIDs(sb.String(), args...)
+}
+
+// unindexedUIDs returns UIDs of messages in the mailbox that are not
+// in the index yet.
+func (idx *ftsIndex) unindexedUIDs(mboxID uint64) ([]uint32, error) {
+	return idx.queryUIDs(`
+		SELECT msgId FROM msgs
+		WHERE mboxId = ?
+		AND extBodyKey NOT IN (SELECT extBodyKey FROM ftsDocs)
+		ORDER BY msgId`, mboxID)
+}
+
+// truncatedUIDs returns UIDs of messages in the mailbox whose text was
+// only partially indexed due to the fts_max_text_size limit.
+func (idx *ftsIndex) truncatedUIDs(mboxID uint64) ([]uint32, error) {
+	return idx.queryUIDs(`
+		SELECT msgId FROM msgs
+		WHERE mboxId = ?
+		AND extBodyKey IN (SELECT extBodyKey FROM ftsTruncDocs)
+		ORDER BY msgId`, mboxID)
+}
+
+func (idx *ftsIndex) queryUIDs(query string, args ...interface{}) ([]uint32, error) {
+	rows, err := idx.db.Query(idx.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var uids []uint32
+	for rows.Next() {
+		var uid uint32
+		if err := rows.Scan(&uid); err != nil {
+			return nil, err
+		}
+		uids = append(uids, uid)
+	}
+	return uids, rows.Err()
+}
+
+func (idx *ftsIndex) mailboxID(userID uint64, name string) (uint64, error) {
+	var id uint64
+	err := idx.db.QueryRow(idx.rebind(`SELECT id FROM mboxes WHERE uid = ? AND name = ?`), userID, name).Scan(&id)
+	return id, err
+}
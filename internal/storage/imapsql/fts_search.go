@@ -0,0 +1,216 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/internal/fts"
+)
+
+// ftsUser wraps go-imap-sql User so mailboxes it returns use the full-text
+// index for searches.
+//
+// All other methods (and optional interfaces implemented by go-imap-sql
+// objects) are available via embedding.
+type ftsUser struct {
+	*imapsql.User
+	idx *ftsIndex
+}
+
+func (u ftsUser) GetMailbox(name string, readOnly bool, conn backend.Conn) (*imap.MailboxStatus, backend.Mailbox, error) {
+	status, mbox, err := u.User.GetMailbox(name, readOnly, conn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if strings.EqualFold(name, "INBOX") {
+		name = "INBOX"
+	}
+	mboxID, err := u.idx.mailboxID(u.User.ID(), name)
+	if err != nil {
+		u.idx.log.Error("failed to get mailbox ID, not using index", err, "mbox", name)
+		return status, mbox, nil
+	}
+
+	return status, &ftsMailbox{
+		Mailbox: mbox.(*imapsql.Mailbox),
+		idx:     u.idx,
+		mboxID:  mboxID,
+	}, nil
+}
+
+type ftsMailbox struct {
+	*imapsql.Mailbox
+	idx    *ftsIndex
+	mboxID uint64
+}
+
+// SearchMessages implements search without the FUZZY modifier.
+//
+// RFC 3501 requires BODY and TEXT keys to match arbitrary substrings in
+// order, so the index is used only to find candidate messages that contain
+// all words of the search key. Candidates are then checked by go-imap-sql
+// as usual.
+func (m *ftsMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	return m.search(uid, criteria, false)
+}
+
+// SearchMessagesFuzzy implements search with the FUZZY modifier (RFC 6203)
+// applied to BODY and TEXT keys.
+func (m *ftsMailbox) SearchMessagesFuzzy(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	return m.search(uid, criteria, true)
+}
+
+// nestedTextSearch reports whether BODY or TEXT keys are used inside NOT or
+// OR keys. Such criteria are not handled by the index.
+func nestedTextSearch(criteria *imap.SearchCriteria) bool {
+	hasText := func(c *imap.SearchCriteria) bool {
+		return len(c.Body) != 0 || len(c.Text) != 0 || nestedTextSearch(c)
+	}
+	for _, not := range criteria.Not {
+		if hasText(not) {
+			return true
+		}
+	}
+	for _, or := range criteria.Or {
+		if hasText(or[0]) || hasText(or[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// restrictUIDs returns criteria that matches only messages with specified
+// UIDs that also match the original criteria.
+func restrictUIDs(criteria *imap.SearchCriteria, uids []uint32) *imap.SearchCriteria {
+	set := new(imap.SeqSet)
+	set.AddNum(uids...)
+
+	if criteria.Uid == nil && criteria.SeqNum == nil {
+		c := *criteria
+		c.Uid = set
+		return &c
+	}
+
+	// go-imap-mess merges SeqNum into Uid instead of intersecting them, so
+	// use double negation to AND original criteria with our set.
+	return &imap.SearchCriteria{
+		Uid: set,
+		Not: []*imap.SearchCriteria{{
+			Not: []*imap.SearchCriteria{criteria},
+		}},
+	}
+}
+
+// mergeUIDs returns sorted union of UID lists.
+func mergeUIDs(lists ...[]uint32) []uint32 {
+	var res []uint32
+	for _, l := range lists {
+		res = append(res, l...)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+
+	out := res[:0]
+	for i, uid := range res {
+		if i != 0 && res[i-1] == uid {
+			continue
+		}
+		out = append(out, uid)
+	}
+	return out
+}
+
+func (m *ftsMailbox) search(uid bool, criteria *imap.SearchCriteria, fuzzy bool) ([]uint32, error) {
+	if (len(criteria.Body) == 0 && len(criteria.Text) == 0) || nestedTextSearch(criteria) {
+		return m.Mailbox.SearchMessages(uid, criteria)
+	}
+
+	var queries []ftsQuery
+	for _, text := range criteria.Body {
+		queries = append(queries, ftsQuery{text: text, inBody: true})
+	}
+	for _, text := range criteria.Text {
+		queries = append(queries, ftsQuery{text: text})
+	}
+	for _, q := range queries {
+		if _, ok := fts.QueryTerms(q.text); !ok {
+			return m.Mailbox.SearchMessages(uid, criteria)
+		}
+	}
+
+	matched, err := m.idx.matchingUIDs(m.mboxID, queries)
+	if err != nil {
+		m.idx.log.Error("index lookup failed, not using index", err, "mbox", m.Mailbox.Name())
+		return m.Mailbox.SearchMessages(uid, criteria)
+	}
+	unindexed, err := m.idx.unindexedUIDs(m.mboxID)
+	if err != nil {
+		m.idx.log.Error("index lookup failed, not using index", err, "mbox", m.Mailbox.Name())
+		return m.Mailbox.SearchMessages(uid, criteria)
+	}
+
+	if !fuzzy {
+		// Text beyond fts_max_text_size is not in the index so these
+		// messages can contain the key even if it was not found.
+		truncated, err := m.idx.truncatedUIDs(m.mboxID)
+		if err != nil {
+			m.idx.log.Error("index lookup failed, not using index", err, "mbox", m.Mailbox.Name())
+			return m.Mailbox.SearchMessages(uid, criteria)
+		}
+
+		candidates := mergeUIDs(matched, unindexed, truncated)
+		if len(candidates) == 0 {
+			return nil, nil
+		}
+		return m.Mailbox.SearchMessages(uid, restrictUIDs(criteria, candidates))
+	}
+
+	var res []uint32
+
+	if len(matched) != 0 {
+		// Text keys are already checked by the index lookup, let go-imap-sql
+		// check the remaining keys without fetching message bodies.
+		rest := *criteria
+		rest.Body = nil
+		rest.Text = nil
+
+		ids, err := m.Mailbox.SearchMessages(uid, restrictUIDs(&rest, matched))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, ids...)
+	}
+
+	if len(unindexed) != 0 {
+		// Messages that are not indexed yet need the full check.
+		ids, err := m.Mailbox.SearchMessages(uid, restrictUIDs(criteria, unindexed))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, ids...)
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res, nil
+}
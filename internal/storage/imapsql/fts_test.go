@@ -0,0 +1,219 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/foxcpp/maddy/framework/config"
+	_ "github.com/foxcpp/maddy/internal/storage/blob/fs"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func initFTSStorage(t *testing.T, compression string) *Storage {
+	dir := testutils.Dir(t)
+
+	mod, err := New("storage.imapsql", "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := mod.(*Storage)
+	store.Log = testutils.Logger(t, "imapsql")
+
+	err = store.Init(config.NewMap(map[string]interface{}{}, config.Node{
+		Children: []config.Node{
+			{Name: "driver", Args: []string{"sqlite3"}},
+			{Name: "dsn", Args: []string{filepath.Join(dir, "test.db")}},
+			{Name: "msg_store", Args: []string{"fs", filepath.Join(dir, "messages")}},
+			{Name: "compression", Args: []string{compression}},
+			{Name: "fts_index", Args: []string{"yes"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+	})
+	return store
+}
+
+func waitIndexed(t *testing.T, store *Storage, mbox *ftsMailbox) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		uids, err := store.fts.unindexedUIDs(mbox.mboxID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(uids) == 0 {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("messages were not indexed")
+}
+
+func testFTSSearch(t *testing.T, compression string) {
+	store := initFTSStorage(t, compression)
+
+	u, err := store.GetOrCreateIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{
+		"Subject: Quarterly report\r\n\r\nNumbers are looking good.\r\n",
+		"Subject: Lunch\r\n\r\nWhere do we go for lunch?\r\n",
+		"Subject: Re: Quarterly report\r\n\r\nThe lunch numbers too.\r\n",
+	} {
+		if err := u.CreateMessage("INBOX", nil, time.Now(), bytes.NewBufferString(msg), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, mboxI, err := u.GetMailbox("INBOX", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, ok := mboxI.(*ftsMailbox)
+	if !ok {
+		t.Fatalf("mailbox is not using the index: %T", mboxI)
+	}
+	waitIndexed(t, store, mbox)
+
+	search := func(criteria *imap.SearchCriteria, fuzzy bool, expected []uint32) {
+		t.Helper()
+		var (
+			res []uint32
+			err error
+		)
+		if fuzzy {
+			res, err = mbox.SearchMessagesFuzzy(true, criteria)
+		} else {
+			res, err = mbox.SearchMessages(true, criteria)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res, expected) {
+			t.Errorf("search %+v (fuzzy: %v): got %v, want %v", criteria, fuzzy, res, expected)
+		}
+	}
+
+	search(&imap.SearchCriteria{Body: []string{"numbers"}}, true, []uint32{1, 3})
+	search(&imap.SearchCriteria{Body: []string{"numbers lunch"}}, true, []uint32{3})
+	search(&imap.SearchCriteria{Body: []string{"quarterly"}}, true, nil)
+	search(&imap.SearchCriteria{Text: []string{"quarterly"}}, true, []uint32{1, 3})
+	search(&imap.SearchCriteria{Body: []string{"numb"}}, true, []uint32{1, 3})
+	search(&imap.SearchCriteria{
+		Text: []string{"lunch"},
+		Uid:  &imap.SeqSet{Set: []imap.Seq{{Start: 1, Stop: 2}}},
+	}, true, []uint32{2})
+
+	// Searches without FUZZY use substring matching.
+	search(&imap.SearchCriteria{Body: []string{"umber"}}, false, []uint32{1, 3})
+	search(&imap.SearchCriteria{Body: []string{"lunch numbers"}}, false, []uint32{3})
+	search(&imap.SearchCriteria{Body: []string{"numbers lunch"}}, false, nil)
+
+	// Messages are still found if they are not indexed.
+	if err := store.fts.clear(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	search(&imap.SearchCriteria{Body: []string{"numbers"}}, true, []uint32{1, 3})
+
+	indexed, err := store.ReindexFTS(context.Background(), "test@example.org", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexed != 3 {
+		t.Errorf("expected 3 messages to be indexed, got %d", indexed)
+	}
+	search(&imap.SearchCriteria{Body: []string{"numb"}}, true, []uint32{1, 3})
+
+}
+
+func TestFTSSearch(t *testing.T) {
+	testFTSSearch(t, "off")
+}
+
+func TestFTSSearch_Zstd(t *testing.T) {
+	testFTSSearch(t, "zstd")
+}
+
+func TestFTSSearch_Candidates(t *testing.T) {
+	store := initFTSStorage(t, "off")
+
+	u, err := store.GetOrCreateIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{
+		"Subject: Report\r\n\r\nNumbers are looking good.\r\n",
+		"Subject: Lunch\r\n\r\nWhere do we go for lunch?\r\n",
+	} {
+		if err := u.CreateMessage("INBOX", nil, time.Now(), bytes.NewBufferString(msg), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, mboxI, err := u.GetMailbox("INBOX", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox := mboxI.(*ftsMailbox)
+	waitIndexed(t, store, mbox)
+
+	// Change the body of the second message behind the index's back. It
+	// should not be checked since the index says it does not contain the
+	// search key.
+	var key string
+	if err := store.Back.DB.QueryRow(`SELECT extBodyKey FROM msgs WHERE mboxId = ? AND msgId = 2`, mbox.mboxID).Scan(&key); err != nil {
+		t.Fatal(err)
+	}
+	msg := "Subject: Lunch\r\n\r\nNumbers.\r\n"
+	blob, err := store.fts.blobs.Create(context.Background(), key, int64(len(msg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := blob.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	if err := blob.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := blob.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := mbox.SearchMessages(true, &imap.SearchCriteria{Body: []string{"umber"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, []uint32{1}) {
+		t.Errorf("got %v, want [1]", res)
+	}
+}
@@ -35,6 +35,7 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/emersion/go-imap"
 	sortthread "github.com/emersion/go-imap-sortthread"
@@ -72,6 +73,15 @@ type Storage struct {
 
 	filters module.IMAPFilter
 
+	fts       *ftsIndex
+	learning  *spamLearning
+	blobStore module.BlobStore
+	fsckStop  chan struct{}
+
+	retention          []retentionRule
+	retentionOverrides module.Table
+	retentionStop      chan struct{}
+
 	deliveryMap       module.Table
 	deliveryNormalize func(context.Context, string) (string, error)
 	authMap           module.Table
@@ -111,6 +121,12 @@ func (store *Storage) Init(cfg *config.Map) error {
 		compression       []string
 		authNormalize     string
 		deliveryNormalize string
+		ftsEnabled        bool
+		ftsMaxTextSize    int
+		fsckInterval      time.Duration
+		fsckOpts          FsckOptions
+		retentionInterval time.Duration
+		spamLearners      []module.SpamLearner
 
 		blobStore module.BlobStore
 	)
@@ -148,6 +164,9 @@ func (store *Storage) Init(cfg *config.Map) error {
 		err := modconfig.GroupFromNode("imap_filters", node.Args, node, m.Globals, &filter)
 		return filter, err
 	}, &store.filters)
+	cfg.Custom("spam_learner", false, false, func() (interface{}, error) {
+		return []module.SpamLearner(nil), nil
+	}, spamLearnerDirective, &spamLearners)
 	cfg.Custom("auth_map", false, false, func() (interface{}, error) {
 		return nil, nil
 	}, modconfig.TableDirective, &store.authMap)
@@ -156,6 +175,18 @@ func (store *Storage) Init(cfg *config.Map) error {
 		return nil, nil
 	}, modconfig.TableDirective, &store.deliveryMap)
 	cfg.String("delivery_normalize", false, false, "precis_casefold_email", &deliveryNormalize)
+	cfg.Bool("fts_index", false, false, &ftsEnabled)
+	cfg.DataSize("fts_max_text_size", false, false, 1024*1024, &ftsMaxTextSize)
+	cfg.Duration("fsck_interval", false, false, 0, &fsckInterval)
+	cfg.Duration("fsck_grace_period", false, false, 24*time.Hour, &fsckOpts.GracePeriod)
+	cfg.Bool("fsck_delete_orphans", false, false, &fsckOpts.DeleteOrphans)
+	cfg.Custom("retention", false, false, func() (interface{}, error) {
+		return []retentionRule(nil), nil
+	}, retentionDirective, &store.retention)
+	cfg.Custom("retention_overrides", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, modconfig.TableDirective, &store.retentionOverrides)
+	cfg.Duration("retention_interval", false, false, time.Hour, &retentionInterval)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
@@ -249,11 +280,63 @@ func (store *Storage) Init(cfg *config.Map) error {
 		}
 	}
 
-	store.Back, err = imapsql.New(driver, dsnStr, ExtBlobStore{Base: blobStore}, opts)
+	store.blobStore = blobStore
+	extStore := ExtBlobStore{Base: blobStore}
+	if ftsEnabled {
+		store.fts = &ftsIndex{
+			driver:       driver,
+			blobs:        blobStore,
+			maxTextSize:  ftsMaxTextSize,
+			log:          log.Logger{Name: "imapsql/fts", Debug: store.Log.Debug},
+			compressAlgo: opts.CompressAlgo,
+		}
+		extStore.observer = store.fts
+	}
+
+	store.Back, err = imapsql.New(driver, dsnStr, extStore, opts)
 	if err != nil {
 		return fmt.Errorf("imapsql: %s", err)
 	}
 
+	if store.fts != nil {
+		store.fts.db = store.Back.DB
+		if err := store.fts.initSchema(); err != nil {
+			return fmt.Errorf("imapsql: %w", err)
+		}
+		store.fts.start()
+	}
+
+	if len(spamLearners) != 0 {
+		store.learning = &spamLearning{
+			db:       store.Back.DB,
+			driver:   driver,
+			blobs:    blobStore,
+			learners: spamLearners,
+			junkMbox: store.junkMbox,
+			log:      log.Logger{Name: "imapsql/spam_learner", Debug: store.Log.Debug},
+		}
+		if err := store.learning.initSchema(); err != nil {
+			return fmt.Errorf("imapsql: %w", err)
+		}
+		store.learning.start()
+	}
+
+	if len(store.retention) != 0 || store.retentionOverrides != nil {
+		if err := store.initRetentionSchema(); err != nil {
+			return fmt.Errorf("imapsql: %w", err)
+		}
+	}
+
+	if fsckInterval != 0 && !module.NoRun {
+		store.fsckStop = make(chan struct{})
+		go store.fsckWorker(fsckInterval, fsckOpts)
+	}
+
+	if (len(store.retention) != 0 || store.retentionOverrides != nil) && retentionInterval != 0 && !module.NoRun {
+		store.retentionStop = make(chan struct{})
+		go store.retentionWorker(retentionInterval)
+	}
+
 	store.Log.Debugln("go-imap-sql version", imapsql.VersionStr)
 
 	store.driver = driver
@@ -356,7 +439,11 @@ func (store *Storage) I18NLevel() int {
 }
 
 func (store *Storage) IMAPExtensions() []string {
-	return []string{"APPENDLIMIT", "MOVE", "CHILDREN", "SPECIAL-USE", "I18NLEVEL=1", "SORT", "THREAD=ORDEREDSUBJECT"}
+	exts := []string{"APPENDLIMIT", "MOVE", "CHILDREN", "SPECIAL-USE", "I18NLEVEL=1", "SORT", "THREAD=ORDEREDSUBJECT"}
+	if store.fts != nil {
+		exts = append(exts, "SEARCH=FUZZY")
+	}
+	return exts
 }
 
 func (store *Storage) CreateMessageLimit() *uint32 {
@@ -369,7 +456,18 @@ func (store *Storage) GetOrCreateIMAPAcct(username string) (backend.User, error)
 		return nil, backend.ErrInvalidCredentials
 	}
 
-	return store.Back.GetOrCreateUser(accountName)
+	u, err := store.Back.GetOrCreateUser(accountName)
+	if err != nil {
+		return nil, err
+	}
+	sqlUser := u.(*imapsql.User)
+	if store.fts != nil {
+		u = ftsUser{User: sqlUser, idx: store.fts}
+	}
+	if store.learning != nil {
+		u = learnUser{User: sqlUser, base: u, l: store.learning}
+	}
+	return u, nil
 }
 
 func (store *Storage) Lookup(ctx context.Context, key string) (string, bool, error) {
@@ -393,6 +491,24 @@ func (store *Storage) Lookup(ctx context.Context, key string) (string, bool, err
 }
 
 func (store *Storage) Close() error {
+	if store.fsckStop != nil {
+		store.fsckStop <- struct{}{}
+		<-store.fsckStop
+	}
+	if store.retentionStop != nil {
+		store.retentionStop <- struct{}{}
+		<-store.retentionStop
+	}
+
+	if store.learning != nil {
+		store.learning.close()
+	}
+
+	// Finish pending index updates while the database is still open.
+	if store.fts != nil {
+		store.fts.close()
+	}
+
 	// Stop backend from generating new updates.
 	store.Back.Close()
 
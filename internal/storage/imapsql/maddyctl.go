@@ -19,7 +19,12 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package imapsql
 
 import (
+	"context"
+	"errors"
+
 	"github.com/emersion/go-imap/backend"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/module"
 )
 
 // These methods wrap corresponding go-imap-sql methods, but also apply
@@ -38,5 +43,65 @@ func (store *Storage) DeleteIMAPAcct(accountName string) error {
 }
 
 func (store *Storage) GetIMAPAcct(accountName string) (backend.User, error) {
-	return store.Back.GetUser(accountName)
+	u, err := store.Back.GetUser(accountName)
+	if err != nil {
+		return nil, err
+	}
+	if store.fts != nil {
+		u = ftsUser{User: u.(*imapsql.User), idx: store.fts}
+	}
+	return u, nil
+}
+
+// ReindexFTS adds messages that are not in the full-text search index yet to
+// it. If rebuild is true, existing index entries are discarded first.
+//
+// If accountName is empty, messages of all accounts are processed.
+// Amount of indexed message bodies is returned.
+func (store *Storage) ReindexFTS(ctx context.Context, accountName string, rebuild bool) (int, error) {
+	if store.fts == nil {
+		return 0, errors.New("imapsql: full-text search index is not enabled (see fts_index)")
+	}
+
+	var userID *uint64
+	if accountName != "" {
+		u, err := store.Back.GetUser(accountName)
+		if err != nil {
+			return 0, err
+		}
+		id := u.(*imapsql.User).ID()
+		userID = &id
+	}
+
+	if rebuild {
+		if err := store.fts.clear(ctx, userID); err != nil {
+			return 0, err
+		}
+	}
+
+	return store.fts.indexPending(ctx, userID)
+}
+
+// BlobStore returns the store used for message bodies.
+func (store *Storage) BlobStore() module.BlobStore {
+	return store.blobStore
+}
+
+// BlobKeys returns keys of all message bodies referenced by messages.
+func (store *Storage) BlobKeys(ctx context.Context) ([]string, error) {
+	rows, err := store.Back.DB.QueryContext(ctx, `SELECT DISTINCT extBodyKey FROM msgs WHERE extBodyKey IS NOT NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
 }
@@ -0,0 +1,97 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	fsckOrphans = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "maddy",
+			Subsystem: "imapsql",
+			Name:      "fsck_orphaned_blobs",
+			Help:      "Amount of unreferenced message bodies found by the last consistency check",
+		},
+		[]string{"module"},
+	)
+	fsckMissing = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "maddy",
+			Subsystem: "imapsql",
+			Name:      "fsck_missing_blobs",
+			Help:      "Amount of messages with missing bodies found by the last consistency check",
+		},
+		[]string{"module"},
+	)
+	fsckUnreadable = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "maddy",
+			Subsystem: "imapsql",
+			Name:      "fsck_unreadable_blobs",
+			Help:      "Amount of messages whose bodies could not be checked by the last consistency check",
+		},
+		[]string{"module"},
+	)
+	fsckDeleted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "imapsql",
+			Name:      "fsck_deleted_blobs",
+			Help:      "Amount of unreferenced message bodies deleted by consistency checks",
+		},
+		[]string{"module"},
+	)
+	fsckLastRun = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "maddy",
+			Subsystem: "imapsql",
+			Name:      "fsck_last_run_timestamp_seconds",
+			Help:      "Time of the last successful consistency check",
+		},
+		[]string{"module"},
+	)
+	retentionExpunged = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "imapsql",
+			Name:      "retention_expunged_messages",
+			Help:      "Amount of messages removed by retention rules",
+		},
+		[]string{"module"},
+	)
+	retentionLastRun = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "maddy",
+			Subsystem: "imapsql",
+			Name:      "retention_last_run_timestamp_seconds",
+			Help:      "Time of the last successful application of retention rules",
+		},
+		[]string{"module"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(fsckOrphans)
+	prometheus.MustRegister(fsckMissing)
+	prometheus.MustRegister(fsckUnreadable)
+	prometheus.MustRegister(fsckDeleted)
+	prometheus.MustRegister(fsckLastRun)
+	prometheus.MustRegister(retentionExpunged)
+	prometheus.MustRegister(retentionLastRun)
+}
@@ -0,0 +1,389 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/sqlutil"
+)
+
+// retentionRule specifies the maximum age of messages in mailboxes with
+// the special-use attribute or name matching the pattern.
+//
+// Age is counted from the time the message was first found in the mailbox
+// by a retention run (see retentionMsgs table), not from INTERNALDATE, which
+// is preserved when messages are moved or copied.
+type retentionRule struct {
+	// Special-use attribute (e.g. \Trash) or path.Match pattern for
+	// the mailbox name.
+	key string
+	// Maximum time since the message was placed in the mailbox. Zero value
+	// disables removal.
+	receivedAge time.Duration
+}
+
+func (r retentionRule) String() string {
+	if r.receivedAge == 0 {
+		return r.key + "=off"
+	}
+	return r.key + "=" + r.receivedAge.String()
+}
+
+func (r retentionRule) matches(info imap.MailboxInfo, junkMbox string) bool {
+	if strings.HasPrefix(r.key, "\\") {
+		if strings.EqualFold(r.key, imap.JunkAttr) && info.Name == junkMbox {
+			return true
+		}
+		for _, attr := range info.Attributes {
+			if strings.EqualFold(attr, r.key) {
+				return true
+			}
+		}
+		return false
+	}
+	ok, _ := path.Match(r.key, info.Name)
+	return ok
+}
+
+// parseRetentionAge parses the duration in time.ParseDuration format with
+// additional support for days ("30d"). "off" and "0" disable removal.
+func parseRetentionAge(s string) (time.Duration, error) {
+	if s == "off" {
+		return 0, nil
+	}
+	var (
+		dur time.Duration
+		err error
+	)
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		var n int
+		n, err = strconv.Atoi(days)
+		dur = time.Duration(n) * 24 * time.Hour
+	} else {
+		dur, err = time.ParseDuration(s)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("malformed duration: %s", s)
+	}
+	if dur < 0 {
+		return 0, fmt.Errorf("duration must not be negative: %s", s)
+	}
+	return dur, nil
+}
+
+func parseRetentionRule(key, age string) (retentionRule, error) {
+	if _, err := path.Match(key, ""); err != nil {
+		return retentionRule{}, fmt.Errorf("malformed pattern: %s", key)
+	}
+	receivedAge, err := parseRetentionAge(age)
+	if err != nil {
+		return retentionRule{}, err
+	}
+	return retentionRule{key: key, receivedAge: receivedAge}, nil
+}
+
+func retentionDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "unexpected arguments")
+	}
+	rules := make([]retentionRule, 0, len(node.Children))
+	for _, child := range node.Children {
+		if len(child.Args) != 1 || len(child.Children) != 0 {
+			return nil, config.NodeErr(child, "expected exactly one argument: max age")
+		}
+		rule, err := parseRetentionRule(child.Name, child.Args[0])
+		if err != nil {
+			return nil, config.NodeErr(child, "%v", err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseRetentionOverrides parses the per-account value from
+// retention_overrides table. It is a space-separated list of key=age pairs,
+// e.g. "\Trash=7d Archive.*=off".
+func parseRetentionOverrides(value string) ([]retentionRule, error) {
+	var rules []retentionRule
+	for _, field := range strings.Fields(value) {
+		sep := strings.LastIndexByte(field, '=')
+		if sep == -1 {
+			return nil, fmt.Errorf("malformed rule: %s", field)
+		}
+		rule, err := parseRetentionRule(field[:sep], field[sep+1:])
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (store *Storage) initRetentionSchema() error {
+	// Time each message was first seen in a mailbox by a retention run.
+	// go-imap-sql does not record when a message was moved or copied,
+	// so this is the closest approximation that does not depend on how
+	// the message got there (delivery, APPEND, COPY, MOVE).
+	_, err := store.Back.DB.Exec(`
+		CREATE TABLE IF NOT EXISTS retentionMsgs (
+			mboxId BIGINT NOT NULL,
+			msgId BIGINT NOT NULL,
+			added BIGINT NOT NULL,
+			PRIMARY KEY (mboxId, msgId),
+			FOREIGN KEY (mboxId, msgId) REFERENCES msgs(mboxId, msgId) ON DELETE CASCADE
+		)`)
+	if err != nil {
+		return fmt.Errorf("create table retentionMsgs: %w", err)
+	}
+	return nil
+}
+
+// expiredUIDs records messages not seen in the mailbox before and returns
+// UIDs of messages placed there earlier than cutoff. If dryRun is true,
+// nothing is recorded.
+func (store *Storage) expiredUIDs(userID uint64, mboxName string, now, cutoff time.Time, dryRun bool) ([]uint32, error) {
+	var mboxID uint64
+	err := store.Back.DB.QueryRow(sqlutil.Rebind(store.driver,
+		`SELECT id FROM mboxes WHERE uid = ? AND name = ?`), userID, mboxName).Scan(&mboxID)
+	if err != nil {
+		return nil, fmt.Errorf("lookup mailbox id: %w", err)
+	}
+
+	if !dryRun {
+		_, err = store.Back.DB.Exec(sqlutil.Rebind(store.driver, `
+			INSERT INTO retentionMsgs(mboxId, msgId, added)
+			SELECT mboxId, msgId, ? FROM msgs
+			WHERE mboxId = ? AND msgId NOT IN (
+				SELECT msgId FROM retentionMsgs WHERE mboxId = ?
+			)`), now.Unix(), mboxID, mboxID)
+		if err != nil {
+			return nil, fmt.Errorf("record messages: %w", err)
+		}
+	}
+
+	rows, err := store.Back.DB.Query(sqlutil.Rebind(store.driver,
+		`SELECT msgId FROM retentionMsgs WHERE mboxId = ? AND added < ?`), mboxID, cutoff.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var uids []uint32
+	for rows.Next() {
+		var uid uint32
+		if err := rows.Scan(&uid); err != nil {
+			return nil, err
+		}
+		uids = append(uids, uid)
+	}
+	return uids, rows.Err()
+}
+
+// RetentionEntry describes messages removed from one mailbox.
+type RetentionEntry struct {
+	Account  string `json:"account"`
+	Mailbox  string `json:"mailbox"`
+	Rule     string `json:"rule"`
+	Messages int    `json:"messages"`
+}
+
+// RetentionReport contains results of ApplyRetention.
+type RetentionReport struct {
+	Started time.Time `json:"started"`
+	DryRun  bool      `json:"dry_run"`
+
+	Entries  []RetentionEntry `json:"entries"`
+	Expunged int              `json:"expunged"`
+	// Accounts rules could not be applied to.
+	Failed int `json:"failed"`
+}
+
+func (store *Storage) accountRetentionRules(ctx context.Context, accountName string) []retentionRule {
+	if store.retentionOverrides == nil {
+		return store.retention
+	}
+	value, ok, err := store.retentionOverrides.Lookup(ctx, accountName)
+	if err != nil {
+		store.Log.Error("retention_overrides lookup failed", err, "account", accountName)
+		return store.retention
+	}
+	if !ok {
+		return store.retention
+	}
+	overrides, err := parseRetentionOverrides(value)
+	if err != nil {
+		store.Log.Error("malformed retention_overrides value", err, "account", accountName)
+		return store.retention
+	}
+	// Overrides are checked first.
+	return append(overrides, store.retention...)
+}
+
+// ApplyRetention removes messages placed in mailboxes earlier than the
+// maximum age set by retention rules. If accountName is empty, all accounts are processed
+// and failures are logged and counted in the report instead of stopping
+// the run. If dryRun is true, messages are only counted.
+func (store *Storage) ApplyRetention(ctx context.Context, accountName string, dryRun bool) (*RetentionReport, error) {
+	report := &RetentionReport{
+		Started: time.Now(),
+		DryRun:  dryRun,
+	}
+
+	accounts := []string{accountName}
+	if accountName == "" {
+		var err error
+		accounts, err = store.Back.ListUsers()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, acct := range accounts {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if err := store.applyAccountRetention(ctx, acct, dryRun, report); err != nil {
+			if accountName != "" {
+				return report, fmt.Errorf("account %s: %w", acct, err)
+			}
+			store.Log.Error("failed to apply retention rules", err, "account", acct)
+			report.Failed++
+		}
+	}
+	return report, nil
+}
+
+func (store *Storage) applyAccountRetention(ctx context.Context, accountName string, dryRun bool, report *RetentionReport) error {
+	rules := store.accountRetentionRules(ctx, accountName)
+	if len(rules) == 0 {
+		return nil
+	}
+
+	u, err := store.Back.GetUser(accountName)
+	if err != nil {
+		return err
+	}
+	sqlUser, ok := u.(*imapsql.User)
+	if !ok {
+		return fmt.Errorf("unexpected user type %T", u)
+	}
+	mboxes, err := u.ListMailboxes(false)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range mboxes {
+		var rule *retentionRule
+		for i := range rules {
+			if rules[i].matches(info, store.junkMbox) {
+				rule = &rules[i]
+				break
+			}
+		}
+		if rule == nil || rule.receivedAge == 0 {
+			continue
+		}
+
+		uids, err := store.expiredUIDs(sqlUser.ID(), info.Name, report.Started, report.Started.Add(-rule.receivedAge), dryRun)
+		if err != nil {
+			return fmt.Errorf("mailbox %s: %w", info.Name, err)
+		}
+		if len(uids) != 0 && !dryRun {
+			_, mbox, err := u.GetMailbox(info.Name, true, nil)
+			if err != nil {
+				return err
+			}
+			// Notifications for connected clients are dispatched by
+			// DelMessages and sent to other processes using the update
+			// pipe.
+			delMbox, ok := mbox.(interface {
+				DelMessages(uid bool, seqset *imap.SeqSet) error
+			})
+			if ok {
+				seq := new(imap.SeqSet)
+				seq.AddNum(uids...)
+				err = delMbox.DelMessages(true, seq)
+			} else {
+				err = fmt.Errorf("mailbox does not support message removal (%T)", mbox)
+			}
+			mbox.Close()
+			if err != nil {
+				return fmt.Errorf("mailbox %s: %w", info.Name, err)
+			}
+		}
+		if len(uids) == 0 {
+			continue
+		}
+
+		report.Entries = append(report.Entries, RetentionEntry{
+			Account:  accountName,
+			Mailbox:  info.Name,
+			Rule:     rule.String(),
+			Messages: len(uids),
+		})
+		if !dryRun {
+			report.Expunged += len(uids)
+		}
+	}
+	return nil
+}
+
+func (store *Storage) retentionWorker(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			store.runRetention()
+		case <-store.retentionStop:
+			store.retentionStop <- struct{}{}
+			return
+		}
+	}
+}
+
+func (store *Storage) runRetention() {
+	store.Log.Debugln("applying retention rules...")
+	report, err := store.ApplyRetention(context.Background(), "", false)
+	if err != nil {
+		store.Log.Error("failed to apply retention rules", err)
+	}
+	if report == nil {
+		return
+	}
+
+	retentionExpunged.WithLabelValues(store.instName).Add(float64(report.Expunged))
+	if err == nil && report.Failed == 0 {
+		retentionLastRun.WithLabelValues(store.instName).Set(float64(report.Started.Unix()))
+	}
+	for _, e := range report.Entries {
+		store.Log.DebugMsg("old messages removed", "account", e.Account, "mbox", e.Mailbox, "rule", e.Rule, "count", e.Messages)
+	}
+	if report.Expunged != 0 {
+		store.Log.Msg("retention rules applied", "expunged", report.Expunged, "duration", time.Since(report.Started).Seconds())
+	}
+}
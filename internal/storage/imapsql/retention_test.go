@@ -0,0 +1,171 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/foxcpp/maddy/framework/config"
+	_ "github.com/foxcpp/maddy/internal/storage/blob/fs"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestParseRetentionOverrides(t *testing.T) {
+	rules, err := parseRetentionOverrides(`\Trash=7d Archive.*=off Junk=36h`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []retentionRule{
+		{key: `\Trash`, receivedAge: 7 * 24 * time.Hour},
+		{key: "Archive.*", receivedAge: 0},
+		{key: "Junk", receivedAge: 36 * time.Hour},
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Errorf("wrong rules: %v", rules)
+	}
+
+	for _, malformed := range []string{`\Trash`, `\Trash=7x`, `\Trash=-1h`, `[=1d`} {
+		if _, err := parseRetentionOverrides(malformed); err == nil {
+			t.Errorf("no error for %s", malformed)
+		}
+	}
+}
+
+func TestRetention(t *testing.T) {
+	dir := testutils.Dir(t)
+
+	mod, err := New("storage.imapsql", "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := mod.(*Storage)
+	store.Log = testutils.Logger(t, "imapsql")
+	err = store.Init(config.NewMap(map[string]interface{}{}, config.Node{
+		Children: []config.Node{
+			{Name: "driver", Args: []string{"sqlite3"}},
+			{Name: "dsn", Args: []string{filepath.Join(dir, "test.db")}},
+			{Name: "msg_store", Args: []string{"fs", filepath.Join(dir, "messages")}},
+			{Name: "retention", Children: []config.Node{
+				{Name: `\Trash`, Args: []string{"30d"}},
+				{Name: `\Junk`, Args: []string{"14d"}},
+			}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	store.retentionOverrides = testutils.Table{M: map[string]string{
+		"user2@example.org": `\Trash=off`,
+	}}
+
+	now := time.Now()
+	for _, acct := range []string{"user1@example.org", "user2@example.org"} {
+		u, err := store.GetOrCreateIMAPAcct(acct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := u.(interface {
+			CreateMailboxSpecial(name, specialUseAttr string) error
+		}).CreateMailboxSpecial("Trash", imap.TrashAttr); err != nil {
+			t.Fatal(err)
+		}
+		// Not created with \Junk, but it is used as junk_mailbox.
+		if err := u.CreateMailbox("Junk"); err != nil {
+			t.Fatal(err)
+		}
+		// INTERNALDATE is ignored, age is counted from the time the message
+		// is placed in the mailbox.
+		for _, mbox := range []string{"INBOX", "Trash", "Junk"} {
+			for i := 0; i < 3; i++ {
+				if err := u.CreateMessage(mbox, nil, now.AddDate(-2, 0, 0), bytes.NewBufferString("Subject: test\r\n\r\nHello\r\n"), nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	// Messages are not removed until they are seen by a run.
+	report, err := store.ApplyRetention(context.Background(), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Entries) != 0 {
+		t.Fatalf("unexpected dry run report before messages are recorded: %+v", report)
+	}
+	report, err = store.ApplyRetention(context.Background(), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Entries) != 0 || report.Expunged != 0 {
+		t.Fatalf("unexpected report for just recorded messages: %+v", report)
+	}
+
+	// Pretend messages were placed in mailboxes 60 days, 20 days and
+	// a moment ago.
+	for msgID, age := range map[int]time.Duration{1: 60 * 24 * time.Hour, 2: 20 * 24 * time.Hour} {
+		if _, err := store.Back.DB.Exec(`UPDATE retentionMsgs SET added = ? WHERE msgId = ?`, now.Add(-age).Unix(), msgID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err = store.ApplyRetention(context.Background(), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []RetentionEntry{
+		{Account: "user1@example.org", Mailbox: "Trash", Rule: `\Trash=720h0m0s`, Messages: 1},
+		{Account: "user1@example.org", Mailbox: "Junk", Rule: `\Junk=336h0m0s`, Messages: 2},
+		{Account: "user2@example.org", Mailbox: "Junk", Rule: `\Junk=336h0m0s`, Messages: 2},
+	}
+	if !reflect.DeepEqual(report.Entries, expected) || report.Expunged != 0 {
+		t.Fatalf("unexpected dry run report: %+v", report)
+	}
+
+	report, err = store.ApplyRetention(context.Background(), "user1@example.org", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Expunged != 3 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	u, err := store.GetIMAPAcct("user1@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for mbox, count := range map[string]uint32{"INBOX": 3, "Trash": 2, "Junk": 1} {
+		status, err := u.Status(mbox, []imap.StatusItem{imap.StatusMessages})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Messages != count {
+			t.Errorf("expected %d messages in %s, got %d", count, mbox, status.Messages)
+		}
+	}
+}
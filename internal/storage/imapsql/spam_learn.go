@@ -0,0 +1,473 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/sqlutil"
+)
+
+// learnQueueSize is the amount of messages that can be waiting to be
+// submitted to learners before new ones are dropped.
+const learnQueueSize = 256
+
+// Keywords used by clients to mark messages as spam or not spam.
+var (
+	junkKeywords    = []string{"$Junk", "Junk"}
+	notJunkKeywords = []string{"$NotJunk", "NotJunk", "NonJunk"}
+)
+
+type learnJob struct {
+	account      string
+	spam         bool
+	key          string
+	compressAlgo string
+}
+
+// spamLearning submits messages to spam learners when users move them to or
+// out of the Junk mailbox or mark them using $Junk and $NotJunk keywords.
+//
+// Last verdict submitted for each message body is stored in the database so
+// the same message is not learned repeatedly (e.g. when it is moved back and
+// forth or copied). Learners are called asynchronously by a background
+// goroutine, IMAP commands do not wait for them.
+type spamLearning struct {
+	db       *sql.DB
+	driver   string
+	blobs    module.BlobStore
+	learners []module.SpamLearner
+	junkMbox string
+	log      log.Logger
+
+	queue   chan learnJob
+	stop    chan struct{}
+	stopped sync.WaitGroup
+}
+
+func spamLearnerDirective(m *config.Map, node config.Node) (interface{}, error) {
+	// spam_learner &rspamd
+	// spam_learner rspamd { ... }
+	if len(node.Args) != 0 {
+		learner, err := modconfig.SpamLearner(m.Globals, node.Args, node)
+		if err != nil {
+			return nil, err
+		}
+		return []module.SpamLearner{learner}, nil
+	}
+
+	// spam_learner {
+	//   rspamd
+	//   command /usr/bin/learn {verdict} {account_name}
+	// }
+	learners := make([]module.SpamLearner, 0, len(node.Children))
+	for _, child := range node.Children {
+		learner, err := modconfig.SpamLearner(m.Globals, append([]string{child.Name}, child.Args...), child)
+		if err != nil {
+			return nil, err
+		}
+		learners = append(learners, learner)
+	}
+	if len(learners) == 0 {
+		return nil, config.NodeErr(node, "at least one learner is required")
+	}
+	return learners, nil
+}
+
+func (l *spamLearning) rebind(query string) string {
+	return sqlutil.Rebind(l.driver, query)
+}
+
+func (l *spamLearning) initSchema() error {
+	_, err := l.db.Exec(`
+		CREATE TABLE IF NOT EXISTS spamLearned (
+			extBodyKey VARCHAR(255) PRIMARY KEY NOT NULL,
+			spam INTEGER NOT NULL
+		)`)
+	if err != nil {
+		return fmt.Errorf("create table spamLearned: %w", err)
+	}
+
+	// Drop entries for removed messages.
+	_, err = l.db.Exec(`
+		DELETE FROM spamLearned
+		WHERE extBodyKey NOT IN (SELECT id FROM extKeys)`)
+	if err != nil {
+		return fmt.Errorf("cleanup spamLearned: %w", err)
+	}
+	return nil
+}
+
+func (l *spamLearning) start() {
+	l.queue = make(chan learnJob, learnQueueSize)
+	l.stop = make(chan struct{})
+	l.stopped.Add(1)
+	go l.worker()
+}
+
+func (l *spamLearning) close() {
+	close(l.stop)
+	l.stopped.Wait()
+	if len(l.queue) != 0 {
+		l.log.Msg("pending messages are not learned", "count", len(l.queue))
+	}
+}
+
+func (l *spamLearning) enqueue(jobs []learnJob) {
+	for _, job := range jobs {
+		select {
+		case l.queue <- job:
+		default:
+			l.log.Msg("learning queue is full, message skipped", "account", job.account, "key", job.key)
+		}
+	}
+}
+
+func (l *spamLearning) worker() {
+	defer l.stopped.Done()
+
+	for {
+		select {
+		case job := <-l.queue:
+			if err := l.learn(context.Background(), job); err != nil {
+				l.log.Error("failed to learn message", err, "account", job.account, "key", job.key, "spam", job.spam)
+			}
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+func (l *spamLearning) learn(ctx context.Context, job learnJob) error {
+	var spam bool
+	err := l.db.QueryRowContext(ctx, l.rebind(`SELECT spam FROM spamLearned WHERE extBodyKey = ?`), job.key).Scan(&spam)
+	switch {
+	case err == nil && spam == job.spam:
+		l.log.DebugMsg("message is already learned", "account", job.account, "key", job.key, "spam", job.spam)
+		return nil
+	case err != nil && err != sql.ErrNoRows:
+		return err
+	}
+
+	msg, err := l.readBlob(ctx, job.key, job.compressAlgo)
+	if err != nil {
+		return err
+	}
+
+	for _, learner := range l.learners {
+		if err := learner.Learn(ctx, job.account, job.spam, msg); err != nil {
+			// The verdict is not saved so the message can be learned again
+			// next time.
+			return err
+		}
+	}
+
+	tx, err := l.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint:errcheck
+	if _, err := tx.Exec(l.rebind(`DELETE FROM spamLearned WHERE extBodyKey = ?`), job.key); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(l.rebind(`INSERT INTO spamLearned(extBodyKey, spam) VALUES (?, ?)`), job.key, job.spam); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	l.log.DebugMsg("message learned", "account", job.account, "key", job.key, "spam", job.spam)
+	return nil
+}
+
+func (l *spamLearning) readBlob(ctx context.Context, key, compressAlgo string) (buffer.Buffer, error) {
+	blob, err := l.blobs.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+
+	r, closeR, err := decompressReader(compressAlgo, blob)
+	if err != nil {
+		return nil, err
+	}
+	defer closeR()
+
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.MemoryBuffer{Slice: body}, nil
+}
+
+// messageJobs creates learning jobs for messages with specified UIDs in the
+// mailbox.
+func (l *spamLearning) messageJobs(u *imapsql.User, mboxName string, uids []uint32, spam bool) ([]learnJob, error) {
+	if len(uids) == 0 {
+		return nil, nil
+	}
+	if strings.EqualFold(mboxName, imap.InboxName) {
+		mboxName = imap.InboxName
+	}
+
+	var mboxID uint64
+	err := l.db.QueryRow(l.rebind(`SELECT id FROM mboxes WHERE uid = ? AND name = ?`), u.ID(), mboxName).Scan(&mboxID)
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[uint32]struct{}, len(uids))
+	minUID, maxUID := uids[0], uids[0]
+	for _, uid := range uids {
+		wanted[uid] = struct{}{}
+		if uid < minUID {
+			minUID = uid
+		}
+		if uid > maxUID {
+			maxUID = uid
+		}
+	}
+
+	rows, err := l.db.Query(l.rebind(`
+		SELECT msgId, extBodyKey, compressAlgo
+		FROM msgs
+		WHERE mboxId = ? AND msgId >= ? AND msgId <= ? AND extBodyKey IS NOT NULL`),
+		mboxID, minUID, maxUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := make([]learnJob, 0, len(uids))
+	for rows.Next() {
+		var (
+			uid  uint32
+			key  string
+			algo sql.NullString
+		)
+		if err := rows.Scan(&uid, &key, &algo); err != nil {
+			return nil, err
+		}
+		if _, ok := wanted[uid]; !ok {
+			continue
+		}
+		jobs = append(jobs, learnJob{
+			account:      u.Username(),
+			spam:         spam,
+			key:          key,
+			compressAlgo: algo.String,
+		})
+	}
+	return jobs, rows.Err()
+}
+
+// mailboxRole reports whether the mailbox is used for junk or trash.
+func (l *spamLearning) mailboxRole(u *imapsql.User, name string) (junk, trash bool, err error) {
+	mboxes, err := u.ListMailboxes(false)
+	if err != nil {
+		return false, false, err
+	}
+	for _, info := range mboxes {
+		if !strings.EqualFold(info.Name, name) {
+			continue
+		}
+		if info.Name == l.junkMbox {
+			junk = true
+		}
+		for _, attr := range info.Attributes {
+			switch {
+			case strings.EqualFold(attr, imap.JunkAttr):
+				junk = true
+			case strings.EqualFold(attr, imap.TrashAttr):
+				trash = true
+			}
+		}
+	}
+	return junk, trash, nil
+}
+
+// learnUser wraps the account object so mailboxes it returns report user
+// actions to spam learners.
+type learnUser struct {
+	*imapsql.User
+	// base is *imapsql.User or ftsUser.
+	base backend.User
+	l    *spamLearning
+}
+
+func (u learnUser) GetMailbox(name string, readOnly bool, conn backend.Conn) (*imap.MailboxStatus, backend.Mailbox, error) {
+	status, mbox, err := u.base.GetMailbox(name, readOnly, conn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sqlMbox, ok := mbox.(*imapsql.Mailbox)
+	if fm, isFTS := mbox.(*ftsMailbox); isFTS {
+		sqlMbox, ok = fm.Mailbox, true
+	}
+	if !ok {
+		return status, mbox, nil
+	}
+
+	return status, &learnMailbox{
+		Mailbox: sqlMbox,
+		base:    mbox,
+		u:       u,
+	}, nil
+}
+
+type learnMailbox struct {
+	*imapsql.Mailbox
+	// base is *imapsql.Mailbox or *ftsMailbox.
+	base backend.Mailbox
+	u    learnUser
+}
+
+func (m *learnMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	return m.base.SearchMessages(uid, criteria)
+}
+
+func (m *learnMailbox) SearchMessagesFuzzy(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	if fm, ok := m.base.(*ftsMailbox); ok {
+		return fm.SearchMessagesFuzzy(uid, criteria)
+	}
+	return m.base.SearchMessages(uid, criteria)
+}
+
+func (m *learnMailbox) uids(uid bool, seqset *imap.SeqSet) ([]uint32, error) {
+	criteria := &imap.SearchCriteria{SeqNum: seqset}
+	if uid {
+		criteria = &imap.SearchCriteria{Uid: seqset}
+	}
+	return m.Mailbox.SearchMessages(true, criteria)
+}
+
+// transferJobs returns learning jobs for messages copied or moved to the
+// dest mailbox.
+//
+// Messages moved to Junk are learned as spam, messages moved out of it are
+// learned as ham unless they are moved to Trash.
+func (m *learnMailbox) transferJobs(uid bool, seqset *imap.SeqSet, dest string) []learnJob {
+	l := m.u.l
+	srcJunk, _, err := l.mailboxRole(m.u.User, m.Mailbox.Name())
+	if err != nil {
+		l.log.Error("failed to get mailbox attributes", err, "mbox", m.Mailbox.Name())
+		return nil
+	}
+	destJunk, destTrash, err := l.mailboxRole(m.u.User, dest)
+	if err != nil {
+		l.log.Error("failed to get mailbox attributes", err, "mbox", dest)
+		return nil
+	}
+
+	var spam bool
+	switch {
+	case !srcJunk && destJunk:
+		spam = true
+	case srcJunk && !destJunk && !destTrash:
+		spam = false
+	default:
+		return nil
+	}
+
+	uids, err := m.uids(uid, seqset)
+	if err != nil {
+		l.log.Error("failed to resolve message set", err, "mbox", m.Mailbox.Name())
+		return nil
+	}
+	jobs, err := l.messageJobs(m.u.User, m.Mailbox.Name(), uids, spam)
+	if err != nil {
+		l.log.Error("failed to get messages for learning", err, "mbox", m.Mailbox.Name())
+		return nil
+	}
+	return jobs
+}
+
+func (m *learnMailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	jobs := m.transferJobs(uid, seqset, dest)
+	if err := m.Mailbox.CopyMessages(uid, seqset, dest); err != nil {
+		return err
+	}
+	m.u.l.enqueue(jobs)
+	return nil
+}
+
+func (m *learnMailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	// Messages are gone from the source mailbox after the move so blob
+	// keys are collected before it.
+	jobs := m.transferJobs(uid, seqset, dest)
+	if err := m.Mailbox.MoveMessages(uid, seqset, dest); err != nil {
+		return err
+	}
+	m.u.l.enqueue(jobs)
+	return nil
+}
+
+func hasKeyword(flags, keywords []string) bool {
+	for _, f := range flags {
+		for _, k := range keywords {
+			if strings.EqualFold(f, k) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m *learnMailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, silent bool, flags []string) error {
+	if err := m.Mailbox.UpdateMessagesFlags(uid, seqset, operation, silent, flags); err != nil {
+		return err
+	}
+	if operation == imap.RemoveFlags {
+		return nil
+	}
+
+	junk, notJunk := hasKeyword(flags, junkKeywords), hasKeyword(flags, notJunkKeywords)
+	if junk == notJunk {
+		return nil
+	}
+
+	l := m.u.l
+	uids, err := m.uids(uid, seqset)
+	if err != nil {
+		l.log.Error("failed to resolve message set", err, "mbox", m.Mailbox.Name())
+		return nil
+	}
+	jobs, err := l.messageJobs(m.u.User, m.Mailbox.Name(), uids, junk)
+	if err != nil {
+		l.log.Error("failed to get messages for learning", err, "mbox", m.Mailbox.Name())
+		return nil
+	}
+	l.enqueue(jobs)
+	return nil
+}
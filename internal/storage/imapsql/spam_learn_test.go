@@ -0,0 +1,177 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	_ "github.com/foxcpp/maddy/internal/storage/blob/fs"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type learned struct {
+	account string
+	spam    bool
+	body    string
+}
+
+type testLearner struct {
+	ch chan learned
+}
+
+func (tl testLearner) Learn(_ context.Context, accountName string, spam bool, msg buffer.Buffer) error {
+	r, err := msg.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	tl.ch <- learned{account: accountName, spam: spam, body: string(body)}
+	return nil
+}
+
+func TestSpamLearning(t *testing.T) {
+	dir := testutils.Dir(t)
+
+	mod, err := New("storage.imapsql", "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := mod.(*Storage)
+	store.Log = testutils.Logger(t, "imapsql")
+	err = store.Init(config.NewMap(map[string]interface{}{}, config.Node{
+		Children: []config.Node{
+			{Name: "driver", Args: []string{"sqlite3"}},
+			{Name: "dsn", Args: []string{filepath.Join(dir, "test.db")}},
+			{Name: "msg_store", Args: []string{"fs", filepath.Join(dir, "messages")}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	tl := testLearner{ch: make(chan learned, 10)}
+	store.learning = &spamLearning{
+		db:       store.Back.DB,
+		driver:   "sqlite3",
+		blobs:    store.blobStore,
+		learners: []module.SpamLearner{tl},
+		junkMbox: store.junkMbox,
+		log:      testutils.Logger(t, "imapsql/spam_learner"),
+	}
+	if err := store.learning.initSchema(); err != nil {
+		t.Fatal(err)
+	}
+	store.learning.start()
+
+	u, err := store.GetOrCreateIMAPAcct("user@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.CreateMailbox("Junk"); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.(interface {
+		CreateMailboxSpecial(name, specialUseAttr string) error
+	}).CreateMailboxSpecial("Trash", imap.TrashAttr); err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"Subject: one\r\n\r\nHello\r\n", "Subject: two\r\n\r\nHello\r\n"} {
+		if err := u.CreateMessage(imap.InboxName, nil, time.Now(), bytes.NewBufferString(body), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seq := func(uids ...uint32) *imap.SeqSet {
+		s := new(imap.SeqSet)
+		s.AddNum(uids...)
+		return s
+	}
+	mailbox := func(name string) backend.Mailbox {
+		t.Helper()
+		_, mbox, err := u.GetMailbox(name, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mbox
+	}
+	expect := func(spam bool, subject string) {
+		t.Helper()
+		select {
+		case l := <-tl.ch:
+			if l.account != "user@example.org" || l.spam != spam || !bytes.Contains([]byte(l.body), []byte(subject)) {
+				t.Fatalf("unexpected learned message: %+v", l)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("message was not learned")
+		}
+	}
+
+	inbox := mailbox(imap.InboxName)
+	defer inbox.Close()
+	if err := inbox.(backend.MoveMailbox).MoveMessages(true, seq(1), "Junk"); err != nil {
+		t.Fatal(err)
+	}
+	expect(true, "Subject: one")
+
+	junk := mailbox("Junk")
+	defer junk.Close()
+	// Copies between regular mailboxes are ignored.
+	if err := inbox.CopyMessages(true, seq(2), imap.InboxName); err != nil {
+		t.Fatal(err)
+	}
+	// Removal of junk is not a ham signal.
+	if err := junk.CopyMessages(true, seq(1), "Trash"); err != nil {
+		t.Fatal(err)
+	}
+	if err := junk.CopyMessages(true, seq(1), imap.InboxName); err != nil {
+		t.Fatal(err)
+	}
+	expect(false, "Subject: one")
+
+	if err := inbox.UpdateMessagesFlags(true, seq(2), imap.AddFlags, true, []string{"$junk"}); err != nil {
+		t.Fatal(err)
+	}
+	expect(true, "Subject: two")
+	// Same verdict is not submitted again.
+	if err := inbox.UpdateMessagesFlags(true, seq(2), imap.AddFlags, true, []string{"$Junk"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := inbox.UpdateMessagesFlags(true, seq(2), imap.AddFlags, true, []string{"$NotJunk"}); err != nil {
+		t.Fatal(err)
+	}
+	expect(false, "Subject: two")
+}
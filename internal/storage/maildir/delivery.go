@@ -0,0 +1,255 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package maildir
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"runtime/trace"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+type addedRcpt struct {
+	rcptTo string
+	user   *User
+
+	// Set by Body.
+	folder  *folder
+	tmpPath string
+	size    int64
+	flags   []string
+}
+
+// delivery writes the message for each recipient into tmp/ of the target
+// folder in Body and moves it into new/ (or cur/ if flags are set) on
+// Commit so the message appears atomically.
+type delivery struct {
+	store    *Storage
+	msgMeta  *module.MsgMetadata
+	mailFrom string
+
+	addedRcpts map[string]*addedRcpt
+}
+
+func (d *delivery) String() string {
+	return d.store.Name() + ":" + d.store.InstanceName()
+}
+
+func userDoesNotExist(actual error) error {
+	return &exterrors.SMTPError{
+		Code:         501,
+		EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+		Message:      "User does not exist",
+		TargetName:   modName,
+		Err:          actual,
+	}
+}
+
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string) error {
+	defer trace.StartRegion(ctx, "maildir/AddRcpt").End()
+
+	accountName, err := d.store.deliveryNormalize(ctx, rcptTo)
+	if err != nil {
+		return userDoesNotExist(err)
+	}
+
+	if _, ok := d.addedRcpts[accountName]; ok {
+		return nil
+	}
+
+	u, err := d.store.getUser(accountName, false)
+	if err != nil {
+		if errors.Is(err, ErrUserDoesntExists) {
+			return userDoesNotExist(err)
+		}
+		return err
+	}
+
+	d.addedRcpts[accountName] = &addedRcpt{
+		rcptTo: rcptTo,
+		user:   u,
+	}
+	return nil
+}
+
+// targetFolder returns the folder message should be placed in. Missing
+// folders requested by imap_filter are created.
+func (d *delivery) targetFolder(rcpt *addedRcpt, mbox string) (*folder, error) {
+	if mbox == "" {
+		mbox = imap.InboxName
+	}
+	f, err := rcpt.user.folder(mbox)
+	if err == nil {
+		return f, nil
+	}
+	if !errors.Is(err, backend.ErrNoSuchMailbox) {
+		return nil, err
+	}
+	if err := rcpt.user.CreateMailbox(mbox); err != nil {
+		return nil, err
+	}
+	return rcpt.user.folder(mbox)
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	defer trace.StartRegion(ctx, "maildir/Body").End()
+
+	for accountName, rcpt := range d.addedRcpts {
+		mbox := ""
+		var flags []string
+		if d.msgMeta.IsQuarantined(rcpt.rcptTo) {
+			mbox = d.store.junkMbox
+		} else if d.store.filters != nil {
+			folder, fflags, err := d.store.filters.IMAPFilter(accountName, rcpt.rcptTo, d.msgMeta, header, body)
+			if err != nil {
+				d.store.Log.Error("IMAPFilter failed", err, "rcpt", accountName)
+			} else {
+				mbox, flags = folder, fflags
+			}
+		}
+
+		f, err := d.targetFolder(rcpt, mbox)
+		if err != nil {
+			if mbox == "" {
+				return err
+			}
+			d.store.Log.Error("failed to open target mailbox, using INBOX", err, "rcpt", accountName, "mailbox", mbox)
+			f, err = d.targetFolder(rcpt, "")
+			if err != nil {
+				return err
+			}
+		}
+
+		// This header is added to the message only for that recipient.
+		userHeader := header.Copy()
+		userHeader.Add("Return-Path", "<"+target.SanitizeForHeader(d.mailFrom)+">")
+		userHeader.Add("Delivered-To", accountName)
+
+		tmpPath, size, err := f.writeTmp(func(w io.Writer) error {
+			if err := textproto.WriteHeader(w, userHeader); err != nil {
+				return err
+			}
+			r, err := body.Open()
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			_, err = io.Copy(w, r)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		rcpt.folder = f
+		rcpt.tmpPath = tmpPath
+		rcpt.size = size
+		rcpt.flags = flags
+	}
+
+	return nil
+}
+
+func (d *delivery) Abort(ctx context.Context) error {
+	defer trace.StartRegion(ctx, "maildir/Abort").End()
+
+	for _, rcpt := range d.addedRcpts {
+		if rcpt.tmpPath != "" {
+			os.Remove(rcpt.tmpPath)
+			rcpt.tmpPath = ""
+		}
+	}
+	return nil
+}
+
+// Commit moves the message into the target folder of each recipient. If it
+// fails for any recipient, messages already added for other recipients
+// are removed so the message is delivered to all recipients or to none of
+// them.
+func (d *delivery) Commit(ctx context.Context) error {
+	defer trace.StartRegion(ctx, "maildir/Commit").End()
+
+	type committedMsg struct {
+		folder *folder
+		uid    uint32
+	}
+	var (
+		committed []committedMsg
+		commitErr error
+	)
+	for accountName, rcpt := range d.addedRcpts {
+		if rcpt.tmpPath == "" {
+			continue
+		}
+		if commitErr != nil {
+			os.Remove(rcpt.tmpPath)
+			rcpt.tmpPath = ""
+			continue
+		}
+
+		rcpt.folder.lock.Lock()
+		uid, err := rcpt.folder.addMessage(rcpt.tmpPath, rcpt.size, rcpt.flags, time.Time{})
+		rcpt.folder.lock.Unlock()
+		if err != nil {
+			d.store.Log.Error("failed to commit message", err, "rcpt", accountName)
+			os.Remove(rcpt.tmpPath)
+			commitErr = err
+		} else {
+			committed = append(committed, committedMsg{folder: rcpt.folder, uid: uid})
+		}
+		rcpt.tmpPath = ""
+	}
+	if commitErr == nil {
+		return nil
+	}
+
+	for _, msg := range committed {
+		var seq imap.SeqSet
+		seq.AddNum(msg.uid)
+
+		msg.folder.lock.Lock()
+		err := msg.folder.remove(&seq, false)
+		msg.folder.lock.Unlock()
+		if err != nil {
+			d.store.Log.Error("failed to roll back the delivery", err, "folder", msg.folder.path, "uid", msg.uid)
+		}
+	}
+	return commitErr
+}
+
+func (store *Storage) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	defer trace.StartRegion(ctx, "maildir/Start").End()
+
+	return &delivery{
+		store:      store,
+		msgMeta:    msgMeta,
+		mailFrom:   mailFrom,
+		addedRcpts: map[string]*addedRcpt{},
+	}, nil
+}
@@ -0,0 +1,964 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package maildir
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap"
+	mess "github.com/foxcpp/go-imap-mess"
+)
+
+const (
+	uidlistName  = "dovecot-uidlist"
+	keywordsName = "dovecot-keywords"
+
+	// Lock files older than that are considered stale and are removed. Same
+	// as the Dovecot default.
+	staleLockAge = 2 * time.Minute
+	lockTimeout  = 30 * time.Second
+
+	// Only lowercase letters can be used for keywords in file names.
+	maxKeywords = 26
+)
+
+var ErrTooManyKeywords = errors.New("maildir: too many keywords in the mailbox")
+
+// Maildir uses single letters in file names to store flags.
+var (
+	letterFlags = map[byte]string{
+		'D': imap.DraftFlag,
+		'F': imap.FlaggedFlag,
+		'R': imap.AnsweredFlag,
+		'S': imap.SeenFlag,
+		'T': imap.DeletedFlag,
+	}
+	flagLetters = map[string]byte{
+		imap.DraftFlag:    'D',
+		imap.FlaggedFlag:  'F',
+		imap.AnsweredFlag: 'R',
+		imap.SeenFlag:     'S',
+		imap.DeletedFlag:  'T',
+	}
+)
+
+// message is a single file in the Maildir folder.
+type message struct {
+	uid uint32
+	// base is the unique part of the file name (before ':'). It does not
+	// change when flags are changed.
+	base string
+	// ext contains uidlist extension fields, they are preserved as is.
+	ext string
+
+	dir  string // "new" or "cur"
+	name string
+}
+
+func splitName(name string) (base, info string) {
+	i := strings.IndexByte(name, ':')
+	if i == -1 {
+		return name, ""
+	}
+	base = name[:i]
+	if strings.HasPrefix(name[i:], ":2,") {
+		info = name[i+3:]
+	}
+	return base, info
+}
+
+func (m *message) info() string {
+	_, info := splitName(m.name)
+	return info
+}
+
+func (m *message) flags(keywords []string) []string {
+	info := m.info()
+	flags := make([]string, 0, len(info))
+	for i := 0; i < len(info); i++ {
+		c := info[i]
+		if f, ok := letterFlags[c]; ok {
+			flags = append(flags, f)
+			continue
+		}
+		if c >= 'a' && c <= 'z' && int(c-'a') < len(keywords) {
+			flags = append(flags, keywords[c-'a'])
+		}
+	}
+	return flags
+}
+
+func (m *message) hasFlag(letter byte) bool {
+	return strings.IndexByte(m.info(), letter) != -1
+}
+
+// folder represents a single Maildir directory.
+//
+// All operations that change the folder are serialized using lock and the
+// Dovecot-compatible dot-lock for dovecot-uidlist.
+type folder struct {
+	s    *Storage
+	key  string
+	path string
+
+	lock        sync.Mutex
+	loaded      bool
+	dirty       bool // uidlist needs to be written
+	uidValidity uint32
+	uidNext     uint32
+	guid        string
+	ext         string // unknown header fields of uidlist
+	msgs        []*message
+	keywords    []string
+}
+
+func (f *folder) exists() bool {
+	info, err := os.Stat(filepath.Join(f.path, "cur"))
+	return err == nil && info.IsDir()
+}
+
+func createMaildir(path string) error {
+	for _, dir := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(path, dir), 0o700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dotlock acquires the uidlist lock file. It is also used to write the
+// updated uidlist contents that are then atomically renamed over the old
+// file.
+func (f *folder) dotlock() (*os.File, error) {
+	lockPath := filepath.Join(f.path, uidlistName+".lock")
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		fl, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err == nil {
+			return fl, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > staleLockAge {
+			f.s.Log.Msg("removing stale uidlist lock", "path", lockPath)
+			os.Remove(lockPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("maildir: timed out waiting for %s", lockPath)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func releaseLock(fl *os.File) {
+	fl.Close()
+	os.Remove(fl.Name())
+}
+
+var lastUidValidity uint32
+
+// newUidValidity returns an unique UIDVALIDITY value based on the current
+// time.
+func newUidValidity() uint32 {
+	for {
+		last := atomic.LoadUint32(&lastUidValidity)
+		val := uint32(time.Now().Unix())
+		if val <= last {
+			val = last + 1
+		}
+		if atomic.CompareAndSwapUint32(&lastUidValidity, last, val) {
+			return val
+		}
+	}
+}
+
+// readUidlist reads dovecot-uidlist. Both version 1 and 3 formats are
+// supported.
+func (f *folder) readUidlist() (entries []*message, exists bool, err error) {
+	fl, err := os.Open(filepath.Join(f.path, uidlistName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	defer fl.Close()
+
+	scnr := bufio.NewScanner(fl)
+	scnr.Buffer(make([]byte, 0, 4096), 1024*1024)
+	if !scnr.Scan() {
+		if err := scnr.Err(); err != nil {
+			return nil, false, err
+		}
+		return nil, false, nil
+	}
+
+	hdr := strings.Fields(scnr.Text())
+	if len(hdr) == 0 {
+		return nil, false, fmt.Errorf("maildir: malformed %s header", uidlistName)
+	}
+	var extHdr []string
+	switch hdr[0] {
+	case "1":
+		if len(hdr) < 3 {
+			return nil, false, fmt.Errorf("maildir: malformed %s header", uidlistName)
+		}
+		validity, err := strconv.ParseUint(hdr[1], 10, 32)
+		if err != nil {
+			return nil, false, fmt.Errorf("maildir: malformed %s header: %w", uidlistName, err)
+		}
+		next, err := strconv.ParseUint(hdr[2], 10, 32)
+		if err != nil {
+			return nil, false, fmt.Errorf("maildir: malformed %s header: %w", uidlistName, err)
+		}
+		f.uidValidity, f.uidNext = uint32(validity), uint32(next)
+	case "3":
+		for _, field := range hdr[1:] {
+			if len(field) < 2 {
+				continue
+			}
+			switch field[0] {
+			case 'V', 'N':
+				val, err := strconv.ParseUint(field[1:], 10, 32)
+				if err != nil {
+					return nil, false, fmt.Errorf("maildir: malformed %s header: %w", uidlistName, err)
+				}
+				if field[0] == 'V' {
+					f.uidValidity = uint32(val)
+				} else {
+					f.uidNext = uint32(val)
+				}
+			case 'G':
+				f.guid = field[1:]
+			default:
+				extHdr = append(extHdr, field)
+			}
+		}
+	default:
+		return nil, false, fmt.Errorf("maildir: unsupported %s version: %s", uidlistName, hdr[0])
+	}
+	f.ext = strings.Join(extHdr, " ")
+
+	for scnr.Scan() {
+		line := scnr.Text()
+		if line == "" {
+			continue
+		}
+		uidStr, rest := line, ""
+		if i := strings.IndexByte(line, ' '); i != -1 {
+			uidStr, rest = line[:i], line[i+1:]
+		}
+		uid, err := strconv.ParseUint(uidStr, 10, 32)
+		if err != nil {
+			return nil, false, fmt.Errorf("maildir: malformed %s line: %q", uidlistName, line)
+		}
+
+		msg := &message{uid: uint32(uid)}
+		if i := strings.Index(rest, ":"); i != -1 && (i == 0 || rest[i-1] == ' ') {
+			msg.ext = strings.TrimSpace(rest[:i])
+			msg.base = rest[i+1:]
+		} else {
+			msg.base = strings.TrimSpace(rest)
+		}
+		msg.base, _ = splitName(msg.base)
+		if msg.base == "" {
+			return nil, false, fmt.Errorf("maildir: malformed %s line: %q", uidlistName, line)
+		}
+		entries = append(entries, msg)
+	}
+	if err := scnr.Err(); err != nil {
+		return nil, false, err
+	}
+
+	if f.uidValidity == 0 {
+		f.uidValidity = newUidValidity()
+	}
+	if f.uidNext == 0 {
+		f.uidNext = 1
+	}
+	return entries, true, nil
+}
+
+func (f *folder) writeUidlist(w io.Writer, msgs []*message) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "3 V%d N%d G%s", f.uidValidity, f.uidNext, f.guid)
+	if f.ext != "" {
+		bw.WriteString(" " + f.ext)
+	}
+	bw.WriteString("\n")
+	for _, msg := range msgs {
+		bw.WriteString(strconv.FormatUint(uint64(msg.uid), 10))
+		if msg.ext != "" {
+			bw.WriteString(" " + msg.ext)
+		}
+		bw.WriteString(" :" + msg.base + "\n")
+	}
+	return bw.Flush()
+}
+
+func (f *folder) readKeywords() error {
+	data, err := os.ReadFile(filepath.Join(f.path, keywordsName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			f.keywords = nil
+			return nil
+		}
+		return err
+	}
+
+	keywords := make([]string, maxKeywords)
+	used := 0
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		idxStr, kw := parts[0], parts[1]
+		idx, err := strconv.Atoi(idxStr)
+		if err != nil || idx < 0 || idx >= maxKeywords {
+			continue
+		}
+		keywords[idx] = kw
+		if idx+1 > used {
+			used = idx + 1
+		}
+	}
+	f.keywords = keywords[:used]
+	return nil
+}
+
+// keywordLetter returns the letter used for the keyword, allocating one if
+// necessary. uidlist lock should be held.
+func (f *folder) keywordLetter(kw string) (byte, error) {
+	free := -1
+	for i, existing := range f.keywords {
+		if strings.EqualFold(existing, kw) {
+			return 'a' + byte(i), nil
+		}
+		if existing == "" && free == -1 {
+			free = i
+		}
+	}
+	if free == -1 {
+		if len(f.keywords) >= maxKeywords {
+			return 0, ErrTooManyKeywords
+		}
+		free = len(f.keywords)
+		f.keywords = append(f.keywords, "")
+	}
+	f.keywords[free] = kw
+
+	var sb strings.Builder
+	for i, existing := range f.keywords {
+		if existing != "" {
+			fmt.Fprintf(&sb, "%d %s\n", i, existing)
+		}
+	}
+	tmpPath := filepath.Join(f.path, keywordsName+".tmp")
+	if err := os.WriteFile(tmpPath, []byte(sb.String()), 0o600); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(f.path, keywordsName)); err != nil {
+		return 0, err
+	}
+	return 'a' + byte(free), nil
+}
+
+// infoFromFlags builds file name info part for the flags. Unknown letters in
+// oldInfo are preserved. uidlist lock should be held.
+func (f *folder) infoFromFlags(oldInfo string, flags []string) (string, error) {
+	letters := make([]byte, 0, len(flags)+len(oldInfo))
+	for i := 0; i < len(oldInfo); i++ {
+		c := oldInfo[i]
+		if c >= 'A' && c <= 'Z' {
+			if _, ok := letterFlags[c]; !ok {
+				letters = append(letters, c)
+			}
+		}
+	}
+	for _, flag := range flags {
+		if flag == imap.RecentFlag {
+			continue
+		}
+		if c, ok := flagLetters[flag]; ok {
+			letters = append(letters, c)
+			continue
+		}
+		if strings.HasPrefix(flag, "\\") {
+			// Unknown system flag.
+			continue
+		}
+		c, err := f.keywordLetter(flag)
+		if err != nil {
+			return "", err
+		}
+		letters = append(letters, c)
+	}
+
+	sort.Slice(letters, func(i, j int) bool { return letters[i] < letters[j] })
+	uniq := letters[:0]
+	for i, c := range letters {
+		if i == 0 || letters[i-1] != c {
+			uniq = append(uniq, c)
+		}
+	}
+	return string(uniq), nil
+}
+
+type fileRef struct {
+	dir  string
+	name string
+}
+
+// scan lists files in the folder. new/ is listed first so messages moved to
+// cur/ concurrently are not missed.
+func (f *folder) scan() (map[string]fileRef, error) {
+	files := map[string]fileRef{}
+	for _, dir := range []string{"new", "cur"} {
+		ents, err := os.ReadDir(filepath.Join(f.path, dir))
+		if err != nil {
+			return nil, err
+		}
+		for _, ent := range ents {
+			name := ent.Name()
+			if strings.HasPrefix(name, ".") || ent.IsDir() {
+				continue
+			}
+			base, _ := splitName(name)
+			files[base] = fileRef{dir: dir, name: name}
+		}
+	}
+	return files, nil
+}
+
+// reload reads the current state of the folder and assigns UIDs to new
+// messages. uidlist lock should be held.
+func (f *folder) reload() error {
+	entries, exists, err := f.readUidlist()
+	if err != nil {
+		return err
+	}
+	f.dirty = !exists
+	if !exists {
+		f.uidValidity = newUidValidity()
+		f.uidNext = 1
+		f.ext = ""
+	}
+	if f.guid == "" {
+		guid := make([]byte, 16)
+		if _, err := rand.Read(guid); err != nil {
+			return err
+		}
+		f.guid = hex.EncodeToString(guid)
+		f.dirty = true
+	}
+	if err := f.readKeywords(); err != nil {
+		return err
+	}
+
+	files, err := f.scan()
+	if err != nil {
+		return err
+	}
+
+	msgs := make([]*message, 0, len(files))
+	for _, msg := range entries {
+		ref, ok := files[msg.base]
+		if !ok {
+			f.dirty = true
+			continue
+		}
+		msg.dir, msg.name = ref.dir, ref.name
+		msgs = append(msgs, msg)
+		delete(files, msg.base)
+		if msg.uid >= f.uidNext {
+			f.uidNext = msg.uid + 1
+			f.dirty = true
+		}
+	}
+
+	newBases := make([]string, 0, len(files))
+	for base := range files {
+		newBases = append(newBases, base)
+	}
+	sort.Strings(newBases)
+	f.msgs = msgs
+	for _, base := range newBases {
+		ref := files[base]
+		f.appendMsg(base, ref.dir, ref.name)
+	}
+	return nil
+}
+
+// appendMsg adds the message to the cached state assigning the next UID to
+// it. uidlist lock should be held.
+func (f *folder) appendMsg(base, dir, name string) *message {
+	msg := &message{
+		uid:  f.uidNext,
+		base: base,
+		dir:  dir,
+		name: name,
+	}
+	f.msgs = append(f.msgs, msg)
+	f.uidNext++
+	f.dirty = true
+	return msg
+}
+
+// update acquires the uidlist lock, reloads the folder state and calls fn (if
+// not nil) to modify it. Changes made by fn and by other processes are then
+// written to the uidlist and dispatched to sessions that have the folder
+// selected.
+//
+// fn can return UIDs of messages with flag changes that were already
+// dispatched by the caller.
+//
+// Lock should be held.
+func (f *folder) update(fn func() (handled map[uint32]struct{}, err error)) error {
+	lockFile, err := f.dotlock()
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			releaseLock(lockFile)
+		}
+	}()
+
+	oldInfo := make(map[uint32]string, len(f.msgs))
+	for _, msg := range f.msgs {
+		oldInfo[msg.uid] = msg.info()
+	}
+
+	if err := f.reload(); err != nil {
+		return err
+	}
+
+	var (
+		handled map[uint32]struct{}
+		fnErr   error
+	)
+	if fn != nil {
+		handled, fnErr = fn()
+	}
+
+	if f.dirty {
+		if err := f.writeUidlist(lockFile, f.msgs); err != nil {
+			return err
+		}
+		if err := lockFile.Sync(); err != nil {
+			return err
+		}
+		if err := lockFile.Close(); err != nil {
+			return err
+		}
+		if err := os.Rename(lockFile.Name(), filepath.Join(f.path, uidlistName)); err != nil {
+			os.Remove(lockFile.Name())
+			return err
+		}
+		committed = true
+		f.dirty = false
+	}
+
+	if f.loaded {
+		if f.dispatch(oldInfo, handled) || len(handled) != 0 {
+			f.s.folderChanged(f.key)
+		}
+	}
+	f.loaded = true
+	return fnErr
+}
+
+// sync reads the current state of the folder and dispatches changes made by
+// other processes. Lock should be held.
+func (f *folder) sync() error {
+	return f.update(nil)
+}
+
+// dispatch sends updates for changes since the previous reload to sessions
+// that have the folder selected. true is returned if there were any changes.
+func (f *folder) dispatch(oldInfo map[uint32]string, handled map[uint32]struct{}) bool {
+	changed := false
+	var added, removed imap.SeqSet
+	for _, msg := range f.msgs {
+		info, ok := oldInfo[msg.uid]
+		if !ok {
+			added.AddNum(msg.uid)
+			continue
+		}
+		delete(oldInfo, msg.uid)
+		if _, ok := handled[msg.uid]; ok {
+			continue
+		}
+		if info != msg.info() {
+			f.s.mngr.ExternalUpdate(mess.Update{
+				Type:     mess.UpdFlags,
+				Key:      f.key,
+				SeqSet:   strconv.FormatUint(uint64(msg.uid), 10),
+				NewFlags: msg.flags(f.keywords),
+			})
+			changed = true
+		}
+	}
+	for uid := range oldInfo {
+		removed.AddNum(uid)
+	}
+
+	if !removed.Empty() {
+		f.s.mngr.ExternalUpdate(mess.Update{
+			Type:   mess.UpdRemoved,
+			Key:    f.key,
+			SeqSet: removed.String(),
+		})
+		changed = true
+	}
+	if !added.Empty() {
+		f.s.mngr.ExternalUpdate(mess.Update{
+			Type:   mess.UpdNewMessage,
+			Key:    f.key,
+			SeqSet: added.String(),
+		})
+		changed = true
+	}
+	return changed
+}
+
+func (f *folder) byUID(uid uint32) *message {
+	i := sort.Search(len(f.msgs), func(i int) bool {
+		return f.msgs[i].uid >= uid
+	})
+	if i < len(f.msgs) && f.msgs[i].uid == uid {
+		return f.msgs[i]
+	}
+	return nil
+}
+
+func (f *folder) uids() []uint32 {
+	uids := make([]uint32, len(f.msgs))
+	for i, msg := range f.msgs {
+		uids[i] = msg.uid
+	}
+	return uids
+}
+
+func (f *folder) msgPath(msg *message) string {
+	return filepath.Join(f.path, msg.dir, msg.name)
+}
+
+// takeRecent moves messages from new/ to cur/ and returns their UIDs.
+// uidlist lock should be held.
+func (f *folder) takeRecent() (*imap.SeqSet, error) {
+	recent := &imap.SeqSet{}
+	for _, msg := range f.msgs {
+		if msg.dir != "new" {
+			continue
+		}
+		newName := msg.base + ":2," + msg.info()
+		err := os.Rename(f.msgPath(msg), filepath.Join(f.path, "cur", newName))
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Taken by another process.
+				continue
+			}
+			return nil, err
+		}
+		msg.dir, msg.name = "cur", newName
+		recent.AddNum(msg.uid)
+	}
+	return recent, nil
+}
+
+// setInfo renames the message file to change its flags. uidlist lock
+// should be held.
+func (f *folder) setInfo(msg *message, info string) error {
+	newName := msg.base + ":2," + info
+	if msg.dir == "cur" && msg.name == newName {
+		return nil
+	}
+	err := os.Rename(f.msgPath(msg), filepath.Join(f.path, "cur", newName))
+	if err != nil {
+		return err
+	}
+	msg.dir, msg.name = "cur", newName
+	return nil
+}
+
+// updateFlags changes flags of messages with UIDs in the set. changed is
+// called for each updated message and is expected to dispatch the update to
+// sessions. Lock should be held.
+func (f *folder) updateFlags(uids *imap.SeqSet, update func(cur []string) []string, changed func(uid uint32, flags []string)) error {
+	return f.update(func() (map[uint32]struct{}, error) {
+		handled := map[uint32]struct{}{}
+		for _, msg := range f.msgs {
+			if !uids.Contains(msg.uid) {
+				continue
+			}
+			info, err := f.infoFromFlags(msg.info(), update(msg.flags(f.keywords)))
+			if err != nil {
+				return handled, err
+			}
+			if err := f.setInfo(msg, info); err != nil {
+				if os.IsNotExist(err) {
+					// Removed by another process, will be noticed on the next
+					// reload.
+					continue
+				}
+				return handled, err
+			}
+			handled[msg.uid] = struct{}{}
+			changed(msg.uid, msg.flags(f.keywords))
+		}
+		return handled, nil
+	})
+}
+
+// remove deletes messages with UIDs in the set. If deletedOnly is set, only
+// messages with \Deleted flag are removed. Lock should be held.
+func (f *folder) remove(uids *imap.SeqSet, deletedOnly bool) error {
+	return f.update(func() (map[uint32]struct{}, error) {
+		var lastErr error
+		kept := make([]*message, 0, len(f.msgs))
+		for _, msg := range f.msgs {
+			if uids != nil && !uids.Contains(msg.uid) || deletedOnly && !msg.hasFlag('T') {
+				kept = append(kept, msg)
+				continue
+			}
+			if err := os.Remove(f.msgPath(msg)); err != nil && !os.IsNotExist(err) {
+				lastErr = err
+				kept = append(kept, msg)
+				continue
+			}
+			f.dirty = true
+		}
+		f.msgs = kept
+		return nil, lastErr
+	})
+}
+
+// copyMessages copies or moves messages with UIDs in the set from src to dst.
+// Locks of both folders should be held.
+func copyMessages(src, dst *folder, uids *imap.SeqSet, move bool) error {
+	work := func() (map[uint32]struct{}, error) {
+		kept := make([]*message, 0, len(src.msgs))
+		var lastErr error
+		for _, msg := range src.msgs {
+			if !uids.Contains(msg.uid) || lastErr != nil {
+				kept = append(kept, msg)
+				continue
+			}
+			if err := copyMessage(src, dst, msg, move); err != nil {
+				if !os.IsNotExist(err) {
+					lastErr = err
+				}
+				kept = append(kept, msg)
+				continue
+			}
+			if !move {
+				kept = append(kept, msg)
+			}
+		}
+		if move && len(kept) != len(src.msgs) {
+			src.msgs = kept
+			src.dirty = true
+		}
+		return nil, lastErr
+	}
+
+	if src == dst {
+		return src.update(work)
+	}
+
+	// Always acquire uidlist locks in the same order to prevent deadlocks.
+	first, second := src, dst
+	if dst.path < src.path {
+		first, second = dst, src
+	}
+	return first.update(func() (map[uint32]struct{}, error) {
+		return nil, second.update(work)
+	})
+}
+
+func copyMessage(src, dst *folder, msg *message, move bool) error {
+	info, err := dst.infoFromFlags(msg.info(), msg.flags(src.keywords))
+	if err != nil {
+		return err
+	}
+
+	srcPath := src.msgPath(msg)
+	if move {
+		name := msg.base + ":2," + info
+		if err := os.Rename(srcPath, filepath.Join(dst.path, "cur", name)); err != nil {
+			return err
+		}
+		if src == dst {
+			msg.dir, msg.name = "cur", name
+			return nil
+		}
+		dst.appendMsg(msg.base, "cur", name)
+		return nil
+	}
+
+	stat, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	base := newBase(stat.Size())
+	name := base + ":2," + info
+	dstPath := filepath.Join(dst.path, "cur", name)
+	if err := os.Link(srcPath, dstPath); err != nil {
+		if os.IsNotExist(err) {
+			return err
+		}
+		if err := copyFile(srcPath, dstPath, stat.ModTime()); err != nil {
+			return err
+		}
+	}
+	dst.appendMsg(base, "cur", name)
+	return nil
+}
+
+func copyFile(srcPath, dstPath string, modTime time.Time) error {
+	srcF, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer srcF.Close()
+
+	tmp, err := os.CreateTemp(filepath.Join(filepath.Dir(filepath.Dir(dstPath)), "tmp"), "maddy-")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, srcF); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chtimes(tmp.Name(), modTime, modTime); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), dstPath)
+}
+
+var deliveryCounter uint32
+
+// newBase generates unique file name for a new message.
+func newBase(size int64) string {
+	now := time.Now()
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s,S=%d,W=%d",
+		now.Unix(), now.Nanosecond()/1000, os.Getpid(),
+		atomic.AddUint32(&deliveryCounter, 1), host, size, size)
+}
+
+// writeTmp writes the message to tmp/ directory of the folder. Name of the
+// created file is returned.
+func (f *folder) writeTmp(write func(w io.Writer) error) (string, int64, error) {
+	tmp, err := os.CreateTemp(filepath.Join(f.path, "tmp"), "maddy-")
+	if err != nil {
+		return "", 0, err
+	}
+	cw := &countWriter{w: tmp}
+	if err := write(cw); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", 0, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", 0, err
+	}
+	return tmp.Name(), cw.n, nil
+}
+
+// addMessage moves the file written using writeTmp into the folder and
+// returns the UID of the added message. Messages without flags are placed
+// into new/. Lock should be held.
+func (f *folder) addMessage(tmpPath string, size int64, flags []string, date time.Time) (uint32, error) {
+	if !date.IsZero() {
+		if err := os.Chtimes(tmpPath, date, date); err != nil {
+			return 0, err
+		}
+	}
+
+	var uid uint32
+	err := f.update(func() (map[uint32]struct{}, error) {
+		base := newBase(size)
+		dir, name := "new", base
+		if len(flags) != 0 {
+			info, err := f.infoFromFlags("", flags)
+			if err != nil {
+				return nil, err
+			}
+			dir, name = "cur", base+":2,"+info
+		}
+		if err := os.Rename(tmpPath, filepath.Join(f.path, dir, name)); err != nil {
+			return nil, err
+		}
+		uid = f.appendMsg(base, dir, name).uid
+		return nil, nil
+	})
+	return uid, err
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
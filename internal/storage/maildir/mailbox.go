@@ -0,0 +1,492 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package maildir
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	gomessage "github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	mess "github.com/foxcpp/go-imap-mess"
+)
+
+// idlePollInterval is how often the folder is rescanned during IDLE to
+// notice changes made by other software (e.g. an external MDA).
+const idlePollInterval = 30 * time.Second
+
+// Mailbox is a mailbox selected by the IMAP session.
+type Mailbox struct {
+	u        *User
+	f        *folder
+	name     string
+	readOnly bool
+	conn     backend.Conn
+	handle   *mess.MailboxHandle
+}
+
+var (
+	_ mess.Mailbox        = &Mailbox{}
+	_ backend.MoveMailbox = &Mailbox{}
+)
+
+func (mbox *Mailbox) Name() string {
+	return mbox.name
+}
+
+func (mbox *Mailbox) Conn() backend.Conn {
+	return mbox.conn
+}
+
+func (mbox *Mailbox) Info() (*imap.MailboxInfo, error) {
+	names, err := mbox.u.mailboxNames()
+	if err != nil {
+		return nil, err
+	}
+	info := mbox.u.mailboxInfo(mbox.name, names)
+	return &info, nil
+}
+
+func (mbox *Mailbox) Close() error {
+	return mbox.handle.Close()
+}
+
+// rescan reads changes made by other processes. Messages delivered since
+// the mailbox was selected are moved to cur/ if the mailbox is writable.
+func (mbox *Mailbox) rescan() error {
+	mbox.f.lock.Lock()
+	defer mbox.f.lock.Unlock()
+	return mbox.f.update(func() (map[uint32]struct{}, error) {
+		if mbox.readOnly || mbox.conn == nil {
+			return nil, nil
+		}
+		_, err := mbox.f.takeRecent()
+		return nil, err
+	})
+}
+
+func (mbox *Mailbox) Poll(expunge bool) error {
+	if err := mbox.rescan(); err != nil {
+		return err
+	}
+	mbox.handle.Sync(expunge)
+	return nil
+}
+
+func (mbox *Mailbox) Idle(done <-chan struct{}) {
+	stop := make(chan struct{})
+	go func() {
+		t := time.NewTicker(idlePollInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if err := mbox.rescan(); err != nil {
+					mbox.u.s.Log.Error("folder rescan failed", err, "key", mbox.f.key)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	mbox.handle.Idle(done)
+	close(stop)
+}
+
+// loadedMsg contains the message contents with line endings normalized to
+// CRLF.
+type loadedMsg struct {
+	body []byte
+	date time.Time
+}
+
+func (l *loadedMsg) headerAndBody() (textproto.Header, *bufio.Reader, error) {
+	body := bufio.NewReader(bytes.NewReader(l.body))
+	hdr, err := textproto.ReadHeader(body)
+	return hdr, body, err
+}
+
+// normalizeCRLF converts bare LF line endings used in Maildir files to CRLF.
+func normalizeCRLF(b []byte) []byte {
+	lfs := bytes.Count(b, []byte{'\n'}) - bytes.Count(b, []byte("\r\n"))
+	if lfs <= 0 {
+		return b
+	}
+	res := make([]byte, 0, len(b)+lfs)
+	for i, c := range b {
+		if c == '\n' && (i == 0 || b[i-1] != '\r') {
+			res = append(res, '\r')
+		}
+		res = append(res, c)
+	}
+	return res
+}
+
+// load reads the message file. If it was renamed by another process, the
+// folder is rescanned to find the new name. Folder lock should be held.
+func (mbox *Mailbox) load(msg *message) (*message, *loadedMsg, error) {
+	for attempt := 0; ; attempt++ {
+		path := mbox.f.msgPath(msg)
+		body, err := os.ReadFile(path)
+		if err == nil {
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, nil, err
+			}
+			return msg, &loadedMsg{body: normalizeCRLF(body), date: info.ModTime()}, nil
+		}
+		if !os.IsNotExist(err) || attempt != 0 {
+			return nil, nil, err
+		}
+
+		if err := mbox.f.sync(); err != nil {
+			return nil, nil, err
+		}
+		msg = mbox.f.byUID(msg.uid)
+		if msg == nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// msgSize returns the message size using the W= field in the file name if
+// possible.
+func msgSize(msg *message) (uint32, bool) {
+	for _, field := range strings.Split(msg.base, ",")[1:] {
+		if strings.HasPrefix(field, "W=") {
+			size, err := strconv.ParseUint(field[2:], 10, 32)
+			if err == nil {
+				return uint32(size), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func (mbox *Mailbox) msgFlags(msg *message) []string {
+	flags := msg.flags(mbox.f.keywords)
+	if mbox.handle.IsRecent(msg.uid) {
+		flags = append(flags, imap.RecentFlag)
+	}
+	return flags
+}
+
+func (mbox *Mailbox) fetch(msg *message, seq uint32, items []imap.FetchItem) (*imap.Message, error) {
+	fetched := imap.NewMessage(seq, items)
+
+	var loaded *loadedMsg
+	getLoaded := func() (*loadedMsg, error) {
+		if loaded != nil {
+			return loaded, nil
+		}
+		var err error
+		msg, loaded, err = mbox.load(msg)
+		return loaded, err
+	}
+
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			l, err := getLoaded()
+			if err != nil {
+				return nil, err
+			}
+			hdr, _, _ := l.headerAndBody()
+			fetched.Envelope, _ = backendutil.FetchEnvelope(hdr)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			l, err := getLoaded()
+			if err != nil {
+				return nil, err
+			}
+			hdr, body, _ := l.headerAndBody()
+			fetched.BodyStructure, _ = backendutil.FetchBodyStructure(hdr, body, item == imap.FetchBodyStructure)
+		case imap.FetchFlags:
+			fetched.Flags = mbox.msgFlags(msg)
+		case imap.FetchInternalDate:
+			if loaded != nil {
+				fetched.InternalDate = loaded.date
+				break
+			}
+			info, err := os.Stat(mbox.f.msgPath(msg))
+			if err != nil {
+				l, err := getLoaded()
+				if err != nil {
+					return nil, err
+				}
+				fetched.InternalDate = l.date
+				break
+			}
+			fetched.InternalDate = info.ModTime()
+		case imap.FetchRFC822Size:
+			if size, ok := msgSize(msg); ok {
+				fetched.Size = size
+				break
+			}
+			l, err := getLoaded()
+			if err != nil {
+				return nil, err
+			}
+			fetched.Size = uint32(len(l.body))
+		case imap.FetchUid:
+			fetched.Uid = msg.uid
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				break
+			}
+
+			l, err := getLoaded()
+			if err != nil {
+				return nil, err
+			}
+			hdr, body, err := l.headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			lit, _ := backendutil.FetchBodySection(hdr, body, section)
+			if lit != nil {
+				fetched.Body[section] = lit
+			} else {
+				fetched.Body[section] = bytes.NewReader(nil)
+			}
+		}
+	}
+
+	return fetched, nil
+}
+
+func (mbox *Mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+	defer mbox.handle.Sync(false)
+
+	setSeen := false
+	if !mbox.readOnly {
+		for _, item := range items {
+			section, err := imap.ParseBodySectionName(item)
+			if err == nil && !section.Peek {
+				setSeen = true
+			}
+		}
+	}
+
+	seqSet, err := mbox.handle.ResolveSeq(uid, seqSet)
+	if err != nil {
+		if uid {
+			return nil
+		}
+		return err
+	}
+
+	mbox.f.lock.Lock()
+	defer mbox.f.lock.Unlock()
+
+	if setSeen {
+		err := mbox.f.updateFlags(seqSet, func(cur []string) []string {
+			return backendutil.UpdateFlags(cur, imap.AddFlags, []string{imap.SeenFlag})
+		}, func(uid uint32, flags []string) {
+			mbox.handle.FlagsChanged(uid, flags, false)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, msg := range mbox.f.msgs {
+		if !seqSet.Contains(msg.uid) {
+			continue
+		}
+		seq, ok := mbox.handle.UidAsSeq(msg.uid)
+		if !ok {
+			continue
+		}
+
+		fetched, err := mbox.fetch(msg, seq, items)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Removed by another process.
+				continue
+			}
+			mbox.u.s.Log.Error("failed to fetch message", err, "key", mbox.f.key, "uid", msg.uid)
+			continue
+		}
+		ch <- fetched
+	}
+	return nil
+}
+
+// needsContents checks whether the message contents are needed to match the
+// criteria.
+func needsContents(c *imap.SearchCriteria) bool {
+	if c.Header != nil || c.Body != nil || c.Text != nil ||
+		c.Larger != 0 || c.Smaller != 0 ||
+		!c.SentBefore.IsZero() || !c.SentSince.IsZero() {
+		return true
+	}
+	for _, not := range c.Not {
+		if needsContents(not) {
+			return true
+		}
+	}
+	for _, or := range c.Or {
+		if needsContents(or[0]) || needsContents(or[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (mbox *Mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	mbox.handle.ResolveCriteria(criteria)
+	defer mbox.handle.Sync(uid)
+
+	mbox.f.lock.Lock()
+	defer mbox.f.lock.Unlock()
+
+	loadContents := needsContents(criteria)
+
+	var ids []uint32
+	for _, msg := range mbox.f.msgs {
+		seq, ok := mbox.handle.UidAsSeq(msg.uid)
+		if !ok {
+			continue
+		}
+
+		var (
+			ent  *gomessage.Entity
+			date time.Time
+		)
+		if loadContents {
+			var (
+				l   *loadedMsg
+				err error
+			)
+			msg, l, err = mbox.load(msg)
+			if err != nil {
+				continue
+			}
+			ent, err = gomessage.Read(bytes.NewReader(l.body))
+			if err != nil && !gomessage.IsUnknownCharset(err) && !gomessage.IsUnknownEncoding(err) {
+				continue
+			}
+			date = l.date
+		} else {
+			ent, _ = gomessage.New(gomessage.Header{}, bytes.NewReader(nil))
+			if info, err := os.Stat(mbox.f.msgPath(msg)); err == nil {
+				date = info.ModTime()
+			}
+		}
+
+		ok, err := backendutil.Match(ent, seq, msg.uid, date, mbox.msgFlags(msg), criteria)
+		if err != nil || !ok {
+			continue
+		}
+		if uid {
+			ids = append(ids, msg.uid)
+		} else {
+			ids = append(ids, seq)
+		}
+	}
+	return ids, nil
+}
+
+func (mbox *Mailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op imap.FlagsOp, silent bool, flags []string) error {
+	newFlags := make([]string, 0, len(flags))
+	for _, flag := range flags {
+		if flag != imap.RecentFlag {
+			newFlags = append(newFlags, flag)
+		}
+	}
+
+	defer mbox.handle.Sync(uid)
+
+	seqSet, err := mbox.handle.ResolveSeq(uid, seqSet)
+	if err != nil {
+		if uid {
+			return nil
+		}
+		return err
+	}
+
+	mbox.f.lock.Lock()
+	defer mbox.f.lock.Unlock()
+	return mbox.f.updateFlags(seqSet, func(cur []string) []string {
+		return backendutil.UpdateFlags(cur, op, newFlags)
+	}, func(uid uint32, flags []string) {
+		mbox.handle.FlagsChanged(uid, flags, silent)
+	})
+}
+
+func (mbox *Mailbox) copyMessages(uid bool, seqSet *imap.SeqSet, destName string, move bool) error {
+	dest, err := mbox.u.folder(destName)
+	if err != nil {
+		return err
+	}
+
+	seqSet, err = mbox.handle.ResolveSeq(uid, seqSet)
+	if err != nil {
+		if uid {
+			return nil
+		}
+		return err
+	}
+
+	unlock := lockFolders(mbox.f, dest)
+	defer unlock()
+	return copyMessages(mbox.f, dest, seqSet, move)
+}
+
+func (mbox *Mailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, destName string) error {
+	defer mbox.handle.Sync(true)
+	return mbox.copyMessages(uid, seqSet, destName, false)
+}
+
+func (mbox *Mailbox) MoveMessages(uid bool, seqSet *imap.SeqSet, destName string) error {
+	defer mbox.handle.Sync(true)
+	return mbox.copyMessages(uid, seqSet, destName, true)
+}
+
+func (mbox *Mailbox) Expunge() error {
+	defer mbox.handle.Sync(true)
+
+	mbox.f.lock.Lock()
+	defer mbox.f.lock.Unlock()
+	return mbox.f.remove(nil, true)
+}
+
+// DelMessages removes messages regardless of the \Deleted flag.
+func (mbox *Mailbox) DelMessages(uid bool, seqSet *imap.SeqSet) error {
+	seqSet, err := mbox.handle.ResolveSeq(uid, seqSet)
+	if err != nil {
+		if uid {
+			return nil
+		}
+		return err
+	}
+
+	mbox.f.lock.Lock()
+	defer mbox.f.lock.Unlock()
+	return mbox.f.remove(seqSet, false)
+}
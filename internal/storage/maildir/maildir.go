@@ -0,0 +1,587 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package maildir implements storage module that keeps messages in
+// Maildir++ directories using Dovecot-compatible dovecot-uidlist and
+// dovecot-keywords files.
+//
+// Interfaces implemented:
+// - module.ManageableStorage
+// - module.DeliveryTarget
+// - updatepipe.Backend
+package maildir
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/utf7"
+	mess "github.com/foxcpp/go-imap-mess"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/authz"
+	"github.com/foxcpp/maddy/internal/updatepipe"
+)
+
+const (
+	modName = "storage.maildir"
+
+	// Delimiter is the hierarchy delimiter used by Maildir++.
+	Delimiter = "."
+)
+
+type Storage struct {
+	instName string
+	Log      log.Logger
+
+	root        string
+	junkMbox    string
+	appendLimit *uint32
+
+	mngr *mess.Manager
+
+	foldersLock sync.Mutex
+	folders     map[string]*folder
+
+	updPipe      updatepipe.P
+	updPushStop  chan struct{}
+	outboundUpds chan mess.Update
+
+	filters module.IMAPFilter
+
+	deliveryMap       module.Table
+	deliveryNormalize func(context.Context, string) (string, error)
+	authMap           module.Table
+	authNormalize     func(context.Context, string) (string, error)
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	store := &Storage{
+		instName: instName,
+		Log:      log.Logger{Name: modName},
+		mngr:     mess.NewManager(),
+		folders:  map[string]*folder{},
+	}
+	switch len(inlineArgs) {
+	case 0:
+	case 1:
+		store.root = inlineArgs[0]
+	default:
+		return nil, fmt.Errorf("%s: expected at most 1 argument", modName)
+	}
+	return store, nil
+}
+
+func (store *Storage) Name() string {
+	return modName
+}
+
+func (store *Storage) InstanceName() string {
+	return store.instName
+}
+
+func (store *Storage) Init(cfg *config.Map) error {
+	var (
+		root              string
+		appendlimitVal    = -1
+		authNormalize     string
+		deliveryNormalize string
+	)
+
+	defaultRoot := store.root
+	if defaultRoot == "" {
+		defaultRoot = filepath.Join(config.StateDirectory, "maildir")
+	}
+	cfg.String("root", false, false, defaultRoot, &root)
+	cfg.DataSize("appendlimit", false, false, 32*1024*1024, &appendlimitVal)
+	cfg.Bool("debug", true, false, &store.Log.Debug)
+	cfg.String("junk_mailbox", false, false, "Junk", &store.junkMbox)
+	cfg.Custom("imap_filter", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, func(m *config.Map, node config.Node) (interface{}, error) {
+		var filter module.IMAPFilter
+		err := modconfig.GroupFromNode("imap_filters", node.Args, node, m.Globals, &filter)
+		return filter, err
+	}, &store.filters)
+	cfg.Custom("auth_map", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, modconfig.TableDirective, &store.authMap)
+	cfg.String("auth_normalize", false, false, "precis_casefold_email", &authNormalize)
+	cfg.Custom("delivery_map", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, modconfig.TableDirective, &store.deliveryMap)
+	cfg.String("delivery_normalize", false, false, "precis_casefold_email", &deliveryNormalize)
+
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	deliveryNormFunc, ok := authz.NormalizeFuncs[deliveryNormalize]
+	if !ok {
+		return fmt.Errorf("%s: unknown normalization function: %s", modName, deliveryNormalize)
+	}
+	store.deliveryNormalize = func(ctx context.Context, s string) (string, error) {
+		return deliveryNormFunc(s)
+	}
+	if store.deliveryMap != nil {
+		store.deliveryNormalize = func(ctx context.Context, email string) (string, error) {
+			email, err := deliveryNormFunc(email)
+			if err != nil {
+				return "", err
+			}
+			mapped, ok, err := store.deliveryMap.Lookup(ctx, email)
+			if err != nil || !ok {
+				return "", userDoesNotExist(err)
+			}
+			return mapped, nil
+		}
+	}
+
+	authNormFunc, ok := authz.NormalizeFuncs[authNormalize]
+	if !ok {
+		return fmt.Errorf("%s: unknown normalization function: %s", modName, authNormalize)
+	}
+	store.authNormalize = func(ctx context.Context, s string) (string, error) {
+		return authNormFunc(s)
+	}
+	if store.authMap != nil {
+		store.authNormalize = func(ctx context.Context, username string) (string, error) {
+			username, err := authNormFunc(username)
+			if err != nil {
+				return "", err
+			}
+			mapped, ok, err := store.authMap.Lookup(ctx, username)
+			if err != nil || !ok {
+				return "", userDoesNotExist(err)
+			}
+			return mapped, nil
+		}
+	}
+
+	if appendlimitVal != -1 {
+		// int is 32-bit on some platforms, so cut off values we can't actually
+		// use.
+		if int(uint32(appendlimitVal)) != appendlimitVal {
+			return fmt.Errorf("%s: appendlimit value is too big", modName)
+		}
+		store.appendLimit = new(uint32)
+		*store.appendLimit = uint32(appendlimitVal)
+	}
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	store.root = root
+
+	return nil
+}
+
+func (store *Storage) EnableUpdatePipe(mode updatepipe.BackendMode) error {
+	if store.updPipe != nil {
+		return nil
+	}
+
+	rootID := sha1.Sum([]byte(store.root))
+	sockPath := filepath.Join(
+		config.RuntimeDirectory,
+		fmt.Sprintf("maildir-%s.sock", hex.EncodeToString(rootID[:])))
+	store.Log.DebugMsg("using unix socket for external updates", "path", sockPath)
+	store.updPipe = &updatepipe.UnixSockPipe{
+		SockPath: sockPath,
+		Log:      log.Logger{Name: modName + "/updpipe", Debug: store.Log.Debug},
+	}
+
+	inbound := make(chan mess.Update, 32)
+	outbound := make(chan mess.Update, 10)
+	store.outboundUpds = outbound
+
+	if mode == updatepipe.ModeReplicate {
+		if err := store.updPipe.Listen(inbound); err != nil {
+			store.updPipe = nil
+			return err
+		}
+	}
+
+	if err := store.updPipe.InitPush(); err != nil {
+		store.updPipe = nil
+		return err
+	}
+
+	store.updPushStop = make(chan struct{}, 1)
+	go func() {
+		defer func() {
+			// Ensure we sent all outbound updates.
+			for upd := range outbound {
+				if err := store.updPipe.Push(upd); err != nil {
+					store.Log.Error("IMAP update pipe push failed", err)
+				}
+			}
+			store.updPushStop <- struct{}{}
+
+			if err := recover(); err != nil {
+				stack := debug.Stack()
+				log.Printf("panic during maildir update push: %v\n%s", err, stack)
+			}
+		}()
+
+		for {
+			select {
+			case u := <-inbound:
+				store.Log.DebugMsg("external update received", "type", u.Type, "key", u.Key)
+				// Rescan can block on the folder lock held by a goroutine
+				// waiting to push an update.
+				go store.externalUpdate(u)
+			case u, ok := <-outbound:
+				if !ok {
+					return
+				}
+				store.Log.DebugMsg("sending external update", "type", u.Type, "key", u.Key)
+				if err := store.updPipe.Push(u); err != nil {
+					store.Log.Error("IMAP update pipe push failed", err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// externalUpdate handles the update received from another process.
+//
+// Updates are used only as a hint that the folder was changed, the
+// actual changes are found by rescanning it.
+func (store *Storage) externalUpdate(u mess.Update) {
+	key, ok := u.Key.(string)
+	if !ok {
+		return
+	}
+
+	if u.Type == mess.UpdMboxDestroyed {
+		store.forgetFolder(key)
+		store.mngr.ExternalUpdate(u)
+		return
+	}
+
+	store.foldersLock.Lock()
+	f := store.folders[key]
+	store.foldersLock.Unlock()
+	if f == nil {
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if !f.loaded {
+		return
+	}
+	if err := f.sync(); err != nil {
+		store.Log.Error("folder rescan failed", err, "key", key)
+	}
+}
+
+// folderChanged notifies other processes about changes in the folder.
+func (store *Storage) folderChanged(key string) {
+	if store.outboundUpds == nil {
+		return
+	}
+	store.outboundUpds <- mess.Update{Type: mess.UpdNewMessage, Key: key}
+}
+
+func (store *Storage) folderDestroyed(key string) {
+	store.forgetFolder(key)
+	store.mngr.MailboxDestroyed(key)
+	if store.outboundUpds != nil {
+		store.outboundUpds <- mess.Update{Type: mess.UpdMboxDestroyed, Key: key}
+	}
+}
+
+// folder returns the folder object for the key. Same object is returned
+// for all calls so it can be used to serialize access to the folder.
+func (store *Storage) folder(key string) *folder {
+	store.foldersLock.Lock()
+	defer store.foldersLock.Unlock()
+
+	f := store.folders[key]
+	if f == nil {
+		f = &folder{
+			s:    store,
+			key:  key,
+			path: filepath.Join(store.root, filepath.FromSlash(key)),
+		}
+		store.folders[key] = f
+	}
+	return f
+}
+
+func (store *Storage) forgetFolder(key string) {
+	store.foldersLock.Lock()
+	defer store.foldersLock.Unlock()
+	delete(store.folders, key)
+}
+
+// lockFolders locks both folders in a consistent order.
+func lockFolders(a, b *folder) (unlock func()) {
+	if a == b {
+		a.lock.Lock()
+		return a.lock.Unlock
+	}
+	if b.key < a.key {
+		a, b = b, a
+	}
+	a.lock.Lock()
+	b.lock.Lock()
+	return func() {
+		b.lock.Unlock()
+		a.lock.Unlock()
+	}
+}
+
+// accountDir converts the account name into the directory name. Names that
+// cannot be safely used as a file name are rejected.
+func accountDir(accountName string) (string, error) {
+	if accountName == "" || accountName == "." || accountName == ".." ||
+		strings.ContainsAny(accountName, "/\\\x00") {
+		return "", fmt.Errorf("%s: invalid account name: %q", modName, accountName)
+	}
+	return accountName, nil
+}
+
+// folderName converts the IMAP mailbox name into the Maildir++ folder name
+// (without leading dot).
+func folderName(mbox string) (string, error) {
+	if strings.ContainsAny(mbox, "/\\\x00") {
+		return "", fmt.Errorf("%s: invalid mailbox name: %q", modName, mbox)
+	}
+	for _, part := range strings.Split(mbox, Delimiter) {
+		if part == "" {
+			return "", fmt.Errorf("%s: invalid mailbox name: %q", modName, mbox)
+		}
+	}
+	return utf7.Encoding.NewEncoder().String(mbox)
+}
+
+// mailboxName converts the Maildir++ folder name (without leading dot) into
+// the IMAP mailbox name.
+func mailboxName(dir string) (string, error) {
+	return utf7.Encoding.NewDecoder().String(dir)
+}
+
+func (store *Storage) I18NLevel() int {
+	return 0
+}
+
+func (store *Storage) IMAPExtensions() []string {
+	return []string{"APPENDLIMIT", "MOVE", "CHILDREN", "SPECIAL-USE"}
+}
+
+func (store *Storage) CreateMessageLimit() *uint32 {
+	return store.appendLimit
+}
+
+func (store *Storage) accountPath(accountName string) (string, error) {
+	dir, err := accountDir(accountName)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(store.root, dir), nil
+}
+
+func (store *Storage) getUser(accountName string, create bool) (*User, error) {
+	path, err := store.accountPath(accountName)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(filepath.Join(path, "cur")); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		if !create {
+			return nil, ErrUserDoesntExists
+		}
+		if err := createMaildir(path); err != nil {
+			return nil, err
+		}
+	}
+
+	return &User{
+		s:        store,
+		username: accountName,
+		dir:      filepath.Base(path),
+		path:     path,
+	}, nil
+}
+
+var ErrUserDoesntExists = errors.New("maildir: user does not exist")
+
+func (store *Storage) GetOrCreateIMAPAcct(username string) (backend.User, error) {
+	accountName, err := store.authNormalize(context.TODO(), username)
+	if err != nil {
+		return nil, backend.ErrInvalidCredentials
+	}
+
+	return store.getUser(accountName, true)
+}
+
+func (store *Storage) GetIMAPAcct(accountName string) (backend.User, error) {
+	return store.getUser(accountName, false)
+}
+
+// OpenDir opens the Maildir++ directory at path as an account without a
+// configured storage instance. If create is true, the directory is created
+// if it does not exist.
+//
+// It is used to read and write Maildir archives of accounts stored using
+// other storage modules.
+func OpenDir(path string, create bool) (backend.User, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(filepath.Join(path, "cur")); err != nil {
+		if !os.IsNotExist(err) || !create {
+			return nil, err
+		}
+		if err := createMaildir(path); err != nil {
+			return nil, err
+		}
+	}
+
+	store := &Storage{
+		Log:      log.Logger{Name: modName},
+		root:     filepath.Dir(path),
+		junkMbox: "Junk",
+		mngr:     mess.NewManager(),
+		folders:  map[string]*folder{},
+	}
+	return &User{
+		s:        store,
+		username: filepath.Base(path),
+		dir:      filepath.Base(path),
+		path:     path,
+	}, nil
+}
+
+func (store *Storage) ListIMAPAccts() ([]string, error) {
+	ents, err := os.ReadDir(store.root)
+	if err != nil {
+		return nil, err
+	}
+
+	accts := make([]string, 0, len(ents))
+	for _, ent := range ents {
+		if !ent.IsDir() || strings.HasPrefix(ent.Name(), ".") {
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(store.root, ent.Name(), "cur")); err != nil || !info.IsDir() {
+			continue
+		}
+		accts = append(accts, ent.Name())
+	}
+	sort.Strings(accts)
+	return accts, nil
+}
+
+func (store *Storage) CreateIMAPAcct(accountName string) error {
+	path, err := store.accountPath(accountName)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s: account already exists", modName)
+	}
+	return createMaildir(path)
+}
+
+func (store *Storage) DeleteIMAPAcct(accountName string) error {
+	u, err := store.getUser(accountName, false)
+	if err != nil {
+		return err
+	}
+
+	mboxes, err := u.ListMailboxes(false)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(u.path); err != nil {
+		return err
+	}
+	for _, mbox := range mboxes {
+		store.folderDestroyed(u.folderKey(mbox.Name))
+	}
+	return nil
+}
+
+func (store *Storage) Lookup(ctx context.Context, key string) (string, bool, error) {
+	accountName, err := store.authNormalize(ctx, key)
+	if err != nil {
+		return "", false, nil
+	}
+
+	if _, err := store.getUser(accountName, false); err != nil {
+		if errors.Is(err, ErrUserDoesntExists) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return "", true, nil
+}
+
+func (store *Storage) Close() error {
+	// Wait for 'updates replicate' goroutine to actually stop so we will send
+	// all updates before shuting down (this is especially important for
+	// maddyctl).
+	if store.updPipe != nil {
+		close(store.outboundUpds)
+		<-store.updPushStop
+
+		store.updPipe.Close()
+	}
+
+	return nil
+}
+
+func (store *Storage) Login(_ *imap.ConnInfo, username, password string) (backend.User, error) {
+	panic("This method should not be called and is added only to satisfy backend.Backend interface")
+}
+
+func init() {
+	var _ module.ManageableStorage = &Storage{}
+	var _ module.DeliveryTarget = &Storage{}
+	var _ updatepipe.Backend = &Storage{}
+	module.Register(modName, New)
+	module.Register("target.maildir", New)
+}
@@ -0,0 +1,372 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package maildir
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	backendtests "github.com/foxcpp/go-imap-backend-tests"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type testBack struct {
+	*Storage
+}
+
+// dateShift is added to internal dates used by go-imap-backend-tests. The
+// tests use dates in year 1 that cannot be stored as the file modification
+// time.
+const dateShift = 1970
+
+func shiftDate(date time.Time) time.Time {
+	if date.IsZero() || date.Year() >= 1970 {
+		return date
+	}
+	return date.AddDate(dateShift, 0, 0)
+}
+
+func unshiftDate(date time.Time) time.Time {
+	if date.Year() >= 2000 {
+		return date
+	}
+	return date.AddDate(-dateShift, 0, 0).UTC()
+}
+
+func shiftCriteria(c *imap.SearchCriteria) {
+	c.Since = shiftDate(c.Since)
+	c.Before = shiftDate(c.Before)
+	for _, not := range c.Not {
+		shiftCriteria(not)
+	}
+	for _, or := range c.Or {
+		shiftCriteria(or[0])
+		shiftCriteria(or[1])
+	}
+}
+
+func (tb testBack) GetUser(username string) (backend.User, error) {
+	u, err := tb.GetIMAPAcct(username)
+	if err != nil {
+		return nil, err
+	}
+	return testUser{User: u}, nil
+}
+
+func (tb testBack) CreateUser(username string) error {
+	return tb.CreateIMAPAcct(username)
+}
+
+type testUser struct {
+	backend.User
+}
+
+func (u testUser) CreateMessage(mbox string, flags []string, date time.Time, body imap.Literal, selected backend.Mailbox) error {
+	return u.User.CreateMessage(mbox, flags, shiftDate(date), body, selected)
+}
+
+func (u testUser) GetMailbox(name string, readOnly bool, conn backend.Conn) (*imap.MailboxStatus, backend.Mailbox, error) {
+	status, mbox, err := u.User.GetMailbox(name, readOnly, conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	return status, testMailbox{Mailbox: mbox.(*Mailbox)}, nil
+}
+
+type testMailbox struct {
+	*Mailbox
+}
+
+func (mbox testMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	inner := make(chan *imap.Message)
+	done := make(chan struct{})
+	go func() {
+		for msg := range inner {
+			msg.InternalDate = unshiftDate(msg.InternalDate)
+			ch <- msg
+		}
+		close(ch)
+		close(done)
+	}()
+	err := mbox.Mailbox.ListMessages(uid, seqSet, items, inner)
+	<-done
+	return err
+}
+
+func (mbox testMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	shiftCriteria(criteria)
+	return mbox.Mailbox.SearchMessages(uid, criteria)
+}
+
+func newTestStorage(t *testing.T, root string) *Storage {
+	mod, err := New(modName, "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mod.Init(config.NewMap(map[string]interface{}{}, config.Node{
+		Children: []config.Node{
+			{
+				Name: "root",
+				Args: []string{root},
+			},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := mod.(*Storage)
+	store.Log = testutils.Logger(t, modName)
+	return store
+}
+
+func TestBackend(t *testing.T) {
+	backendtests.RunTests(t, func() backendtests.Backend {
+		return testBack{Storage: newTestStorage(t, testutils.Dir(t))}
+	}, func(b backendtests.Backend) {
+		os.RemoveAll(b.(testBack).root)
+	})
+}
+
+func writeFile(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDovecotCompat(t *testing.T) {
+	root := testutils.Dir(t)
+	acct := filepath.Join(root, "user")
+	for _, dir := range []string{"tmp", ".Work/cur", ".Work/new", ".Work/tmp"} {
+		if err := os.MkdirAll(filepath.Join(acct, dir), 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, filepath.Join(acct, "cur", "1.M1P1.host,S=20:2,Sa"), "Subject: one\n\nbody\n")
+	writeFile(t, filepath.Join(acct, "cur", "2.M1P1.host,S=20:2,FT"), "Subject: two\n\nbody\n")
+	writeFile(t, filepath.Join(acct, "new", "3.M1P1.host,S=22"), "Subject: three\n\nbody\n")
+	writeFile(t, filepath.Join(acct, "dovecot-uidlist"), "3 V1234 N10 Gabcdef\n"+
+		"5 :1.M1P1.host,S=20\n"+
+		"7 W21 :2.M1P1.host,S=20\n")
+	writeFile(t, filepath.Join(acct, "dovecot-keywords"), "0 $Important\n")
+	writeFile(t, filepath.Join(acct, "subscriptions"), "V\t2\n\nWork\n")
+
+	store := newTestStorage(t, root)
+
+	accts, err := store.ListIMAPAccts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(accts, []string{"user"}) {
+		t.Fatal("Wrong accounts list:", accts)
+	}
+
+	u, err := store.GetIMAPAcct("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subs, err := u.ListMailboxes(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 1 || subs[0].Name != "Work" {
+		t.Fatal("Wrong subscriptions:", subs)
+	}
+
+	status, mbox, err := u.GetMailbox(imap.InboxName, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.UidValidity != 1234 {
+		t.Error("Wrong UIDVALIDITY:", status.UidValidity)
+	}
+	if status.Messages != 3 {
+		t.Error("Wrong message count:", status.Messages)
+	}
+
+	ch := make(chan *imap.Message, 10)
+	seq, _ := imap.ParseSeqSet("1:*")
+	if err := mbox.ListMessages(true, seq, []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchRFC822Size}, ch); err != nil {
+		t.Fatal(err)
+	}
+	var msgs []*imap.Message
+	for msg := range ch {
+		sort.Strings(msg.Flags)
+		msgs = append(msgs, msg)
+	}
+	if len(msgs) != 3 {
+		t.Fatal("Wrong amount of messages fetched:", len(msgs))
+	}
+	if msgs[0].Uid != 5 || !reflect.DeepEqual(msgs[0].Flags, []string{"$Important", imap.SeenFlag}) {
+		t.Error("Wrong first message:", msgs[0].Uid, msgs[0].Flags)
+	}
+	if msgs[1].Uid != 7 || !reflect.DeepEqual(msgs[1].Flags, []string{imap.DeletedFlag, imap.FlaggedFlag}) {
+		t.Error("Wrong second message:", msgs[1].Uid, msgs[1].Flags)
+	}
+	if msgs[2].Uid != 10 {
+		t.Error("New message got wrong UID:", msgs[2].Uid)
+	}
+	// Bare LF should be converted to CRLF.
+	if msgs[2].Size != 24 {
+		t.Error("Wrong size of the new message:", msgs[2].Size)
+	}
+
+	if err := mbox.UpdateMessagesFlags(true, seq, imap.AddFlags, true, []string{"custom"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal(err)
+	}
+
+	uidlist, err := os.ReadFile(filepath.Join(acct, "dovecot-uidlist"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(uidlist)), "\n")
+	if lines[0] != "3 V1234 N11 Gabcdef" {
+		t.Error("Wrong uidlist header:", lines[0])
+	}
+	if !reflect.DeepEqual(lines[1:], []string{"5 :1.M1P1.host,S=20", "10 :3.M1P1.host,S=22"}) {
+		t.Error("Wrong uidlist entries:", lines[1:])
+	}
+
+	keywords, err := os.ReadFile(filepath.Join(acct, "dovecot-keywords"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(keywords) != "0 $Important\n1 custom\n" {
+		t.Errorf("Wrong keywords file: %q", keywords)
+	}
+	if _, err := os.Stat(filepath.Join(acct, "cur", "1.M1P1.host,S=20:2,Sab")); err != nil {
+		t.Error("Flags are not stored in the file name:", err)
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	store := newTestStorage(t, testutils.Dir(t))
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	hdr, body := testutils.BodyFromStr(t, "Subject: hello\r\n\r\nbody\r\n")
+	for _, quarantine := range []bool{false, true} {
+		delivery, err := store.Start(context.Background(), &module.MsgMetadata{
+			ID:         "test",
+			Quarantine: quarantine,
+		}, "sender@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := delivery.AddRcpt(context.Background(), "test@example.org"); err != nil {
+			t.Fatal(err)
+		}
+		if err := delivery.AddRcpt(context.Background(), "nobody@example.org"); err == nil {
+			t.Fatal("Expected an error for non-existent recipient")
+		}
+		if err := delivery.Body(context.Background(), hdr, body); err != nil {
+			t.Fatal(err)
+		}
+		if err := delivery.Commit(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, dir := range []string{"new", ".Junk/new"} {
+		ents, err := os.ReadDir(filepath.Join(store.root, "test@example.org", dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ents) != 1 {
+			t.Fatalf("Expected one message in %s, got %d", dir, len(ents))
+		}
+		contents, err := os.ReadFile(filepath.Join(store.root, "test@example.org", dir, ents[0].Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(contents), "Delivered-To: test@example.org\r\n") ||
+			!strings.Contains(string(contents), "Return-Path: <sender@example.org>\r\n") {
+			t.Errorf("Missing headers in %s:\n%s", dir, contents)
+		}
+	}
+
+	tmp, err := os.ReadDir(filepath.Join(store.root, "test@example.org", "tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tmp) != 0 {
+		t.Error("Temporary files left in tmp/")
+	}
+}
+
+func TestDelivery_CommitRollback(t *testing.T) {
+	store := newTestStorage(t, testutils.Dir(t))
+	for _, acct := range []string{"a@example.org", "b@example.org"} {
+		if err := store.CreateIMAPAcct(acct); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hdr, body := testutils.BodyFromStr(t, "Subject: hello\r\n\r\nbody\r\n")
+	d, err := store.Start(context.Background(), &module.MsgMetadata{ID: "test"}, "sender@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range []string{"a@example.org", "b@example.org"} {
+		if err := d.AddRcpt(context.Background(), rcpt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Body(context.Background(), hdr, body); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make the commit fail for one of the recipients.
+	if err := os.Remove(d.(*delivery).addedRcpts["b@example.org"].tmpPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Commit(context.Background()); err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	for _, acct := range []string{"a@example.org", "b@example.org"} {
+		for _, dir := range []string{"new", "cur", "tmp"} {
+			ents, err := os.ReadDir(filepath.Join(store.root, acct, dir))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ents) != 0 {
+				t.Errorf("Expected no files in %s/%s, got %d", acct, dir, len(ents))
+			}
+		}
+	}
+}
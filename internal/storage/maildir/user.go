@@ -0,0 +1,527 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package maildir
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+const subscriptionsName = "subscriptions"
+
+// specialUse contains SPECIAL-USE attributes assigned to mailboxes based on
+// their names.
+var specialUse = map[string]string{
+	"Archive": imap.ArchiveAttr,
+	"Drafts":  imap.DraftsAttr,
+	"Junk":    imap.JunkAttr,
+	"Sent":    imap.SentAttr,
+	"Trash":   imap.TrashAttr,
+}
+
+// User is a single account stored in the Maildir++ directory. INBOX is the
+// directory itself and other mailboxes are subdirectories with names
+// starting with a dot.
+type User struct {
+	s        *Storage
+	username string
+	dir      string
+	path     string
+}
+
+func (u *User) Username() string {
+	return u.username
+}
+
+func (u *User) CreateMessageLimit() *uint32 {
+	return u.s.appendLimit
+}
+
+// folderKey returns the key used to identify the folder for the mailbox in
+// Storage.
+func (u *User) folderKey(mbox string) string {
+	if strings.EqualFold(mbox, imap.InboxName) {
+		return u.dir
+	}
+	name, err := folderName(mbox)
+	if err != nil {
+		// Such folder cannot be created anyway.
+		return u.dir + "/.\x00" + mbox
+	}
+	return u.dir + "/." + name
+}
+
+// folder returns the folder for the mailbox. backend.ErrNoSuchMailbox is
+// returned if it does not exist.
+func (u *User) folder(mbox string) (*folder, error) {
+	if _, err := folderName(mbox); err != nil {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	f := u.s.folder(u.folderKey(mbox))
+	if !f.exists() {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	return f, nil
+}
+
+func (u *User) mailboxNames() ([]string, error) {
+	ents, err := os.ReadDir(u.path)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{imap.InboxName}
+	for _, ent := range ents {
+		name := ent.Name()
+		if !ent.IsDir() || !strings.HasPrefix(name, ".") || name == "." || name == ".." {
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(u.path, name, "cur")); err != nil || !info.IsDir() {
+			continue
+		}
+		mbox, err := mailboxName(name[1:])
+		if err != nil {
+			u.s.Log.Error("malformed folder name", err, "username", u.username, "folder", name)
+			continue
+		}
+		names = append(names, mbox)
+	}
+	sort.Strings(names[1:])
+	return names, nil
+}
+
+func (u *User) mailboxInfo(name string, all []string) imap.MailboxInfo {
+	info := imap.MailboxInfo{
+		Delimiter: Delimiter,
+		Name:      name,
+	}
+
+	hasChildren := false
+	for _, other := range all {
+		if strings.HasPrefix(other, name+Delimiter) {
+			hasChildren = true
+			break
+		}
+	}
+	if hasChildren {
+		info.Attributes = append(info.Attributes, imap.HasChildrenAttr)
+	} else {
+		info.Attributes = append(info.Attributes, imap.HasNoChildrenAttr)
+	}
+
+	if attr, ok := specialUse[name]; ok {
+		info.Attributes = append(info.Attributes, attr)
+	} else if name == u.s.junkMbox {
+		info.Attributes = append(info.Attributes, imap.JunkAttr)
+	}
+	return info
+}
+
+func (u *User) ListMailboxes(subscribed bool) ([]imap.MailboxInfo, error) {
+	names, err := u.mailboxNames()
+	if err != nil {
+		return nil, err
+	}
+
+	var subs map[string]struct{}
+	if subscribed {
+		subs, err = u.readSubscriptions()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	infos := make([]imap.MailboxInfo, 0, len(names))
+	for _, name := range names {
+		if subscribed {
+			if _, ok := subs[name]; !ok {
+				continue
+			}
+		}
+		infos = append(infos, u.mailboxInfo(name, names))
+	}
+	return infos, nil
+}
+
+// readSubscriptions reads the Dovecot subscriptions file. Both the version
+// 2 format (hierarchy separated using tabs) and the older one (one mailbox
+// name per line) are supported.
+func (u *User) readSubscriptions() (map[string]struct{}, error) {
+	data, err := os.ReadFile(filepath.Join(u.path, subscriptionsName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]struct{}{}, nil
+		}
+		return nil, err
+	}
+
+	lines := strings.Split(string(data), "\n")
+	v2 := len(lines) != 0 && lines[0] == "V\t2"
+	if v2 {
+		lines = lines[1:]
+	}
+
+	subs := make(map[string]struct{}, len(lines))
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		if v2 {
+			line = strings.ReplaceAll(line, "\t", Delimiter)
+		}
+		subs[line] = struct{}{}
+	}
+	return subs, nil
+}
+
+func (u *User) writeSubscriptions(subs map[string]struct{}) error {
+	names := make([]string, 0, len(subs))
+	for name := range subs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString("V\t2\n\n")
+	for _, name := range names {
+		sb.WriteString(strings.ReplaceAll(name, Delimiter, "\t"))
+		sb.WriteString("\n")
+	}
+
+	tmpPath := filepath.Join(u.path, subscriptionsName+".tmp")
+	if err := os.WriteFile(tmpPath, []byte(sb.String()), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(u.path, subscriptionsName))
+}
+
+func (u *User) SetSubscribed(name string, subscribed bool) error {
+	if _, err := u.folder(name); err != nil {
+		return err
+	}
+
+	subs, err := u.readSubscriptions()
+	if err != nil {
+		return err
+	}
+	if subscribed {
+		subs[name] = struct{}{}
+	} else {
+		delete(subs, name)
+	}
+	return u.writeSubscriptions(subs)
+}
+
+func (u *User) flags(f *folder) []string {
+	flags := []string{imap.SeenFlag, imap.AnsweredFlag, imap.FlaggedFlag, imap.DeletedFlag, imap.DraftFlag}
+	for _, kw := range f.keywords {
+		if kw != "" {
+			flags = append(flags, kw)
+		}
+	}
+	return flags
+}
+
+// status builds the mailbox status. Folder lock should be held.
+func (u *User) status(name string, f *folder, items []imap.StatusItem) *imap.MailboxStatus {
+	status := imap.NewMailboxStatus(name, items)
+	status.Flags = u.flags(f)
+	status.PermanentFlags = append([]string{"\\*"}, status.Flags...)
+
+	for i, msg := range f.msgs {
+		if !msg.hasFlag('S') {
+			status.UnseenSeqNum = uint32(i + 1)
+			break
+		}
+	}
+
+	for _, item := range items {
+		switch item {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(f.msgs))
+		case imap.StatusUidNext:
+			status.UidNext = f.uidNext
+		case imap.StatusUidValidity:
+			status.UidValidity = f.uidValidity
+		case imap.StatusRecent:
+			status.Recent = 0
+			for _, msg := range f.msgs {
+				if msg.dir == "new" {
+					status.Recent++
+				}
+			}
+		case imap.StatusUnseen:
+			status.Unseen = 0
+			for _, msg := range f.msgs {
+				if !msg.hasFlag('S') {
+					status.Unseen++
+				}
+			}
+		}
+	}
+	return status
+}
+
+func (u *User) Status(name string, items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	f, err := u.folder(name)
+	if err != nil {
+		return nil, err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.sync(); err != nil {
+		return nil, err
+	}
+	return u.status(name, f, items), nil
+}
+
+func (u *User) GetMailbox(name string, readOnly bool, conn backend.Conn) (*imap.MailboxStatus, backend.Mailbox, error) {
+	f, err := u.folder(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if strings.EqualFold(name, imap.InboxName) {
+		name = imap.InboxName
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	// Messages in new/ are considered \Recent. The first session that selects
+	// the mailbox moves them to cur/.
+	var (
+		recent *imap.SeqSet
+		status *imap.MailboxStatus
+	)
+	err = f.update(func() (map[uint32]struct{}, error) {
+		status = u.status(name, f, []imap.StatusItem{
+			imap.StatusMessages, imap.StatusRecent, imap.StatusUnseen,
+			imap.StatusUidNext, imap.StatusUidValidity,
+		})
+		if readOnly || conn == nil {
+			recent = &imap.SeqSet{}
+			return nil, nil
+		}
+		var err error
+		recent, err = f.takeRecent()
+		return nil, err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mbox := &Mailbox{
+		u:        u,
+		f:        f,
+		name:     name,
+		readOnly: readOnly,
+		conn:     conn,
+	}
+	if conn == nil {
+		mbox.handle = u.s.mngr.ManagementHandle(f.key, f.uids(), recent)
+	} else {
+		mbox.handle, err = u.s.mngr.Mailbox(f.key, mbox, f.uids(), recent)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return status, mbox, nil
+}
+
+func (u *User) CreateMessage(mboxName string, flags []string, date time.Time, body imap.Literal, _ backend.Mailbox) error {
+	f, err := u.folder(mboxName)
+	if err != nil {
+		return err
+	}
+	if u.s.appendLimit != nil && body.Len() > int(*u.s.appendLimit) {
+		return backend.ErrTooBig
+	}
+
+	newFlags := make([]string, 0, len(flags))
+	for _, flag := range flags {
+		if flag != imap.RecentFlag {
+			newFlags = append(newFlags, flag)
+		}
+	}
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	tmpPath, size, err := f.writeTmp(func(w io.Writer) error {
+		_, err := io.Copy(w, body)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, err := f.addMessage(tmpPath, size, newFlags, date); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+func (u *User) createFolder(name string) error {
+	f := u.s.folder(u.folderKey(name))
+	if err := createMaildir(f.path); err != nil {
+		return err
+	}
+	// Dovecot uses this file to tell Maildir++ folders from other
+	// directories.
+	fl, err := os.OpenFile(filepath.Join(f.path, "maildirfolder"), os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	return fl.Close()
+}
+
+func (u *User) CreateMailbox(name string) error {
+	name = strings.TrimSuffix(name, Delimiter)
+	if strings.EqualFold(name, imap.InboxName) {
+		return backend.ErrMailboxAlreadyExists
+	}
+	if _, err := folderName(name); err != nil {
+		return err
+	}
+	if _, err := u.folder(name); err == nil {
+		return backend.ErrMailboxAlreadyExists
+	}
+
+	parts := strings.Split(name, Delimiter)
+	for i := range parts {
+		parent := strings.Join(parts[:i+1], Delimiter)
+		if i == 0 && strings.EqualFold(parent, imap.InboxName) {
+			continue
+		}
+		if err := u.createFolder(parent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *User) DeleteMailbox(name string) error {
+	if strings.EqualFold(name, imap.InboxName) {
+		return errors.New("cannot delete INBOX")
+	}
+	f, err := u.folder(name)
+	if err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	err = os.RemoveAll(f.path)
+	f.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	u.s.folderDestroyed(f.key)
+
+	subs, err := u.readSubscriptions()
+	if err != nil {
+		return err
+	}
+	if _, ok := subs[name]; ok {
+		delete(subs, name)
+		return u.writeSubscriptions(subs)
+	}
+	return nil
+}
+
+func (u *User) RenameMailbox(existingName, newName string) error {
+	newName = strings.TrimSuffix(newName, Delimiter)
+	if strings.EqualFold(newName, imap.InboxName) {
+		return backend.ErrMailboxAlreadyExists
+	}
+	if strings.HasPrefix(newName, existingName+Delimiter) {
+		return errors.New("cannot move mailbox into itself")
+	}
+	src, err := u.folder(existingName)
+	if err != nil {
+		return err
+	}
+	if _, err := u.folder(newName); err == nil {
+		return backend.ErrMailboxAlreadyExists
+	}
+	if err := u.CreateMailbox(newName); err != nil {
+		return err
+	}
+
+	if strings.EqualFold(existingName, imap.InboxName) {
+		// INBOX cannot be removed, RFC 3501 requires to move all messages
+		// from it instead.
+		dst, err := u.folder(newName)
+		if err != nil {
+			return err
+		}
+		unlock := lockFolders(src, dst)
+		defer unlock()
+		if err := src.sync(); err != nil {
+			return err
+		}
+		all := &imap.SeqSet{}
+		all.AddRange(1, 0)
+		return copyMessages(src, dst, all, true)
+	}
+
+	names, err := u.mailboxNames()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name != existingName && !strings.HasPrefix(name, existingName+Delimiter) {
+			continue
+		}
+		target := newName + strings.TrimPrefix(name, existingName)
+		from := u.s.folder(u.folderKey(name))
+		to := u.s.folder(u.folderKey(target))
+
+		unlock := lockFolders(from, to)
+		// Replace the empty folder created by CreateMailbox.
+		if err := os.RemoveAll(to.path); err != nil {
+			unlock()
+			return err
+		}
+		err := os.Rename(from.path, to.path)
+		unlock()
+		if err != nil {
+			return err
+		}
+
+		u.s.folderDestroyed(from.key)
+		u.s.folderDestroyed(to.key)
+	}
+	return nil
+}
+
+func (u *User) Logout() error {
+	return nil
+}
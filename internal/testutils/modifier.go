@@ -39,6 +39,10 @@ type Modifier struct {
 	RcptTo   map[string][]string
 	AddHdr   textproto.Header
 
+	// If set, the message body is replaced with this value using
+	// module.BodyReplacer interface.
+	NewBody []byte
+
 	UnclosedStates int
 }
 
@@ -109,6 +113,13 @@ func (ms modifierState) RewriteBody(ctx context.Context, h *textproto.Header, bo
 	return nil
 }
 
+func (ms modifierState) ReplaceBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	if ms.m.NewBody == nil {
+		return nil, nil
+	}
+	return buffer.MemoryBuffer{Slice: ms.m.NewBody}, nil
+}
+
 func (ms modifierState) Close() error {
 	ms.m.UnclosedStates--
 	return nil
@@ -46,15 +46,22 @@ import (
 	_ "github.com/foxcpp/maddy/internal/auth/pass_table"
 	_ "github.com/foxcpp/maddy/internal/auth/plain_separate"
 	_ "github.com/foxcpp/maddy/internal/auth/shadow"
+	_ "github.com/foxcpp/maddy/internal/check/attachments"
 	_ "github.com/foxcpp/maddy/internal/check/authorize_sender"
+	_ "github.com/foxcpp/maddy/internal/check/bayes"
+	_ "github.com/foxcpp/maddy/internal/check/clamav"
 	_ "github.com/foxcpp/maddy/internal/check/command"
+	_ "github.com/foxcpp/maddy/internal/check/correspondents"
 	_ "github.com/foxcpp/maddy/internal/check/dkim"
 	_ "github.com/foxcpp/maddy/internal/check/dns"
 	_ "github.com/foxcpp/maddy/internal/check/dnsbl"
 	_ "github.com/foxcpp/maddy/internal/check/domainbl"
 	_ "github.com/foxcpp/maddy/internal/check/geobl"
+	_ "github.com/foxcpp/maddy/internal/check/impersonation"
 	_ "github.com/foxcpp/maddy/internal/check/milter"
+	_ "github.com/foxcpp/maddy/internal/check/monitor"
 	_ "github.com/foxcpp/maddy/internal/check/pattern"
+	_ "github.com/foxcpp/maddy/internal/check/policyd"
 	_ "github.com/foxcpp/maddy/internal/check/requiretls"
 	_ "github.com/foxcpp/maddy/internal/check/rspamd"
 	_ "github.com/foxcpp/maddy/internal/check/spamassassin"
@@ -68,11 +75,16 @@ import (
 	_ "github.com/foxcpp/maddy/internal/libdns"
 	_ "github.com/foxcpp/maddy/internal/modify"
 	_ "github.com/foxcpp/maddy/internal/modify/dkim"
+	_ "github.com/foxcpp/maddy/internal/storage/blob/cache"
+	_ "github.com/foxcpp/maddy/internal/storage/blob/compress"
 	_ "github.com/foxcpp/maddy/internal/storage/blob/crypto"
+	_ "github.com/foxcpp/maddy/internal/storage/blob/dedup"
 	_ "github.com/foxcpp/maddy/internal/storage/blob/fs"
+	_ "github.com/foxcpp/maddy/internal/storage/blob/mirror"
 	_ "github.com/foxcpp/maddy/internal/storage/blob/s3"
 	_ "github.com/foxcpp/maddy/internal/storage/blob/table"
 	_ "github.com/foxcpp/maddy/internal/storage/imapsql"
+	_ "github.com/foxcpp/maddy/internal/storage/maildir"
 	_ "github.com/foxcpp/maddy/internal/table"
 	_ "github.com/foxcpp/maddy/internal/target/queue"
 	_ "github.com/foxcpp/maddy/internal/target/remote"